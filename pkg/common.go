@@ -8,6 +8,8 @@ package pkg
 
 import (
 	"net/http"
+	"sort"
+	"strings"
 )
 
 type HTTPDoer interface {
@@ -30,3 +32,39 @@ var SupportedPlatforms = []string{
 	"vultr-github",
 	"vultr-gitlab",
 }
+
+// PlatformCompletions returns SupportedPlatforms sorted, for shell completion of <cloud>-<git> values
+func PlatformCompletions() []string {
+	platforms := append([]string{}, SupportedPlatforms...)
+	sort.Strings(platforms)
+	return platforms
+}
+
+// CloudProviders returns the sorted, deduplicated cloud providers of SupportedPlatforms
+func CloudProviders() []string {
+	return platformParts(func(cloud, git string) string { return cloud })
+}
+
+// GitProviders returns the sorted, deduplicated git providers of SupportedPlatforms
+func GitProviders() []string {
+	return platformParts(func(cloud, git string) string { return git })
+}
+
+// platformParts returns the sorted unique values of part over the <cloud>-<git> SupportedPlatforms
+func platformParts(part func(cloud, git string) string) []string {
+	seen := map[string]bool{}
+	parts := []string{}
+	for _, platform := range SupportedPlatforms {
+		i := strings.LastIndex(platform, "-")
+		if i < 0 {
+			continue
+		}
+		value := part(platform[:i], platform[i+1:])
+		if !seen[value] {
+			seen[value] = true
+			parts = append(parts, value)
+		}
+	}
+	sort.Strings(parts)
+	return parts
+}
@@ -0,0 +1,63 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package pkg
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestPlatformCompletions(t *testing.T) {
+
+	defer func(platforms []string) { SupportedPlatforms = platforms }(SupportedPlatforms)
+	SupportedPlatforms = []string{"k3d-gitlab", "aws-github", "k3d-github", "civo-github", "aws-gitlab"}
+
+	tests := []struct {
+		name string
+		got  []string
+		want []string
+	}{
+		{name: "platforms", got: PlatformCompletions(), want: []string{"aws-github", "aws-gitlab", "civo-github", "k3d-github", "k3d-gitlab"}},
+		{name: "cloud providers", got: CloudProviders(), want: []string{"aws", "civo", "k3d"}},
+		{name: "git providers", got: GitProviders(), want: []string{"github", "gitlab"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !reflect.DeepEqual(tt.got, tt.want) {
+				t.Errorf("%s = %v, want %v", tt.name, tt.got, tt.want)
+			}
+		})
+	}
+
+	if SupportedPlatforms[0] != "k3d-gitlab" {
+		t.Errorf("PlatformCompletions() reordered SupportedPlatforms: %v", SupportedPlatforms)
+	}
+}
+
+func TestPlatformCompletionsSupportedPlatforms(t *testing.T) {
+
+	for name, got := range map[string][]string{
+		"PlatformCompletions": PlatformCompletions(),
+		"CloudProviders":      CloudProviders(),
+		"GitProviders":        GitProviders(),
+	} {
+		if !sort.StringsAreSorted(got) {
+			t.Errorf("%s() = %v, want sorted", name, got)
+		}
+		seen := map[string]bool{}
+		for _, value := range got {
+			if seen[value] {
+				t.Errorf("%s() = %v, %s is duplicated", name, got, value)
+			}
+			seen[value] = true
+		}
+	}
+	if len(PlatformCompletions()) != len(SupportedPlatforms) {
+		t.Errorf("PlatformCompletions() = %v, want every supported platform", PlatformCompletions())
+	}
+}
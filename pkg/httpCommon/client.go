@@ -8,7 +8,10 @@ package httpCommon
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"net/http"
+	"os"
 	"time"
 )
 
@@ -24,6 +27,31 @@ func CustomHttpClient(allowInsecure bool) *http.Client {
 	return &httpClient
 }
 
+// CustomHttpClientWithCA - creates a http client based on k1 standards trusting the
+// PEM encoded certificates in caCertPath, falling back to the system roots when empty
+func CustomHttpClientWithCA(caCertPath string) (*http.Client, error) {
+	httpClient := CustomHttpClient(false)
+	if caCertPath == "" {
+		return httpClient, nil
+	}
+
+	caCert, err := os.ReadFile(caCertPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading ca bundle %s: %s", caCertPath, err)
+	}
+
+	rootCAs, err := x509.SystemCertPool()
+	if err != nil || rootCAs == nil {
+		rootCAs = x509.NewCertPool()
+	}
+	if !rootCAs.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("no valid PEM certificates found in ca bundle %s", caCertPath)
+	}
+	httpClient.Transport.(*http.Transport).TLSClientConfig.RootCAs = rootCAs
+
+	return httpClient, nil
+}
+
 // ResolveAddress returns whether or not an address is resolvable
 func ResolveAddress(address string) error {
 	httpClient := &http.Client{Timeout: 10 * time.Second}
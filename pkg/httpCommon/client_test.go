@@ -0,0 +1,68 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package httpCommon
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCustomHttpClientWithCA(t *testing.T) {
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	bundle := filepath.Join(dir, "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(bundle, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	notPEM := filepath.Join(dir, "not-pem.txt")
+	if err := os.WriteFile(notPEM, []byte("not a certificate\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		caCertPath string
+		wantErr    string
+		wantTrust  bool
+	}{
+		{name: "system roots without a ca bundle"},
+		{name: "ca bundle trusts the self-signed server", caCertPath: bundle, wantTrust: true},
+		{name: "missing ca bundle", caCertPath: filepath.Join(dir, "missing.pem"), wantErr: "error reading ca bundle"},
+		{name: "ca bundle without certificates", caCertPath: notPEM, wantErr: "no valid PEM certificates"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			httpClient, err := CustomHttpClientWithCA(tt.caCertPath)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("CustomHttpClientWithCA() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CustomHttpClientWithCA() error = %v", err)
+			}
+
+			resp, err := httpClient.Get(server.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if (err == nil) != tt.wantTrust {
+				t.Errorf("CustomHttpClientWithCA() get %s error = %v, want trusted %v", server.URL, err, tt.wantTrust)
+			}
+		})
+	}
+}
@@ -7,9 +7,13 @@ See the LICENSE file for more details.
 package k3d
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"syscall"
 
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/config"
@@ -18,62 +22,442 @@ import (
 	"github.com/kubefirst/runtime/pkg/gitClient"
 	cp "github.com/otiai10/copy"
 	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
 )
 
-func AdjustGitopsRepo(cloudProvider, clusterName, clusterType, gitopsRepoDir, gitopsRepoName, gitProvider, k1Dir string, removeAtlantis bool) error {
+// AdjustOptions provides optional behaviour for AdjustGitopsRepo and AdjustMetaphorRepo,
+// the zero value keeps the default behaviour
+type AdjustOptions struct {
+	// SkipDockerfileRelocation leaves the metaphor Dockerfile where the template placed it
+	SkipDockerfileRelocation bool
+	// StrictArch fails the adjust when no console component matches the detected arch
+	StrictArch bool
+	// PostAdjustHook is an executable run with the gitops repo dir and cluster name
+	// as arguments once AdjustGitopsRepo has populated the registry
+	PostAdjustHook string
+	// MetaphorTokens, when set, are substituted into the metaphor content before it is committed
+	MetaphorTokens *MetaphorTokenValues
+	// Delimiters surround the MetaphorTokens in the metaphor content, defaults to DefaultDelimiters
+	Delimiters Delimiters
+	// StrictLFS fails the adjust when unresolved git lfs pointer files are copied
+	StrictLFS bool
+	// DirMode is the mode of directories created by the adjust functions, defaults to 0700
+	DirMode os.FileMode
+	// FailOnSecrets fails the adjust when ScanForSecrets finds a possible credential,
+	// findings are only logged otherwise
+	FailOnSecrets bool
+	// CommitIdentity is the author and committer of the metaphor commit, defaults to DefaultCommitIdentity
+	CommitIdentity CommitIdentity
+	// PreserveHistory starts the metaphor repo from a copy of the template clone's .git
+	// so the detokenized content is committed on top of the template history
+	PreserveHistory bool
+	// KeepClusterTypes leaves cluster-types in the gitops repo so ResetRegistry can revert the
+	// cluster registry, meant for testing as the cluster types are committed with the repo
+	KeepClusterTypes bool
+	// CommitMessage is the message of the initial metaphor commit, defaults to
+	// "committing initial detokenized metaphor repo content"
+	CommitMessage string
+	// LargeFileThreshold is the size in bytes above which files are reported before the
+	// repositories are committed, defaults to 50MB
+	LargeFileThreshold int64
+	// StrictLargeFiles fails the adjust when a file is larger than LargeFileThreshold
+	StrictLargeFiles bool
+	// CIProviders are the git providers whose ci content is copied into the metaphor repo,
+	// defaults to the git provider passed to AdjustMetaphorRepo
+	CIProviders []string
+	// AuditLogPath, when set, is a file the adjust functions append a json line to for every
+	// file or directory they copy, remove, detokenize, rewrite or create
+	AuditLogPath string
+}
+
+// ciProviders returns the providers whose ci content is copied, falling back to gitProvider
+func (o AdjustOptions) ciProviders(gitProvider string) []string {
+	if len(o.CIProviders) == 0 {
+		return []string{gitProvider}
+	}
+	return o.CIProviders
+}
+
+// delimiters returns Delimiters, falling back to DefaultDelimiters
+func (o AdjustOptions) delimiters() Delimiters {
+	if o.Delimiters == (Delimiters{}) {
+		return DefaultDelimiters
+	}
+	return o.Delimiters
+}
+
+// largeFileThreshold returns LargeFileThreshold, falling back to defaultLargeFileThreshold
+func (o AdjustOptions) largeFileThreshold() int64 {
+	if o.LargeFileThreshold <= 0 {
+		return defaultLargeFileThreshold
+	}
+	return o.LargeFileThreshold
+}
+
+// defaultDirMode is the mode of directories created by the package
+const defaultDirMode os.FileMode = 0700
+
+// dirMode returns the configured directory mode or the package default
+func (opts AdjustOptions) dirMode() os.FileMode {
+	if opts.DirMode == 0 {
+		return defaultDirMode
+	}
+	return opts.DirMode
+}
+
+// mkdirWithMode creates dir and its parents, applying mode to dir regardless of umask
+func mkdirWithMode(dir string, mode os.FileMode) error {
+	err := os.MkdirAll(dir, mode)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(dir, mode)
+}
+
+// checkWritable creates and removes a temporary file in dir, so a read-only destination fails
+// before any content is copied
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".kubefirst-write-check-*")
+	if err != nil {
+		return fmt.Errorf("destination %s is not writable, check it is not on a read-only volume: %s", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// nearestExistingDir returns dir when it exists, or its closest existing ancestor
+func nearestExistingDir(dir string) string {
+	for {
+		if _, err := os.Lstat(dir); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+// copyOptions - options shared by the adjust copies
+func copyOptions() cp.Options {
+	return cp.Options{
+		Skip:      skipCopy,
+		OnSymlink: onSymlink,
+	}
+}
+
+// onSymlink copies symlinks as symlinks, skipping the ones that form a loop so the copied
+// tree can be walked by tools following symlinks
+func onSymlink(src string) cp.SymlinkAction {
+	if symlinkLoops(src) {
+		log.Warn().Str("path", src).Msg("skipping symlink that loops back to its own directory tree")
+		return cp.Skip
+	}
+	return cp.Shallow
+}
+
+// symlinkLoops reports whether the symlink at src resolves to itself or to one of its ancestor
+// directories, comparing the inodes of the target and every parent of src
+func symlinkLoops(src string) bool {
+	target, err := os.Stat(src)
+	if errors.Is(err, syscall.ELOOP) {
+		return true
+	}
+	if err != nil || !target.IsDir() {
+		return false
+	}
+
+	dir, err := filepath.Abs(filepath.Dir(src))
+	if err != nil {
+		return false
+	}
+	for {
+		fi, err := os.Stat(dir)
+		if err == nil && os.SameFile(fi, target) {
+			return true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return false
+		}
+		dir = parent
+	}
+}
+
+// skipCopy excludes any path with a .git component, including nested
+// submodule directories, and terraform working directories
+func skipCopy(src string) (bool, error) {
+	for _, component := range strings.Split(filepath.ToSlash(src), "/") {
+		if component == ".git" {
+			return true, nil
+		}
+	}
+	if strings.Index(src, "/.terraform") > 0 {
+		return true, nil
+	}
+	//Add more stuff to be ignored here
+	return false, nil
+}
+
+// AvailableClusterTypes lists the cluster types, the directories under cluster-types, of the gitops
+// template at gitopsRepoDir
+func AvailableClusterTypes(gitopsRepoDir string) ([]string, error) {
+	clusterTypesDir := filepath.Join(gitopsRepoDir, "cluster-types")
+	entries, err := os.ReadDir(clusterTypesDir)
+	if err != nil {
+		return nil, fmt.Errorf("error listing cluster types in %s: %s", clusterTypesDir, err)
+	}
+
+	clusterTypes := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			clusterTypes = append(clusterTypes, entry.Name())
+		}
+	}
+	return clusterTypes, nil
+}
+
+// validateClusterType checks clusterType is one of available, suggesting the closest cluster type
+// when it looks like a typo
+func validateClusterType(clusterType string, available []string) error {
+	if len(available) == 0 {
+		return fmt.Errorf("no cluster types found in the gitops template")
+	}
+	sorted := []string{}
+	seen := map[string]bool{}
+	for _, candidate := range available {
+		if candidate == clusterType {
+			return nil
+		}
+		if !seen[candidate] {
+			seen[candidate] = true
+			sorted = append(sorted, candidate)
+		}
+	}
+	sort.Strings(sorted)
+
+	closest, closestDistance := "", -1
+	for _, candidate := range sorted {
+		distance := editDistance(strings.ToLower(clusterType), strings.ToLower(candidate))
+		if closestDistance < 0 || distance < closestDistance {
+			closest, closestDistance = candidate, distance
+		}
+	}
+	// only suggest names a typo away, at most a third of the name changed
+	if closestDistance <= len(closest)/3+1 {
+		return fmt.Errorf("unknown cluster type %q, did you mean %q? available cluster types: %s", clusterType, closest, strings.Join(sorted, ", "))
+	}
+	return fmt.Errorf("unknown cluster type %q, available cluster types: %s", clusterType, strings.Join(sorted, ", "))
+}
+
+// editDistance returns the levenshtein distance between a and b
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	previous := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		current := make([]int, len(rb)+1)
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = min3(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// copyClusterContent copies the cluster type content to the registry directory. When the copy fails
+// part way a registry directory it created is removed so a retry starts clean, a registry directory
+// that existed before the copy, e.g. from a prior cluster, is left in place
+func copyClusterContent(clusterContent, registryLocation string, opt cp.Options) error {
+	_, statErr := os.Stat(registryLocation)
+	preexisting := statErr == nil
+
+	err := cp.Copy(clusterContent, registryLocation, opt)
+	if err == nil {
+		return nil
+	}
+
+	if preexisting {
+		log.Warn().Str("dest", registryLocation).Msg("registry directory existed before the copy, leaving it in place")
+		return err
+	}
+	cleanupErr := os.RemoveAll(registryLocation)
+	if cleanupErr != nil {
+		return fmt.Errorf("%s, and error removing partial registry %s: %s", err, registryLocation, cleanupErr)
+	}
+	log.Info().Str("dest", registryLocation).Msg("removed partially copied registry directory")
+	return err
+}
+
+// consoleComponentFiles returns the console component to keep for the arch
+// and the one to remove
+func consoleComponentFiles(arch, cloudProvider string) (string, string) {
+	if arch == "arm64" && cloudProvider == CloudProvider {
+		return "console-arm.yaml", "console.yaml"
+	}
+	return "console.yaml", "console-arm.yaml"
+}
+
+// RemovePlatform removes the directory of a single platform, e.g. civo-github, from the gitops repo
+// platform must be one of pkg.SupportedPlatforms so no path outside the platform directories can be removed
+func RemovePlatform(gitopsRepoDir, platform string) error {
+	supported := false
+	for _, supportedPlatform := range pkg.SupportedPlatforms {
+		if platform == supportedPlatform {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		return fmt.Errorf("refusing to remove %q: not a supported platform", platform)
+	}
+
+	err := os.RemoveAll(filepath.Join(gitopsRepoDir, platform))
+	if err != nil {
+		return fmt.Errorf("error removing platform %s from %s: %s", platform, gitopsRepoDir, err)
+	}
+
+	return nil
+}
+
+func AdjustGitopsRepo(cloudProvider, clusterName, clusterType, gitopsRepoDir, gitopsRepoName, gitProvider, k1Dir string, removeAtlantis bool, opts ...AdjustOptions) error {
+	options := adjustOptions(opts)
+
+	// cluster types are found at the top of the repo or in the platform directory copied there below
+	available := []string{}
+	for _, dir := range []string{gitopsRepoDir, fmt.Sprintf("%s/%s-%s", gitopsRepoDir, CloudProvider, gitProvider)} {
+		if _, err := os.Stat(filepath.Join(dir, "cluster-types")); os.IsNotExist(err) {
+			continue
+		}
+		clusterTypes, err := AvailableClusterTypes(dir)
+		if err != nil {
+			return err
+		}
+		available = append(available, clusterTypes...)
+	}
+	err := validateClusterType(clusterType, available)
+	if err != nil {
+		return err
+	}
+	registryLocation, err := RegistryPath(gitopsRepoDir, clusterName)
+	if err != nil {
+		return err
+	}
+
+	audit, err := openAuditLog(options.AuditLogPath)
+	if err != nil {
+		return err
+	}
+	defer audit.close()
 
 	//* clean up all other platforms
 	for _, platform := range pkg.SupportedPlatforms {
 		if platform != fmt.Sprintf("%s-%s", CloudProvider, gitProvider) {
-			os.RemoveAll(gitopsRepoDir + "/" + platform)
+			platformDir := filepath.Join(gitopsRepoDir, platform)
+			_, statErr := os.Lstat(platformDir)
+			err := RemovePlatform(gitopsRepoDir, platform)
+			if err != nil {
+				log.Warn().Err(err).Str("platform", platform).Msg("error removing unused platform")
+			} else if statErr == nil {
+				audit.record(auditRemove, platformDir, "")
+			}
 		}
 	}
 
 	//* copy options
-	opt := cp.Options{
-		Skip: func(src string) (bool, error) {
-			if strings.HasSuffix(src, ".git") {
-				return true, nil
-			} else if strings.Index(src, "/.terraform") > 0 {
-				return true, nil
-			}
-			//Add more stuff to be ignored here
-			return false, nil
-
-		},
-	}
+	opt := copyOptions()
 
 	//* copy $cloudProvider-$gitProvider/* $HOME/.k1/gitops/
 	driverContent := fmt.Sprintf("%s/%s-%s/", gitopsRepoDir, CloudProvider, gitProvider)
-	err := cp.Copy(driverContent, gitopsRepoDir, opt)
+	log.Info().Str("source", driverContent).Str("dest", gitopsRepoDir).Msg("copying driver content")
+	err = cp.Copy(driverContent, gitopsRepoDir, opt)
 	if err != nil {
-		log.Info().Msgf("Error populating gitops repository with driver content: %s. error: %s", fmt.Sprintf("%s-%s", CloudProvider, gitProvider), err.Error())
+		log.Error().Err(err).Str("source", driverContent).Str("dest", gitopsRepoDir).Msg("error populating gitops repository with driver content")
 		return err
 	}
-	os.RemoveAll(driverContent)
+	audit.record(auditCopy, gitopsRepoDir, driverContent)
+	err = audit.removeAll(driverContent)
+	if err != nil {
+		return fmt.Errorf("error removing driver content %s: %s", driverContent, err)
+	}
 
 	//* copy $HOME/.k1/gitops/cluster-types/${clusterType}/* $HOME/.k1/gitops/registry/${clusterName}
 	clusterContent := fmt.Sprintf("%s/cluster-types/%s", gitopsRepoDir, clusterType)
-	err = cp.Copy(clusterContent, fmt.Sprintf("%s/registry/%s", gitopsRepoDir, clusterName), opt)
+	log.Info().Str("source", clusterContent).Str("dest", registryLocation).Msg("copying cluster content")
+	err = copyClusterContent(clusterContent, registryLocation, opt)
 	if err != nil {
-		log.Info().Msgf("Error populating cluster content with %s. error: %s", clusterContent, err.Error())
+		log.Error().Err(err).Str("source", clusterContent).Str("dest", registryLocation).Msg("error populating cluster content")
 		return err
 	}
-	os.RemoveAll(fmt.Sprintf("%s/cluster-types", gitopsRepoDir))
-	os.RemoveAll(fmt.Sprintf("%s/services", gitopsRepoDir))
-
-	registryLocation := fmt.Sprintf("%s/registry/%s", gitopsRepoDir, clusterName)
-	if pkg.LocalhostARCH == "arm64" && cloudProvider == CloudProvider {
-		amdConsoleFileLocation := fmt.Sprintf("%s/components/kubefirst/console.yaml", registryLocation)
-		os.Remove(amdConsoleFileLocation)
+	audit.record(auditCopy, registryLocation, clusterContent)
+	removed := []string{fmt.Sprintf("%s/services", gitopsRepoDir)}
+	if options.KeepClusterTypes {
+		log.Info().Str("path", gitopsRepoDir).Msg("keeping cluster types for ResetRegistry")
 	} else {
-		armConsoleFileLocation := fmt.Sprintf("%s/components/kubefirst/console-arm.yaml", registryLocation)
-		os.Remove(armConsoleFileLocation)
+		removed = append([]string{fmt.Sprintf("%s/cluster-types", gitopsRepoDir)}, removed...)
+	}
+	for _, dir := range removed {
+		err = audit.removeAll(dir)
+		if err != nil {
+			return fmt.Errorf("error removing %s: %s", dir, err)
+		}
+	}
+
+	err = fixRegistryPaths(registryLocation, clusterName, audit)
+	if err != nil {
+		return err
+	}
+
+	err = checkLFSPointers(gitopsRepoDir, options.StrictLFS)
+	if err != nil {
+		return err
+	}
+
+	consoleFile, unsupportedConsoleFile := consoleComponentFiles(pkg.LocalhostARCH, cloudProvider)
+	err = audit.removeAll(fmt.Sprintf("%s/components/kubefirst/%s", registryLocation, unsupportedConsoleFile))
+	if err != nil {
+		return fmt.Errorf("error removing unsupported console component %s: %s", unsupportedConsoleFile, err)
+	}
+
+	consoleFileLocation := fmt.Sprintf("%s/components/kubefirst/%s", registryLocation, consoleFile)
+	if _, err := os.Stat(consoleFileLocation); os.IsNotExist(err) {
+		if options.StrictArch {
+			return fmt.Errorf("no console component for arch %s found at %s", pkg.LocalhostARCH, consoleFileLocation)
+		}
+		log.Warn().Str("arch", pkg.LocalhostARCH).Str("path", consoleFileLocation).Msg("no console component for arch, continuing")
 	}
 
 	if removeAtlantis {
+		_, references, err := CanRemoveAtlantis(gitopsRepoDir, clusterName)
+		if err != nil {
+			return err
+		}
+		for _, reference := range references {
+			log.Warn().Str("path", registryLocation).Str("reference", reference).Msg("atlantis is still referenced after its removal")
+		}
 		atlantisRegistryFileLocation := fmt.Sprintf("%s/atlantis.yaml", registryLocation)
-		os.Remove(atlantisRegistryFileLocation)
+		err = audit.removeAll(atlantisRegistryFileLocation)
+		if err != nil {
+			return fmt.Errorf("error removing atlantis from %s: %s", registryLocation, err)
+		}
 	}
 
 	path := fmt.Sprintf("%s/%s", gitopsRepoDir, "terraform/github/repos.tf")
@@ -81,107 +465,237 @@ func AdjustGitopsRepo(cloudProvider, clusterName, clusterType, gitopsRepoDir, gi
 	err = cp.Copy(tmplpath, path)
 
 	if err != nil {
-		log.Info().Msgf("Error problem copying %s to %s error: %s",
-			tmplpath, path, err.Error())
+		log.Error().Err(err).Str("source", tmplpath).Str("dest", path).Msg("error copying terraform repos template")
+		return err
+	}
+	audit.record(auditCopy, path, tmplpath)
+
+	err = detokenizeFile(path, []TokenReplacement{{"GITOPS_REPO_NAME", fmt.Sprintf("%q", gitopsRepoName)}})
+	if err != nil {
+		log.Error().Err(err).Str("gitopsRepoName", gitopsRepoName).Str("path", path).Msg("error replacing gitops repository name")
 		return err
 	}
+	audit.record(auditDetokenize, path, "")
 
-	pattern := fmt.Sprintf("s/GITOPS_REPO_NAME/\"%s\"/", gitopsRepoName)
-	_, _, err = pkg.ExecShellReturnStrings("sed", "-i", pattern, path)
+	err = checkSecrets(gitopsRepoDir, options.FailOnSecrets)
+	if err != nil {
+		return err
+	}
 
+	err = checkLargeFiles(gitopsRepoDir, options.largeFileThreshold(), options.StrictLargeFiles)
 	if err != nil {
-		log.Info().Msgf("Error problem replacing gitops directory name with gitopsRepoName=%s path=%s pattern=%s error: %s",
-			gitopsRepoName, path, pattern, err.Error())
 		return err
 	}
 
+	if options.PostAdjustHook != "" {
+		err = runPostAdjustHook(options.PostAdjustHook, gitopsRepoDir, clusterName)
+		if err != nil {
+			return err
+		}
+	}
+
 	return err
 }
 
-func AdjustMetaphorRepo(destinationMetaphorRepoGitURL, gitopsRepoDir, metaphorRepoName, gitProvider, k1Dir string) error {
+// detokenizeGitlabCI substitutes the metaphor tokens into the gitlab ci file and
+// verifies the result is still valid yaml
+func detokenizeGitlabCI(path string, tokens *MetaphorTokenValues) error {
+	for _, r := range metaphorTokenReplacements(tokens) {
+		if strings.ContainsAny(r.Value, "\r\n") {
+			return fmt.Errorf("value for %s contains a line break and would break %s", r.Token, path)
+		}
+	}
+
+	err := detokenizeFile(path, metaphorTokenReplacements(tokens))
+	if err != nil {
+		return fmt.Errorf("error detokenizing %s: %s", path, err)
+	}
 
-	//* create ~/.k1/metaphor
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var ci map[string]interface{}
+	err = yaml.Unmarshal(content, &ci)
+	if err != nil {
+		return fmt.Errorf("detokenized %s is not valid yaml: %s", path, err)
+	}
+
+	return nil
+}
+
+// runPostAdjustHook runs the post adjust hook, failing if it is not executable or exits non-zero
+func runPostAdjustHook(hook, gitopsRepoDir, clusterName string) error {
+	fi, err := os.Stat(hook)
+	if err != nil {
+		return fmt.Errorf("error finding post adjust hook %s: %s", hook, err)
+	}
+	if fi.IsDir() || fi.Mode()&0111 == 0 {
+		return fmt.Errorf("post adjust hook %s is not executable", hook)
+	}
+
+	log.Info().Str("hook", hook).Str("gitopsRepoDir", gitopsRepoDir).Str("clusterName", clusterName).Msg("running post adjust hook")
+	_, stdErr, err := pkg.ExecShellReturnStrings(hook, gitopsRepoDir, clusterName)
+	if err != nil {
+		return fmt.Errorf("post adjust hook %s failed: %s %s", hook, err, stdErr)
+	}
+
+	return nil
+}
+
+func AdjustMetaphorRepo(destinationMetaphorRepoGitURL, gitopsRepoDir, metaphorRepoName, gitProvider, k1Dir string, opts ...AdjustOptions) error {
+	options := adjustOptions(opts)
+
+	if options.MetaphorTokens != nil {
+		err := ValidateMetaphorURLs(*options.MetaphorTokens)
+		if err != nil {
+			return err
+		}
+	}
+
+	//* check the destinations are writable, the metaphor directory is checked where it will be created
 	metaphorDir := fmt.Sprintf("%s/metaphor", k1Dir)
-	os.Mkdir(metaphorDir, 0700)
+	for _, dir := range []string{nearestExistingDir(metaphorDir), gitopsRepoDir} {
+		err := checkWritable(dir)
+		if err != nil {
+			return err
+		}
+	}
 
-	//* git init
-	metaphorRepo, err := git.PlainInit(metaphorDir, false)
+	audit, err := openAuditLog(options.AuditLogPath)
 	if err != nil {
 		return err
 	}
+	defer audit.close()
 
-	//* copy options
-	opt := cp.Options{
-		Skip: func(src string) (bool, error) {
-			if strings.HasSuffix(src, ".git") {
-				return true, nil
-			} else if strings.Index(src, "/.terraform") > 0 {
-				return true, nil
-			}
-			//Add more stuff to be ignored here
-			return false, nil
+	//* create ~/.k1/metaphor
+	err = mkdirWithMode(metaphorDir, options.dirMode())
+	if err != nil {
+		return fmt.Errorf("error creating metaphor directory %s: %s", metaphorDir, err)
+	}
+	audit.record(auditMkdir, metaphorDir, "")
 
-		},
+	//* git init, reusing the repository from a previous run
+	var metaphorRepo *git.Repository
+	if _, err := os.Stat(fmt.Sprintf("%s/.git", metaphorDir)); err == nil {
+		log.Info().Str("path", metaphorDir).Msg("metaphor repository already initialized, skipping git init")
+		metaphorRepo, err = git.PlainOpen(metaphorDir)
+		if err != nil {
+			return fmt.Errorf("error opening existing metaphor repository %s: %s", metaphorDir, err)
+		}
+	} else if options.PreserveHistory {
+		metaphorRepo, err = copyTemplateHistory(gitopsRepoDir, metaphorDir, audit)
+		if err != nil {
+			return err
+		}
+	} else {
+		metaphorRepo, err = git.PlainInit(metaphorDir, false)
+		if err != nil {
+			return err
+		}
 	}
 
+	//* copy options
+	opt := copyOptions()
+
 	//* metaphor app source
 	metaphorContent := fmt.Sprintf("%s/metaphor", gitopsRepoDir)
+	log.Info().Str("source", metaphorContent).Str("dest", metaphorDir).Msg("copying metaphor content")
 	err = cp.Copy(metaphorContent, metaphorDir, opt)
 	if err != nil {
-		log.Info().Msgf("Error populating metaphor content with %s. error: %s", metaphorContent, err.Error())
+		log.Error().Err(err).Str("source", metaphorContent).Str("dest", metaphorDir).Msg("error populating metaphor content")
 		return err
 	}
+	audit.record(auditCopy, metaphorDir, metaphorContent)
+	//* the copy takes on the source directory mode, reapply the configured one
+	err = os.Chmod(metaphorDir, options.dirMode())
+	if err != nil {
+		return fmt.Errorf("error setting mode on metaphor directory %s: %s", metaphorDir, err)
+	}
 
 	//* copy ci content
-	switch gitProvider {
-	case "github":
-		//* copy $HOME/.k1/gitops/ci/.github/* $HOME/.k1/metaphor/.github
-		githubActionsFolderContent := fmt.Sprintf("%s/gitops/ci/.github", k1Dir)
-		log.Info().Msgf("copying github content: %s", githubActionsFolderContent)
-		err := cp.Copy(githubActionsFolderContent, fmt.Sprintf("%s/.github", metaphorDir), opt)
-		if err != nil {
-			log.Info().Msgf("error populating metaphor repository with %s: %s", githubActionsFolderContent, err)
-			return err
-		}
-	case "gitlab":
-		//* copy $HOME/.k1/gitops/ci/.gitlab-ci.yml/* $HOME/.k1/metaphor/.github
-		gitlabCIContent := fmt.Sprintf("%s/gitops/ci/.gitlab-ci.yml", k1Dir)
-		log.Info().Msgf("copying gitlab content: %s", gitlabCIContent)
-		err := cp.Copy(gitlabCIContent, fmt.Sprintf("%s/.gitlab-ci.yml", metaphorDir), opt)
+	for _, provider := range options.ciProviders(gitProvider) {
+		err = copyCIContent(k1Dir, metaphorDir, provider, options.MetaphorTokens, audit)
 		if err != nil {
-			log.Info().Msgf("error populating metaphor repository with %s: %s", gitlabCIContent, err)
 			return err
 		}
 	}
 
 	//* copy $HOME/.k1/gitops/ci/.argo/* $HOME/.k1/metaphor/.argo
 	argoWorkflowsFolderContent := fmt.Sprintf("%s/gitops/ci/.argo", k1Dir)
-	log.Info().Msgf("copying argo workflows content: %s", argoWorkflowsFolderContent)
-	err = cp.Copy(argoWorkflowsFolderContent, fmt.Sprintf("%s/.argo", metaphorDir), opt)
+	argoWorkflowsFolderDest := fmt.Sprintf("%s/.argo", metaphorDir)
+	log.Info().Str("source", argoWorkflowsFolderContent).Str("dest", argoWorkflowsFolderDest).Msg("copying argo workflows content")
+	err = cp.Copy(argoWorkflowsFolderContent, argoWorkflowsFolderDest, opt)
 	if err != nil {
-		log.Info().Msgf("error populating metaphor repository with %s: %s", argoWorkflowsFolderContent, err)
+		log.Error().Err(err).Str("source", argoWorkflowsFolderContent).Str("dest", argoWorkflowsFolderDest).Msg("error populating metaphor repository with argo workflows content")
 		return err
 	}
+	audit.record(auditCopy, argoWorkflowsFolderDest, argoWorkflowsFolderContent)
 
 	//* copy $HOME/.k1/gitops/metaphor/Dockerfile $HOME/.k1/metaphor/build/Dockerfile
 	dockerfileContent := fmt.Sprintf("%s/Dockerfile", metaphorDir)
-	os.Mkdir(metaphorDir+"/build", 0700)
-	log.Info().Msgf("copying dockerfile content: %s", argoWorkflowsFolderContent)
-	err = cp.Copy(dockerfileContent, fmt.Sprintf("%s/build/Dockerfile", metaphorDir), opt)
+	dockerfileTarget := fmt.Sprintf("%s/build/Dockerfile", metaphorDir)
+	if options.SkipDockerfileRelocation {
+		log.Info().Msg("dockerfile relocation disabled, skipping")
+	} else if _, err := os.Stat(dockerfileTarget); err == nil {
+		log.Info().Str("path", dockerfileTarget).Msg("dockerfile already present, skipping relocation")
+	} else {
+		err = mkdirWithMode(metaphorDir+"/build", options.dirMode())
+		if err != nil {
+			return fmt.Errorf("error creating metaphor build directory: %s", err)
+		}
+		audit.record(auditMkdir, metaphorDir+"/build", "")
+		log.Info().Str("source", dockerfileContent).Str("dest", dockerfileTarget).Msg("copying dockerfile content")
+		err = cp.Copy(dockerfileContent, dockerfileTarget, opt)
+		if err != nil {
+			log.Error().Err(err).Str("source", dockerfileContent).Str("dest", dockerfileTarget).Msg("error populating metaphor repository with dockerfile content")
+			return err
+		}
+		audit.record(auditCopy, dockerfileTarget, dockerfileContent)
+	}
+	for _, dir := range []string{fmt.Sprintf("%s/ci", gitopsRepoDir), fmt.Sprintf("%s/metaphor", gitopsRepoDir)} {
+		err = audit.removeAll(dir)
+		if err != nil {
+			return fmt.Errorf("error removing %s: %s", dir, err)
+		}
+	}
+
+	//* detokenize before the commit so the repo starts from a single initial commit
+	if options.MetaphorTokens != nil {
+		err = detokenizeGitMetaphor(metaphorDir, options.MetaphorTokens, options.delimiters())
+		if err != nil {
+			return fmt.Errorf("error detokenizing metaphor content in %s: %s", metaphorDir, err)
+		}
+		audit.record(auditDetokenize, metaphorDir, "")
+	}
+
+	err = normalizeLineEndings(metaphorDir, metaphorLineEndingFiles, audit)
+	if err != nil {
+		return fmt.Errorf("error normalizing line endings in %s: %s", metaphorDir, err)
+	}
+
+	err = checkLFSPointers(metaphorDir, options.StrictLFS)
 	if err != nil {
-		log.Info().Msgf("error populating metaphor repository with %s: %s", argoWorkflowsFolderContent, err)
 		return err
 	}
-	os.RemoveAll(fmt.Sprintf("%s/ci", gitopsRepoDir))
-	os.RemoveAll(fmt.Sprintf("%s/metaphor", gitopsRepoDir))
 
-	//  add
-	// commit
-	err = gitClient.Commit(metaphorRepo, "committing initial detokenized metaphor repo content")
+	err = checkSecrets(metaphorDir, options.FailOnSecrets)
+	if err != nil {
+		return err
+	}
+
+	err = checkLargeFiles(metaphorDir, options.largeFileThreshold(), options.StrictLargeFiles)
 	if err != nil {
 		return err
 	}
 
+	//  add
+	// commit, staging the removal of any template content when the history is preserved
+	_, err = commitRepo(metaphorRepo, commitMessageOrDefault(options.CommitMessage, defaultMetaphorCommitMessage), options.CommitIdentity)
+	if err != nil {
+		return fmt.Errorf("error committing metaphor repo: %s", err)
+	}
+
 	metaphorRepo, err = gitClient.SetRefToMainBranch(metaphorRepo)
 	if err != nil {
 		return err
@@ -195,22 +709,206 @@ func AdjustMetaphorRepo(destinationMetaphorRepoGitURL, gitopsRepoDir, metaphorRe
 
 	// replace metaphore repo name in repos.tf
 	path := fmt.Sprintf("%s/terraform/github/repos.tf", gitopsRepoDir)
-	pattern := fmt.Sprintf("s/METAPHOR_REPO_NAME/\"%s\"/", metaphorRepoName)
-	_, _, err = pkg.ExecShellReturnStrings("sed", "-i", pattern, path)
+	err = detokenizeFile(path, []TokenReplacement{{"METAPHOR_REPO_NAME", fmt.Sprintf("%q", metaphorRepoName)}})
 	if err != nil {
 		return fmt.Errorf("error replacing gitops repo name in repos.tf: %s", err)
 	}
+	audit.record(auditDetokenize, path, "")
 
 	// create remote
 	_, err = metaphorRepo.CreateRemote(&config.RemoteConfig{
 		Name: "origin",
 		URLs: []string{destinationMetaphorRepoGitURL},
 	})
-
-	if err != nil {
+	if errors.Is(err, git.ErrRemoteExists) {
+		log.Info().Str("path", metaphorDir).Msg("metaphor remote origin already exists, skipping")
+	} else if err != nil {
 		return fmt.Errorf("error problem creating Metaphore repo: URL=%s: %s",
 			destinationMetaphorRepoGitURL, err)
 	}
 
-	return err
+	return VerifyRepo(metaphorDir)
+}
+
+// copyCIContent copies the ci content of a single git provider from the gitops clone in k1Dir
+// into metaphorDir, detokenizing the gitlab ci file when tokens are provided
+func copyCIContent(k1Dir, metaphorDir, provider string, tokens *MetaphorTokenValues, audit *auditLog) error {
+	opt := copyOptions()
+
+	switch provider {
+	case "github":
+		//* copy $HOME/.k1/gitops/ci/.github/* $HOME/.k1/metaphor/.github
+		githubActionsFolderContent := fmt.Sprintf("%s/gitops/ci/.github", k1Dir)
+		githubActionsFolderDest := fmt.Sprintf("%s/.github", metaphorDir)
+		log.Info().Str("source", githubActionsFolderContent).Str("dest", githubActionsFolderDest).Msg("copying github content")
+		err := cp.Copy(githubActionsFolderContent, githubActionsFolderDest, opt)
+		if err != nil {
+			log.Error().Err(err).Str("source", githubActionsFolderContent).Str("dest", githubActionsFolderDest).Msg("error populating metaphor repository with github content")
+			return err
+		}
+		audit.record(auditCopy, githubActionsFolderDest, githubActionsFolderContent)
+	case "gitlab":
+		//* copy $HOME/.k1/gitops/ci/.gitlab-ci.yml $HOME/.k1/metaphor/.gitlab-ci.yml
+		gitlabCIContent := fmt.Sprintf("%s/gitops/ci/.gitlab-ci.yml", k1Dir)
+		gitlabCIDest := fmt.Sprintf("%s/.gitlab-ci.yml", metaphorDir)
+		log.Info().Str("source", gitlabCIContent).Str("dest", gitlabCIDest).Msg("copying gitlab content")
+		err := cp.Copy(gitlabCIContent, gitlabCIDest, opt)
+		if err != nil {
+			log.Error().Err(err).Str("source", gitlabCIContent).Str("dest", gitlabCIDest).Msg("error populating metaphor repository with gitlab content")
+			return err
+		}
+		audit.record(auditCopy, gitlabCIDest, gitlabCIContent)
+		if tokens != nil {
+			err = detokenizeGitlabCI(gitlabCIDest, tokens)
+			if err != nil {
+				return err
+			}
+			audit.record(auditDetokenize, gitlabCIDest, "")
+		}
+	default:
+		return fmt.Errorf("unsupported ci provider %q, expected github or gitlab", provider)
+	}
+
+	return nil
+}
+
+// copyTemplateHistory copies the .git of the template clone at gitopsRepoDir into metaphorDir,
+// dropping the template origin so the metaphor remote can be added
+func copyTemplateHistory(gitopsRepoDir, metaphorDir string, audit *auditLog) (*git.Repository, error) {
+	templateGitDir := fmt.Sprintf("%s/.git", gitopsRepoDir)
+	metaphorGitDir := fmt.Sprintf("%s/.git", metaphorDir)
+	log.Info().Str("source", templateGitDir).Str("dest", metaphorGitDir).Msg("copying template history")
+	err := cp.Copy(templateGitDir, metaphorGitDir)
+	if err != nil {
+		return nil, fmt.Errorf("error copying template history from %s: %s", templateGitDir, err)
+	}
+	audit.record(auditCopy, metaphorGitDir, templateGitDir)
+
+	repo, err := git.PlainOpen(metaphorDir)
+	if err != nil {
+		return nil, fmt.Errorf("error opening metaphor repository %s: %s", metaphorDir, err)
+	}
+	err = repo.DeleteRemote("origin")
+	if err != nil && !errors.Is(err, git.ErrRemoteNotFound) {
+		return nil, fmt.Errorf("error removing template origin from %s: %s", metaphorDir, err)
+	}
+
+	return repo, nil
+}
+
+// CopyComponent copies a single component from cluster-types/<clusterType>/components/<componentName>
+// into the cluster registry, replacing only the tokens derivable from the cluster name, cluster
+// type and k3d defaults - remaining tokens are left for a full detokenization pass. Only the
+// AuditLogPath of opts is used
+func CopyComponent(gitopsRepoDir, clusterName, clusterType, componentName string, opts ...AdjustOptions) error {
+	componentContent := fmt.Sprintf("%s/cluster-types/%s/components/%s", gitopsRepoDir, clusterType, componentName)
+	if _, err := os.Stat(componentContent); err != nil {
+		return fmt.Errorf("component %s not found for cluster type %s: %s", componentName, clusterType, err)
+	}
+
+	registryLocation, err := RegistryPath(gitopsRepoDir, clusterName)
+	if err != nil {
+		return err
+	}
+	audit, err := openAuditLog(adjustOptions(opts).AuditLogPath)
+	if err != nil {
+		return err
+	}
+	defer audit.close()
+
+	componentDest := fmt.Sprintf("%s/components/%s", registryLocation, componentName)
+	log.Info().Str("source", componentContent).Str("dest", componentDest).Msg("copying component content")
+	err = cp.Copy(componentContent, componentDest, copyOptions())
+	if err != nil {
+		log.Error().Err(err).Str("source", componentContent).Str("dest", componentDest).Msg("error copying component content")
+		return err
+	}
+	audit.record(auditCopy, componentDest, componentContent)
+
+	err = detokenizeDir(componentDest, literalReplacer(clusterTokenReplacements(clusterName, clusterType)))
+	if err != nil {
+		return err
+	}
+	audit.record(auditDetokenize, componentDest, "")
+	return nil
+}
+
+// adjustOptions returns the options passed to the variadic registry functions
+func adjustOptions(opts []AdjustOptions) AdjustOptions {
+	if len(opts) == 0 {
+		return AdjustOptions{}
+	}
+	return opts[0]
+}
+
+// clusterTokenReplacements are the token replacements derivable from the cluster name,
+// cluster type and k3d defaults
+func clusterTokenReplacements(clusterName, clusterType string) []TokenReplacement {
+	return []TokenReplacement{
+		{"<ARGOCD_INGRESS_URL>", ArgocdURL},
+		{"<ARGO_WORKFLOWS_INGRESS_URL>", ArgoWorkflowsURL},
+		{"<ATLANTIS_INGRESS_URL>", AtlantisURL},
+		{"<CLUSTER_NAME>", clusterName},
+		{"<CLOUD_PROVIDER>", CloudProvider},
+		{"<CLUSTER_TYPE>", clusterType},
+		{"<DOMAIN_NAME>", DomainName},
+		{"<K3D_DOMAIN>", DomainName},
+		{"<METAPHOR_DEVELOPMENT_INGRESS_URL>", MetaphorDevelopmentURL},
+		{"<METAPHOR_STAGING_INGRESS_URL>", MetaphorStagingURL},
+		{"<METAPHOR_PRODUCTION_INGRESS_URL>", MetaphorProductionURL},
+		{"<VAULT_INGRESS_URL>", VaultURL},
+	}
+}
+
+// ResetRegistry reverts registry/<clusterName> to the content of cluster-types/<clusterType>,
+// fixing the application paths, dropping the console component of the other arch and replacing
+// the tokens derivable from the cluster name and type as CopyComponent does. It requires the
+// cluster types kept by AdjustGitopsRepo with KeepClusterTypes, a registry whose atlantis was
+// removed gets it back. Only the AuditLogPath of opts is used
+func ResetRegistry(gitopsRepoDir, clusterName, clusterType string, opts ...AdjustOptions) error {
+	registryLocation, err := RegistryPath(gitopsRepoDir, clusterName)
+	if err != nil {
+		return err
+	}
+	clusterContent := fmt.Sprintf("%s/cluster-types/%s", gitopsRepoDir, clusterType)
+	if _, err := os.Stat(clusterContent); err != nil {
+		return fmt.Errorf("cluster type %s source %s is not available, adjust the gitops repo with KeepClusterTypes to reset its registry: %s", clusterType, clusterContent, err)
+	}
+
+	audit, err := openAuditLog(adjustOptions(opts).AuditLogPath)
+	if err != nil {
+		return err
+	}
+	defer audit.close()
+
+	log.Info().Str("path", registryLocation).Msg("removing cluster registry")
+	err = audit.removeAll(registryLocation)
+	if err != nil {
+		return fmt.Errorf("error removing cluster registry %s: %s", registryLocation, err)
+	}
+
+	log.Info().Str("source", clusterContent).Str("dest", registryLocation).Msg("copying cluster content")
+	err = copyClusterContent(clusterContent, registryLocation, copyOptions())
+	if err != nil {
+		return fmt.Errorf("error copying cluster content to %s: %s", registryLocation, err)
+	}
+	audit.record(auditCopy, registryLocation, clusterContent)
+
+	err = fixRegistryPaths(registryLocation, clusterName, audit)
+	if err != nil {
+		return err
+	}
+
+	_, unsupportedConsoleFile := consoleComponentFiles(pkg.LocalhostARCH, CloudProvider)
+	err = audit.removeAll(fmt.Sprintf("%s/components/kubefirst/%s", registryLocation, unsupportedConsoleFile))
+	if err != nil {
+		return fmt.Errorf("error removing unsupported console component %s: %s", unsupportedConsoleFile, err)
+	}
+
+	err = detokenizeDir(registryLocation, literalReplacer(clusterTokenReplacements(clusterName, clusterType)))
+	if err != nil {
+		return err
+	}
+	audit.record(auditDetokenize, registryLocation, "")
+	return nil
 }
@@ -0,0 +1,1074 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/kubefirst/runtime/pkg"
+	cp "github.com/otiai10/copy"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// writeFixture creates files relative to root, creating parent directories as needed
+func writeFixture(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// newMetaphorFixture lays out a k1 directory containing a gitops clone with
+// the metaphor and ci content AdjustMetaphorRepo expects
+func newMetaphorFixture(t *testing.T, metaphorFiles map[string]string) (string, string) {
+	t.Helper()
+
+	return newMetaphorFixtureAt(t, t.TempDir(), metaphorFiles)
+}
+
+// newMetaphorFixtureAt lays out the gitops clone of a metaphor fixture in an existing k1Dir
+func newMetaphorFixtureAt(t *testing.T, k1Dir string, metaphorFiles map[string]string) (string, string) {
+	t.Helper()
+
+	gitopsDir := filepath.Join(k1Dir, "gitops")
+	writeFixture(t, gitopsDir, map[string]string{
+		"ci/.argo/workflow.yaml":      "kind: Workflow\n",
+		"ci/.github/workflows/ci.yml": "name: ci\n",
+		"ci/.gitlab-ci.yml":           "stages:\n  - build\n",
+		"terraform/github/repos.tf":   "name = METAPHOR_REPO_NAME\n",
+	})
+	writeFixture(t, filepath.Join(gitopsDir, "metaphor"), metaphorFiles)
+
+	return k1Dir, gitopsDir
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestAdjustMetaphorRepoDockerfile(t *testing.T) {
+
+	tests := []struct {
+		name           string
+		metaphorFiles  map[string]string
+		opts           AdjustOptions
+		wantRoot       bool
+		wantRelocated  bool
+		wantDockerfile string
+	}{
+		{
+			name:           "relocates root dockerfile",
+			metaphorFiles:  map[string]string{"Dockerfile": "FROM root\n"},
+			wantRoot:       true,
+			wantRelocated:  true,
+			wantDockerfile: "FROM root\n",
+		},
+		{
+			name:           "dockerfile already in build",
+			metaphorFiles:  map[string]string{"build/Dockerfile": "FROM build\n"},
+			wantRoot:       false,
+			wantRelocated:  true,
+			wantDockerfile: "FROM build\n",
+		},
+		{
+			name:          "relocation disabled",
+			metaphorFiles: map[string]string{"Dockerfile": "FROM root\n"},
+			opts:          AdjustOptions{SkipDockerfileRelocation: true},
+			wantRoot:      true,
+			wantRelocated: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k1Dir, gitopsDir := newMetaphorFixture(t, tt.metaphorFiles)
+
+			err := AdjustMetaphorRepo("https://github.com/kubefirst/metaphor.git", gitopsDir, "metaphor", "github", k1Dir, tt.opts)
+			if err != nil {
+				t.Fatalf("AdjustMetaphorRepo() error = %v", err)
+			}
+
+			metaphorDir := filepath.Join(k1Dir, "metaphor")
+			if got := fileExists(filepath.Join(metaphorDir, "Dockerfile")); got != tt.wantRoot {
+				t.Errorf("root Dockerfile present = %v, want %v", got, tt.wantRoot)
+			}
+			relocated := filepath.Join(metaphorDir, "build", "Dockerfile")
+			if got := fileExists(relocated); got != tt.wantRelocated {
+				t.Errorf("build/Dockerfile present = %v, want %v", got, tt.wantRelocated)
+			}
+			if tt.wantDockerfile != "" {
+				content, _ := os.ReadFile(relocated)
+				if string(content) != tt.wantDockerfile {
+					t.Errorf("build/Dockerfile = %q, want %q", content, tt.wantDockerfile)
+				}
+			}
+		})
+	}
+}
+
+func TestSkipCopy(t *testing.T) {
+
+	tests := []struct {
+		name string
+		src  string
+		want bool
+	}{
+		{name: "repo git directory", src: "/home/k1/gitops/.git", want: true},
+		{name: "nested submodule git config", src: "/home/k1/gitops/foo/.git/config", want: true},
+		{name: "terraform working directory", src: "/home/k1/gitops/terraform/.terraform", want: true},
+		{name: "gitignore file", src: "/home/k1/gitops/.gitignore", want: false},
+		{name: "github directory", src: "/home/k1/gitops/ci/.github", want: false},
+		{name: "file ending in git", src: "/home/k1/gitops/docs/using.git", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := skipCopy(tt.src)
+			if err != nil {
+				t.Fatalf("skipCopy() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("skipCopy(%q) got = %v, want %v", tt.src, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCopyOptionsSkipsNestedGit(t *testing.T) {
+
+	src := t.TempDir()
+	dst := t.TempDir()
+	writeFixture(t, src, map[string]string{
+		"foo/.git/config": "[core]\n",
+		"foo/main.tf":     "terraform {}\n",
+	})
+
+	if err := cp.Copy(src, dst, copyOptions()); err != nil {
+		t.Fatal(err)
+	}
+	if fileExists(filepath.Join(dst, "foo", ".git", "config")) {
+		t.Error("nested .git/config was copied")
+	}
+	if !fileExists(filepath.Join(dst, "foo", "main.tf")) {
+		t.Error("foo/main.tf was not copied")
+	}
+}
+
+// newGitopsFixture lays out a gitops template clone with k3d-github driver content
+// and a single cluster type
+func newGitopsFixture(t *testing.T, clusterFiles map[string]string) (string, string) {
+	t.Helper()
+
+	k1Dir := t.TempDir()
+	gitopsDir := filepath.Join(k1Dir, "gitops")
+	writeFixture(t, gitopsDir, map[string]string{
+		"k3d-github/terraform/github/repos.tf.tmpl": "name = GITOPS_REPO_NAME\n",
+		"civo-github/terraform/main.tf":             "terraform {}\n",
+		"services/README.md":                        "services\n",
+	})
+	writeFixture(t, filepath.Join(gitopsDir, "cluster-types", "mgmt"), clusterFiles)
+
+	return k1Dir, gitopsDir
+}
+
+func TestAdjustGitopsRepoConsoleArch(t *testing.T) {
+
+	consoleFile, unsupportedConsoleFile := consoleComponentFiles(pkg.LocalhostARCH, CloudProvider)
+
+	tests := []struct {
+		name         string
+		clusterFiles map[string]string
+		opts         AdjustOptions
+		wantErr      bool
+	}{
+		{
+			name: "both console files present",
+			clusterFiles: map[string]string{
+				"components/kubefirst/" + consoleFile:            "kind: Application\n",
+				"components/kubefirst/" + unsupportedConsoleFile: "kind: Application\n",
+			},
+			opts: AdjustOptions{StrictArch: true},
+		},
+		{
+			name:         "missing correct arch lenient",
+			clusterFiles: map[string]string{"components/kubefirst/" + unsupportedConsoleFile: "kind: Application\n"},
+		},
+		{
+			name:         "missing correct arch strict",
+			clusterFiles: map[string]string{"components/kubefirst/" + unsupportedConsoleFile: "kind: Application\n"},
+			opts:         AdjustOptions{StrictArch: true},
+			wantErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k1Dir, gitopsDir := newGitopsFixture(t, tt.clusterFiles)
+
+			err := AdjustGitopsRepo(CloudProvider, "kubefirst", "mgmt", gitopsDir, "gitops", "github", k1Dir, false, tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AdjustGitopsRepo() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			unsupported := filepath.Join(gitopsDir, "registry", "kubefirst", "components", "kubefirst", unsupportedConsoleFile)
+			if fileExists(unsupported) {
+				t.Errorf("%s was not removed", unsupportedConsoleFile)
+			}
+		})
+	}
+}
+
+func TestAdjustMetaphorRepoStructuredLogging(t *testing.T) {
+
+	var buf bytes.Buffer
+	defaultLogger := log.Logger
+	log.Logger = zerolog.New(&buf)
+	defer func() { log.Logger = defaultLogger }()
+
+	k1Dir, gitopsDir := newMetaphorFixture(t, map[string]string{"Dockerfile": "FROM scratch\n"})
+	err := AdjustMetaphorRepo("https://github.com/kubefirst/metaphor.git", gitopsDir, "metaphor", "github", k1Dir)
+	if err != nil {
+		t.Fatalf("AdjustMetaphorRepo() error = %v", err)
+	}
+
+	want := map[string][2]string{
+		"copying metaphor content":       {filepath.Join(gitopsDir, "metaphor"), filepath.Join(k1Dir, "metaphor")},
+		"copying github content":         {filepath.Join(k1Dir, "gitops/ci/.github"), filepath.Join(k1Dir, "metaphor/.github")},
+		"copying argo workflows content": {filepath.Join(k1Dir, "gitops/ci/.argo"), filepath.Join(k1Dir, "metaphor/.argo")},
+		"copying dockerfile content":     {filepath.Join(k1Dir, "metaphor/Dockerfile"), filepath.Join(k1Dir, "metaphor/build/Dockerfile")},
+	}
+	found := map[string]bool{}
+	for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		entry := map[string]interface{}{}
+		if err := json.Unmarshal(line, &entry); err != nil {
+			t.Fatalf("log line is not json: %s", line)
+		}
+		message, _ := entry["message"].(string)
+		fields, ok := want[message]
+		if !ok {
+			continue
+		}
+		found[message] = true
+		if entry["source"] != fields[0] || entry["dest"] != fields[1] {
+			t.Errorf("%q fields source=%v dest=%v, want source=%s dest=%s", message, entry["source"], entry["dest"], fields[0], fields[1])
+		}
+	}
+	for message := range want {
+		if !found[message] {
+			t.Errorf("no %q log entry found", message)
+		}
+	}
+}
+
+func TestCopyComponent(t *testing.T) {
+
+	_, gitopsDir := newGitopsFixture(t, map[string]string{
+		"components/vault/application.yaml":  "cluster: <CLUSTER_NAME>\nhost: <VAULT_INGRESS_URL>\nowner: <GITHUB_OWNER>\n",
+		"components/argocd/application.yaml": "cluster: <CLUSTER_NAME>\n",
+	})
+
+	err := CopyComponent(gitopsDir, "kubefirst", "mgmt", "vault")
+	if err != nil {
+		t.Fatalf("CopyComponent() error = %v", err)
+	}
+
+	components := filepath.Join(gitopsDir, "registry", "kubefirst", "components")
+	content, err := os.ReadFile(filepath.Join(components, "vault", "application.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "cluster: kubefirst\nhost: https://vault.kubefirst.dev\nowner: <GITHUB_OWNER>\n"
+	if string(content) != want {
+		t.Errorf("CopyComponent() vault application = %q, want %q", content, want)
+	}
+	if fileExists(filepath.Join(components, "argocd")) {
+		t.Error("CopyComponent() copied argocd component")
+	}
+
+	if err := CopyComponent(gitopsDir, "kubefirst", "mgmt", "atlantis"); err == nil {
+		t.Error("CopyComponent() expected error for missing component")
+	}
+}
+
+func TestAdjustGitopsRepoPostAdjustHook(t *testing.T) {
+
+	consoleFile, _ := consoleComponentFiles(pkg.LocalhostARCH, CloudProvider)
+	hookDir := t.TempDir()
+	writeFixture(t, hookDir, map[string]string{
+		"marker.sh": "#!/bin/sh\ntouch \"$1/hook-ran-$2\"\n",
+		"fail.sh":   "#!/bin/sh\nexit 3\n",
+	})
+	for _, hook := range []string{"marker.sh", "fail.sh"} {
+		if err := os.Chmod(filepath.Join(hookDir, hook), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		hook       string
+		wantErr    bool
+		wantMarker bool
+	}{
+		{name: "hook touches marker", hook: filepath.Join(hookDir, "marker.sh"), wantMarker: true},
+		{name: "hook fails", hook: filepath.Join(hookDir, "fail.sh"), wantErr: true},
+		{name: "hook missing", hook: filepath.Join(hookDir, "missing.sh"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k1Dir, gitopsDir := newGitopsFixture(t, map[string]string{"components/kubefirst/" + consoleFile: "kind: Application\n"})
+
+			err := AdjustGitopsRepo(CloudProvider, "kubefirst", "mgmt", gitopsDir, "gitops", "github", k1Dir, false, AdjustOptions{PostAdjustHook: tt.hook})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AdjustGitopsRepo() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := fileExists(filepath.Join(gitopsDir, "hook-ran-kubefirst")); got != tt.wantMarker {
+				t.Errorf("hook marker present = %v, want %v", got, tt.wantMarker)
+			}
+		})
+	}
+}
+
+func TestAdjustMetaphorRepoTwice(t *testing.T) {
+
+	metaphorFiles := map[string]string{"Dockerfile": "FROM scratch\n"}
+	k1Dir, gitopsDir := newMetaphorFixture(t, metaphorFiles)
+	for run := 1; run <= 2; run++ {
+		if run == 2 {
+			// the first run removes the metaphor and ci content from the gitops clone
+			_, gitopsDir = newMetaphorFixtureAt(t, k1Dir, metaphorFiles)
+		}
+		err := AdjustMetaphorRepo("https://github.com/kubefirst/metaphor.git", gitopsDir, "metaphor", "github", k1Dir)
+		if err != nil {
+			t.Fatalf("AdjustMetaphorRepo() run %d error = %v", run, err)
+		}
+	}
+
+	repo, err := git.PlainOpen(filepath.Join(k1Dir, "metaphor"))
+	if err != nil {
+		t.Fatalf("metaphor repository cannot be opened: %v", err)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Name() != plumbing.NewBranchReferenceName("main") {
+		t.Errorf("HEAD = %s, want refs/heads/main", head.Name())
+	}
+	remotes, err := repo.Remotes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remotes) != 1 || remotes[0].Config().URLs[0] != "https://github.com/kubefirst/metaphor.git" {
+		t.Errorf("remotes = %v, want a single origin", remotes)
+	}
+}
+
+func TestAdjustMetaphorRepoGitlabCI(t *testing.T) {
+
+	k1Dir, gitopsDir := newMetaphorFixture(t, map[string]string{"Dockerfile": "FROM scratch\n"})
+	writeFixture(t, gitopsDir, map[string]string{
+		"ci/.gitlab-ci.yml": "variables:\n  CLUSTER_NAME: <CLUSTER_NAME>\n  REGISTRY: <CONTAINER_REGISTRY_URL>\nbuild:\n  script:\n    - docker push <CONTAINER_REGISTRY_URL>/metaphor\n",
+	})
+	tokens := &MetaphorTokenValues{
+		ClusterName:                   "kubefirst",
+		ContainerRegistryURL:          "registry.gitlab.com/kubefirst",
+		MetaphorDevelopmentIngressURL: MetaphorDevelopmentURL,
+		MetaphorStagingIngressURL:     MetaphorStagingURL,
+		MetaphorProductionIngressURL:  MetaphorProductionURL,
+	}
+
+	err := AdjustMetaphorRepo("https://gitlab.com/kubefirst/metaphor.git", gitopsDir, "metaphor", "gitlab", k1Dir, AdjustOptions{MetaphorTokens: tokens})
+	if err != nil {
+		t.Fatalf("AdjustMetaphorRepo() error = %v", err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(k1Dir, "metaphor", ".gitlab-ci.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ci := struct {
+		Variables map[string]string `yaml:"variables"`
+		Build     struct {
+			Script []string `yaml:"script"`
+		} `yaml:"build"`
+	}{}
+	if err := yaml.Unmarshal(content, &ci); err != nil {
+		t.Fatalf("detokenized .gitlab-ci.yml does not parse: %v", err)
+	}
+	if ci.Variables["CLUSTER_NAME"] != "kubefirst" || ci.Variables["REGISTRY"] != "registry.gitlab.com/kubefirst" {
+		t.Errorf("variables = %v, want detokenized values", ci.Variables)
+	}
+	if len(ci.Build.Script) != 1 || ci.Build.Script[0] != "docker push registry.gitlab.com/kubefirst/metaphor" {
+		t.Errorf("build script = %v, want detokenized registry", ci.Build.Script)
+	}
+}
+
+func TestAdjustMetaphorRepoDirMode(t *testing.T) {
+
+	tests := []struct {
+		name string
+		opts AdjustOptions
+		want os.FileMode
+	}{
+		{name: "default mode", want: 0700},
+		{name: "configured mode", opts: AdjustOptions{DirMode: 0750}, want: 0750},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k1Dir, gitopsDir := newMetaphorFixture(t, map[string]string{"Dockerfile": "FROM scratch\n"})
+
+			err := AdjustMetaphorRepo("https://github.com/kubefirst/metaphor.git", gitopsDir, "metaphor", "github", k1Dir, tt.opts)
+			if err != nil {
+				t.Fatalf("AdjustMetaphorRepo() error = %v", err)
+			}
+
+			for _, dir := range []string{"metaphor", "metaphor/build"} {
+				fi, err := os.Stat(filepath.Join(k1Dir, dir))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := fi.Mode().Perm(); got != tt.want {
+					t.Errorf("%s mode = %v, want %v", dir, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestAdjustReposWithSpacesInPath(t *testing.T) {
+
+	k1Dir := filepath.Join(t.TempDir(), "Application Support", "k1 dir")
+	_, gitopsDir := newMetaphorFixtureAt(t, k1Dir, map[string]string{"Dockerfile": "FROM scratch\n"})
+	writeFixture(t, gitopsDir, map[string]string{
+		"k3d-github/terraform/github/repos.tf.tmpl": "gitops = GITOPS_REPO_NAME\nmetaphor = METAPHOR_REPO_NAME\n",
+		"cluster-types/mgmt/README.md":              "mgmt\n",
+	})
+	hook := writeStubTool(t, k1Dir, "post adjust", `test -d "$1/registry/$2"`)
+
+	err := AdjustGitopsRepo(CloudProvider, "kubefirst", "mgmt", gitopsDir, "gitops", "github", k1Dir, false, AdjustOptions{PostAdjustHook: hook})
+	if err != nil {
+		t.Fatalf("AdjustGitopsRepo() error = %v", err)
+	}
+	err = AdjustMetaphorRepo("https://github.com/kubefirst/metaphor.git", gitopsDir, "metaphor", "github", k1Dir)
+	if err != nil {
+		t.Fatalf("AdjustMetaphorRepo() error = %v", err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(gitopsDir, "terraform", "github", "repos.tf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "gitops = \"gitops\"\nmetaphor = \"metaphor\"\n"; string(content) != want {
+		t.Errorf("repos.tf = %q, want %q", content, want)
+	}
+}
+
+func TestAdjustMetaphorRepoPreserveHistory(t *testing.T) {
+
+	tests := []struct {
+		name        string
+		opts        AdjustOptions
+		wantCommits int
+	}{
+		{name: "fresh history", wantCommits: 1},
+		{name: "preserved history", opts: AdjustOptions{PreserveHistory: true}, wantCommits: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k1Dir, gitopsDir := newMetaphorFixture(t, map[string]string{"Dockerfile": "FROM scratch\n"})
+			templateRepo, err := git.PlainInit(gitopsDir, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = templateRepo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{"https://github.com/kubefirst/gitops-template.git"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, message := range []string{"initial template", "template update"} {
+				writeFixture(t, gitopsDir, map[string]string{"CHANGELOG.md": message + "\n"})
+				if _, err := CommitGitopsRepo(gitopsDir, message); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err = AdjustMetaphorRepo("https://github.com/kubefirst/metaphor.git", gitopsDir, "metaphor", "github", k1Dir, tt.opts)
+			if err != nil {
+				t.Fatalf("AdjustMetaphorRepo() error = %v", err)
+			}
+
+			repo, err := git.PlainOpen(filepath.Join(k1Dir, "metaphor"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			commits, err := repo.Log(&git.LogOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			count := 0
+			commits.ForEach(func(*object.Commit) error {
+				count++
+				return nil
+			})
+			if count != tt.wantCommits {
+				t.Errorf("metaphor history = %d commits, want %d", count, tt.wantCommits)
+			}
+
+			head, _ := repo.Head()
+			commit, _ := repo.CommitObject(head.Hash())
+			if _, err := commit.File("terraform/github/repos.tf"); err == nil {
+				t.Error("template gitops content was committed to the metaphor repo")
+			}
+			if _, err := commit.File("build/Dockerfile"); err != nil {
+				t.Errorf("metaphor content missing from head commit: %v", err)
+			}
+			remote, _ := repo.Remote("origin")
+			if got := remote.Config().URLs[0]; got != "https://github.com/kubefirst/metaphor.git" {
+				t.Errorf("metaphor origin = %s", got)
+			}
+		})
+	}
+}
+
+func TestAdjustMetaphorRepoCommitIdentity(t *testing.T) {
+
+	k1Dir, gitopsDir := newMetaphorFixture(t, map[string]string{"Dockerfile": "FROM scratch\n"})
+	identity := CommitIdentity{Name: "Platform Team", Email: "platform@example.com"}
+
+	err := AdjustMetaphorRepo("https://github.com/kubefirst/metaphor.git", gitopsDir, "metaphor", "github", k1Dir, AdjustOptions{CommitIdentity: identity})
+	if err != nil {
+		t.Fatalf("AdjustMetaphorRepo() error = %v", err)
+	}
+
+	repo, err := git.PlainOpen(filepath.Join(k1Dir, "metaphor"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, _ := repo.Head()
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commit.Author.Name != identity.Name || commit.Author.Email != identity.Email {
+		t.Errorf("metaphor commit author = %s <%s>, want %s <%s>", commit.Author.Name, commit.Author.Email, identity.Name, identity.Email)
+	}
+	if commit.Committer.Email != identity.Email {
+		t.Errorf("metaphor commit committer = %s, want %s", commit.Committer.Email, identity.Email)
+	}
+}
+
+func TestAdjustMetaphorRepoCommitMessage(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		message string
+		want    string
+	}{
+		{name: "default", want: defaultMetaphorCommitMessage},
+		{name: "configured", message: "PLAT-42: create metaphor repository", want: "PLAT-42: create metaphor repository"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k1Dir, gitopsDir := newMetaphorFixture(t, map[string]string{"Dockerfile": "FROM scratch\n"})
+
+			err := AdjustMetaphorRepo("https://github.com/kubefirst/metaphor.git", gitopsDir, "metaphor", "github", k1Dir, AdjustOptions{CommitMessage: tt.message})
+			if err != nil {
+				t.Fatalf("AdjustMetaphorRepo() error = %v", err)
+			}
+
+			repo, err := git.PlainOpen(filepath.Join(k1Dir, "metaphor"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			head, _ := repo.Head()
+			commit, err := repo.CommitObject(head.Hash())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if commit.Message != tt.want {
+				t.Errorf("metaphor commit message = %q, want %q", commit.Message, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdjustMetaphorRepoDetokenizes(t *testing.T) {
+
+	tokens := &MetaphorTokenValues{
+		ClusterName:                   "kubefirst",
+		MetaphorDevelopmentIngressURL: "https://metaphor-development.kubefirst.dev",
+		MetaphorStagingIngressURL:     "https://metaphor-staging.kubefirst.dev",
+		MetaphorProductionIngressURL:  "https://metaphor-production.kubefirst.dev",
+	}
+
+	tests := []struct {
+		name   string
+		values string
+		delims Delimiters
+		want   string
+	}{
+		{
+			name:   "default delimiters",
+			values: "cluster: <CLUSTER_NAME>\n",
+			want:   "cluster: kubefirst\n",
+		},
+		{
+			name:   "custom delimiters",
+			values: "cluster: << .ClusterName >>\nhost: <<METAPHOR_STAGING_INGRESS_URL>>\nliteral: <CLUSTER_NAME>\n",
+			delims: Delimiters{Left: "<<", Right: ">>"},
+			want:   "cluster: kubefirst\nhost: https://metaphor-staging.kubefirst.dev\nliteral: <CLUSTER_NAME>\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k1Dir, gitopsDir := newMetaphorFixture(t, map[string]string{"Dockerfile": "FROM scratch\n", "chart/values.yaml": tt.values})
+
+			err := AdjustMetaphorRepo("https://github.com/kubefirst/metaphor.git", gitopsDir, "metaphor", "github", k1Dir, AdjustOptions{MetaphorTokens: tokens, Delimiters: tt.delims})
+			if err != nil {
+				t.Fatalf("AdjustMetaphorRepo() error = %v", err)
+			}
+
+			repo, err := git.PlainOpen(filepath.Join(k1Dir, "metaphor"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			head, _ := repo.Head()
+			commit, err := repo.CommitObject(head.Hash())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if commit.NumParents() != 0 {
+				t.Errorf("metaphor head commit has %d parents, want a single initial commit", commit.NumParents())
+			}
+			file, err := commit.File("chart/values.yaml")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if content, _ := file.Contents(); content != tt.want {
+				t.Errorf("committed chart/values.yaml = %q, want %q", content, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemovePlatform(t *testing.T) {
+
+	root := t.TempDir()
+	gitopsDir := filepath.Join(root, "gitops")
+	writeFixture(t, root, map[string]string{
+		"gitops/civo-github/terraform/main.tf": "terraform {}\n",
+		"gitops/k3d-github/terraform/main.tf":  "terraform {}\n",
+		"kubeconfig":                           "apiVersion: v1\n",
+	})
+
+	tests := []struct {
+		name     string
+		platform string
+		wantErr  bool
+	}{
+		{name: "supported platform", platform: "civo-github"},
+		{name: "path traversal", platform: "../", wantErr: true},
+		{name: "nested traversal", platform: "k3d-github/../../kubeconfig", wantErr: true},
+		{name: "unknown platform", platform: "services", wantErr: true},
+		{name: "empty platform", platform: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := RemovePlatform(gitopsDir, tt.platform)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("RemovePlatform() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if fileExists(filepath.Join(gitopsDir, "civo-github")) {
+		t.Error("civo-github was not removed")
+	}
+	for _, path := range []string{"gitops/k3d-github/terraform/main.tf", "kubeconfig"} {
+		if !fileExists(filepath.Join(root, path)) {
+			t.Errorf("%s was removed", path)
+		}
+	}
+}
+
+func TestCopyClusterContentCleanup(t *testing.T) {
+
+	tests := []struct {
+		name         string
+		failOn       string
+		existing     map[string]string
+		wantRegistry bool
+		wantFiles    []string
+	}{
+		{name: "copy succeeds", wantRegistry: true, wantFiles: []string{"argocd.yaml", "components/vault/application.yaml", "vault.yaml"}},
+		{name: "fresh registry removed on failure", failOn: "vault.yaml"},
+		{
+			name:         "existing registry kept on failure",
+			failOn:       "vault.yaml",
+			existing:     map[string]string{"prior.yaml": "kind: Application\n"},
+			wantRegistry: true,
+			wantFiles:    []string{"prior.yaml"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			clusterContent := filepath.Join(root, "cluster-types", "mgmt")
+			writeFixture(t, clusterContent, map[string]string{
+				"argocd.yaml":                       "kind: Application\n",
+				"components/vault/application.yaml": "kind: Application\n",
+				"vault.yaml":                        "kind: Application\n",
+			})
+			registry := filepath.Join(root, "registry", "kubefirst")
+			if tt.existing != nil {
+				writeFixture(t, registry, tt.existing)
+			}
+
+			// fail part way through, after argocd.yaml and components have been copied
+			opt := copyOptions()
+			opt.Skip = func(src string) (bool, error) {
+				if tt.failOn != "" && filepath.Base(src) == tt.failOn {
+					return false, errors.New("disk full")
+				}
+				return skipCopy(src)
+			}
+
+			err := copyClusterContent(clusterContent, registry, opt)
+			if (err != nil) != (tt.failOn != "") {
+				t.Fatalf("copyClusterContent() error = %v, want failure %v", err, tt.failOn != "")
+			}
+			if fileExists(registry) != tt.wantRegistry {
+				t.Fatalf("registry exists = %v, want %v", fileExists(registry), tt.wantRegistry)
+			}
+			for _, file := range tt.wantFiles {
+				if !fileExists(filepath.Join(registry, file)) {
+					t.Errorf("%s missing from registry", file)
+				}
+			}
+		})
+	}
+}
+
+func TestCopyOptionsSymlinkLoops(t *testing.T) {
+
+	src := filepath.Join(t.TempDir(), "metaphor")
+	writeFixture(t, src, map[string]string{
+		"build/Dockerfile":   "FROM alpine:3.17\n",
+		"charts/values.yaml": "replicaCount: 1\n",
+	})
+	links := map[string]string{
+		"charts/parent":   "..",                  // loops back to the root of the copy
+		"charts/self":     ".",                   // loops back to its own directory
+		"build/loop":      "loop",                // resolves to itself
+		"charts/build":    "../build",            // sibling directory, not a loop
+		"charts/docker":   "../build/Dockerfile", // file
+		"charts/dangling": "missing.yaml",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(src, link)); err != nil {
+			t.Skipf("symlinks not supported: %v", err)
+		}
+	}
+
+	dest := filepath.Join(t.TempDir(), "copy")
+	done := make(chan error, 1)
+	go func() { done <- cp.Copy(src, dest, copyOptions()) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("cp.Copy() error = %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("cp.Copy() did not terminate on a symlink loop")
+	}
+
+	tests := []struct {
+		link     string
+		wantCopy bool
+	}{
+		{link: "charts/parent"},
+		{link: "charts/self"},
+		{link: "build/loop"},
+		{link: "charts/build", wantCopy: true},
+		{link: "charts/docker", wantCopy: true},
+		{link: "charts/dangling", wantCopy: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.link, func(t *testing.T) {
+			target, err := os.Readlink(filepath.Join(dest, tt.link))
+			if (err == nil) != tt.wantCopy {
+				t.Fatalf("%s copied = %v, want %v", tt.link, err == nil, tt.wantCopy)
+			}
+			if tt.wantCopy && target != links[tt.link] {
+				t.Errorf("%s -> %s, want -> %s", tt.link, target, links[tt.link])
+			}
+		})
+	}
+	if !fileExists(filepath.Join(dest, "build", "Dockerfile")) {
+		t.Error("regular files were not copied")
+	}
+}
+
+func TestAvailableClusterTypes(t *testing.T) {
+
+	gitopsDir := t.TempDir()
+	writeFixture(t, gitopsDir, map[string]string{
+		"cluster-types/mgmt/argocd.yaml":         "kind: Application\n",
+		"cluster-types/workload/argocd.yaml":     "kind: Application\n",
+		"cluster-types/workload-vcluster/a.yaml": "kind: Application\n",
+		"cluster-types/README.md":                "cluster types\n",
+	})
+
+	got, err := AvailableClusterTypes(gitopsDir)
+	if err != nil {
+		t.Fatalf("AvailableClusterTypes() error = %v", err)
+	}
+	if want := []string{"mgmt", "workload", "workload-vcluster"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("AvailableClusterTypes() = %v, want %v", got, want)
+	}
+	if _, err := AvailableClusterTypes(t.TempDir()); err == nil {
+		t.Error("AvailableClusterTypes() expected error without a cluster-types directory")
+	}
+
+	tests := []struct {
+		clusterType string
+		wantErr     string
+	}{
+		{clusterType: "mgmt"},
+		{clusterType: "workload-vcluster"},
+		{clusterType: "mgnt", wantErr: `did you mean "mgmt"?`},
+		{clusterType: "Workload", wantErr: `did you mean "workload"?`},
+		{clusterType: "workload-vclustr", wantErr: `did you mean "workload-vcluster"?`},
+		{clusterType: "edge", wantErr: "available cluster types: mgmt, workload, workload-vcluster"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.clusterType, func(t *testing.T) {
+			err := validateClusterType(tt.clusterType, got)
+			if (err != nil) != (tt.wantErr != "") {
+				t.Fatalf("validateClusterType() error = %v, wantErr %q", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validateClusterType() error = %q, want it to contain %q", err, tt.wantErr)
+			}
+			if tt.clusterType == "edge" && strings.Contains(err.Error(), "did you mean") {
+				t.Errorf("validateClusterType() suggested a cluster type for an unrelated name: %v", err)
+			}
+		})
+	}
+
+	k1Dir, fixtureDir := newGitopsFixture(t, map[string]string{"argocd.yaml": "kind: Application\n"})
+	err = AdjustGitopsRepo(CloudProvider, "kubefirst", "mgnt", fixtureDir, "gitops", "github", k1Dir, false)
+	if err == nil || !strings.Contains(err.Error(), `did you mean "mgmt"?`) {
+		t.Errorf("AdjustGitopsRepo() error = %v, want a cluster type suggestion", err)
+	}
+	if !fileExists(filepath.Join(fixtureDir, "civo-github")) {
+		t.Error("AdjustGitopsRepo() modified the repo before validating the cluster type")
+	}
+}
+
+func TestAdjustMetaphorRepoDuplicateURLs(t *testing.T) {
+
+	k1Dir, gitopsDir := newMetaphorFixture(t, map[string]string{"Dockerfile": "FROM scratch\n"})
+	tokens := BuildMetaphorValues(&K3dConfig{ClusterName: "kubefirst"}, "", "ghcr.io/kubefirst")
+	tokens.MetaphorProductionIngressURL = tokens.MetaphorStagingIngressURL
+
+	err := AdjustMetaphorRepo("https://github.com/kubefirst/metaphor.git", gitopsDir, "metaphor", "github", k1Dir, AdjustOptions{MetaphorTokens: &tokens})
+	if err == nil || !strings.Contains(err.Error(), "share the ingress host") {
+		t.Fatalf("AdjustMetaphorRepo() error = %v, want duplicate ingress urls rejected", err)
+	}
+	if fileExists(filepath.Join(k1Dir, "metaphor")) {
+		t.Error("AdjustMetaphorRepo() created the metaphor repo before validating the ingress urls")
+	}
+}
+
+func TestAdjustMetaphorRepoCIProviders(t *testing.T) {
+
+	tests := []struct {
+		name        string
+		gitProvider string
+		opts        AdjustOptions
+		wantGithub  bool
+		wantGitlab  bool
+		wantErr     bool
+	}{
+		{name: "defaults to the git provider", gitProvider: "github", wantGithub: true},
+		{name: "gitlab only", gitProvider: "gitlab", wantGitlab: true},
+		{
+			name:        "github and gitlab",
+			gitProvider: "github",
+			opts:        AdjustOptions{CIProviders: []string{"github", "gitlab"}},
+			wantGithub:  true,
+			wantGitlab:  true,
+		},
+		{
+			name:        "unsupported provider",
+			gitProvider: "github",
+			opts:        AdjustOptions{CIProviders: []string{"github", "bitbucket"}},
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k1Dir, gitopsDir := newMetaphorFixture(t, map[string]string{"Dockerfile": "FROM scratch\n"})
+
+			err := AdjustMetaphorRepo("https://github.com/kubefirst/metaphor.git", gitopsDir, "metaphor", tt.gitProvider, k1Dir, tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AdjustMetaphorRepo() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			metaphorDir := filepath.Join(k1Dir, "metaphor")
+			if got := fileExists(filepath.Join(metaphorDir, ".github", "workflows", "ci.yml")); got != tt.wantGithub {
+				t.Errorf(".github present = %v, want %v", got, tt.wantGithub)
+			}
+			if got := fileExists(filepath.Join(metaphorDir, ".gitlab-ci.yml")); got != tt.wantGitlab {
+				t.Errorf(".gitlab-ci.yml present = %v, want %v", got, tt.wantGitlab)
+			}
+		})
+	}
+}
+
+func TestAdjustGitopsRepoRejectsTraversal(t *testing.T) {
+
+	k1Dir, gitopsDir := newGitopsFixture(t, map[string]string{"argocd.yaml": "kind: Application\n"})
+
+	err := AdjustGitopsRepo(CloudProvider, "../../escaped", "mgmt", gitopsDir, "gitops", "github", k1Dir, false)
+	if err == nil || !strings.Contains(err.Error(), "invalid cluster name") {
+		t.Fatalf("AdjustGitopsRepo() error = %v, want the cluster name rejected", err)
+	}
+	if fileExists(filepath.Join(k1Dir, "escaped")) {
+		t.Error("AdjustGitopsRepo() wrote outside the gitops repo")
+	}
+	if !fileExists(filepath.Join(gitopsDir, "civo-github")) {
+		t.Error("AdjustGitopsRepo() modified the gitops repo before rejecting the cluster name")
+	}
+}
+
+func TestResetRegistry(t *testing.T) {
+
+	consoleFile, unsupportedConsoleFile := consoleComponentFiles(pkg.LocalhostARCH, CloudProvider)
+	clusterFiles := map[string]string{
+		"argocd.yaml":                                    application("argocd", "cluster-types/mgmt/components/argocd"),
+		"components/argocd/values.yaml":                  "cluster: <CLUSTER_NAME>\ntype: <CLUSTER_TYPE>\n",
+		"components/kubefirst/" + consoleFile:            "kind: Application\n",
+		"components/kubefirst/" + unsupportedConsoleFile: "kind: Application\n",
+	}
+
+	// a fresh adjust with the cluster tokens replaced is the pristine registry
+	k1Dir, freshGitopsDir := newGitopsFixture(t, clusterFiles)
+	err := AdjustGitopsRepo(CloudProvider, "kubefirst", "mgmt", freshGitopsDir, "gitops", "github", k1Dir, false)
+	if err != nil {
+		t.Fatalf("AdjustGitopsRepo() error = %v", err)
+	}
+	freshRegistry := filepath.Join(freshGitopsDir, "registry", "kubefirst")
+	err = DetokenizeGitopsRepo(freshRegistry, &GitopsDirectoryValues{ClusterName: "kubefirst", ClusterType: "mgmt"}, "https", 1)
+	if err != nil {
+		t.Fatalf("DetokenizeGitopsRepo() error = %v", err)
+	}
+
+	k1Dir, gitopsDir := newGitopsFixture(t, clusterFiles)
+	err = AdjustGitopsRepo(CloudProvider, "kubefirst", "mgmt", gitopsDir, "gitops", "github", k1Dir, false, AdjustOptions{KeepClusterTypes: true})
+	if err != nil {
+		t.Fatalf("AdjustGitopsRepo() error = %v", err)
+	}
+	registry := filepath.Join(gitopsDir, "registry", "kubefirst")
+	writeFixture(t, registry, map[string]string{
+		"components/argocd/values.yaml": "cluster: edited\n",
+		"components/extra/app.yaml":     "kind: Application\n",
+	})
+
+	err = ResetRegistry(gitopsDir, "kubefirst", "mgmt")
+	if err != nil {
+		t.Fatalf("ResetRegistry() error = %v", err)
+	}
+	diffs, err := DiffRegistries(freshRegistry, registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("ResetRegistry() registry differs from a fresh adjust: %v", diffs)
+	}
+}
+
+func TestResetRegistrySourceRemoved(t *testing.T) {
+
+	k1Dir, gitopsDir := newGitopsFixture(t, map[string]string{"argocd.yaml": "kind: Application\n"})
+	err := AdjustGitopsRepo(CloudProvider, "kubefirst", "mgmt", gitopsDir, "gitops", "github", k1Dir, false)
+	if err != nil {
+		t.Fatalf("AdjustGitopsRepo() error = %v", err)
+	}
+	writeFixture(t, gitopsDir, map[string]string{"registry/kubefirst/edited.yaml": "kind: Application\n"})
+
+	err = ResetRegistry(gitopsDir, "kubefirst", "mgmt")
+	if err == nil || !strings.Contains(err.Error(), "KeepClusterTypes") {
+		t.Fatalf("ResetRegistry() error = %v, want the missing cluster type source reported", err)
+	}
+	if !fileExists(filepath.Join(gitopsDir, "registry", "kubefirst", "edited.yaml")) {
+		t.Error("ResetRegistry() removed the registry without a source to reset it from")
+	}
+}
+
+func TestCheckWritable(t *testing.T) {
+
+	dir := t.TempDir()
+	if err := checkWritable(dir); err != nil {
+		t.Fatalf("checkWritable() error = %v", err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Errorf("checkWritable() left %d files behind", len(entries))
+	}
+
+	if os.Geteuid() == 0 {
+		t.Skip("root can write to read-only directories")
+	}
+	readOnly := filepath.Join(dir, "readonly")
+	if err := os.Mkdir(readOnly, 0500); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(readOnly, 0700) })
+	err := checkWritable(readOnly)
+	if err == nil || !strings.Contains(err.Error(), "is not writable") {
+		t.Errorf("checkWritable() on a read-only directory error = %v, want it reported as not writable", err)
+	}
+}
+
+func TestAdjustMetaphorRepoUnwritableDestination(t *testing.T) {
+
+	k1Dir, gitopsDir := newMetaphorFixture(t, map[string]string{"Dockerfile": "FROM scratch\n"})
+	// a file where the metaphor directory belongs can't be written into
+	writeFixture(t, k1Dir, map[string]string{"metaphor": "not a directory\n"})
+
+	err := AdjustMetaphorRepo("https://github.com/kubefirst/metaphor.git", gitopsDir, "metaphor", "github", k1Dir)
+	if err == nil || !strings.Contains(err.Error(), "destination "+filepath.Join(k1Dir, "metaphor")+" is not writable") {
+		t.Fatalf("AdjustMetaphorRepo() error = %v, want the destination reported as not writable", err)
+	}
+	if !fileExists(filepath.Join(gitopsDir, "metaphor", "Dockerfile")) {
+		t.Error("AdjustMetaphorRepo() modified the gitops repo before failing")
+	}
+}
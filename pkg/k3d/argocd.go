@@ -0,0 +1,243 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/kubefirst/runtime/pkg/httpCommon"
+	"github.com/kubefirst/runtime/pkg/k8s"
+	"github.com/rs/zerolog/log"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// argocdAPIURL is the argocd server polled by WaitForArgoSync
+var argocdAPIURL = ArgocdURL
+
+// argoSyncPollInterval is the delay between application status checks
+var argoSyncPollInterval = 10 * time.Second
+
+// argoApplicationStatus is the subset of an argocd application used to determine readiness
+type argoApplicationStatus struct {
+	Status struct {
+		Sync struct {
+			Status string `json:"status"`
+		} `json:"sync"`
+		Health struct {
+			Status string `json:"status"`
+		} `json:"health"`
+	} `json:"status"`
+}
+
+// ArgoRepoURL returns the gitops repo url argocd registers for cfg.GitProtocol, the https url
+// authenticated with the git token or the ssh url authenticated with the kbot ssh key. Without
+// an ssh url argocd has no ssh credentials to use, so the https url is returned
+func ArgoRepoURL(cfg *K3dConfig) string {
+	if cfg.GitProtocol == "https" || cfg.DestinationGitopsRepoGitURL == "" {
+		return cfg.DestinationGitopsRepoURL
+	}
+	return cfg.DestinationGitopsRepoGitURL
+}
+
+// GetArgoInitialAdminPassword returns the admin password from the argocd-initial-admin-secret,
+// read through the kubernetes api so the password never passes through logged command output
+func GetArgoInitialAdminPassword(cfg *K3dConfig) (string, error) {
+	clientset, err := k8s.GetClientSet(cfg.Kubeconfig)
+	if err != nil {
+		return "", fmt.Errorf("error getting kubernetes clientset: %s", err)
+	}
+
+	return argocdAdminPassword(clientset)
+}
+
+// WaitForArgoSync polls the argocd api until appName reports Synced and Healthy, authenticating
+// as admin with the argocd-initial-admin-secret password, and returns an error once timeout elapses
+func WaitForArgoSync(cfg *K3dConfig, appName string, timeout time.Duration) error {
+	clientset, err := k8s.GetClientSet(cfg.Kubeconfig)
+	if err != nil {
+		return fmt.Errorf("error getting kubernetes clientset: %s", err)
+	}
+
+	return waitForArgoSync(clientset, httpCommon.CustomHttpClient(true), argocdAPIURL, appName, timeout)
+}
+
+func waitForArgoSync(clientset kubernetes.Interface, httpClient *http.Client, baseURL, appName string, timeout time.Duration) error {
+	token, err := argocdAdminToken(clientset, httpClient, baseURL)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		status, err := argocdApplicationStatus(httpClient, baseURL, token, appName)
+		if err != nil {
+			log.Warn().Msgf("error checking argocd application %s: %s", appName, err)
+		} else if status.Status.Sync.Status == "Synced" && status.Status.Health.Status == "Healthy" {
+			log.Info().Msgf("argocd application %s is synced and healthy", appName)
+			return nil
+		} else {
+			log.Info().Msgf("waiting for argocd application %s, sync: %s health: %s", appName, status.Status.Sync.Status, status.Status.Health.Status)
+		}
+
+		if time.Now().Add(argoSyncPollInterval).After(deadline) {
+			return fmt.Errorf("timed out after %s waiting for argocd application %s to be synced and healthy", timeout, appName)
+		}
+		time.Sleep(argoSyncPollInterval)
+	}
+}
+
+// TestArgoRepoConnection asks argocd to connect to repoURL with the credentials it has stored
+// for the repository and returns the connection failure argocd reports, e.g. missing or
+// rejected credentials, authenticating as admin with the argocd-initial-admin-secret password
+func TestArgoRepoConnection(cfg *K3dConfig, repoURL string) error {
+	clientset, err := k8s.GetClientSet(cfg.Kubeconfig)
+	if err != nil {
+		return fmt.Errorf("error getting kubernetes clientset: %s", err)
+	}
+
+	return testArgoRepoConnection(clientset, httpCommon.CustomHttpClient(true), argocdAPIURL, repoURL)
+}
+
+func testArgoRepoConnection(clientset kubernetes.Interface, httpClient *http.Client, baseURL, repoURL string) error {
+	token, err := argocdAdminToken(clientset, httpClient, baseURL)
+	if err != nil {
+		return err
+	}
+
+	// forceRefresh makes argocd connect to the repository instead of returning a cached state
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/api/v1/repositories/%s?forceRefresh=true", baseURL, url.QueryEscape(repoURL)), nil)
+	if err != nil {
+		return fmt.Errorf("error building argocd repository request: %s", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error testing argocd connection to %s: %s", repoURL, err)
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusForbidden:
+		return fmt.Errorf("repository %s is not registered with argocd: %s", repoURL, res.Status)
+	default:
+		return fmt.Errorf("unexpected status testing argocd connection to %s: %s", repoURL, res.Status)
+	}
+
+	var repository struct {
+		ConnectionState struct {
+			Status  string `json:"status"`
+			Message string `json:"message"`
+		} `json:"connectionState"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&repository)
+	if err != nil {
+		return fmt.Errorf("error decoding argocd repository: %s", err)
+	}
+	if repository.ConnectionState.Status != "Successful" {
+		return fmt.Errorf("argocd cannot connect to %s: %s, check the credentials in the repo-credentials-template secret of the argocd namespace",
+			repoURL, repository.ConnectionState.Message)
+	}
+
+	log.Info().Msgf("argocd connected to repository %s", repoURL)
+	return nil
+}
+
+// argocdAdminPassword returns the admin password from the argocd-initial-admin-secret
+func argocdAdminPassword(clientset kubernetes.Interface) (string, error) {
+	secret, err := clientset.CoreV1().Secrets("argocd").Get(context.TODO(), "argocd-initial-admin-secret", metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return "", fmt.Errorf("argocd-initial-admin-secret not found, argocd may not have finished installing")
+	}
+	if err != nil {
+		return "", fmt.Errorf("error getting argocd initial admin secret: %s", err)
+	}
+	password := string(secret.Data["password"])
+	if password == "" {
+		return "", fmt.Errorf("argocd initial admin secret has no password")
+	}
+
+	return password, nil
+}
+
+// argocdAdminToken returns an argocd api token for admin using the argocd-initial-admin-secret password
+func argocdAdminToken(clientset kubernetes.Interface, httpClient *http.Client, baseURL string) (string, error) {
+	password, err := argocdAdminPassword(clientset)
+	if err != nil {
+		return "", err
+	}
+
+	return argocdSessionToken(httpClient, baseURL, "admin", password)
+}
+
+// argocdSessionToken exchanges the username and password for an argocd api token
+func argocdSessionToken(httpClient *http.Client, baseURL, username, password string) (string, error) {
+	payload, err := json.Marshal(map[string]string{"username": username, "password": password})
+	if err != nil {
+		return "", fmt.Errorf("error encoding argocd session request: %s", err)
+	}
+
+	res, err := httpClient.Post(baseURL+"/api/v1/session", "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return "", fmt.Errorf("error creating argocd session: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unable to retrieve argocd token: %s", res.Status)
+	}
+
+	var session struct {
+		Token string `json:"token"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&session)
+	if err != nil {
+		return "", fmt.Errorf("error decoding argocd session response: %s", err)
+	}
+	if session.Token == "" {
+		return "", fmt.Errorf("unable to retrieve argocd token, make sure provided credentials are valid")
+	}
+
+	return session.Token, nil
+}
+
+// argocdApplicationStatus returns the sync and health status of appName
+func argocdApplicationStatus(httpClient *http.Client, baseURL, token, appName string) (argoApplicationStatus, error) {
+	var status argoApplicationStatus
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/api/v1/applications/%s", baseURL, url.PathEscape(appName)), nil)
+	if err != nil {
+		return status, fmt.Errorf("error building argocd application request: %s", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return status, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return status, fmt.Errorf("unexpected status getting application: %s", res.Status)
+	}
+
+	err = json.NewDecoder(res.Body).Decode(&status)
+	if err != nil {
+		return status, fmt.Errorf("error decoding argocd application: %s", err)
+	}
+
+	return status, nil
+}
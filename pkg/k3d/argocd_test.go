@@ -0,0 +1,232 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// newArgoCDServer serves a session endpoint accepting password and an application
+// endpoint returning each of statuses in turn, repeating the last one
+func newArgoCDServer(t *testing.T, password string, statuses [][2]string) *httptest.Server {
+	t.Helper()
+
+	polls := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/session", func(w http.ResponseWriter, r *http.Request) {
+		var session map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&session)
+		if session["username"] != "admin" || session["password"] != password {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"token":"argocd-token"}`)
+	})
+	mux.HandleFunc("/api/v1/applications/registry", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer argocd-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		status := statuses[len(statuses)-1]
+		if polls < len(statuses) {
+			status = statuses[polls]
+		}
+		polls++
+		fmt.Fprintf(w, `{"metadata":{"name":"registry"},"status":{"sync":{"status":%q},"health":{"status":%q}}}`, status[0], status[1])
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestWaitForArgoSync(t *testing.T) {
+
+	interval := argoSyncPollInterval
+	argoSyncPollInterval = 10 * time.Millisecond
+	defer func() { argoSyncPollInterval = interval }()
+
+	tests := []struct {
+		name           string
+		secretPassword string
+		statuses       [][2]string
+		wantErr        bool
+	}{
+		{
+			name:           "progressing then synced",
+			secretPassword: "admin-password",
+			statuses:       [][2]string{{"OutOfSync", "Progressing"}, {"Synced", "Progressing"}, {"Synced", "Healthy"}},
+		},
+		{
+			name:           "never healthy",
+			secretPassword: "admin-password",
+			statuses:       [][2]string{{"Synced", "Degraded"}},
+			wantErr:        true,
+		},
+		{
+			name:           "wrong admin password",
+			secretPassword: "stale-password",
+			statuses:       [][2]string{{"Synced", "Healthy"}},
+			wantErr:        true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newArgoCDServer(t, "admin-password", tt.statuses)
+			clientset := fake.NewSimpleClientset(&v1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "argocd-initial-admin-secret", Namespace: "argocd"},
+				Data:       map[string][]byte{"password": []byte(tt.secretPassword)},
+			})
+
+			err := waitForArgoSync(clientset, server.Client(), server.URL, "registry", 200*time.Millisecond)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("waitForArgoSync() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestArgoAdminPassword(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		secret  *v1.Secret
+		want    string
+		wantErr string
+	}{
+		{
+			name: "secret present",
+			secret: &v1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "argocd-initial-admin-secret", Namespace: "argocd"},
+				Data:       map[string][]byte{"password": []byte("admin-password")},
+			},
+			want: "admin-password",
+		},
+		{name: "secret not found", wantErr: "argocd may not have finished installing"},
+		{
+			name: "missing password",
+			secret: &v1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "argocd-initial-admin-secret", Namespace: "argocd"},
+				Data:       map[string][]byte{},
+			},
+			wantErr: "has no password",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset()
+			if tt.secret != nil {
+				clientset = fake.NewSimpleClientset(tt.secret)
+			}
+
+			got, err := argocdAdminPassword(clientset)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("argocdAdminPassword() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("argocdAdminPassword() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("argocdAdminPassword() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestArgoRepoURL(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		protocol string
+		gitURL   string
+		want     string
+	}{
+		{name: "ssh", protocol: "ssh", gitURL: "git@github.com:kubefirst/gitops.git", want: "git@github.com:kubefirst/gitops.git"},
+		{name: "https", protocol: "https", gitURL: "git@github.com:kubefirst/gitops.git", want: "https://github.com/kubefirst/gitops.git"},
+		{name: "ssh without an ssh url", protocol: "ssh", want: "https://github.com/kubefirst/gitops.git"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &K3dConfig{
+				GitProtocol:                 tt.protocol,
+				DestinationGitopsRepoURL:    "https://github.com/kubefirst/gitops.git",
+				DestinationGitopsRepoGitURL: tt.gitURL,
+			}
+			if got := ArgoRepoURL(cfg); got != tt.want {
+				t.Errorf("ArgoRepoURL() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTestArgoRepoConnection(t *testing.T) {
+
+	repoURL := "https://github.com/kubefirst/gitops.git"
+
+	tests := []struct {
+		name    string
+		repoURL string
+		state   string
+		wantErr string
+	}{
+		{name: "connected", repoURL: repoURL, state: `{"status":"Successful","message":""}`},
+		{
+			name:    "authentication failure",
+			repoURL: repoURL,
+			state:   `{"status":"Failed","message":"authentication required"}`,
+			wantErr: "argocd cannot connect to " + repoURL + ": authentication required, check the credentials",
+		},
+		{name: "not registered", repoURL: "https://github.com/kubefirst/other.git", wantErr: "is not registered with argocd"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// a plain handler as ServeMux would clean the // of the escaped repo url out of the path
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case r.URL.Path == "/api/v1/session":
+					fmt.Fprint(w, `{"token":"argocd-token"}`)
+				case r.Header.Get("Authorization") != "Bearer argocd-token":
+					w.WriteHeader(http.StatusForbidden)
+				case r.URL.EscapedPath() == "/api/v1/repositories/"+url.QueryEscape(repoURL) && r.URL.Query().Get("forceRefresh") == "true":
+					fmt.Fprintf(w, `{"repo":%q,"connectionState":%s}`, repoURL, tt.state)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer server.Close()
+			clientset := fake.NewSimpleClientset(&v1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "argocd-initial-admin-secret", Namespace: "argocd"},
+				Data:       map[string][]byte{"password": []byte("admin-password")},
+			})
+
+			err := testArgoRepoConnection(clientset, server.Client(), server.URL, tt.repoURL)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("testArgoRepoConnection() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("testArgoRepoConnection() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	atlantisNamespace         = "atlantis"
+	atlantisWebhookSecretName = "atlantis-webhook"
+	// atlantisVaultPath is the vault kv secret holding the atlantis credentials
+	atlantisVaultPath = "atlantis"
+)
+
+// atlantisWebhookSecretKeys are the atlantis environment variables holding the webhook secret per git provider
+var atlantisWebhookSecretKeys = map[string]string{
+	"github": "ATLANTIS_GH_WEBHOOK_SECRET",
+	"gitlab": "ATLANTIS_GITLAB_WEBHOOK_SECRET",
+}
+
+// GenerateAtlantisConfig generates the atlantis webhook secret, writes an ExternalSecret syncing it from
+// vault to registry/<cluster>/components/atlantis in the gitops repo and replaces <ATLANTIS_ALLOW_LIST> in
+// the registry atlantis.yaml with cfg.AtlantisAllowList. The webhook secret itself is never written to
+// the repo - the caller stores it in vault at secret/atlantis under ATLANTIS_GH_WEBHOOK_SECRET or
+// ATLANTIS_GITLAB_WEBHOOK_SECRET, e.g. with SeedVaultSecrets. Nothing is generated when cfg.RemoveAtlantis is set
+func GenerateAtlantisConfig(cfg *K3dConfig) (webhookSecret string, err error) {
+	if cfg.RemoveAtlantis {
+		log.Info().Msg("atlantis removed, skipping atlantis webhook configuration")
+		return "", nil
+	}
+
+	secretKey, ok := atlantisWebhookSecretKeys[cfg.GitProvider]
+	if !ok {
+		return "", fmt.Errorf("error generating atlantis config: unsupported git provider %q", cfg.GitProvider)
+	}
+	if cfg.AtlantisAllowList == "" {
+		return "", fmt.Errorf("error generating atlantis config: atlantis allow list is empty")
+	}
+
+	registryDir, err := RegistryPath(cfg.GitopsDir, cfg.ClusterName)
+	if err != nil {
+		return "", err
+	}
+	atlantisRegistryFile := filepath.Join(registryDir, "atlantis.yaml")
+	if _, err := os.Stat(atlantisRegistryFile); err != nil {
+		return "", fmt.Errorf("error finding atlantis registry file %s: %s", atlantisRegistryFile, err)
+	}
+
+	secretBytes := make([]byte, 20)
+	_, err = rand.Read(secretBytes)
+	if err != nil {
+		return "", fmt.Errorf("error generating atlantis webhook secret: %s", err)
+	}
+	webhookSecret = hex.EncodeToString(secretBytes)
+
+	manifestYAML, err := vaultExternalSecret(atlantisWebhookSecretName, atlantisNamespace, atlantisVaultPath, []string{secretKey})
+	if err != nil {
+		return "", err
+	}
+
+	componentDir := filepath.Join(registryDir, "components", "atlantis")
+	err = os.MkdirAll(componentDir, cfg.dirMode())
+	if err != nil {
+		return "", fmt.Errorf("error creating atlantis component directory %s: %s", componentDir, err)
+	}
+	manifestPath := filepath.Join(componentDir, atlantisWebhookSecretName+".yaml")
+	err = os.WriteFile(manifestPath, manifestYAML, 0644)
+	if err != nil {
+		return "", fmt.Errorf("error writing atlantis webhook external secret %s: %s", manifestPath, err)
+	}
+	log.Info().Str("path", manifestPath).Str("vaultPath", atlantisVaultPath).Msg("atlantis webhook external secret written")
+
+	err = detokenizeFile(atlantisRegistryFile, []TokenReplacement{{"<ATLANTIS_ALLOW_LIST>", cfg.AtlantisAllowList}})
+	if err != nil {
+		return "", fmt.Errorf("error detokenizing %s: %s", atlantisRegistryFile, err)
+	}
+
+	return webhookSecret, nil
+}
+
+// atlantisReference matches a mention of atlantis in registry content
+var atlantisReference = regexp.MustCompile(`(?i)\batlantis\b`)
+
+// CanRemoveAtlantis reports whether atlantis can be removed from the registry of clusterName by
+// deleting its atlantis.yaml application, returning the path:line of every reference to atlantis
+// in the registry outside that application and the components/atlantis content it deploys.
+// References would be left dangling by the removal and have to be cleaned first
+func CanRemoveAtlantis(gitopsRepoDir, clusterName string) (bool, []string, error) {
+	registryDir, err := RegistryPath(gitopsRepoDir, clusterName)
+	if err != nil {
+		return false, nil, err
+	}
+	if _, err := os.Stat(registryDir); err != nil {
+		return false, nil, fmt.Errorf("error reading registry of cluster %s: %s", clusterName, err)
+	}
+
+	owned := map[string]bool{
+		"atlantis.yaml":                         true,
+		filepath.Join("components", "atlantis"): true,
+	}
+	references := []string{}
+	err = filepath.Walk(registryDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(registryDir, path)
+		if err != nil {
+			return err
+		}
+		if owned[rel] {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fi.IsDir() || !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if bytes.IndexByte(content, 0) != -1 {
+			return nil
+		}
+		for i, line := range strings.Split(string(content), "\n") {
+			if atlantisReference.MatchString(line) {
+				references = append(references, fmt.Sprintf("%s:%d", filepath.ToSlash(rel), i+1))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return false, nil, fmt.Errorf("error scanning registry of cluster %s for atlantis references: %s", clusterName, err)
+	}
+
+	return len(references) == 0, references, nil
+}
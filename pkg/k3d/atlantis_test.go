@@ -0,0 +1,180 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+const atlantisRegistryTemplate = `apiVersion: argoproj.io/v1alpha1
+kind: Application
+metadata:
+  name: atlantis
+spec:
+  source:
+    helm:
+      values: |-
+        orgAllowlist: <ATLANTIS_ALLOW_LIST>
+`
+
+func TestGenerateAtlantisConfig(t *testing.T) {
+
+	tests := []struct {
+		name           string
+		gitProvider    string
+		removeAtlantis bool
+		allowList      string
+		wantKey        string
+		wantErr        bool
+	}{
+		{name: "github", gitProvider: "github", allowList: "github.com/kubefirst/*", wantKey: "ATLANTIS_GH_WEBHOOK_SECRET"},
+		{name: "gitlab", gitProvider: "gitlab", allowList: "gitlab.com/kubefirst/*", wantKey: "ATLANTIS_GITLAB_WEBHOOK_SECRET"},
+		{name: "atlantis removed", gitProvider: "github", removeAtlantis: true, allowList: "github.com/kubefirst/*"},
+		{name: "empty allow list", gitProvider: "github", wantErr: true},
+		{name: "unsupported provider", gitProvider: "bitbucket", allowList: "bitbucket.org/kubefirst/*", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &K3dConfig{
+				GitopsDir:         t.TempDir(),
+				ClusterName:       "kubefirst",
+				GitProvider:       tt.gitProvider,
+				AtlantisAllowList: tt.allowList,
+				RemoveAtlantis:    tt.removeAtlantis,
+			}
+			registryDir := filepath.Join(cfg.GitopsDir, "registry", "kubefirst")
+			writeFixture(t, registryDir, map[string]string{"atlantis.yaml": atlantisRegistryTemplate})
+
+			webhookSecret, err := GenerateAtlantisConfig(cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GenerateAtlantisConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			manifestPath := filepath.Join(registryDir, "components", "atlantis", "atlantis-webhook.yaml")
+			if tt.wantErr || tt.removeAtlantis {
+				if webhookSecret != "" || fileExists(manifestPath) {
+					t.Errorf("GenerateAtlantisConfig() generated a secret when it should not have")
+				}
+				return
+			}
+			if len(webhookSecret) < 32 {
+				t.Errorf("GenerateAtlantisConfig() webhook secret %q is too short", webhookSecret)
+			}
+
+			content, err := os.ReadFile(manifestPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var secret struct {
+				Kind     string
+				Metadata struct{ Name, Namespace string }
+				Spec     struct {
+					SecretStoreRef struct{ Name string } `yaml:"secretStoreRef"`
+					Data           []struct {
+						SecretKey string                         `yaml:"secretKey"`
+						RemoteRef struct{ Key, Property string } `yaml:"remoteRef"`
+					}
+				}
+			}
+			err = yaml.Unmarshal(content, &secret)
+			if err != nil {
+				t.Fatalf("external secret is not valid yaml: %v", err)
+			}
+			if secret.Kind != "ExternalSecret" || secret.Metadata.Name != "atlantis-webhook" || secret.Metadata.Namespace != "atlantis" {
+				t.Errorf("unexpected external secret header: %+v", secret)
+			}
+			if len(secret.Spec.Data) != 1 || secret.Spec.Data[0].SecretKey != tt.wantKey || secret.Spec.Data[0].RemoteRef.Key != "atlantis" || secret.Spec.Data[0].RemoteRef.Property != tt.wantKey {
+				t.Errorf("external secret data = %+v, want only %s synced from atlantis/%s", secret.Spec.Data, tt.wantKey, tt.wantKey)
+			}
+			if secret.Spec.SecretStoreRef.Name != vaultSecretStore {
+				t.Errorf("external secret store = %s, want %s", secret.Spec.SecretStoreRef.Name, vaultSecretStore)
+			}
+			if strings.Contains(string(content), webhookSecret) || strings.Contains(string(content), base64.StdEncoding.EncodeToString([]byte(webhookSecret))) {
+				t.Error("atlantis webhook secret was written to the gitops repo")
+			}
+
+			registry, _ := os.ReadFile(filepath.Join(registryDir, "atlantis.yaml"))
+			var app struct {
+				Spec struct {
+					Source struct {
+						Helm struct{ Values string }
+					}
+				}
+			}
+			err = yaml.Unmarshal(registry, &app)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := "orgAllowlist: " + tt.allowList; app.Spec.Source.Helm.Values != want {
+				t.Errorf("atlantis.yaml values = %q, want %q", app.Spec.Source.Helm.Values, want)
+			}
+		})
+	}
+}
+
+func TestCanRemoveAtlantis(t *testing.T) {
+
+	tests := []struct {
+		name           string
+		registry       map[string]string
+		wantRemovable  bool
+		wantReferences []string
+	}{
+		{
+			name: "atlantis only in its application",
+			registry: map[string]string{
+				"atlantis.yaml":                          application("atlantis", "registry/kubefirst/components/atlantis"),
+				"components/atlantis/application.yaml":   application("atlantis-components", "charts/atlantis"),
+				"components/vault/application.yaml":      application("vault", "registry/kubefirst/components/vault"),
+				"components/argo-workflows/values.yaml":  "replicas: 1\n",
+				"components/console/logo.png":            "\x89PNG\x00atlantis",
+				"components/console/atlantisfeature.txt": "not a whole word\n",
+			},
+			wantRemovable:  true,
+			wantReferences: []string{},
+		},
+		{
+			name: "atlantis referenced by other components",
+			registry: map[string]string{
+				"atlantis.yaml":                       application("atlantis", "registry/kubefirst/components/atlantis"),
+				"components/atlantis/secret.yaml":     "kind: Secret\n",
+				"registry.yaml":                       "kind: Application\nspec:\n  ignoreDifferences:\n    - name: Atlantis\n",
+				"components/vault/policies.yaml":      "path:\n  - secret/data/ci-secrets\n  - secret/data/atlantis\n",
+				"components/argo-workflows/wait.yaml": "dependsOn: atlantis-webhook\n",
+			},
+			wantRemovable: false,
+			wantReferences: []string{
+				"components/argo-workflows/wait.yaml:1",
+				"components/vault/policies.yaml:3",
+				"registry.yaml:4",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gitopsDir := t.TempDir()
+			writeFixture(t, filepath.Join(gitopsDir, "registry", "kubefirst"), tt.registry)
+
+			removable, references, err := CanRemoveAtlantis(gitopsDir, "kubefirst")
+			if err != nil {
+				t.Fatalf("CanRemoveAtlantis() error = %v", err)
+			}
+			if removable != tt.wantRemovable {
+				t.Errorf("CanRemoveAtlantis() removable = %v, want %v", removable, tt.wantRemovable)
+			}
+			if !reflect.DeepEqual(references, tt.wantReferences) {
+				t.Errorf("CanRemoveAtlantis() references = %v, want %v", references, tt.wantReferences)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// audit log operations, one per kind of filesystem mutation made by the adjust functions
+const (
+	auditCopy       = "copy"
+	auditRemove     = "remove"
+	auditDetokenize = "detokenize"
+	auditMkdir      = "mkdir"
+	auditRewrite    = "rewrite"
+)
+
+// auditEntry is a line of the audit log, Source is only set for copies
+type auditEntry struct {
+	Time   time.Time `json:"time"`
+	Op     string    `json:"op"`
+	Path   string    `json:"path"`
+	Source string    `json:"source,omitempty"`
+}
+
+// auditLog appends an auditEntry per filesystem mutation to a json lines file. A nil
+// *auditLog records nothing, so callers don't need to check whether auditing is enabled
+type auditLog struct {
+	mu      sync.Mutex
+	f       *os.File
+	encoder *json.Encoder
+}
+
+// openAuditLog opens path for appending, returning a nil *auditLog when path is empty
+func openAuditLog(path string) (*auditLog, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening audit log %s: %s", path, err)
+	}
+	return &auditLog{f: f, encoder: json.NewEncoder(f)}, nil
+}
+
+// record appends op on path to the audit log, failing to write is logged but doesn't stop the adjust
+func (a *auditLog) record(op, path, source string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	err := a.encoder.Encode(auditEntry{Time: time.Now().UTC(), Op: op, Path: path, Source: source})
+	if err != nil {
+		log.Warn().Err(err).Str("path", a.f.Name()).Msg("error writing audit log entry")
+	}
+}
+
+// removeAll removes path, recording the removal when path existed
+func (a *auditLog) removeAll(path string) error {
+	_, statErr := os.Lstat(path)
+	err := os.RemoveAll(path)
+	if err == nil && statErr == nil {
+		a.record(auditRemove, path, "")
+	}
+	return err
+}
+
+// close closes the audit log file
+func (a *auditLog) close() {
+	if a == nil {
+		return
+	}
+	err := a.f.Close()
+	if err != nil {
+		log.Warn().Err(err).Str("path", a.f.Name()).Msg("error closing audit log")
+	}
+}
@@ -0,0 +1,231 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/kubefirst/runtime/pkg"
+)
+
+// readAuditLog parses every line of the audit log at path
+func readAuditLog(t *testing.T, path string) []auditEntry {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	entries := []auditEntry{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		entry := auditEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("audit log line %q is not json: %v", scanner.Text(), err)
+		}
+		if entry.Time.IsZero() {
+			t.Errorf("audit log line %q has no time", scanner.Text())
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestAdjustAuditLog(t *testing.T) {
+
+	consoleFile, unsupportedConsoleFile := consoleComponentFiles(pkg.LocalhostARCH, CloudProvider)
+	k1Dir, gitopsDir := newMetaphorFixture(t, map[string]string{"Dockerfile": "FROM scratch\n"})
+	writeFixture(t, gitopsDir, map[string]string{
+		"k3d-github/terraform/github/repos.tf.tmpl":                         "gitops = GITOPS_REPO_NAME\nmetaphor = METAPHOR_REPO_NAME\n",
+		"civo-github/terraform/main.tf":                                     "terraform {}\n",
+		"services/README.md":                                                "services\n",
+		"cluster-types/mgmt/atlantis.yaml":                                  "kind: Application\n",
+		"cluster-types/mgmt/components/kubefirst/" + consoleFile:            "kind: Application\n",
+		"cluster-types/mgmt/components/kubefirst/" + unsupportedConsoleFile: "kind: Application\n",
+	})
+	auditLogPath := filepath.Join(t.TempDir(), "audit.jsonl")
+	opts := AdjustOptions{AuditLogPath: auditLogPath, CIProviders: []string{"github", "gitlab"}}
+
+	err := AdjustGitopsRepo(CloudProvider, "kubefirst", "mgmt", gitopsDir, "gitops", "github", k1Dir, true, opts)
+	if err != nil {
+		t.Fatalf("AdjustGitopsRepo() error = %v", err)
+	}
+	err = AdjustMetaphorRepo("https://github.com/kubefirst/metaphor.git", gitopsDir, "metaphor", "github", k1Dir, opts)
+	if err != nil {
+		t.Fatalf("AdjustMetaphorRepo() error = %v", err)
+	}
+
+	registry := filepath.Join(gitopsDir, "registry", "kubefirst")
+	metaphorDir := filepath.Join(k1Dir, "metaphor")
+	reposTf := filepath.Join(gitopsDir, "terraform", "github", "repos.tf")
+	want := []auditEntry{
+		{Op: auditRemove, Path: filepath.Join(gitopsDir, "civo-github")},
+		{Op: auditCopy, Path: gitopsDir},
+		{Op: auditRemove, Path: filepath.Join(gitopsDir, "k3d-github")},
+		{Op: auditCopy, Path: registry},
+		{Op: auditRemove, Path: filepath.Join(gitopsDir, "cluster-types")},
+		{Op: auditRemove, Path: filepath.Join(gitopsDir, "services")},
+		{Op: auditRemove, Path: filepath.Join(registry, "components", "kubefirst", unsupportedConsoleFile)},
+		{Op: auditRemove, Path: filepath.Join(registry, "atlantis.yaml")},
+		{Op: auditCopy, Path: reposTf},
+		{Op: auditDetokenize, Path: reposTf},
+		{Op: auditMkdir, Path: metaphorDir},
+		{Op: auditCopy, Path: metaphorDir},
+		{Op: auditCopy, Path: filepath.Join(metaphorDir, ".github")},
+		{Op: auditCopy, Path: filepath.Join(metaphorDir, ".gitlab-ci.yml")},
+		{Op: auditCopy, Path: filepath.Join(metaphorDir, ".argo")},
+		{Op: auditMkdir, Path: filepath.Join(metaphorDir, "build")},
+		{Op: auditCopy, Path: filepath.Join(metaphorDir, "build", "Dockerfile")},
+		{Op: auditRemove, Path: filepath.Join(gitopsDir, "ci")},
+		{Op: auditRemove, Path: filepath.Join(gitopsDir, "metaphor")},
+		{Op: auditDetokenize, Path: reposTf},
+	}
+
+	entries := readAuditLog(t, auditLogPath)
+	if len(entries) != len(want) {
+		t.Fatalf("audit log has %d lines, want %d: %+v", len(entries), len(want), entries)
+	}
+	for i, entry := range entries {
+		if filepath.Clean(entry.Path) != want[i].Path || entry.Op != want[i].Op {
+			t.Errorf("audit log line %d = %s %s, want %s %s", i+1, entry.Op, entry.Path, want[i].Op, want[i].Path)
+		}
+		if entry.Op == auditCopy && entry.Source == "" {
+			t.Errorf("audit log line %d copies %s without a source", i+1, entry.Path)
+		}
+	}
+}
+
+func TestAuditLogDisabled(t *testing.T) {
+
+	audit, err := openAuditLog("")
+	if err != nil || audit != nil {
+		t.Fatalf("openAuditLog(\"\") = %v, %v, want a nil audit log", audit, err)
+	}
+
+	// a disabled audit log still removes the path
+	path := filepath.Join(t.TempDir(), "removed")
+	writeFixture(t, path, map[string]string{"file": "content\n"})
+	audit.record(auditCopy, path, "source")
+	if err := audit.removeAll(path); err != nil {
+		t.Fatalf("removeAll() error = %v", err)
+	}
+	if fileExists(path) {
+		t.Errorf("removeAll() left %s in place", path)
+	}
+	audit.close()
+}
+
+func TestRegistryAuditLog(t *testing.T) {
+
+	consoleFile, unsupportedConsoleFile := consoleComponentFiles(pkg.LocalhostARCH, CloudProvider)
+	k1Dir, gitopsDir := newGitopsFixture(t, map[string]string{
+		"argocd.yaml":                                    application("argocd", "cluster-types/mgmt/components/argocd"),
+		"components/argocd/values.yaml":                  "cluster: <CLUSTER_NAME>\n",
+		"components/vault/values.yaml":                   "cluster: <CLUSTER_NAME>\n",
+		"components/kubefirst/" + consoleFile:            "kind: Application\n",
+		"components/kubefirst/" + unsupportedConsoleFile: "kind: Application\n",
+	})
+	err := AdjustGitopsRepo(CloudProvider, "kubefirst", "mgmt", gitopsDir, "gitops", "github", k1Dir, false, AdjustOptions{KeepClusterTypes: true})
+	if err != nil {
+		t.Fatalf("AdjustGitopsRepo() error = %v", err)
+	}
+	registry := filepath.Join(gitopsDir, "registry", "kubefirst")
+
+	tests := []struct {
+		name   string
+		mutate func(opts AdjustOptions) error
+		want   []auditEntry
+	}{
+		{
+			name:   "reset registry",
+			mutate: func(opts AdjustOptions) error { return ResetRegistry(gitopsDir, "kubefirst", "mgmt", opts) },
+			want: []auditEntry{
+				{Op: auditRemove, Path: registry},
+				{Op: auditCopy, Path: registry},
+				{Op: auditRewrite, Path: filepath.Join(registry, "argocd.yaml")},
+				{Op: auditRemove, Path: filepath.Join(registry, "components", "kubefirst", unsupportedConsoleFile)},
+				{Op: auditDetokenize, Path: registry},
+			},
+		},
+		{
+			name:   "copy component",
+			mutate: func(opts AdjustOptions) error { return CopyComponent(gitopsDir, "kubefirst", "mgmt", "vault", opts) },
+			want: []auditEntry{
+				{Op: auditCopy, Path: filepath.Join(registry, "components", "vault")},
+				{Op: auditDetokenize, Path: filepath.Join(registry, "components", "vault")},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auditLogPath := filepath.Join(t.TempDir(), "audit.jsonl")
+			if err := tt.mutate(AdjustOptions{AuditLogPath: auditLogPath}); err != nil {
+				t.Fatalf("%s error = %v", tt.name, err)
+			}
+
+			entries := readAuditLog(t, auditLogPath)
+			if len(entries) != len(tt.want) {
+				t.Fatalf("audit log has %d lines, want %d: %+v", len(entries), len(tt.want), entries)
+			}
+			for i, entry := range entries {
+				if filepath.Clean(entry.Path) != tt.want[i].Path || entry.Op != tt.want[i].Op {
+					t.Errorf("audit log line %d = %s %s, want %s %s", i+1, entry.Op, entry.Path, tt.want[i].Op, tt.want[i].Path)
+				}
+			}
+		})
+	}
+}
+
+func TestAdjustMetaphorRepoAuditLog(t *testing.T) {
+
+	k1Dir, gitopsDir := newMetaphorFixture(t, map[string]string{"Dockerfile": "FROM scratch\r\n"})
+	templateRepo, err := git.PlainInit(gitopsDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := templateRepo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{"https://github.com/kubefirst/gitops-template.git"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CommitGitopsRepo(gitopsDir, "initial template"); err != nil {
+		t.Fatal(err)
+	}
+
+	auditLogPath := filepath.Join(t.TempDir(), "audit.jsonl")
+	err = AdjustMetaphorRepo("https://github.com/kubefirst/metaphor.git", gitopsDir, "metaphor", "github", k1Dir, AdjustOptions{AuditLogPath: auditLogPath, PreserveHistory: true})
+	if err != nil {
+		t.Fatalf("AdjustMetaphorRepo() error = %v", err)
+	}
+
+	metaphorDir := filepath.Join(k1Dir, "metaphor")
+	recorded := map[auditEntry]bool{}
+	for _, entry := range readAuditLog(t, auditLogPath) {
+		if entry.Source != "" {
+			entry.Source = filepath.Clean(entry.Source)
+		}
+		recorded[auditEntry{Op: entry.Op, Path: filepath.Clean(entry.Path), Source: entry.Source}] = true
+	}
+	for _, want := range []auditEntry{
+		{Op: auditCopy, Path: filepath.Join(metaphorDir, ".git"), Source: filepath.Join(gitopsDir, ".git")},
+		{Op: auditRewrite, Path: filepath.Join(metaphorDir, "Dockerfile")},
+		{Op: auditRewrite, Path: filepath.Join(metaphorDir, "build", "Dockerfile")},
+	} {
+		if !recorded[want] {
+			t.Errorf("audit log is missing %s %s", want.Op, want.Path)
+		}
+	}
+}
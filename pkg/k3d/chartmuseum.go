@@ -0,0 +1,62 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	chartMuseumNamespace  = "chartmuseum"
+	chartMuseumSecretName = "chartmuseum-auth"
+	chartMuseumUser       = "kbot"
+	// chartMuseumVaultPath is the vault kv secret holding the chartmuseum credentials
+	chartMuseumVaultPath = "chartmuseum"
+)
+
+// GenerateChartMuseumAuth generates basic auth credentials for ChartMuseum and writes an ExternalSecret
+// to registry/<cluster>/components/chartmuseum in the gitops repo syncing them from vault. The
+// credentials themselves are never written to the repo - the caller stores user and pass in vault
+// at secret/chartmuseum under BASIC_AUTH_USER and BASIC_AUTH_PASS, e.g. with SeedVaultSecrets
+func GenerateChartMuseumAuth(cfg *K3dConfig) (user, pass string, manifestYAML []byte, err error) {
+	passBytes := make([]byte, 24)
+	_, err = rand.Read(passBytes)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("error generating chartmuseum password: %s", err)
+	}
+	user = chartMuseumUser
+	pass = hex.EncodeToString(passBytes)
+
+	manifestYAML, err = vaultExternalSecret(chartMuseumSecretName, chartMuseumNamespace, chartMuseumVaultPath, []string{"BASIC_AUTH_USER", "BASIC_AUTH_PASS"})
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	registryDir, err := RegistryPath(cfg.GitopsDir, cfg.ClusterName)
+	if err != nil {
+		return "", "", nil, err
+	}
+	componentDir := filepath.Join(registryDir, "components", "chartmuseum")
+	err = os.MkdirAll(componentDir, cfg.dirMode())
+	if err != nil {
+		return "", "", nil, fmt.Errorf("error creating chartmuseum component directory %s: %s", componentDir, err)
+	}
+	manifestPath := filepath.Join(componentDir, chartMuseumSecretName+".yaml")
+	err = os.WriteFile(manifestPath, manifestYAML, 0644)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("error writing chartmuseum external secret %s: %s", manifestPath, err)
+	}
+	log.Info().Str("path", manifestPath).Str("vaultPath", chartMuseumVaultPath).Msg("chartmuseum auth external secret written")
+
+	return user, pass, manifestYAML, nil
+}
@@ -0,0 +1,80 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestGenerateChartMuseumAuth(t *testing.T) {
+
+	cfg := &K3dConfig{GitopsDir: t.TempDir(), ClusterName: "kubefirst"}
+
+	user, pass, manifestYAML, err := GenerateChartMuseumAuth(cfg)
+	if err != nil {
+		t.Fatalf("GenerateChartMuseumAuth() error = %v", err)
+	}
+	if user == "" || len(pass) < 32 {
+		t.Errorf("GenerateChartMuseumAuth() credentials = %q/%q, want a user and a 32+ character password", user, pass)
+	}
+
+	var secret struct {
+		APIVersion string `yaml:"apiVersion"`
+		Kind       string
+		Metadata   struct{ Name, Namespace string }
+		Spec       struct {
+			SecretStoreRef struct{ Kind, Name string } `yaml:"secretStoreRef"`
+			Target         struct{ Name string }
+			Data           []struct {
+				SecretKey string                         `yaml:"secretKey"`
+				RemoteRef struct{ Key, Property string } `yaml:"remoteRef"`
+			}
+		}
+	}
+	err = yaml.Unmarshal(manifestYAML, &secret)
+	if err != nil {
+		t.Fatalf("external secret is not valid yaml: %v", err)
+	}
+	if secret.Kind != "ExternalSecret" || secret.APIVersion != "external-secrets.io/v1beta1" || secret.Metadata.Namespace != "chartmuseum" {
+		t.Errorf("unexpected external secret header: %+v", secret)
+	}
+	if secret.Spec.SecretStoreRef.Name != vaultSecretStore || secret.Spec.Target.Name != "chartmuseum-auth" {
+		t.Errorf("external secret store = %s, target = %s", secret.Spec.SecretStoreRef.Name, secret.Spec.Target.Name)
+	}
+	synced := map[string]bool{}
+	for _, data := range secret.Spec.Data {
+		if data.RemoteRef.Key != "chartmuseum" || data.RemoteRef.Property != data.SecretKey {
+			t.Errorf("%s is synced from %s/%s, want chartmuseum/%s", data.SecretKey, data.RemoteRef.Key, data.RemoteRef.Property, data.SecretKey)
+		}
+		synced[data.SecretKey] = true
+	}
+	if !synced["BASIC_AUTH_USER"] || !synced["BASIC_AUTH_PASS"] || len(synced) != 2 {
+		t.Errorf("external secret syncs %v, want BASIC_AUTH_USER and BASIC_AUTH_PASS", synced)
+	}
+	if bytes.Contains(manifestYAML, []byte(pass)) || bytes.Contains(manifestYAML, []byte(base64.StdEncoding.EncodeToString([]byte(pass)))) {
+		t.Error("chartmuseum password was written to the gitops repo")
+	}
+
+	written, err := os.ReadFile(filepath.Join(cfg.GitopsDir, "registry", "kubefirst", "components", "chartmuseum", "chartmuseum-auth.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(written, manifestYAML) {
+		t.Error("written manifest does not match the returned external secret")
+	}
+
+	_, secondPass, _, _ := GenerateChartMuseumAuth(cfg)
+	if secondPass == pass {
+		t.Error("GenerateChartMuseumAuth() generated the same password twice")
+	}
+}
@@ -0,0 +1,192 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// checkpointFileName records the completed install steps, one per line, under K1Dir. The file
+// is suffixed with the cluster name so installs of different clusters sharing K1Dir don't
+// skip each other's steps
+const checkpointFileName = ".install-checkpoint"
+
+// install steps recorded by PrepareGitRepositories
+const (
+	checkpointGitopsPrepared   = "gitops-repository-prepared"
+	checkpointMetaphorPrepared = "metaphor-repository-prepared"
+	checkpointGitopsCommitted  = "gitops-repository-committed"
+)
+
+// SaveCheckpoint records step as completed for cfg.ClusterName, saving an already recorded step again is a no-op
+func SaveCheckpoint(cfg *K3dConfig, step string) error {
+	path, err := checkpointPath(cfg.K1Dir, cfg.ClusterName)
+	if err != nil {
+		return err
+	}
+	return saveCheckpoint(path, step)
+}
+
+// LastCheckpoint returns the most recently completed step of cfg.ClusterName, or an empty string when none is recorded
+func LastCheckpoint(cfg *K3dConfig) (string, error) {
+	path, err := checkpointPath(cfg.K1Dir, cfg.ClusterName)
+	if err != nil {
+		return "", err
+	}
+	steps, err := completedSteps(path)
+	if err != nil || len(steps) == 0 {
+		return "", err
+	}
+	return steps[len(steps)-1], nil
+}
+
+// checkpointPath returns the checkpoint file of clusterName under k1Dir
+func checkpointPath(k1Dir, clusterName string) (string, error) {
+	if clusterName == "" || strings.ContainsAny(clusterName, `/\`) || strings.HasPrefix(clusterName, ".") {
+		return "", fmt.Errorf("error locating checkpoint: invalid cluster name %q", clusterName)
+	}
+	return filepath.Join(k1Dir, fmt.Sprintf("%s-%s", checkpointFileName, clusterName)), nil
+}
+
+func saveCheckpoint(path, step string) error {
+	if step == "" || strings.ContainsAny(step, "\r\n") {
+		return fmt.Errorf("error saving checkpoint: invalid step name %q", step)
+	}
+
+	steps, err := completedSteps(path)
+	if err != nil {
+		return err
+	}
+	for _, completed := range steps {
+		if completed == step {
+			return nil
+		}
+	}
+	steps = append(steps, step)
+
+	err = writeCheckpoint(path, steps)
+	if err != nil {
+		return err
+	}
+	log.Info().Msgf("checkpoint saved: %s", step)
+	return nil
+}
+
+// removeCheckpoint drops step from the checkpoint file at path so it runs again
+func removeCheckpoint(path, step string) error {
+	steps, err := completedSteps(path)
+	if err != nil {
+		return err
+	}
+	kept := []string{}
+	for _, completed := range steps {
+		if completed != step {
+			kept = append(kept, completed)
+		}
+	}
+	if len(kept) == len(steps) {
+		return nil
+	}
+
+	err = writeCheckpoint(path, kept)
+	if err != nil {
+		return err
+	}
+	log.Info().Msgf("checkpoint removed: %s", step)
+	return nil
+}
+
+// clearCheckpoint removes the checkpoint file at path so the next install runs every step again
+func clearCheckpoint(path string) error {
+	err := os.Remove(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error removing checkpoint: %s", err)
+	}
+	return nil
+}
+
+// writeCheckpoint replaces the file atomically so a crash never leaves a truncated checkpoint
+func writeCheckpoint(path string, steps []string) error {
+	content := ""
+	if len(steps) > 0 {
+		content = strings.Join(steps, "\n") + "\n"
+	}
+	tmpPath := path + ".tmp"
+	err := os.WriteFile(tmpPath, []byte(content), 0600)
+	if err != nil {
+		return fmt.Errorf("error writing checkpoint: %s", err)
+	}
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return fmt.Errorf("error saving checkpoint: %s", err)
+	}
+	return nil
+}
+
+// completedSteps returns the steps recorded at path in the order they completed
+func completedSteps(path string) ([]string, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading checkpoint: %s", err)
+	}
+
+	steps := []string{}
+	for _, line := range strings.Split(string(content), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			steps = append(steps, line)
+		}
+	}
+	return steps, nil
+}
+
+// stepCompleted reports whether step is recorded at path
+func stepCompleted(path, step string) (bool, error) {
+	steps, err := completedSteps(path)
+	if err != nil {
+		return false, err
+	}
+	for _, completed := range steps {
+		if completed == step {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// runCheckpointed runs fn unless step is already recorded at path, recording it once fn succeeds.
+// clean, when set, runs first to remove the outputs a failed earlier attempt of step left behind
+func runCheckpointed(path, step string, clean func() error, fn func() error) error {
+	completed, err := stepCompleted(path, step)
+	if err != nil {
+		return err
+	}
+	if completed {
+		log.Info().Msgf("step %s already completed, skipping", step)
+		return nil
+	}
+
+	if clean != nil {
+		err = clean()
+		if err != nil {
+			return fmt.Errorf("error cleaning up before step %s: %s", step, err)
+		}
+	}
+	err = fn()
+	if err != nil {
+		return err
+	}
+	return saveCheckpoint(path, step)
+}
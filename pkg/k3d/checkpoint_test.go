@@ -0,0 +1,274 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+)
+
+func TestSaveCheckpoint(t *testing.T) {
+
+	cfg := &K3dConfig{K1Dir: t.TempDir(), ClusterName: "kubefirst"}
+
+	last, err := LastCheckpoint(cfg)
+	if err != nil || last != "" {
+		t.Fatalf("LastCheckpoint() without checkpoint = %q, %v, want empty", last, err)
+	}
+
+	tests := []struct {
+		step     string
+		wantLast string
+		wantErr  bool
+	}{
+		{step: "tools-downloaded", wantLast: "tools-downloaded"},
+		{step: "cluster-created", wantLast: "cluster-created"},
+		{step: "tools-downloaded", wantLast: "cluster-created"},
+		{step: "", wantLast: "cluster-created", wantErr: true},
+		{step: "multi\nline", wantLast: "cluster-created", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.step, func(t *testing.T) {
+			err := SaveCheckpoint(cfg, tt.step)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SaveCheckpoint() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			last, err := LastCheckpoint(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if last != tt.wantLast {
+				t.Errorf("LastCheckpoint() = %q, want %q", last, tt.wantLast)
+			}
+		})
+	}
+
+	steps, _ := completedSteps(filepath.Join(cfg.K1Dir, ".install-checkpoint-kubefirst"))
+	if want := []string{"tools-downloaded", "cluster-created"}; !reflect.DeepEqual(steps, want) {
+		t.Errorf("completedSteps() = %v, want %v", steps, want)
+	}
+
+	// the steps of another cluster sharing the k1 directory are tracked separately
+	other := &K3dConfig{K1Dir: cfg.K1Dir, ClusterName: "kubefirst-dev"}
+	if last, err := LastCheckpoint(other); err != nil || last != "" {
+		t.Errorf("LastCheckpoint() of another cluster = %q, %v, want empty", last, err)
+	}
+	if err := SaveCheckpoint(&K3dConfig{K1Dir: cfg.K1Dir, ClusterName: "../kubefirst"}, "tools-downloaded"); err == nil {
+		t.Error("SaveCheckpoint() with a path in the cluster name error = nil, want invalid cluster name")
+	}
+}
+
+func TestRunCheckpointed(t *testing.T) {
+
+	checkpoint := filepath.Join(t.TempDir(), ".install-checkpoint-kubefirst")
+	runs, cleans := 0, 0
+	step := func() error {
+		runs++
+		return nil
+	}
+	clean := func() error {
+		cleans++
+		return nil
+	}
+
+	for i := 0; i < 3; i++ {
+		err := runCheckpointed(checkpoint, "cluster-created", clean, step)
+		if err != nil {
+			t.Fatalf("runCheckpointed() error = %v", err)
+		}
+	}
+	if runs != 1 || cleans != 1 {
+		t.Errorf("runCheckpointed() ran a completed step %d times and cleaned it %d times, want 1", runs, cleans)
+	}
+
+	failure := errors.New("cluster create failed")
+	err := runCheckpointed(checkpoint, "vault-unsealed", nil, func() error { return failure })
+	if !errors.Is(err, failure) {
+		t.Errorf("runCheckpointed() error = %v, want %v", err, failure)
+	}
+	steps, _ := completedSteps(checkpoint)
+	if want := []string{"cluster-created"}; !reflect.DeepEqual(steps, want) {
+		t.Errorf("failed step was checkpointed, completedSteps() = %v, want %v", steps, want)
+	}
+
+	// a failed clean stops the step from running
+	err = runCheckpointed(checkpoint, "vault-unsealed", func() error { return failure }, step)
+	if err == nil || runs != 1 {
+		t.Errorf("runCheckpointed() with a failed clean error = %v and ran the step %d times, want an error and 1", err, runs)
+	}
+}
+
+func TestPrepareGitRepositoriesResumes(t *testing.T) {
+
+	k1Dir := t.TempDir()
+	for _, step := range []string{checkpointGitopsPrepared, checkpointMetaphorPrepared, checkpointGitopsCommitted} {
+		if err := saveCheckpoint(filepath.Join(k1Dir, ".install-checkpoint-kubefirst"), step); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// every step is checkpointed so nothing is cloned, adjusted or committed
+	err := PrepareGitRepositories("github", "kubefirst", "mgmt",
+		"https://github.com/kubefirst/gitops.git", filepath.Join(k1Dir, "gitops"), "main", "file:///nonexistent/gitops-template",
+		"gitops", "https://github.com/kubefirst/metaphor.git", k1Dir, &GitopsDirectoryValues{},
+		filepath.Join(k1Dir, "metaphor"), &MetaphorTokenValues{}, "metaphor", "https", false)
+	if err != nil {
+		t.Errorf("PrepareGitRepositories() with all steps checkpointed error = %v", err)
+	}
+	if fileExists(filepath.Join(k1Dir, "gitops")) || fileExists(filepath.Join(k1Dir, "metaphor")) {
+		t.Error("PrepareGitRepositories() re-ran completed steps")
+	}
+}
+
+func TestPrepareGitRepositoriesCommitMessage(t *testing.T) {
+
+	k1Dir := t.TempDir()
+	for _, step := range []string{checkpointGitopsPrepared, checkpointMetaphorPrepared} {
+		if err := saveCheckpoint(filepath.Join(k1Dir, ".install-checkpoint-kubefirst"), step); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gitopsDir := filepath.Join(k1Dir, "gitops")
+	writeFixture(t, gitopsDir, map[string]string{"registry/kubefirst/argocd.yaml": "kind: Application\n"})
+	repo, err := git.PlainInit(gitopsDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only the gitops commit step is left to run
+	message := "PLAT-42: create gitops repository"
+	identity := CommitIdentity{Name: "Platform Team", Email: "platform@example.com"}
+	err = PrepareGitRepositories("github", "kubefirst", "mgmt",
+		"https://github.com/kubefirst/gitops.git", gitopsDir, "main", "file:///nonexistent/gitops-template",
+		"gitops", "https://github.com/kubefirst/metaphor.git", k1Dir, &GitopsDirectoryValues{},
+		filepath.Join(k1Dir, "metaphor"), &MetaphorTokenValues{}, "metaphor", "https", false, PrepareOptions{CommitMessage: message, CommitIdentity: identity})
+	if err != nil {
+		t.Fatalf("PrepareGitRepositories() error = %v", err)
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commit.Message != message {
+		t.Errorf("gitops commit message = %q, want %q", commit.Message, message)
+	}
+	if commit.Author.Name != identity.Name || commit.Author.Email != identity.Email {
+		t.Errorf("gitops commit author = %s <%s>, want %s <%s>", commit.Author.Name, commit.Author.Email, identity.Name, identity.Email)
+	}
+}
+
+func TestPrepareGitRepositoriesRetry(t *testing.T) {
+
+	tests := []struct {
+		name        string
+		checkpoints []string
+		leftovers   map[string]string
+		wantRemoved []string
+	}{
+		{
+			name:        "gitops step retried from a clean directory",
+			leftovers:   map[string]string{"gitops/README.md": "partial clone\n"},
+			wantRemoved: []string{"gitops/README.md"},
+		},
+		{
+			name:        "interrupted metaphor step restarts from the gitops clone",
+			checkpoints: []string{checkpointGitopsPrepared},
+			leftovers:   map[string]string{"gitops/registry/kubefirst/argocd.yaml": "kind: Application\n", "metaphor/Dockerfile": "FROM scratch\n"},
+			wantRemoved: []string{"gitops/registry/kubefirst/argocd.yaml"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k1Dir := t.TempDir()
+			for _, step := range tt.checkpoints {
+				if err := saveCheckpoint(filepath.Join(k1Dir, ".install-checkpoint-kubefirst"), step); err != nil {
+					t.Fatal(err)
+				}
+			}
+			writeFixture(t, k1Dir, tt.leftovers)
+
+			// the template can't be cloned, which is returned instead of panicking
+			err := PrepareGitRepositories("github", "kubefirst", "mgmt",
+				"https://github.com/kubefirst/gitops.git", filepath.Join(k1Dir, "gitops"), "main", "file:///nonexistent/gitops-template",
+				"gitops", "https://github.com/kubefirst/metaphor.git", k1Dir, &GitopsDirectoryValues{},
+				filepath.Join(k1Dir, "metaphor"), &MetaphorTokenValues{}, "metaphor", "https", false)
+			if err == nil || !strings.Contains(err.Error(), "error cloning gitops template") {
+				t.Fatalf("PrepareGitRepositories() error = %v, want the gitops template clone to fail", err)
+			}
+			for _, path := range tt.wantRemoved {
+				if fileExists(filepath.Join(k1Dir, path)) {
+					t.Errorf("PrepareGitRepositories() left %s from the failed attempt", path)
+				}
+			}
+			if last, _ := LastCheckpoint(&K3dConfig{K1Dir: k1Dir, ClusterName: "kubefirst"}); last != "" {
+				t.Errorf("LastCheckpoint() = %q, want the gitops step to be run again", last)
+			}
+		})
+	}
+}
+
+func TestPrepareGitRepositoriesReinstall(t *testing.T) {
+
+	k1Dir := t.TempDir()
+	checkpoint := filepath.Join(k1Dir, ".install-checkpoint-kubefirst")
+	gitopsDir := filepath.Join(k1Dir, "gitops")
+	defaultSettle := clusterDeleteSettle
+	defer func() { clusterDeleteSettle = defaultSettle }()
+	clusterDeleteSettle = 0
+	k3dClient := writeStubTool(t, t.TempDir(), "k3d", `[ "$*" = "cluster delete kubefirst" ] || exit 2`+"\n")
+	prepare := func() error {
+		return PrepareGitRepositories("github", "kubefirst", "mgmt",
+			"https://github.com/kubefirst/gitops.git", gitopsDir, "main", "file:///nonexistent/gitops-template",
+			"gitops", "https://github.com/kubefirst/metaphor.git", k1Dir, &GitopsDirectoryValues{},
+			filepath.Join(k1Dir, "metaphor"), &MetaphorTokenValues{}, "metaphor", "https", false)
+	}
+	saveSteps := func(steps ...string) {
+		for _, step := range steps {
+			if err := saveCheckpoint(checkpoint, step); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// install, only the gitops commit is left to run
+	saveSteps(checkpointGitopsPrepared, checkpointMetaphorPrepared)
+	writeFixture(t, gitopsDir, map[string]string{"registry/kubefirst/argocd.yaml": "kind: Application\n"})
+	if _, err := git.PlainInit(gitopsDir, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := prepare(); err != nil {
+		t.Fatalf("PrepareGitRepositories() error = %v", err)
+	}
+	if fileExists(checkpoint) {
+		t.Error("PrepareGitRepositories() left the checkpoint of a completed install")
+	}
+
+	// destroy, after an interrupted install left its checkpoint
+	saveSteps(checkpointGitopsPrepared, checkpointMetaphorPrepared)
+	if err := DeleteK3dCluster("kubefirst", k1Dir, k3dClient); err != nil {
+		t.Fatalf("DeleteK3dCluster() error = %v", err)
+	}
+	if fileExists(checkpoint) {
+		t.Error("DeleteK3dCluster() left the install checkpoint")
+	}
+
+	// install again, every step runs so the template is cloned
+	err := prepare()
+	if err == nil || !strings.Contains(err.Error(), "error cloning gitops template") {
+		t.Errorf("PrepareGitRepositories() after destroy error = %v, want the gitops template clone to run", err)
+	}
+}
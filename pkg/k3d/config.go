@@ -8,10 +8,16 @@ package k3d
 
 import (
 	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"reflect"
 	"runtime"
+	"strconv"
+	"strings"
 
 	"github.com/caarlos0/env/v6"
+	"github.com/kubefirst/runtime/configs"
 	"github.com/rs/zerolog/log"
 )
 
@@ -30,22 +36,74 @@ const (
 	VaultPortForwardURL  = "http://localhost:8200"
 )
 
+// subdomains the k3d ingress serves each service under
+const (
+	argocdSubdomain              = "argocd"
+	argoWorkflowsSubdomain       = "argo"
+	atlantisSubdomain            = "atlantis"
+	chartMuseumSubdomain         = "chartmuseum"
+	consoleSubdomain             = "kubefirst"
+	metaphorDevelopmentSubdomain = "metaphor-development"
+	metaphorStagingSubdomain     = "metaphor-staging"
+	metaphorProductionSubdomain  = "metaphor-production"
+	minioSubdomain               = "minio"
+	minioConsoleSubdomain        = "minio-console"
+	vaultSubdomain               = "vault"
+)
+
+// ingressService is a service the k3d ingress serves under subdomain, with its tls secret in namespace
+type ingressService struct {
+	subdomain string
+	namespace string
+}
+
+// ingressServices are the services served by the k3d ingress, the ingress urls, hostnames and
+// certificates of the package, the summary and the gitops values are all derived from them
+var ingressServices = []ingressService{
+	{subdomain: argocdSubdomain, namespace: "argocd"},
+	{subdomain: vaultSubdomain, namespace: "vault"},
+	{subdomain: argoWorkflowsSubdomain, namespace: "argo"},
+	{subdomain: atlantisSubdomain, namespace: "atlantis"},
+	{subdomain: chartMuseumSubdomain, namespace: "chartmuseum"},
+	{subdomain: consoleSubdomain, namespace: "kubefirst"},
+	{subdomain: minioSubdomain, namespace: "minio"},
+	{subdomain: minioConsoleSubdomain, namespace: "minio"},
+	{subdomain: metaphorDevelopmentSubdomain, namespace: "development"},
+	{subdomain: metaphorStagingSubdomain, namespace: "staging"},
+	{subdomain: metaphorProductionSubdomain, namespace: "production"},
+}
+
+// metaphorSubdomains are the ingress subdomains of the metaphor environments keyed by environment name
+var metaphorSubdomains = map[string]string{
+	"development": metaphorDevelopmentSubdomain,
+	"staging":     metaphorStagingSubdomain,
+	"production":  metaphorProductionSubdomain,
+}
+
 var (
-	ArgocdURL              = fmt.Sprintf("https://argocd.%s", DomainName)
-	ArgoWorkflowsURL       = fmt.Sprintf("https://argo.%s", DomainName)
-	AtlantisURL            = fmt.Sprintf("https://atlantis.%s", DomainName)
-	ChartMuseumURL         = fmt.Sprintf("https://chartmuseum.%s", DomainName)
-	KubefirstConsoleURL    = fmt.Sprintf("https://kubefirst.%s", DomainName)
-	MetaphorDevelopmentURL = fmt.Sprintf("https://metaphor-devlopment.%s", DomainName)
-	MetaphorStagingURL     = fmt.Sprintf("https://metaphor-staging.%s", DomainName)
-	MetaphorProductionURL  = fmt.Sprintf("https://metaphor-production.%s", DomainName)
-	VaultURL               = fmt.Sprintf("https://vault.%s", DomainName)
+	ArgocdURL              = ingressURL(argocdSubdomain, DomainName)
+	ArgoWorkflowsURL       = ingressURL(argoWorkflowsSubdomain, DomainName)
+	AtlantisURL            = ingressURL(atlantisSubdomain, DomainName)
+	ChartMuseumURL         = ingressURL(chartMuseumSubdomain, DomainName)
+	KubefirstConsoleURL    = ingressURL(consoleSubdomain, DomainName)
+	MetaphorDevelopmentURL = ingressURL(metaphorDevelopmentSubdomain, DomainName)
+	MetaphorStagingURL     = ingressURL(metaphorStagingSubdomain, DomainName)
+	MetaphorProductionURL  = ingressURL(metaphorProductionSubdomain, DomainName)
+	VaultURL               = ingressURL(vaultSubdomain, DomainName)
 )
 
 type K3dConfig struct {
-	GithubToken string
-	GitlabToken string
+	GithubToken string `env:"GITHUB_TOKEN"`
+	GitlabToken string `env:"GITLAB_TOKEN"`
+	// GitlabHost overrides GitlabHost for self-managed instances and may carry the port of the
+	// https endpoint, e.g. gitlab.internal:8443
+	GitlabHost string `env:"GITLAB_HOST"`
+	// GitSSHPort is the ssh port of the git host when it isn't 22
+	GitSSHPort int `env:"GIT_SSH_PORT"`
 
+	// CACertPath is an optional PEM bundle trusted when calling self-hosted git provider APIs
+	CACertPath                      string
+	ClusterName                     string
 	DestinationGitopsRepoGitURL     string
 	DestinationGitopsRepoURL        string
 	DestinationMetaphorRepoURL      string
@@ -68,6 +126,136 @@ type K3dConfig struct {
 	ToolsDir                        string
 	GitopsRepoName                  string
 	MetaphorRepoName                string
+
+	// AtlantisAllowList is the repository allow list atlantis accepts webhooks from
+	AtlantisAllowList string
+	// RemoveAtlantis is set when atlantis is removed from the gitops registry
+	RemoveAtlantis bool
+	// LocalAccessMode reaches services through their port-forward urls, for setups without
+	// wildcard dns for DomainName, see AllServiceURLs
+	LocalAccessMode bool
+	// GitOwner is the user or organization (group on gitlab) the repositories are created under
+	GitOwner string
+	// EgressEndpoints are the endpoints the install needs to reach, see CheckEgress
+	EgressEndpoints []string
+	// DirMode is the mode of the directories created for the config, defaults to 0700
+	DirMode os.FileMode
+}
+
+// dirMode returns the configured directory mode or the package default
+func (cfg *K3dConfig) dirMode() os.FileMode {
+	if cfg.DirMode == 0 {
+		return defaultDirMode
+	}
+	return cfg.DirMode
+}
+
+// requiredEnvFields are the K3dConfig fields, loaded from their env tag, each git provider needs
+var requiredEnvFields = map[string][]string{
+	"github": {"GithubToken"},
+	"gitlab": {"GitlabToken"},
+}
+
+// validateParsedEnv checks the environment variables required by provider were set, returning
+// a single error naming every variable that is missing or padded with whitespace
+func validateParsedEnv(cfg *K3dConfig, provider string) error {
+	fields, ok := requiredEnvFields[provider]
+	if !ok {
+		return fmt.Errorf("unsupported git provider %q", provider)
+	}
+
+	v := reflect.ValueOf(cfg).Elem()
+	missing := []string{}
+	padded := []string{}
+	for _, name := range fields {
+		field, _ := v.Type().FieldByName(name)
+		envName := field.Tag.Get("env")
+		value := v.FieldByName(name).String()
+		switch {
+		case strings.TrimSpace(value) == "":
+			missing = append(missing, envName)
+		case strings.TrimSpace(value) != value:
+			padded = append(padded, envName)
+		}
+	}
+
+	problems := []string{}
+	if len(missing) > 0 {
+		problems = append(problems, fmt.Sprintf("missing required environment variables for %s: %s", provider, strings.Join(missing, ", ")))
+	}
+	if len(padded) > 0 {
+		problems = append(problems, fmt.Sprintf("environment variables with leading or trailing whitespace: %s", strings.Join(padded, ", ")))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// validGitProtocols are the protocols the repositories can be cloned and pushed with
+var validGitProtocols = []string{"ssh", "https"}
+
+// providerTokenPrefixes are the prefixes of the tokens each git provider issues
+var providerTokenPrefixes = map[string][]string{
+	"github": {"ghp_", "gho_", "ghu_", "ghs_", "ghr_", "github_pat_"},
+	"gitlab": {"glpat-"},
+}
+
+// ValidateProviderTokenMatch checks the token of cfg.GitProvider is set and that it is not a
+// token issued by the other provider, which happens when the provider flag and the exported
+// token disagree
+func ValidateProviderTokenMatch(cfg *K3dConfig) error {
+	tokens := map[string]string{"github": cfg.GithubToken, "gitlab": cfg.GitlabToken}
+	envNames := map[string]string{"github": "GITHUB_TOKEN", "gitlab": "GITLAB_TOKEN"}
+
+	other := ""
+	switch cfg.GitProvider {
+	case "github":
+		other = "gitlab"
+	case "gitlab":
+		other = "github"
+	default:
+		return fmt.Errorf("unsupported git provider %q, valid values are: github, gitlab", cfg.GitProvider)
+	}
+
+	token := tokens[cfg.GitProvider]
+	if token == "" {
+		if tokens[other] != "" {
+			return fmt.Errorf("the git provider is %s but only %s is set, export %s or switch the git provider to %s",
+				cfg.GitProvider, envNames[other], envNames[cfg.GitProvider], other)
+		}
+		return fmt.Errorf("the git provider is %s but %s is not set, export a %s personal access token as %s",
+			cfg.GitProvider, envNames[cfg.GitProvider], cfg.GitProvider, envNames[cfg.GitProvider])
+	}
+	for _, prefix := range providerTokenPrefixes[other] {
+		if strings.HasPrefix(token, prefix) {
+			return fmt.Errorf("%s holds a %s token, export a %s personal access token as %s or switch the git provider to %s",
+				envNames[cfg.GitProvider], other, cfg.GitProvider, envNames[cfg.GitProvider], other)
+		}
+	}
+
+	return nil
+}
+
+// ValidateGitProtocol checks protocol is one of the supported git protocols
+func ValidateGitProtocol(protocol string) error {
+	for _, valid := range validGitProtocols {
+		if protocol == valid {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid git protocol %q, valid values are: %s", protocol, strings.Join(validGitProtocols, ", "))
+}
+
+// ValidateEnv checks the environment variables gitProvider requires are set and hold a token of
+// that provider. GetConfig doesn't check them, as not every caller needs a git token, so callers
+// that do decide how to report the returned error
+func ValidateEnv(gitProvider string) error {
+	config := K3dConfig{}
+	if err := env.Parse(&config); err != nil {
+		return fmt.Errorf("error loading the environment variables: %s", err)
+	}
+	return validateParsedEnv(&config, gitProvider)
 }
 
 // GetConfig - load default values from kubefirst installer
@@ -83,21 +271,25 @@ func GetConfig(configName string, clusterName string, gitopsRepoName string, met
 		log.Fatal().Msgf("something went wrong getting home path: %s", err)
 	}
 
-	// cGitHost describes which git host to use depending on gitProvider
-	var cGitHost string
-	switch gitProvider {
-	case "github":
-		cGitHost = GithubHost
-	case "gitlab":
-		cGitHost = GitlabHost
+	if err := ValidateGitProtocol(gitProtocol); err != nil {
+		log.Fatal().Msgf("something went wrong validating the git protocol: %s", err)
 	}
 
+	// cGitHost describes which git host to use depending on gitProvider
+	cGitHost := gitHost(gitProvider, config.GitlabHost)
+
+	config.AtlantisAllowList = fmt.Sprintf("%s/%s/*", cGitHost, gitOwner)
+	config.EgressEndpoints = defaultEgressEndpoints(cGitHost)
+	config.ClusterName = clusterName
+	config.GitOwner = gitOwner
 	config.GitopsRepoName = gitopsRepoName
 	config.MetaphorRepoName = metaphorRepoName
-	config.DestinationGitopsRepoURL = fmt.Sprintf("https://%s/%s/%s.git", cGitHost, gitOwner, gitopsRepoName)
-	config.DestinationGitopsRepoGitURL = fmt.Sprintf("git@%s:%s/%s.git", cGitHost, gitOwner, gitopsRepoName)
-	config.DestinationMetaphorRepoURL = fmt.Sprintf("https://%s/%s/%s.git", cGitHost, gitOwner, metaphorRepoName)
-	config.DestinationMetaphorRepoGitURL = fmt.Sprintf("git@%s:%s/%s.git", cGitHost, gitOwner, metaphorRepoName)
+	config.DestinationGitopsRepoURL = gitHTTPSURL(cGitHost, gitOwner, gitopsRepoName) + ".git"
+	config.DestinationGitopsRepoGitURL = gitSSHURL(cGitHost, config.GitSSHPort, gitOwner, gitopsRepoName)
+	config.DestinationMetaphorRepoURL = gitHTTPSURL(cGitHost, gitOwner, metaphorRepoName) + ".git"
+	config.DestinationMetaphorRepoGitURL = gitSSHURL(cGitHost, config.GitSSHPort, gitOwner, metaphorRepoName)
+	config.DestinationGitopsRepoHttpsURL = gitHTTPSURL(cGitHost, gitOwner, gitopsRepoName)
+	config.DestinationMetaphorRepoHttpsURL = gitHTTPSURL(cGitHost, gitOwner, metaphorRepoName)
 
 	config.GitopsDir = fmt.Sprintf("%s/.k1/configs/%s/gitops", homeDir, configName)
 	config.GitProvider = gitProvider
@@ -117,6 +309,199 @@ func GetConfig(configName string, clusterName string, gitopsRepoName string, met
 	return &config
 }
 
+// SetUniqueGitopsRepoName replaces cfg.GitopsRepoName with a name free under gitOwner on the
+// configured git provider, updating the destination gitops repository urls to match
+func SetUniqueGitopsRepoName(cfg *K3dConfig, gitOwner string) error {
+	var token string
+	switch cfg.GitProvider {
+	case "github":
+		token = cfg.GithubToken
+	case "gitlab":
+		token = cfg.GitlabToken
+	default:
+		return fmt.Errorf("unsupported git provider %q", cfg.GitProvider)
+	}
+	host := gitHost(cfg.GitProvider, cfg.GitlabHost)
+
+	httpClient, err := ProviderHttpClient(cfg)
+	if err != nil {
+		return err
+	}
+	gitopsRepoName, err := EnsureUniqueRepoName(httpClient, token, host, gitOwner, cfg.GitopsRepoName)
+	if err != nil {
+		return err
+	}
+	if gitopsRepoName == cfg.GitopsRepoName {
+		return nil
+	}
+
+	log.Info().Msgf("gitops repository %s/%s already exists, using %s", gitOwner, cfg.GitopsRepoName, gitopsRepoName)
+	cfg.GitopsRepoName = gitopsRepoName
+	cfg.DestinationGitopsRepoURL = gitHTTPSURL(host, gitOwner, gitopsRepoName) + ".git"
+	cfg.DestinationGitopsRepoGitURL = gitSSHURL(host, cfg.GitSSHPort, gitOwner, gitopsRepoName)
+	cfg.DestinationGitopsRepoHttpsURL = gitHTTPSURL(host, gitOwner, gitopsRepoName)
+
+	return nil
+}
+
+// gitHost returns the git host of gitProvider, gitlabHost overrides GitlabHost for self-managed
+// instances and may carry their https port, e.g. gitlab.internal:8443
+func gitHost(gitProvider, gitlabHost string) string {
+	switch gitProvider {
+	case "github":
+		return GithubHost
+	case "gitlab":
+		if gitlabHost != "" {
+			return gitlabHost
+		}
+		return GitlabHost
+	default:
+		return ""
+	}
+}
+
+// sshHost splits gitHost into the host and port ssh connects to, a port in gitHost is the
+// https port and is dropped in favour of sshPort, defaulting to defaultSSHPort
+func sshHost(gitHost string, sshPort int) (string, int) {
+	host := gitHost
+	if hostname, _, err := net.SplitHostPort(gitHost); err == nil {
+		host = hostname
+	}
+	if sshPort == 0 {
+		sshPort = defaultSSHPort
+	}
+	return host, sshPort
+}
+
+// gitFQDN returns the prefix the repository paths of gitHost are appended to for gitProtocol,
+// e.g. https://github.com/ or git@github.com:, using the ssh:// form for a non default ssh port
+func gitFQDN(gitHost string, sshPort int, gitProtocol string) string {
+	if gitProtocol == "https" {
+		return fmt.Sprintf("https://%s/", gitHost)
+	}
+	host, port := sshHost(gitHost, sshPort)
+	if port == defaultSSHPort {
+		return fmt.Sprintf("git@%s:", host)
+	}
+	return fmt.Sprintf("ssh://git@%s/", net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+// defaultSSHPort is the ssh port of the scp-like repository urls, e.g. git@github.com:owner/repo.git
+const defaultSSHPort = 22
+
+// gitHTTPSURL returns the https url of owner/repo on gitHost, which may carry the port of a
+// self-managed instance, e.g. gitlab.internal:8443
+func gitHTTPSURL(gitHost, owner, repo string) string {
+	return fmt.Sprintf("https://%s/%s/%s", gitHost, owner, repo)
+}
+
+// gitSSHURL returns the ssh url of owner/repo on gitHost. A port in gitHost is the https port
+// and is dropped, ssh connects on sshPort with the scp-like form kept for the default port
+func gitSSHURL(gitHost string, sshPort int, owner, repo string) string {
+	return fmt.Sprintf("%s%s/%s.git", gitFQDN(gitHost, sshPort, "ssh"), owner, repo)
+}
+
+// BrowserRepoURL returns the https link a browser opens for the repository cloned from gitURL,
+// dropping the .git suffix and any credentials. ssh urls, scp-like or ssh://, are converted to
+// https on the same host, their ssh port is dropped as the https port of the host isn't known
+func BrowserRepoURL(gitURL string) string {
+	repoURL := strings.TrimSpace(gitURL)
+	if repoURL == "" {
+		return ""
+	}
+
+	// scp-like form, git@github.com:owner/repo.git
+	if !strings.Contains(repoURL, "://") {
+		if userHost, path, ok := strings.Cut(repoURL, ":"); ok {
+			_, host, found := strings.Cut(userHost, "@")
+			if !found {
+				host = userHost
+			}
+			repoURL = fmt.Sprintf("https://%s/%s", host, strings.TrimPrefix(path, "/"))
+		}
+	}
+
+	u, err := url.Parse(repoURL)
+	if err != nil || u.Host == "" {
+		return strings.TrimSuffix(strings.TrimSuffix(repoURL, "/"), ".git")
+	}
+	host := u.Host
+	if u.Scheme != "https" && u.Scheme != "http" {
+		host = u.Hostname()
+	}
+
+	path := strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), ".git")
+	return fmt.Sprintf("https://%s%s", host, path)
+}
+
+// InitK1Scaffold creates the directories of the config the adjust functions write to, applying
+// cfg.DirMode to each. Existing directories and their content are kept, so it is safe to rerun
+func InitK1Scaffold(cfg *K3dConfig) error {
+	dirs := []struct{ name, path string }{
+		{"k1", cfg.K1Dir},
+		{"gitops", cfg.GitopsDir},
+		{"tools", cfg.ToolsDir},
+		{"mkcert pem", cfg.MkCertPemDir},
+		{"mkcert ssl secret", cfg.MkCertSSLSecretDir},
+		{"metaphor", cfg.MetaphorDir},
+	}
+	for _, dir := range dirs {
+		if dir.path == "" {
+			return fmt.Errorf("error creating k1 scaffold: %s directory is not set", dir.name)
+		}
+		err := mkdirWithMode(dir.path, cfg.dirMode())
+		if err != nil {
+			return fmt.Errorf("error creating %s directory %s: %s", dir.name, dir.path, err)
+		}
+	}
+	log.Info().Str("path", cfg.K1Dir).Msg("k1 directory scaffold ready")
+	return nil
+}
+
+// MigrateLegacyK1Layout moves a config from the legacy ~/.k1/<configName> layout
+// to ~/.k1/configs/<configName>, returning whether anything was moved
+func MigrateLegacyK1Layout(configName string) (bool, error) {
+	if configName == "" || configName == "configs" || strings.ContainsAny(configName, `/\`) || strings.Contains(configName, "..") {
+		return false, fmt.Errorf("invalid config name %q", configName)
+	}
+
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return false, fmt.Errorf("something went wrong getting home path: %s", err)
+	}
+
+	legacyDir := fmt.Sprintf("%s/.k1/%s", homeDir, configName)
+	configDir := fmt.Sprintf("%s/.k1/configs/%s", homeDir, configName)
+
+	fi, err := os.Stat(legacyDir)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error checking legacy config directory %s: %s", legacyDir, err)
+	}
+	if !fi.IsDir() {
+		return false, nil
+	}
+
+	if _, err := os.Stat(configDir); err == nil {
+		log.Warn().Msgf("both %s and %s exist, leaving legacy directory in place", legacyDir, configDir)
+		return false, nil
+	}
+
+	err = os.MkdirAll(fmt.Sprintf("%s/.k1/configs", homeDir), defaultDirMode)
+	if err != nil {
+		return false, fmt.Errorf("error creating configs directory: %s", err)
+	}
+	err = os.Rename(legacyDir, configDir)
+	if err != nil {
+		return false, fmt.Errorf("error migrating %s to %s: %s", legacyDir, configDir, err)
+	}
+	log.Info().Msgf("migrated legacy config directory %s to %s", legacyDir, configDir)
+
+	return true, nil
+}
+
 type GitopsDirectoryValues struct {
 	GithubOwner                   string
 	GithubUser                    string
@@ -132,6 +517,7 @@ type GitopsDirectoryValues struct {
 	ClusterType                   string
 	GithubHost                    string
 	GitlabHost                    string
+	GitSSHPort                    int
 	ArgoWorkflowsIngressURL       string
 	VaultIngressURL               string
 	ArgocdIngressURL              string
@@ -146,7 +532,7 @@ type GitopsDirectoryValues struct {
 	GitProvider                   string
 	CloudProvider                 string
 	ClusterId                     string
-	KubeconfigPath                string
+	KubeconfigPath                string `token:"KUBE_CONFIG_PATH"`
 }
 
 type MetaphorTokenValues struct {
@@ -158,3 +544,95 @@ type MetaphorTokenValues struct {
 	MetaphorStagingIngressURL     string
 	MetaphorProductionIngressURL  string
 }
+
+// DefaultAlertsEmail returns the admin address under domainName the alert configs are sent to
+// when no alerts email is supplied
+func DefaultAlertsEmail(domainName string) string {
+	return fmt.Sprintf("admin@%s", domainName)
+}
+
+// alertsEmail returns tokens.AlertsEmail, falling back to DefaultAlertsEmail for the domain of the values
+func alertsEmail(tokens *GitopsDirectoryValues) string {
+	if tokens.AlertsEmail != "" {
+		return tokens.AlertsEmail
+	}
+	email := DefaultAlertsEmail(valuesDomain(tokens))
+	log.Info().Msgf("no alerts email supplied, using %s", email)
+	return email
+}
+
+// valuesDomain returns tokens.DomainName, falling back to DomainName when the values carry no domain
+func valuesDomain(tokens *GitopsDirectoryValues) string {
+	if tokens.DomainName != "" {
+		return tokens.DomainName
+	}
+	return DomainName
+}
+
+// MetaphorURLs returns the metaphor ingress url of each environment under domainName, keyed by
+// environment name for the console
+func MetaphorURLs(domainName string) map[string]string {
+	urls := map[string]string{}
+	for environment, subdomain := range metaphorSubdomains {
+		urls[environment] = ingressURL(subdomain, domainName)
+	}
+	return urls
+}
+
+// ingressURL returns the https url of the service served under subdomain of domainName
+func ingressURL(subdomain, domainName string) string {
+	return fmt.Sprintf("https://%s.%s", subdomain, domainName)
+}
+
+// BuildGitopsValues - assemble the gitops token values from the k3d config, deriving every
+// ingress url from domainName the same way as the package url vars are for DomainName
+func BuildGitopsValues(cfg *K3dConfig, clusterType, domainName string) GitopsDirectoryValues {
+	metaphorURLs := MetaphorURLs(domainName)
+	values := GitopsDirectoryValues{
+		AlertsEmail:                   DefaultAlertsEmail(domainName),
+		AtlantisAllowList:             cfg.AtlantisAllowList,
+		ClusterName:                   cfg.ClusterName,
+		ClusterType:                   clusterType,
+		CloudProvider:                 CloudProvider,
+		DomainName:                    domainName,
+		GitProvider:                   cfg.GitProvider,
+		GitSSHPort:                    cfg.GitSSHPort,
+		GitopsRepoGitURL:              cfg.DestinationGitopsRepoGitURL,
+		GitopsRepoHttpsURL:            cfg.DestinationGitopsRepoHttpsURL,
+		GitopsRepoURL:                 BrowserRepoURL(cfg.DestinationGitopsRepoURL),
+		KubeconfigPath:                cfg.Kubeconfig,
+		KubefirstVersion:              configs.K1Version,
+		ArgocdIngressURL:              ingressURL(argocdSubdomain, domainName),
+		ArgoWorkflowsIngressURL:       ingressURL(argoWorkflowsSubdomain, domainName),
+		AtlantisIngressURL:            ingressURL(atlantisSubdomain, domainName),
+		VaultIngressURL:               ingressURL(vaultSubdomain, domainName),
+		MetaphorDevelopmentIngressURL: metaphorURLs["development"],
+		MetaphorStagingIngressURL:     metaphorURLs["staging"],
+		MetaphorProductionIngressURL:  metaphorURLs["production"],
+	}
+
+	switch cfg.GitProvider {
+	case "github":
+		values.GithubHost = GithubHost
+		values.GithubOwner = cfg.GitOwner
+	case "gitlab":
+		values.GitlabHost = gitHost(cfg.GitProvider, cfg.GitlabHost)
+		values.GitlabOwner = cfg.GitOwner
+	}
+
+	return values
+}
+
+// BuildMetaphorValues - assemble the metaphor token values from the k3d config,
+// leaving only the cloud region and container registry to the caller
+func BuildMetaphorValues(cfg *K3dConfig, cloudRegion, registryURL string) MetaphorTokenValues {
+	return MetaphorTokenValues{
+		ClusterName:                   cfg.ClusterName,
+		CloudRegion:                   cloudRegion,
+		ContainerRegistryURL:          registryURL,
+		DomainName:                    DomainName,
+		MetaphorDevelopmentIngressURL: MetaphorDevelopmentURL,
+		MetaphorStagingIngressURL:     MetaphorStagingURL,
+		MetaphorProductionIngressURL:  MetaphorProductionURL,
+	}
+}
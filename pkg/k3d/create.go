@@ -7,8 +7,15 @@ See the LICENSE file for more details.
 package k3d
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/go-git/go-git/v5"
@@ -23,84 +30,294 @@ const (
 	k3dImageTag string = "v1.26.3-k3s1"
 )
 
-// ClusterCreate create an k3d cluster
-func ClusterCreate(clusterName string, k1Dir string, k3dClient string, kubeconfig string) error {
-	log.Info().Msg("creating K3d cluster...")
+// ClusterExists reports whether a k3d cluster named cfg.ClusterName already exists
+func ClusterExists(cfg *K3dConfig) (bool, error) {
+	stdOut, stdErr, err := pkg.ExecShellReturnStrings(cfg.K3dClient, "cluster", "list", "-o", "json")
+	if err != nil {
+		return false, fmt.Errorf("error listing k3d clusters: %s %s", err, stdErr)
+	}
 
-	volumeDir := fmt.Sprintf("%s/minio-storage", k1Dir)
-	if _, err := os.Stat(volumeDir); os.IsNotExist(err) {
-		err := os.MkdirAll(volumeDir, os.ModePerm)
-		if err != nil {
-			log.Info().Msgf("%s directory already exists, continuing", volumeDir)
-		}
+	var clusters []struct {
+		Name string `json:"name"`
 	}
-	errLineOne, errLineTwo, err := pkg.ExecShellReturnStrings(k3dClient, "cluster", "create",
-		clusterName,
-		"--image", fmt.Sprintf("rancher/k3s:%s", k3dImageTag),
-		"--agents", "3",
-		"--agents-memory", "1024m",
-		"--registry-create", "k3d-"+clusterName+"-registry",
-		"--k3s-arg", `--kubelet-arg=eviction-hard=imagefs.available<1%,nodefs.available<1%@agent:*`,
-		"--k3s-arg", `--kubelet-arg=eviction-minimum-reclaim=imagefs.available=1%,nodefs.available=1%@agent:*`,
-		"--volume", volumeDir+":/var/lib/rancher/k3s/storage@all",
-		"--port", "443:443@loadbalancer",
-	)
+	err = json.Unmarshal([]byte(stdOut), &clusters)
 	if err != nil {
-		log.Info().Msg("error creating k3d cluster")
-		log.Info().Msgf(" err: %s %s %s", errLineOne, errLineTwo, err)
-		return err
+		return false, fmt.Errorf("error parsing k3d cluster list: %s", err)
 	}
 
-	time.Sleep(20 * time.Second)
+	for _, cluster := range clusters {
+		if cluster.Name == cfg.ClusterName {
+			return true, nil
+		}
+	}
+	return false, nil
+}
 
-	kConfigString, _, err := pkg.ExecShellReturnStrings(k3dClient, "kubeconfig", "get", clusterName)
-	if err != nil {
-		return err
+// ClusterCreate create an k3d cluster, see CreateCluster for the options
+func ClusterCreate(clusterName string, k1Dir string, k3dClient string, kubeconfig string, opts ...CreateOptions) error {
+	cfg := &K3dConfig{ClusterName: clusterName, K1Dir: k1Dir, K3dClient: k3dClient, Kubeconfig: kubeconfig}
+	_, err := CreateCluster(cfg, createOptions(opts))
+	return err
+}
+
+// registryContainerPort is the port the k3d registry container listens on inside the docker network
+const registryContainerPort = 5000
+
+// RegistryConfig describes a local image registry created alongside the k3d cluster
+type RegistryConfig struct {
+	Name string
+	Port int
+}
+
+// CreateOptions holds optional settings for CreateCluster
+type CreateOptions struct {
+	// Registry creates a local image registry with the cluster when set, otherwise
+	// the default k3d-<cluster>-registry is created
+	Registry *RegistryConfig
+	// K3sImage is the rancher/k3s node image, defaults to rancher/k3s:<k3dImageTag>
+	K3sImage string
+	// Agents is the number of agent nodes, defaults to 3
+	Agents int
+	// AgentsMemory is the memory limit of each agent node, defaults to 1024m
+	AgentsMemory string
+	// ConsoleAPI mounts the k1 directory into the nodes at /.k1 for the console and api
+	// instead of the minio storage volume
+	ConsoleAPI bool
+}
+
+// createOptions returns the options passed to the variadic ClusterCreate wrappers
+func createOptions(opts []CreateOptions) CreateOptions {
+	if len(opts) == 0 {
+		return CreateOptions{}
+	}
+	return opts[0]
+}
+
+// consoleAPIOptions applies the console and api defaults, one 2048m agent, to opts
+func consoleAPIOptions(opts CreateOptions) CreateOptions {
+	opts.ConsoleAPI = true
+	if opts.Agents == 0 {
+		opts.Agents = 1
 	}
+	if opts.AgentsMemory == "" {
+		opts.AgentsMemory = "2048m"
+	}
+	return opts
+}
 
-	err = os.WriteFile(kubeconfig, []byte(kConfigString), 0644)
-	if err != nil {
-		log.Error().Err(err).Msg("error updating config")
-		return fmt.Errorf("error updating config")
+// k3sImage returns the node image to create the cluster with
+func (opts CreateOptions) k3sImage() string {
+	if opts.K3sImage != "" {
+		return opts.K3sImage
 	}
+	return fmt.Sprintf("rancher/k3s:%s", k3dImageTag)
+}
 
+// agents returns the number of agent nodes and their memory limit
+func (opts CreateOptions) agents() (string, string) {
+	agents, memory := opts.Agents, opts.AgentsMemory
+	if agents == 0 {
+		agents = 3
+	}
+	if memory == "" {
+		memory = "1024m"
+	}
+	return strconv.Itoa(agents), memory
+}
+
+// Address returns the host:port the registry is reachable at, for use as ContainerRegistryURL
+func (r RegistryConfig) Address() string {
+	return fmt.Sprintf("%s:%d", r.Name, r.Port)
+}
+
+func (r RegistryConfig) validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("error validating registry config: name is required")
+	}
+	if r.Port < 1 || r.Port > 65535 {
+		return fmt.Errorf("error validating registry config: invalid port %d", r.Port)
+	}
 	return nil
 }
 
-// ClusterCreate create an k3d cluster for use with console and api
-func ClusterCreateConsoleAPI(clusterName string, k1Dir string, k3dClient string, kubeconfig string) error {
-	log.Info().Msg("creating K3d cluster...")
+// registriesYAML returns a k3s registries.yaml mirroring the registry address to the registry container
+func (r RegistryConfig) registriesYAML() []byte {
+	return []byte(fmt.Sprintf(`mirrors:
+  "%s":
+    endpoint:
+      - http://%s:%d
+`, r.Address(), r.Name, registryContainerPort))
+}
+
+// args returns the k3d arguments creating the registry and configuring the cluster to pull from it
+func (r RegistryConfig) args(registryConfigPath string) []string {
+	return []string{
+		"--registry-create", fmt.Sprintf("%s:0.0.0.0:%d", r.Name, r.Port),
+		"--registry-config", registryConfigPath,
+	}
+}
+
+// listenTCP binds the ports checked by CheckPortsAvailable
+var listenTCP = net.Listen
+
+// CheckPortsAvailable attempts to bind each of ports on all interfaces and returns the ports
+// that are already in use, along with an error naming them. Other bind errors, e.g. an
+// unprivileged user binding 443, can't tell whether the port is free and are only logged
+func CheckPortsAvailable(ports []int) ([]int, error) {
+	conflicts := []int{}
+	for _, port := range ports {
+		if port < 1 || port > 65535 {
+			return nil, fmt.Errorf("error checking port availability: invalid port %d", port)
+		}
+		listener, err := listenTCP("tcp", fmt.Sprintf(":%d", port))
+		if errors.Is(err, syscall.EADDRINUSE) {
+			log.Debug().Msgf("port %d is unavailable: %s", port, err)
+			conflicts = append(conflicts, port)
+			continue
+		}
+		if err != nil {
+			log.Warn().Msgf("unable to check port %d is available, continuing: %s", port, err)
+			continue
+		}
+		listener.Close()
+	}
+
+	if len(conflicts) > 0 {
+		inUse := make([]string, 0, len(conflicts))
+		for _, port := range conflicts {
+			inUse = append(inUse, strconv.Itoa(port))
+		}
+		return conflicts, fmt.Errorf("port(s) %s are already in use, stop the process or cluster using them before creating the k3d cluster", strings.Join(inUse, ", "))
+	}
+	return conflicts, nil
+}
+
+// clusterHostPorts returns the host ports mapped by clusterCreateArgs
+func clusterHostPorts(opts CreateOptions) []int {
+	ports := []int{443}
+	if opts.Registry != nil {
+		ports = append(ports, opts.Registry.Port)
+	}
+	return ports
+}
+
+// clusterVolume returns the k3d volume mount of the cluster, the minio storage under cfg.K1Dir
+// or, for the console and api, cfg.K1Dir itself
+func clusterVolume(cfg *K3dConfig, opts CreateOptions) string {
+	if opts.ConsoleAPI {
+		return cfg.K1Dir + ":/.k1"
+	}
+	return filepath.Join(cfg.K1Dir, "minio-storage") + ":/var/lib/rancher/k3s/storage@all"
+}
 
-	_, _, err := pkg.ExecShellReturnStrings(k3dClient, "cluster", "create",
-		clusterName,
-		"--image", fmt.Sprintf("rancher/k3s:%s", k3dImageTag),
-		"--agents", "1",
-		"--agents-memory", "2048m",
-		"--registry-create", "k3d-"+clusterName+"-registry",
+// clusterCreateArgs builds the k3d cluster create arguments for cfg
+func clusterCreateArgs(cfg *K3dConfig, opts CreateOptions) []string {
+	agents, agentsMemory := opts.agents()
+	args := []string{
+		"cluster", "create",
+		cfg.ClusterName,
+		"--image", opts.k3sImage(),
+		"--agents", agents,
+		"--agents-memory", agentsMemory,
+	}
+	if opts.Registry != nil {
+		args = append(args, opts.Registry.args(filepath.Join(cfg.K1Dir, "registries.yaml"))...)
+	} else {
+		args = append(args, "--registry-create", "k3d-"+cfg.ClusterName+"-registry")
+	}
+	return append(args,
 		"--k3s-arg", `--kubelet-arg=eviction-hard=imagefs.available<1%,nodefs.available<1%@agent:*`,
 		"--k3s-arg", `--kubelet-arg=eviction-minimum-reclaim=imagefs.available=1%,nodefs.available=1%@agent:*`,
+		"--volume", clusterVolume(cfg, opts),
 		"--port", "443:443@loadbalancer",
-		"--volume", k1Dir+":/.k1",
 	)
+}
+
+// CreateCluster creates the k3d cluster described by cfg and returns the address of the
+// local registry configured in opts, or an empty string when none is configured
+func CreateCluster(cfg *K3dConfig, opts CreateOptions) (string, error) {
+	log.Info().Msg("creating K3d cluster...")
+
+	var err error
+	if !opts.ConsoleAPI {
+		volumeDir := filepath.Join(cfg.K1Dir, "minio-storage")
+		err = os.MkdirAll(volumeDir, cfg.dirMode())
+		if err != nil {
+			return "", fmt.Errorf("error creating %s: %s", volumeDir, err)
+		}
+	}
+
+	registryURL := ""
+	if opts.Registry != nil {
+		err = opts.Registry.validate()
+		if err != nil {
+			return "", err
+		}
+		err = os.WriteFile(filepath.Join(cfg.K1Dir, "registries.yaml"), opts.Registry.registriesYAML(), 0644)
+		if err != nil {
+			return "", fmt.Errorf("error writing registry config: %s", err)
+		}
+		registryURL = opts.Registry.Address()
+	}
+
+	_, err = CheckPortsAvailable(clusterHostPorts(opts))
 	if err != nil {
-		log.Info().Msg("error creating k3d cluster")
-		return err
+		return "", err
+	}
+
+	errLineOne, errLineTwo, err := pkg.ExecShellReturnStrings(cfg.K3dClient, clusterCreateArgs(cfg, opts)...)
+	if err != nil {
+		log.Info().Msgf(" err: %s %s %s", errLineOne, errLineTwo, err)
+		return "", fmt.Errorf("error creating k3d cluster: %s", err)
 	}
 
 	time.Sleep(20 * time.Second)
 
-	kConfigString, _, err := pkg.ExecShellReturnStrings(k3dClient, "kubeconfig", "get", clusterName)
+	kConfigString, _, err := pkg.ExecShellReturnStrings(cfg.K3dClient, "kubeconfig", "get", cfg.ClusterName)
 	if err != nil {
-		return err
+		return "", fmt.Errorf("error getting k3d kubeconfig: %s", err)
 	}
 
-	err = os.WriteFile(kubeconfig, []byte(kConfigString), 0644)
+	err = os.WriteFile(cfg.Kubeconfig, []byte(kConfigString), 0644)
 	if err != nil {
-		log.Error().Err(err).Msg("error updating config")
-		return fmt.Errorf("error updating config")
+		return "", fmt.Errorf("error updating config: %s", err)
 	}
 
-	return nil
+	if registryURL != "" {
+		log.Info().Msgf("local registry available at %s", registryURL)
+	}
+	return registryURL, nil
+}
+
+// ClusterCreateConsoleAPI create an k3d cluster for use with console and api, see CreateCluster
+// for the options
+func ClusterCreateConsoleAPI(clusterName string, k1Dir string, k3dClient string, kubeconfig string, opts ...CreateOptions) error {
+	cfg := &K3dConfig{ClusterName: clusterName, K1Dir: k1Dir, K3dClient: k3dClient, Kubeconfig: kubeconfig}
+	_, err := CreateCluster(cfg, consoleAPIOptions(createOptions(opts)))
+	return err
+}
+
+// isEmptyDir reports whether dir is missing or has no entries
+func isEmptyDir(dir string) bool {
+	entries, err := os.ReadDir(dir)
+	return err != nil || len(entries) == 0
+}
+
+// PrepareOptions holds optional settings for PrepareGitRepositories
+type PrepareOptions struct {
+	// CommitIdentity is the author and committer of the initial gitops and metaphor commits,
+	// defaults to DefaultCommitIdentity
+	CommitIdentity CommitIdentity
+	// CommitMessage replaces the default message of the initial gitops and metaphor commits
+	CommitMessage string
+}
+
+// prepareOptions returns the options passed to the variadic PrepareGitRepositories
+func prepareOptions(opts []PrepareOptions) PrepareOptions {
+	if len(opts) == 0 {
+		return PrepareOptions{}
+	}
+	return opts[0]
 }
 
 // should tokens be a *GitopsDirectoryValues? does it matter
@@ -121,68 +338,104 @@ func PrepareGitRepositories(
 	metaphorRepoName string,
 	gitProtocol string,
 	removeAtlantis bool,
+	opts ...PrepareOptions,
 ) error {
+	options := prepareOptions(opts)
+	commitMessage, identity := options.CommitMessage, options.CommitIdentity
 
-	//* clone the gitops-template repo
-	gitopsRepo, err := gitClient.CloneRefSetMain(gitopsTemplateBranch, gitopsDir, gitopsTemplateURL)
+	// each step is checkpointed under k1Dir so an interrupted run resumes after the last completed step
+	checkpoint, err := checkpointPath(k1Dir, clusterName)
 	if err != nil {
-		log.Panic().Msgf("error opening repo at: %s, err: %v", gitopsDir, err)
-	}
-	log.Info().Msg("gitops repository clone complete")
-
-	// * adjust the content for the gitops repo
-	err = AdjustGitopsRepo(CloudProvider, clusterName, clusterType, gitopsDir, gitopsRepoName, gitProvider, k1Dir, removeAtlantis)
-	if err != nil {
-		log.Info().Msgf("err: %v", err)
 		return err
 	}
 
-	// * detokenize the gitops repo
-	err = detokenizeGitGitops(gitopsDir, gitopsTokens, gitProtocol)
+	// the metaphor step moves content out of the gitops repo, so a metaphor step interrupted
+	// after it started can't be retried alone and both steps start over from a fresh clone
+	metaphorPrepared, err := stepCompleted(checkpoint, checkpointMetaphorPrepared)
 	if err != nil {
 		return err
 	}
-
-	// * add new remote
-	err = gitClient.AddRemote(DestinationGitopsRepoURL, gitProvider, gitopsRepo)
-	if err != nil {
-		return err
+	if !metaphorPrepared && !isEmptyDir(metaphorDir) {
+		err = removeCheckpoint(checkpoint, checkpointGitopsPrepared)
+		if err != nil {
+			return err
+		}
 	}
 
-	// ! metaphor
-	// * adjust the content for the gitops repo
-	err = AdjustMetaphorRepo(DestinationMetaphorRepoURL, gitopsDir, metaphorRepoName, gitProvider, k1Dir)
-	if err != nil {
-		return err
-	}
+	err = runCheckpointed(checkpoint, checkpointGitopsPrepared, func() error {
+		return os.RemoveAll(gitopsDir)
+	}, func() error {
+		//* clone the gitops-template repo
+		gitopsRepo, err := gitClient.CloneRefSetMain(gitopsTemplateBranch, gitopsDir, gitopsTemplateURL)
+		if err != nil {
+			return fmt.Errorf("error cloning gitops template %s into %s: %s", gitopsTemplateURL, gitopsDir, err)
+		}
+		log.Info().Msg("gitops repository clone complete")
 
-	// * detokenize the gitops repo
-	err = detokenizeGitMetaphor(metaphorDir, metaphorTokens)
-	if err != nil {
-		return err
-	}
+		// * adjust the content for the gitops repo
+		err = AdjustGitopsRepo(CloudProvider, clusterName, clusterType, gitopsDir, gitopsRepoName, gitProvider, k1Dir, removeAtlantis)
+		if err != nil {
+			log.Info().Msgf("err: %v", err)
+			return err
+		}
+
+		// * detokenize the gitops repo
+		err = DetokenizeGitopsRepo(gitopsDir, gitopsTokens, gitProtocol, 0)
+		if err != nil {
+			return err
+		}
+
+		// * validate the detokenized manifests before they are committed
+		err = ValidateManifests(fmt.Sprintf("%s/registry", gitopsDir))
+		if err != nil {
+			return err
+		}
 
-	metaphorRepo, _ := git.PlainOpen(metaphorDir)
-	//* commit initial gitops-template content
-	err = gitClient.Commit(metaphorRepo, "committing initial detokenized metaphor repo content")
+		// * add new remote
+		return gitClient.AddRemote(DestinationGitopsRepoURL, gitProvider, gitopsRepo)
+	})
 	if err != nil {
 		return err
 	}
 
-	// * add new remote
-	err = gitClient.AddRemote(DestinationMetaphorRepoURL, gitProvider, metaphorRepo)
+	// ! metaphor
+	err = runCheckpointed(checkpoint, checkpointMetaphorPrepared, func() error {
+		return os.RemoveAll(metaphorDir)
+	}, func() error {
+		// * adjust, detokenize and commit the content for the metaphor repo
+		err := AdjustMetaphorRepo(DestinationMetaphorRepoURL, gitopsDir, metaphorRepoName, gitProvider, k1Dir, AdjustOptions{MetaphorTokens: metaphorTokens, CommitIdentity: identity, CommitMessage: commitMessage})
+		if err != nil {
+			return err
+		}
+
+		metaphorRepo, err := git.PlainOpen(metaphorDir)
+		if err != nil {
+			return fmt.Errorf("error opening repo at: %s, err: %s", metaphorDir, err)
+		}
+
+		// * add new remote
+		return gitClient.AddRemote(DestinationMetaphorRepoURL, gitProvider, metaphorRepo)
+	})
 	if err != nil {
 		return err
 	}
 
 	// * commit initial gitops-template content
 	// commit after metaphor content has been removed from gitops
-	err = gitClient.Commit(gitopsRepo, "committing initial detokenized gitops-template repo content")
+	err = runCheckpointed(checkpoint, checkpointGitopsCommitted, nil, func() error {
+		gitopsRepo, err := git.PlainOpen(gitopsDir)
+		if err != nil {
+			return fmt.Errorf("error opening repo at: %s, err: %s", gitopsDir, err)
+		}
+		_, err = commitRepo(gitopsRepo, commitMessageOrDefault(commitMessage, defaultGitopsCommitMessage), identity)
+		return err
+	})
 	if err != nil {
 		return err
 	}
 
-	return nil
+	// every step completed, a later install of the same cluster starts over
+	return clearCheckpoint(checkpoint)
 }
 
 func PostRunPrepareGitopsRepository(clusterName string,
@@ -0,0 +1,291 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestClusterExists(t *testing.T) {
+
+	toolsDir := t.TempDir()
+
+	tests := []struct {
+		name    string
+		output  string
+		want    bool
+		wantErr bool
+	}{
+		{
+			name:   "cluster present",
+			output: `[{"name":"dev","nodes":[]},{"name":"kubefirst","nodes":[{"name":"k3d-kubefirst-server-0","role":"server"}],"serversCount":1}]`,
+			want:   true,
+		},
+		{name: "cluster absent", output: `[{"name":"kubefirst-dev","nodes":[]}]`},
+		{name: "no clusters", output: `[]`},
+		{name: "invalid output", output: `INFO[0000] no clusters`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &K3dConfig{
+				ClusterName: "kubefirst",
+				K3dClient: writeStubTool(t, toolsDir, "k3d", `[ "$*" = "cluster list -o json" ] || exit 1
+echo '`+tt.output+`'
+`),
+			}
+
+			got, err := ClusterExists(cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ClusterExists() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ClusterExists() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClusterCreateArgsRegistry(t *testing.T) {
+
+	cfg := &K3dConfig{ClusterName: "kubefirst", K1Dir: "/home/kbot/.k1/configs/kubefirst"}
+
+	tests := []struct {
+		name         string
+		registry     *RegistryConfig
+		wantArgs     []string
+		wantURL      string
+		wantYAML     string
+		wantValidErr bool
+	}{
+		{
+			name:     "default registry",
+			wantArgs: []string{"--registry-create", "k3d-kubefirst-registry"},
+		},
+		{
+			name:     "local registry",
+			registry: &RegistryConfig{Name: "k3d-metaphor-registry", Port: 5001},
+			wantArgs: []string{
+				"--registry-create", "k3d-metaphor-registry:0.0.0.0:5001",
+				"--registry-config", "/home/kbot/.k1/configs/kubefirst/registries.yaml",
+			},
+			wantURL:  "k3d-metaphor-registry:5001",
+			wantYAML: "mirrors:\n  \"k3d-metaphor-registry:5001\":\n    endpoint:\n      - http://k3d-metaphor-registry:5000\n",
+		},
+		{name: "missing name", registry: &RegistryConfig{Port: 5001}, wantValidErr: true},
+		{name: "invalid port", registry: &RegistryConfig{Name: "registry", Port: 70000}, wantValidErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.wantValidErr {
+				_, err := CreateCluster(&K3dConfig{ClusterName: "kubefirst", K1Dir: t.TempDir()}, CreateOptions{Registry: tt.registry})
+				if err == nil {
+					t.Error("CreateCluster() error = nil, want invalid registry error")
+				}
+				return
+			}
+
+			args := clusterCreateArgs(cfg, CreateOptions{Registry: tt.registry})
+			var got []string
+			for i, arg := range args {
+				if arg == "--registry-create" || arg == "--registry-config" {
+					got = append(got, arg, args[i+1])
+				}
+			}
+			if !reflect.DeepEqual(got, tt.wantArgs) {
+				t.Errorf("clusterCreateArgs() registry args = %v, want %v", got, tt.wantArgs)
+			}
+
+			if tt.registry == nil {
+				return
+			}
+			if url := tt.registry.Address(); url != tt.wantURL {
+				t.Errorf("Address() = %s, want %s", url, tt.wantURL)
+			}
+			if yaml := string(tt.registry.registriesYAML()); yaml != tt.wantYAML {
+				t.Errorf("registriesYAML() = %q, want %q", yaml, tt.wantYAML)
+			}
+		})
+	}
+}
+
+func TestCheckPortsAvailable(t *testing.T) {
+
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	boundPort := listener.Addr().(*net.TCPAddr).Port
+
+	free, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	freePort := free.Addr().(*net.TCPAddr).Port
+	free.Close()
+
+	tests := []struct {
+		name          string
+		ports         []int
+		wantConflicts []int
+		wantErr       bool
+	}{
+		{name: "free port", ports: []int{freePort}, wantConflicts: []int{}},
+		{name: "bound port", ports: []int{freePort, boundPort}, wantConflicts: []int{boundPort}, wantErr: true},
+		{name: "invalid port", ports: []int{70000}, wantErr: true},
+		{name: "permission denied", ports: []int{443}, wantConflicts: []int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// binding privileged ports fails for unprivileged users without the port being in use
+			listenTCP = func(network, address string) (net.Listener, error) {
+				if address == ":443" {
+					return nil, &net.OpError{Op: "listen", Net: network, Err: os.NewSyscallError("bind", syscall.EACCES)}
+				}
+				return net.Listen(network, address)
+			}
+			defer func() { listenTCP = net.Listen }()
+
+			conflicts, err := CheckPortsAvailable(tt.ports)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CheckPortsAvailable() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(conflicts, tt.wantConflicts) {
+				t.Errorf("CheckPortsAvailable() = %v, want %v", conflicts, tt.wantConflicts)
+			}
+			if len(tt.wantConflicts) > 0 && !strings.Contains(err.Error(), strconv.Itoa(boundPort)) {
+				t.Errorf("CheckPortsAvailable() error %q does not name port %d", err, boundPort)
+			}
+		})
+	}
+}
+
+func TestClusterCreateArgsImage(t *testing.T) {
+
+	cfg := &K3dConfig{ClusterName: "kubefirst", K1Dir: "/home/kbot/.k1/configs/kubefirst"}
+
+	tests := []struct {
+		name     string
+		k3sImage string
+		want     string
+	}{
+		{name: "default image", want: "rancher/k3s:" + k3dImageTag},
+		{name: "pinned image", k3sImage: "rancher/k3s:v1.24.12-k3s1", want: "rancher/k3s:v1.24.12-k3s1"},
+		{name: "mirrored image", k3sImage: "registry.example.com/rancher/k3s:v1.26.3-k3s1", want: "registry.example.com/rancher/k3s:v1.26.3-k3s1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := clusterCreateArgs(cfg, CreateOptions{K3sImage: tt.k3sImage})
+			images := []string{}
+			for i, arg := range args {
+				if arg == "--image" {
+					images = append(images, args[i+1])
+				}
+			}
+			if !reflect.DeepEqual(images, []string{tt.want}) {
+				t.Errorf("clusterCreateArgs() --image = %v, want [%s]", images, tt.want)
+			}
+		})
+	}
+}
+
+func TestClusterCreateArgsProfiles(t *testing.T) {
+
+	cfg := &K3dConfig{ClusterName: "kubefirst", K1Dir: "/home/kbot/.k1/configs/kubefirst"}
+	evictionArgs := []string{
+		"--k3s-arg", `--kubelet-arg=eviction-hard=imagefs.available<1%,nodefs.available<1%@agent:*`,
+		"--k3s-arg", `--kubelet-arg=eviction-minimum-reclaim=imagefs.available=1%,nodefs.available=1%@agent:*`,
+	}
+
+	tests := []struct {
+		name string
+		opts CreateOptions
+		want []string
+	}{
+		{
+			name: "cluster",
+			opts: createOptions(nil),
+			want: append(append([]string{
+				"cluster", "create", "kubefirst",
+				"--image", "rancher/k3s:" + k3dImageTag,
+				"--agents", "3",
+				"--agents-memory", "1024m",
+				"--registry-create", "k3d-kubefirst-registry",
+			}, evictionArgs...),
+				"--volume", "/home/kbot/.k1/configs/kubefirst/minio-storage:/var/lib/rancher/k3s/storage@all",
+				"--port", "443:443@loadbalancer",
+			),
+		},
+		{
+			name: "console and api",
+			opts: consoleAPIOptions(createOptions(nil)),
+			want: append(append([]string{
+				"cluster", "create", "kubefirst",
+				"--image", "rancher/k3s:" + k3dImageTag,
+				"--agents", "1",
+				"--agents-memory", "2048m",
+				"--registry-create", "k3d-kubefirst-registry",
+			}, evictionArgs...),
+				"--volume", "/home/kbot/.k1/configs/kubefirst:/.k1",
+				"--port", "443:443@loadbalancer",
+			),
+		},
+		{
+			name: "console and api with options",
+			opts: consoleAPIOptions(createOptions([]CreateOptions{{
+				K3sImage: "registry.example.com/rancher/k3s:v1.26.3-k3s1",
+				Registry: &RegistryConfig{Name: "k3d-metaphor-registry", Port: 5001},
+				Agents:   2,
+			}})),
+			want: append(append([]string{
+				"cluster", "create", "kubefirst",
+				"--image", "registry.example.com/rancher/k3s:v1.26.3-k3s1",
+				"--agents", "2",
+				"--agents-memory", "2048m",
+				"--registry-create", "k3d-metaphor-registry:0.0.0.0:5001",
+				"--registry-config", "/home/kbot/.k1/configs/kubefirst/registries.yaml",
+			}, evictionArgs...),
+				"--volume", "/home/kbot/.k1/configs/kubefirst:/.k1",
+				"--port", "443:443@loadbalancer",
+			),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := clusterCreateArgs(cfg, tt.opts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("clusterCreateArgs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClusterCreateConsoleAPIPortCheck(t *testing.T) {
+
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	boundPort := listener.Addr().(*net.TCPAddr).Port
+
+	// the registry port is taken, so the wrapper fails the port check before k3d is run
+	k1Dir := t.TempDir()
+	k3dClient := writeStubTool(t, k1Dir, "k3d", "exit 1\n")
+	err = ClusterCreateConsoleAPI("kubefirst", k1Dir, k3dClient, filepath.Join(k1Dir, "kubeconfig"), CreateOptions{
+		Registry: &RegistryConfig{Name: "k3d-metaphor-registry", Port: boundPort},
+	})
+	if err == nil || !strings.Contains(err.Error(), strconv.Itoa(boundPort)) {
+		t.Errorf("ClusterCreateConsoleAPI() error = %v, want port %d in use", err, boundPort)
+	}
+}
@@ -19,7 +19,10 @@ import (
 	"github.com/kubefirst/runtime/pkg"
 )
 
-// DeleteK3dCluster delete a k3d cluster
+// clusterDeleteSettle is the time given to k3d to release the cluster resources after a delete
+var clusterDeleteSettle = 20 * time.Second
+
+// DeleteK3dCluster delete a k3d cluster, clearing its install checkpoint so a reinstall runs every step
 func DeleteK3dCluster(clusterName string, k1Dir string, k3dClient string) error {
 
 	log.Info().Msgf("deleting k3d cluster %s", clusterName)
@@ -29,11 +32,71 @@ func DeleteK3dCluster(clusterName string, k1Dir string, k3dClient string) error
 		return err
 	}
 	// todo: remove it?
-	time.Sleep(20 * time.Second)
+	time.Sleep(clusterDeleteSettle)
 
 	volumeDir := fmt.Sprintf("%s/minio-storage", k1Dir)
 	os.RemoveAll(volumeDir)
 
+	checkpoint, err := checkpointPath(k1Dir, clusterName)
+	if err != nil {
+		return err
+	}
+	err = clearCheckpoint(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// dockerClient is the docker cli used to manage k3d volumes and images
+var dockerClient = "docker"
+
+// PruneClusterVolumes removes the docker volumes k3d labelled as belonging to cfg.ClusterName.
+// Only volumes carrying the exact k3d.cluster label are removed, and nothing is removed while the
+// cluster still exists
+func PruneClusterVolumes(cfg *K3dConfig) error {
+	exists, err := ClusterExists(cfg)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("k3d cluster %s still exists, delete it before pruning its volumes", cfg.ClusterName)
+	}
+
+	clusterLabel := "k3d.cluster=" + cfg.ClusterName
+	stdOut, stdErr, err := pkg.ExecShellReturnStrings(dockerClient, "volume", "ls",
+		"--filter", "label="+clusterLabel, "--format", `{{.Name}}\t{{.Labels}}`)
+	if err != nil {
+		return fmt.Errorf("error listing docker volumes: %s %s", err, stdErr)
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(stdOut), "\n") {
+		name, labels, _ := strings.Cut(line, "\t")
+		if name == "" {
+			continue
+		}
+
+		// the filter already matched, check again so a broad or ignored filter can never
+		// remove volumes of other clusters
+		owned := false
+		for _, label := range strings.Split(labels, ",") {
+			if label == clusterLabel {
+				owned = true
+			}
+		}
+		if !owned {
+			log.Warn().Msgf("skipping docker volume %s, not labelled %s", name, clusterLabel)
+			continue
+		}
+
+		_, stdErr, err := pkg.ExecShellReturnStrings(dockerClient, "volume", "rm", name)
+		if err != nil {
+			return fmt.Errorf("error removing docker volume %s: %s %s", name, err, stdErr)
+		}
+		log.Info().Msgf("removed docker volume %s", name)
+	}
+
 	return nil
 }
 
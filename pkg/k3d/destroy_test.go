@@ -0,0 +1,79 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPruneClusterVolumes(t *testing.T) {
+
+	tests := []struct {
+		name        string
+		clusters    string
+		volumes     string
+		wantRemoved []string
+		wantErr     bool
+	}{
+		{
+			name:     "cluster volumes",
+			clusters: `[]`,
+			volumes: "k3d-kubefirst-images\tapp=k3d,k3d.cluster=kubefirst\n" +
+				"k3d-kubefirst-dev-images\tapp=k3d,k3d.cluster=kubefirst-dev\n" +
+				"postgres-data\tcom.docker.compose.project=kubefirst\n",
+			wantRemoved: []string{"k3d-kubefirst-images"},
+		},
+		{name: "no volumes", clusters: `[]`, volumes: ""},
+		{
+			name:     "cluster still running",
+			clusters: `[{"name":"kubefirst"}]`,
+			volumes:  "k3d-kubefirst-images\tapp=k3d,k3d.cluster=kubefirst\n",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			toolsDir := t.TempDir()
+			removedLog := filepath.Join(toolsDir, "removed")
+			writeFixture(t, toolsDir, map[string]string{"volumes": tt.volumes})
+
+			dockerClient = writeStubTool(t, toolsDir, "docker", `case "$*" in
+"volume ls --filter label=k3d.cluster=kubefirst --format {{.Name}}\t{{.Labels}}") cat `+filepath.Join(toolsDir, "volumes")+` ;;
+"volume rm "*) echo "$3" >> `+removedLog+` ;;
+*) exit 1 ;;
+esac
+`)
+			defer func() { dockerClient = "docker" }()
+			cfg := &K3dConfig{
+				ClusterName: "kubefirst",
+				K3dClient:   writeStubTool(t, toolsDir, "k3d", "echo '"+tt.clusters+"'\n"),
+			}
+
+			err := PruneClusterVolumes(cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PruneClusterVolumes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			removed := []string{}
+			content, _ := os.ReadFile(removedLog)
+			for _, name := range strings.Fields(string(content)) {
+				removed = append(removed, name)
+			}
+			want := tt.wantRemoved
+			if want == nil {
+				want = []string{}
+			}
+			if !reflect.DeepEqual(removed, want) {
+				t.Errorf("PruneClusterVolumes() removed %v, want %v", removed, want)
+			}
+		})
+	}
+}
@@ -7,191 +7,460 @@ See the LICENSE file for more details.
 package k3d
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"unicode"
 
 	"github.com/kubefirst/runtime/configs"
 )
 
-// detokenizeGitGitops - Translate tokens by values on a given path
-func detokenizeGitGitops(path string, tokens *GitopsDirectoryValues, gitProtocol string) error {
+// TokenReplacement pairs a template token with the value it is replaced by
+type TokenReplacement struct {
+	Token string
+	Value string
+}
 
-	err := filepath.Walk(path, detokenizeGitops(path, tokens, gitProtocol))
-	if err != nil {
-		return err
+// FileChange describes the token replacements detokenization would make in a single file
+type FileChange struct {
+	Path         string
+	Replacements []TokenReplacement
+}
+
+// gitopsTokenReplacements - ordered gitops token replacements
+func gitopsTokenReplacements(tokens *GitopsDirectoryValues, gitProtocol string) []TokenReplacement {
+	// todo reduce to terraform tokens by moving to helm chart?
+	replacements := []TokenReplacement{
+		{"<ALERTS_EMAIL>", alertsEmail(tokens)},
+		{"<ARGOCD_INGRESS_URL>", tokens.ArgocdIngressURL},
+		{"<ARGO_WORKFLOWS_INGRESS_URL>", tokens.ArgoWorkflowsIngressURL},
+		{"<ATLANTIS_ALLOW_LIST>", tokens.AtlantisAllowList},
+		{"<ATLANTIS_INGRESS_URL>", tokens.AtlantisIngressURL},
+		{"<CLUSTER_NAME>", tokens.ClusterName},
+		{"<CLOUD_PROVIDER>", tokens.CloudProvider},
+		{"<CLUSTER_ID>", tokens.ClusterId},
+		{"<CLUSTER_TYPE>", tokens.ClusterType},
+		{"<DOMAIN_NAME>", valuesDomain(tokens)},
+		{"<KUBEFIRST_TEAM>", tokens.KubefirstTeam},
+		{"<KUBEFIRST_VERSION>", configs.K1Version},
+		{"<KUBE_CONFIG_PATH>", tokens.KubeconfigPath},
+		{"<METAPHOR_DEVELOPMENT_INGRESS_URL>", tokens.MetaphorDevelopmentIngressURL},
+		{"<METAPHOR_STAGING_INGRESS_URL>", tokens.MetaphorStagingIngressURL},
+		{"<METAPHOR_PRODUCTION_INGRESS_URL>", tokens.MetaphorProductionIngressURL},
+		{"<GITHUB_HOST>", tokens.GithubHost},
+		{"<GITHUB_OWNER>", strings.ToLower(tokens.GithubOwner)},
+		{"<GITHUB_USER>", tokens.GithubUser},
+		{"<GIT_PROVIDER>", tokens.GitProvider},
+		{"<GIT-PROTOCOL>", gitProtocol},
+		{"<GITLAB_HOST>", tokens.GitlabHost},
+		{"<GITLAB_OWNER>", tokens.GitlabOwner},
+		{"<GITLAB_USER>", tokens.GitlabUser},
+		{"<GITLAB_OWNER_GROUP_ID>", strconv.Itoa(tokens.GitlabOwnerGroupID)},
+		{"<VAULT_INGRESS_URL>", tokens.VaultIngressURL},
+		{"<USE_TELEMETRY>", tokens.UseTelemetry},
+		{"<K3D_DOMAIN>", valuesDomain(tokens)},
+		{"<GITOPS_REPO_URL>", BrowserRepoURL(tokens.GitopsRepoURL)},
 	}
 
-	return nil
+	// Switch the repo url based on https flag, values without a host fall back to the saas host of the provider
+	host := tokens.GithubHost
+	if tokens.GitProvider == "gitlab" {
+		host = tokens.GitlabHost
+	}
+	if host == "" {
+		host = fmt.Sprintf("%v.com", tokens.GitProvider)
+	}
+	replacements = append(replacements, TokenReplacement{"<GIT_FQDN>", gitFQDN(host, tokens.GitSSHPort, gitProtocol)})
+
+	return replacements
 }
 
-func detokenizeGitops(path string, tokens *GitopsDirectoryValues, gitProtocol string) filepath.WalkFunc {
-	return filepath.WalkFunc(func(path string, fi os.FileInfo, err error) error {
+// metaphorTokenReplacements - ordered metaphor token replacements
+func metaphorTokenReplacements(tokens *MetaphorTokenValues) []TokenReplacement {
+	return []TokenReplacement{
+		{"<METAPHOR_DEVELOPMENT_INGRESS_URL>", tokens.MetaphorDevelopmentIngressURL},
+		{"<METAPHOR_STAGING_INGRESS_URL>", tokens.MetaphorStagingIngressURL},
+		{"<METAPHOR_PRODUCTION_INGRESS_URL>", tokens.MetaphorProductionIngressURL},
+		{"<CONTAINER_REGISTRY_URL>", tokens.ContainerRegistryURL}, // todo need to fix metaphor repo names
+		{"<DOMAIN_NAME>", tokens.DomainName},
+		{"<CLOUD_REGION>", tokens.CloudRegion},
+		{"<CLUSTER_NAME>", tokens.ClusterName},
+	}
+}
+
+// DetokenizationPlan - list the files under dir the detokenizer would modify along with
+// the tokens found and their replacement values, without modifying anything
+// values may be a *GitopsDirectoryValues, *MetaphorTokenValues or a map of token to value,
+// gitProtocol is the protocol gitops values are detokenized for and is ignored otherwise
+func DetokenizationPlan(dir string, values interface{}, gitProtocol string) ([]FileChange, error) {
+	var replacements []TokenReplacement
+	switch v := values.(type) {
+	case *GitopsDirectoryValues:
+		err := ValidateGitProtocol(gitProtocol)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		replacements = gitopsTokenReplacements(v, gitProtocol)
+	case *MetaphorTokenValues:
+		replacements = metaphorTokenReplacements(v)
+	case map[string]string:
+		for token, value := range v {
+			replacements = append(replacements, TokenReplacement{token, value})
+		}
+		sort.Slice(replacements, func(i, j int) bool { return replacements[i].Token < replacements[j].Token })
+	default:
+		return nil, fmt.Errorf("unsupported detokenization values type %T", values)
+	}
 
-		if !!fi.IsDir() {
-			return nil
+	// the same files the detokenizers rewrite
+	paths, err := detokenizePaths(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []FileChange{}
+	for _, path := range paths {
+		read, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
 		}
+		content := stripBOM(string(read))
 
-		// var matched bool
-		matched, _ := filepath.Match("*", fi.Name())
+		found := []TokenReplacement{}
+		for _, r := range replacements {
+			if strings.Contains(content, r.Token) {
+				found = append(found, TokenReplacement{r.Token, maskTokenValue(r.Token, r.Value)})
+			}
+		}
+		if len(found) > 0 {
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, FileChange{Path: rel, Replacements: found})
+		}
+	}
 
-		if matched {
-			// ignore .git files
-			if !strings.Contains(path, "/.git/") {
-				read, err := ioutil.ReadFile(path)
-				if err != nil {
-					return err
-				}
+	return changes, nil
+}
 
-				// todo reduce to terraform tokens by moving to helm chart?
-				newContents := string(read)
-				newContents = strings.Replace(newContents, "<ALERTS_EMAIL>", "your@email.com", -1) //
-				newContents = strings.Replace(newContents, "<ARGOCD_INGRESS_URL>", tokens.ArgocdIngressURL, -1)
-				newContents = strings.Replace(newContents, "<ARGO_WORKFLOWS_INGRESS_URL>", tokens.ArgoWorkflowsIngressURL, -1)
-				newContents = strings.Replace(newContents, "<ATLANTIS_ALLOW_LIST>", tokens.AtlantisAllowList, -1)
-				newContents = strings.Replace(newContents, "<ATLANTIS_INGRESS_URL>", tokens.AtlantisIngressURL, -1)
-				newContents = strings.Replace(newContents, "<CLUSTER_NAME>", tokens.ClusterName, -1)
-				newContents = strings.Replace(newContents, "<CLOUD_PROVIDER>", tokens.CloudProvider, -1)
-				newContents = strings.Replace(newContents, "<CLUSTER_ID>", tokens.ClusterId, -1)
-				newContents = strings.Replace(newContents, "<CLUSTER_TYPE>", tokens.ClusterType, -1)
-				newContents = strings.Replace(newContents, "<DOMAIN_NAME>", DomainName, -1)
-				newContents = strings.Replace(newContents, "<KUBEFIRST_TEAM>", tokens.KubefirstTeam, -1)
-				newContents = strings.Replace(newContents, "<KUBEFIRST_VERSION>", configs.K1Version, -1)
-				newContents = strings.Replace(newContents, "<KUBE_CONFIG_PATH>", tokens.KubeconfigPath, -1)
-				newContents = strings.Replace(newContents, "<METAPHOR_DEVELOPMENT_INGRESS_URL>", tokens.MetaphorDevelopmentIngressURL, -1)
-				newContents = strings.Replace(newContents, "<METAPHOR_STAGING_INGRESS_URL>", tokens.MetaphorStagingIngressURL, -1)
-				newContents = strings.Replace(newContents, "<METAPHOR_PRODUCTION_INGRESS_URL>", tokens.MetaphorProductionIngressURL, -1)
-				newContents = strings.Replace(newContents, "<GITHUB_HOST>", tokens.GithubHost, -1)
-				newContents = strings.Replace(newContents, "<GITHUB_OWNER>", strings.ToLower(tokens.GithubOwner), -1)
-				newContents = strings.Replace(newContents, "<GITHUB_USER>", tokens.GithubUser, -1)
-				newContents = strings.Replace(newContents, "<GIT_PROVIDER>", tokens.GitProvider, -1)
-				newContents = strings.Replace(newContents, "<GIT-PROTOCOL>", gitProtocol, -1)
-				newContents = strings.Replace(newContents, "<GITLAB_HOST>", tokens.GitlabHost, -1)
-				newContents = strings.Replace(newContents, "<GITLAB_OWNER>", tokens.GitlabOwner, -1)
-				newContents = strings.Replace(newContents, "<GITLAB_USER>", tokens.GitlabUser, -1)
-				newContents = strings.Replace(newContents, "<GITLAB_OWNER_GROUP_ID>", strconv.Itoa(tokens.GitlabOwnerGroupID), -1)
-				newContents = strings.Replace(newContents, "<VAULT_INGRESS_URL>", tokens.VaultIngressURL, -1)
-				newContents = strings.Replace(newContents, "<USE_TELEMETRY>", tokens.UseTelemetry, -1)
-				newContents = strings.Replace(newContents, "<K3D_DOMAIN>", DomainName, -1)
-
-				newContents = strings.Replace(newContents, "<GITOPS_REPO_URL>", tokens.GitopsRepoURL, -1)
-
-				// Switch the repo url based on https flag
-				if gitProtocol == "https" {
-					newContents = strings.Replace(newContents, "<GIT_FQDN>", fmt.Sprintf("https://%v.com/", tokens.GitProvider), -1)
-				} else {
-					newContents = strings.Replace(newContents, "<GIT_FQDN>", fmt.Sprintf("git@%v.com:", tokens.GitProvider), -1)
-				}
+// detokenizeDir - apply replace to every file under dir, ignoring .git, see detokenizePath
+func detokenizeDir(dir string, replace func(string) string) error {
+	paths, err := detokenizePaths(dir)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		err = detokenizePath(path, replace)
+		if err != nil {
+			return fmt.Errorf("error detokenizing %s: %s", path, err)
+		}
+	}
+	return nil
+}
 
-				err = ioutil.WriteFile(path, []byte(newContents), 0)
-				if err != nil {
-					return err
-				}
+// detokenizePaths lists the regular files under dir the detokenizers rewrite, skipping .git
+func detokenizePaths(dir string) ([]string, error) {
+	paths := []string{}
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if fi.Name() == ".git" {
+				return filepath.SkipDir
 			}
+			return nil
+		}
+		if fi.Mode().IsRegular() {
+			paths = append(paths, path)
 		}
 		return nil
 	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing files to detokenize in %s: %s", dir, err)
+	}
+	return paths, nil
 }
 
-// postRunDetokenizeGitGitops - Translate tokens by values on a given path
-func postRunDetokenizeGitGitops(path string, tokens *GitopsDirectoryValues) error {
+// detokenizePath applies replace to the file at path once a leading byte order mark is stripped,
+// see rewriteFile
+func detokenizePath(path string, replace func(string) string) error {
+	return rewriteFile(path, func(content string) string { return replace(stripBOM(content)) })
+}
+
+// detokenizeFile - apply replacements to a single file, leaving it untouched when no token is found
+func detokenizeFile(path string, replacements []TokenReplacement) error {
+	return detokenizePath(path, literalReplacer(replacements))
+}
 
-	err := filepath.Walk(path, postRunDetokenizeGitops(path, tokens))
+// literalReplacer returns a function replacing every token of replacements, in order, by its value
+func literalReplacer(replacements []TokenReplacement) func(string) string {
+	return func(content string) string {
+		for _, r := range replacements {
+			content = strings.Replace(content, r.Token, r.Value, -1)
+		}
+		return content
+	}
+}
+
+// rewriteFile replaces the content of path with replace(content), keeping its mode and
+// leaving it untouched when nothing changed. A .json file must still parse once replaced, so
+// a value breaking the json, e.g. one containing a quote, fails instead of being written
+func rewriteFile(path string, replace func(string) string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	read, err := os.ReadFile(path)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	newContents := replace(string(read))
+	if newContents == string(read) {
+		return nil
+	}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		var parsed interface{}
+		if err := json.Unmarshal([]byte(newContents), &parsed); err != nil {
+			return fmt.Errorf("detokenized json in %s does not parse: %s", path, err)
+		}
+	}
+
+	return os.WriteFile(path, []byte(newContents), fi.Mode())
 }
 
-func postRunDetokenizeGitops(path string, tokens *GitopsDirectoryValues) filepath.WalkFunc {
-	return filepath.WalkFunc(func(path string, fi os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
+// Delimiters surround the tokens in the templates, e.g. << and >> to keep clear of helm's {{ }}
+type Delimiters struct {
+	Left  string
+	Right string
+}
 
-		if !!fi.IsDir() {
-			return nil
+// DefaultDelimiters are the delimiters of the <TOKEN> placeholders used by the kubefirst templates
+var DefaultDelimiters = Delimiters{Left: "<", Right: ">"}
+
+// replacer returns the function applying replacements to a file's content. The default delimiters
+// replace the tokens literally, other delimiters match Left, optional spaces, the token name or
+// the name of its field in fieldTokens (optionally prefixed with a dot), optional spaces and Right,
+// so both <<CLUSTER_NAME>> and << .ClusterName >> are replaced. Unknown tokens are left untouched
+func (d Delimiters) replacer(replacements []TokenReplacement, fieldTokens map[string]string) (func(string) string, error) {
+	if d == DefaultDelimiters {
+		return literalReplacer(replacements), nil
+	}
+	if d.Left == "" || d.Right == "" {
+		return nil, fmt.Errorf("invalid token delimiters %q and %q: both must be set", d.Left, d.Right)
+	}
+
+	pattern := regexp.MustCompile(regexp.QuoteMeta(d.Left) + `\s*\.?([A-Za-z0-9_-]+)\s*` + regexp.QuoteMeta(d.Right))
+	values := map[string]string{}
+	for _, r := range replacements {
+		values[strings.TrimSuffix(strings.TrimPrefix(r.Token, DefaultDelimiters.Left), DefaultDelimiters.Right)] = r.Value
+	}
+
+	return func(content string) string {
+		return pattern.ReplaceAllStringFunc(content, func(match string) string {
+			name := pattern.FindStringSubmatch(match)[1]
+			if token, ok := fieldTokens[name]; ok {
+				name = token
+			}
+			if value, ok := values[name]; ok {
+				return value
+			}
+			return match
+		})
+	}, nil
+}
+
+// maskTokenValue hides values of tokens that look like credentials
+func maskTokenValue(token string, value string) string {
+	name := strings.ToUpper(token)
+	for _, secret := range []string{"TOKEN", "PASSWORD", "SECRET", "KEY"} {
+		if strings.Contains(name, secret) {
+			return strings.Repeat("*", len(value))
 		}
+	}
+	return value
+}
 
-		// var matched bool
-		matched, _ := filepath.Match("*", fi.Name())
+// DetokenizeGitopsRepo replaces the gitops tokens in every file of the gitops repository,
+// spreading files over concurrency workers, GOMAXPROCS when concurrency is not positive
+// the first error stops the remaining work and is returned
+func DetokenizeGitopsRepo(gitopsRepoDir string, tokens *GitopsDirectoryValues, gitProtocol string, concurrency int) error {
+	return DetokenizeGitopsRepoWithDelimiters(gitopsRepoDir, tokens, gitProtocol, concurrency, DefaultDelimiters)
+}
 
-		if matched {
-			// ignore .git files
-			if !strings.Contains(path, "/.git/") {
-				read, err := ioutil.ReadFile(path)
-				if err != nil {
-					return err
-				}
+// DetokenizeGitopsRepoWithDelimiters is DetokenizeGitopsRepo for templates whose tokens are surrounded
+// by delims instead of DefaultDelimiters, see Delimiters.replacer for the accepted token forms
+func DetokenizeGitopsRepoWithDelimiters(gitopsRepoDir string, tokens *GitopsDirectoryValues, gitProtocol string, concurrency int, delims Delimiters) error {
+	replace, err := delims.replacer(gitopsTokenReplacements(tokens, gitProtocol), fieldTokenNames(reflect.TypeOf(*tokens)))
+	if err != nil {
+		return err
+	}
+	if concurrency <= 0 {
+		concurrency = runtime.GOMAXPROCS(0)
+	}
 
-				//change Minio post cluster launch to cluster svc address
-				newContents := string(read)
-				newContents = strings.Replace(newContents, fmt.Sprintf("https://minio.%s", DomainName), "http://minio.minio.svc.cluster.local:9000", -1)
-				err = ioutil.WriteFile(path, []byte(newContents), 0)
+	paths, err := detokenizePaths(gitopsRepoDir)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// each path is handed to exactly one worker so no two writes target the same file
+	work := make(chan string)
+	var firstErr error
+	var errOnce sync.Once
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range work {
+				err := detokenizePath(path, replace)
 				if err != nil {
-					return err
+					errOnce.Do(func() {
+						firstErr = fmt.Errorf("error detokenizing %s: %s", path, err)
+						cancel()
+					})
 				}
 			}
+		}()
+	}
+
+dispatch:
+	for _, path := range paths {
+		select {
+		case work <- path:
+		case <-ctx.Done():
+			break dispatch
 		}
-		return nil
-	})
+	}
+	close(work)
+	wg.Wait()
+
+	return firstErr
 }
 
-// detokenizeGitMetaphor - Translate tokens by values on a given path
-func detokenizeGitMetaphor(path string, tokens *MetaphorTokenValues) error {
+// postRunDetokenizeGitGitops - point the minio urls of the gitops repo at path to the in-cluster
+// minio service once the cluster is up
+func postRunDetokenizeGitGitops(path string, tokens *GitopsDirectoryValues) error {
+	return detokenizeDir(path, literalReplacer([]TokenReplacement{
+		{fmt.Sprintf("https://minio.%s", DomainName), "http://minio.minio.svc.cluster.local:9000"},
+	}))
+}
 
-	err := filepath.Walk(path, detokenize(path, tokens))
+// detokenizeGitMetaphor - Translate the metaphor tokens, surrounded by delims, of the files under path
+func detokenizeGitMetaphor(path string, tokens *MetaphorTokenValues, delims Delimiters) error {
+	replace, err := delims.replacer(metaphorTokenReplacements(tokens), fieldTokenNames(reflect.TypeOf(*tokens)))
 	if err != nil {
 		return err
 	}
-
-	return nil
+	return detokenizeDir(path, replace)
 }
 
-func detokenize(metaphorDir string, tokens *MetaphorTokenValues) filepath.WalkFunc {
-	return filepath.WalkFunc(func(path string, fi os.FileInfo, err error) error {
+// templateToken matches the <TOKEN> placeholders used in the templates
+var templateToken = regexp.MustCompile(`<([A-Z0-9_-]+)>`)
+
+// CheckTemplateCoverage compares the tokens found in the files under templateDir with the fields of
+// the values struct, returning tokens without a matching field and fields never referenced by a token
+// a field matches the token named by its `token` tag, or its name in upper snake case,
+// e.g. ArgocdIngressURL matches <ARGOCD_INGRESS_URL>
+func CheckTemplateCoverage(templateDir string, values interface{}) (missingTokens, unusedFields []string, err error) {
+	v := reflect.ValueOf(values)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil, nil, fmt.Errorf("values must be a struct or pointer to struct, got %T", values)
+	}
+
+	fieldTokens := map[string]string{}
+	for field, token := range fieldTokenNames(v.Type()) {
+		fieldTokens[token] = field
+	}
+
+	found := map[string]bool{}
+	err = filepath.Walk(templateDir, func(path string, fi os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-
-		if !!fi.IsDir() {
+		if fi.IsDir() {
+			if fi.Name() == ".git" {
+				return filepath.SkipDir
+			}
 			return nil
 		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		for _, match := range templateToken.FindAllStringSubmatch(string(content), -1) {
+			found[match[1]] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("error scanning templates in %s: %s", templateDir, err)
+	}
 
-		// var matched bool
-		matched, _ := filepath.Match("*", fi.Name())
+	missingTokens = []string{}
+	for token := range found {
+		if _, ok := fieldTokens[token]; !ok {
+			missingTokens = append(missingTokens, token)
+		}
+	}
+	unusedFields = []string{}
+	for token, field := range fieldTokens {
+		if !found[token] {
+			unusedFields = append(unusedFields, field)
+		}
+	}
+	sort.Strings(missingTokens)
+	sort.Strings(unusedFields)
 
-		if matched {
-			// ignore .git files
-			if !strings.Contains(path, "/.git/") {
-				read, err := ioutil.ReadFile(path)
-				if err != nil {
-					return err
-				}
+	return missingTokens, unusedFields, nil
+}
 
-				// todo reduce to terraform tokens by moving to helm chart?
-				newContents := string(read)
-				newContents = strings.Replace(newContents, "<METAPHOR_DEVELOPMENT_INGRESS_URL>", tokens.MetaphorDevelopmentIngressURL, -1)
-				newContents = strings.Replace(newContents, "<METAPHOR_STAGING_INGRESS_URL>", tokens.MetaphorStagingIngressURL, -1)
-				newContents = strings.Replace(newContents, "<METAPHOR_PRODUCTION_INGRESS_URL>", tokens.MetaphorProductionIngressURL, -1)
-				newContents = strings.Replace(newContents, "<CONTAINER_REGISTRY_URL>", tokens.ContainerRegistryURL, -1) // todo need to fix metaphor repo names
-				newContents = strings.Replace(newContents, "<DOMAIN_NAME>", tokens.DomainName, -1)
-				newContents = strings.Replace(newContents, "<CLOUD_REGION>", tokens.CloudRegion, -1)
-				newContents = strings.Replace(newContents, "<CLUSTER_NAME>", tokens.ClusterName, -1)
-
-				err = ioutil.WriteFile(path, []byte(newContents), 0)
-				if err != nil {
-					return err
-				}
+// fieldTokenNames maps the field names of the struct type t to the token each is replaced by, the
+// token named by its `token` tag or its name in upper snake case
+func fieldTokenNames(t reflect.Type) map[string]string {
+	tokens := map[string]string{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		token := field.Tag.Get("token")
+		if token == "" {
+			token = tokenName(field.Name)
+		}
+		tokens[field.Name] = token
+	}
+	return tokens
+}
+
+// tokenName converts a Go field name to its upper snake case token, keeping acronyms together
+func tokenName(fieldName string) string {
+	runes := []rune(fieldName)
+	var b strings.Builder
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				b.WriteRune('_')
 			}
 		}
-		return nil
-	})
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
 }
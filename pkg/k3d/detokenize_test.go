@@ -0,0 +1,466 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDetokenizationPlan(t *testing.T) {
+
+	dir := t.TempDir()
+	writeFixture(t, dir, map[string]string{
+		"app/ingress.yaml":     "host: <METAPHOR_STAGING_INGRESS_URL>\ncluster: <CLUSTER_NAME>\n",
+		"app/readme.md":        "nothing to see here\n",
+		"ci/registry.yaml":     "image: <CONTAINER_REGISTRY_URL>/metaphor\n",
+		".git/config":          "<CLUSTER_NAME>\n",
+		"secrets/auth.yaml":    "token: <GIT_TOKEN>\n",
+		"registry/gitops.yaml": "repoURL: <GIT_FQDN>kubefirst/gitops.git\n",
+	})
+	// links are left alone by the detokenizers, so the plan skips them too
+	if err := os.Symlink(filepath.Join(dir, "app", "ingress.yaml"), filepath.Join(dir, "app", "link.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	gitopsValues := &GitopsDirectoryValues{GitProvider: "github", GithubHost: GithubHost, GitopsRepoURL: "https://github.com/kubefirst/gitops"}
+
+	tests := []struct {
+		name        string
+		values      interface{}
+		gitProtocol string
+		want        []FileChange
+	}{
+		{
+			name: "metaphor values",
+			values: &MetaphorTokenValues{
+				ClusterName:               "kubefirst",
+				ContainerRegistryURL:      "ghcr.io/kubefirst",
+				MetaphorStagingIngressURL: "https://metaphor-staging.kubefirst.dev",
+			},
+			want: []FileChange{
+				{
+					Path: "app/ingress.yaml",
+					Replacements: []TokenReplacement{
+						{"<METAPHOR_STAGING_INGRESS_URL>", "https://metaphor-staging.kubefirst.dev"},
+						{"<CLUSTER_NAME>", "kubefirst"},
+					},
+				},
+				{
+					Path:         "ci/registry.yaml",
+					Replacements: []TokenReplacement{{"<CONTAINER_REGISTRY_URL>", "ghcr.io/kubefirst"}},
+				},
+			},
+		},
+		{
+			name:        "gitops values over ssh",
+			values:      gitopsValues,
+			gitProtocol: "ssh",
+			want: []FileChange{
+				{Path: "app/ingress.yaml", Replacements: []TokenReplacement{{"<CLUSTER_NAME>", ""}, {"<METAPHOR_STAGING_INGRESS_URL>", ""}}},
+				{Path: "registry/gitops.yaml", Replacements: []TokenReplacement{{"<GIT_FQDN>", "git@github.com:"}}},
+			},
+		},
+		{
+			name:        "gitops values over https",
+			values:      gitopsValues,
+			gitProtocol: "https",
+			want: []FileChange{
+				{Path: "app/ingress.yaml", Replacements: []TokenReplacement{{"<CLUSTER_NAME>", ""}, {"<METAPHOR_STAGING_INGRESS_URL>", ""}}},
+				{Path: "registry/gitops.yaml", Replacements: []TokenReplacement{{"<GIT_FQDN>", "https://github.com/"}}},
+			},
+		},
+		{
+			name:   "secret values are masked",
+			values: map[string]string{"<GIT_TOKEN>": "ghp_abc123"},
+			want: []FileChange{
+				{
+					Path:         "secrets/auth.yaml",
+					Replacements: []TokenReplacement{{"<GIT_TOKEN>", "**********"}},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DetokenizationPlan(dir, tt.values, tt.gitProtocol)
+			if err != nil {
+				t.Fatalf("DetokenizationPlan() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DetokenizationPlan() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	content, _ := os.ReadFile(filepath.Join(dir, "app/ingress.yaml"))
+	if string(content) != "host: <METAPHOR_STAGING_INGRESS_URL>\ncluster: <CLUSTER_NAME>\n" {
+		t.Errorf("DetokenizationPlan() modified app/ingress.yaml: %q", content)
+	}
+
+	if _, err := DetokenizationPlan(dir, "unsupported", "https"); err == nil {
+		t.Error("DetokenizationPlan() expected error for unsupported values type")
+	}
+}
+
+// newTokenizedGitopsRepo writes count tokenized files into a new gitops directory
+func newTokenizedGitopsRepo(tb testing.TB, count int) string {
+	tb.Helper()
+
+	dir := tb.TempDir()
+	for i := 0; i < count; i++ {
+		path := filepath.Join(dir, "registry", fmt.Sprintf("app-%d", i%10), fmt.Sprintf("manifest-%d.yaml", i))
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			tb.Fatal(err)
+		}
+		content := fmt.Sprintf("name: app-%d\ncluster: <CLUSTER_NAME>\nhost: <ARGOCD_INGRESS_URL>\n", i)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestDetokenizeGitopsRepo(t *testing.T) {
+
+	tokens := &GitopsDirectoryValues{ClusterName: "kubefirst", ArgocdIngressURL: ArgocdURL}
+
+	for _, concurrency := range []int{0, 1, 16} {
+		t.Run(fmt.Sprintf("concurrency %d", concurrency), func(t *testing.T) {
+			dir := newTokenizedGitopsRepo(t, 200)
+			writeFixture(t, dir, map[string]string{".git/config": "<CLUSTER_NAME>\n"})
+
+			err := DetokenizeGitopsRepo(dir, tokens, "https", concurrency)
+			if err != nil {
+				t.Fatalf("DetokenizeGitopsRepo() error = %v", err)
+			}
+
+			for i := 0; i < 200; i++ {
+				path := filepath.Join(dir, "registry", fmt.Sprintf("app-%d", i%10), fmt.Sprintf("manifest-%d.yaml", i))
+				got, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := fmt.Sprintf("name: app-%d\ncluster: kubefirst\nhost: %s\n", i, ArgocdURL)
+				if string(got) != want {
+					t.Fatalf("%s = %q, want %q", path, got, want)
+				}
+			}
+			gitConfig, _ := os.ReadFile(filepath.Join(dir, ".git", "config"))
+			if string(gitConfig) != "<CLUSTER_NAME>\n" {
+				t.Errorf(".git/config was detokenized: %q", gitConfig)
+			}
+		})
+	}
+}
+
+func TestDetokenizeGitopsRepoStripsBOM(t *testing.T) {
+
+	dir := t.TempDir()
+	binary := "\xef\xbb\xbf\x00<CLUSTER_NAME>"
+	writeFixture(t, dir, map[string]string{
+		"registry/kubefirst/values.yaml": "\xef\xbb\xbfcluster: <CLUSTER_NAME>\nreplicas: 1\n",
+		"registry/kubefirst/plain.yaml":  "replicas: 1\n",
+		"registry/kubefirst/image.bin":   binary,
+	})
+
+	err := DetokenizeGitopsRepo(dir, &GitopsDirectoryValues{ClusterName: "kubefirst"}, "https", 1)
+	if err != nil {
+		t.Fatalf("DetokenizeGitopsRepo() error = %v", err)
+	}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "registry/kubefirst/values.yaml", want: "cluster: kubefirst\nreplicas: 1\n"},
+		{path: "registry/kubefirst/plain.yaml", want: "replicas: 1\n"},
+		{path: "registry/kubefirst/image.bin", want: "\xef\xbb\xbf\x00kubefirst"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := os.ReadFile(filepath.Join(dir, tt.path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("DetokenizeGitopsRepo() %s = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetokenizeGitopsRepoJSON(t *testing.T) {
+
+	template := "{\n  \"cluster\": \"<CLUSTER_NAME>\",\n  \"groupId\": <GITLAB_OWNER_GROUP_ID>\n}\n"
+
+	tests := []struct {
+		name        string
+		clusterName string
+		want        string
+		wantErr     bool
+	}{
+		{
+			name:        "tokens replaced",
+			clusterName: "kubefirst",
+			want:        "{\n  \"cluster\": \"kubefirst\",\n  \"groupId\": 42\n}\n",
+		},
+		{
+			name:        "replacement breaking the json",
+			clusterName: `kube"first`,
+			want:        template,
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFixture(t, dir, map[string]string{"registry/kubefirst/components/console/config.json": template})
+			tokens := &GitopsDirectoryValues{ClusterName: tt.clusterName, GitlabOwnerGroupID: 42}
+
+			err := DetokenizeGitopsRepo(dir, tokens, "https", 1)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DetokenizeGitopsRepo() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && !strings.Contains(err.Error(), "config.json does not parse") {
+				t.Errorf("DetokenizeGitopsRepo() error = %v, want the invalid json file named", err)
+			}
+
+			got, err := os.ReadFile(filepath.Join(dir, "registry", "kubefirst", "components", "console", "config.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("config.json = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetokenizeGitopsRepoWithDelimiters(t *testing.T) {
+
+	tokens := &GitopsDirectoryValues{ClusterName: "kubefirst", ArgocdIngressURL: ArgocdURL, KubeconfigPath: "/home/k1/kubeconfig"}
+	template := `cluster: << .ClusterName >>
+argocd: <<ARGOCD_INGRESS_URL>>
+kubeconfig: <<.KubeconfigPath>>
+domain: << DOMAIN_NAME >>
+legacy: <CLUSTER_NAME>
+unknown: << .NotAField >>
+helm: {{ .Values.clusterName }}
+`
+
+	tests := []struct {
+		name    string
+		delims  Delimiters
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "custom delimiters",
+			delims: Delimiters{Left: "<<", Right: ">>"},
+			want: fmt.Sprintf(`cluster: kubefirst
+argocd: %s
+kubeconfig: /home/k1/kubeconfig
+domain: %s
+legacy: <CLUSTER_NAME>
+unknown: << .NotAField >>
+helm: {{ .Values.clusterName }}
+`, ArgocdURL, DomainName),
+		},
+		{
+			name:   "default delimiters",
+			delims: DefaultDelimiters,
+			// only the exact <TOKEN> form is replaced, including inside <<TOKEN>>
+			want: strings.NewReplacer("<ARGOCD_INGRESS_URL>", ArgocdURL, "<CLUSTER_NAME>", "kubefirst").Replace(template),
+		},
+		{name: "missing right delimiter", delims: Delimiters{Left: "<<"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFixture(t, dir, map[string]string{"registry/kubefirst/argocd.yaml": template})
+
+			err := DetokenizeGitopsRepoWithDelimiters(dir, tokens, "https", 1, tt.delims)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DetokenizeGitopsRepoWithDelimiters() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got, err := os.ReadFile(filepath.Join(dir, "registry", "kubefirst", "argocd.yaml"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("detokenized = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func BenchmarkDetokenizeGitopsRepo(b *testing.B) {
+
+	tokens := &GitopsDirectoryValues{ClusterName: "kubefirst", ArgocdIngressURL: ArgocdURL}
+	for _, concurrency := range []int{1, 4, 0} {
+		b.Run(fmt.Sprintf("concurrency %d", concurrency), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				dir := newTokenizedGitopsRepo(b, 500)
+				b.StartTimer()
+
+				if err := DetokenizeGitopsRepo(dir, tokens, "https", concurrency); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestTokenName(t *testing.T) {
+
+	tests := []struct {
+		field string
+		want  string
+	}{
+		{field: "ArgocdIngressURL", want: "ARGOCD_INGRESS_URL"},
+		{field: "ArgoWorkflowsIngressURL", want: "ARGO_WORKFLOWS_INGRESS_URL"},
+		{field: "GitlabOwnerGroupID", want: "GITLAB_OWNER_GROUP_ID"},
+		{field: "ClusterId", want: "CLUSTER_ID"},
+		{field: "GitopsRepoHttpsURL", want: "GITOPS_REPO_HTTPS_URL"},
+		{field: "K3dDomain", want: "K3D_DOMAIN"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.field, func(t *testing.T) {
+			if got := tokenName(tt.field); got != tt.want {
+				t.Errorf("tokenName() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckTemplateCoverage(t *testing.T) {
+
+	dir := t.TempDir()
+	writeFixture(t, dir, map[string]string{
+		"registry/argocd.yaml":  "host: <ARGOCD_INGRESS_URL>\ncluster: <CLUSTER_NAME>\n",
+		"terraform/vault.tf":    "path = \"<KUBE_CONFIG_PATH>\"\nregion = \"<CLOUD_REGION>\"\n",
+		"terraform/unknown.tf":  "value = \"<NOT_A_FIELD>\"\n<html>\n",
+		".git/COMMIT_EDITMSG":   "<GIT_ONLY_TOKEN>\n",
+		"registry/metaphor.yml": "host: <ARGOCD_INGRESS_URL>\n",
+	})
+
+	values := &struct {
+		ArgocdIngressURL string
+		ClusterName      string
+		KubeconfigPath   string `token:"KUBE_CONFIG_PATH"`
+		VaultIngressURL  string
+		GitlabOwnerID    int
+	}{}
+
+	missing, unused, err := CheckTemplateCoverage(dir, values)
+	if err != nil {
+		t.Fatalf("CheckTemplateCoverage() error = %v", err)
+	}
+	if want := []string{"CLOUD_REGION", "NOT_A_FIELD"}; !reflect.DeepEqual(missing, want) {
+		t.Errorf("CheckTemplateCoverage() missingTokens = %v, want %v", missing, want)
+	}
+	if want := []string{"GitlabOwnerID", "VaultIngressURL"}; !reflect.DeepEqual(unused, want) {
+		t.Errorf("CheckTemplateCoverage() unusedFields = %v, want %v", unused, want)
+	}
+
+	if _, _, err := CheckTemplateCoverage(dir, "not a struct"); err == nil {
+		t.Error("CheckTemplateCoverage() expected an error for non struct values")
+	}
+}
+
+func TestDetokenizeGitMetaphor(t *testing.T) {
+
+	tokens := &MetaphorTokenValues{ClusterName: "kubefirst", MetaphorStagingIngressURL: "https://metaphor-staging.kubefirst.dev"}
+
+	tests := []struct {
+		name    string
+		delims  Delimiters
+		files   map[string]string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name:   "default delimiters",
+			delims: DefaultDelimiters,
+			files: map[string]string{
+				"chart/values.yaml": "\ufeffcluster: <CLUSTER_NAME>\n",
+				".git/config":       "<CLUSTER_NAME>\n",
+			},
+			want: map[string]string{
+				"chart/values.yaml": "cluster: kubefirst\n",
+				".git/config":       "<CLUSTER_NAME>\n",
+			},
+		},
+		{
+			name:   "custom delimiters",
+			delims: Delimiters{Left: "<<", Right: ">>"},
+			files:  map[string]string{"chart/values.yaml": "cluster: << .ClusterName >>\nhost: <<METAPHOR_STAGING_INGRESS_URL>>\n"},
+			want:   map[string]string{"chart/values.yaml": "cluster: kubefirst\nhost: https://metaphor-staging.kubefirst.dev\n"},
+		},
+		{
+			name:    "json broken by a value",
+			delims:  DefaultDelimiters,
+			files:   map[string]string{"package.json": `{"name": <CLUSTER_NAME>}`},
+			want:    map[string]string{"package.json": `{"name": <CLUSTER_NAME>}`},
+			wantErr: "does not parse",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFixture(t, dir, tt.files)
+
+			err := detokenizeGitMetaphor(dir, tokens, tt.delims)
+			if (err != nil) != (tt.wantErr != "") || (err != nil && !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("detokenizeGitMetaphor() error = %v, wantErr %q", err, tt.wantErr)
+			}
+			for path, want := range tt.want {
+				got, err := os.ReadFile(filepath.Join(dir, path))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != want {
+					t.Errorf("%s = %q, want %q", path, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPostRunDetokenizeGitGitops(t *testing.T) {
+
+	dir := t.TempDir()
+	writeFixture(t, dir, map[string]string{
+		"registry/kubefirst/minio.yaml": "\ufeffendpoint: https://minio." + DomainName + "\n",
+		".git/config":                   "url = https://minio." + DomainName + "\n",
+	})
+
+	err := postRunDetokenizeGitGitops(dir, &GitopsDirectoryValues{})
+	if err != nil {
+		t.Fatalf("postRunDetokenizeGitGitops() error = %v", err)
+	}
+	for path, want := range map[string]string{
+		"registry/kubefirst/minio.yaml": "endpoint: http://minio.minio.svc.cluster.local:9000\n",
+		".git/config":                   "url = https://minio." + DomainName + "\n",
+	} {
+		got, err := os.ReadFile(filepath.Join(dir, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s = %q, want %q", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+const (
+	// diagnosticsLogFiles is the number of most recent log files added to a diagnostics bundle
+	diagnosticsLogFiles = 3
+	// diagnosticsLogBytes is the size of the tail kept of each log file
+	diagnosticsLogBytes = 1 << 20
+)
+
+// scrubSecrets removes the known secret values and anything secretDetectors match from content
+func scrubSecrets(content []byte, knownSecrets []string) []byte {
+	for _, secret := range knownSecrets {
+		if secret != "" {
+			content = bytes.ReplaceAll(content, []byte(secret), []byte(redacted))
+		}
+	}
+	for _, detector := range secretDetectors {
+		replacement := detector.replacement
+		if replacement == "" {
+			replacement = redacted
+		}
+		content = detector.pattern.ReplaceAll(content, []byte(replacement))
+	}
+	return content
+}
+
+// CollectDiagnostics writes a gzipped tarball to destPath for sharing when reporting a failed install,
+// holding the k3d config, the kubefirst config, the adjust result, the installed tool versions and the
+// tail of the most recent logs. Tokens, passwords and keys are scrubbed from every file
+func CollectDiagnostics(cfg *K3dConfig, destPath string) error {
+	knownSecrets := []string{cfg.GithubToken, cfg.GitlabToken}
+	files := map[string][]byte{}
+
+	safeCfg := *cfg
+	safeCfg.GithubToken, safeCfg.GitlabToken = "", ""
+	content, err := json.MarshalIndent(safeCfg, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling config for diagnostics: %s", err)
+	}
+	files["config.json"] = content
+
+	if content, err := os.ReadFile(cfg.KubefirstConfig); err == nil {
+		files["kubefirst.yaml"] = content
+	} else {
+		log.Warn().Msgf("kubefirst config not added to diagnostics: %s", err)
+	}
+
+	if result, err := GetAdjustResult(cfg.GitopsDir, cfg.ClusterName); err == nil {
+		content, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return fmt.Errorf("error marshalling adjust result for diagnostics: %s", err)
+		}
+		files["adjust-result.json"] = content
+	} else {
+		files["adjust-result.json"] = []byte(fmt.Sprintf("{\"error\": %q}\n", err.Error()))
+	}
+
+	files["tool-versions.txt"] = diagnosticsToolVersions(cfg)
+
+	for name, content := range recentLogs(viper.GetString("k1-paths.log-file")) {
+		files["logs/"+name] = content
+	}
+
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, name := range names {
+		content := scrubSecrets(files[name], knownSecrets)
+		err = tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(content)), ModTime: time.Now(), Typeflag: tar.TypeReg})
+		if err == nil {
+			_, err = tw.Write(content)
+		}
+		if err != nil {
+			return fmt.Errorf("error adding %s to diagnostics: %s", name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("error closing diagnostics archive: %s", err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("error closing diagnostics archive: %s", err)
+	}
+
+	err = os.WriteFile(destPath, buf.Bytes(), 0600)
+	if err != nil {
+		return fmt.Errorf("error writing diagnostics %s: %s", destPath, err)
+	}
+	log.Info().Str("path", destPath).Msg("diagnostics collected")
+	return nil
+}
+
+// diagnosticsToolVersions lists the installed version of each tool next to its pinned version
+func diagnosticsToolVersions(cfg *K3dConfig) []byte {
+	var b strings.Builder
+	b.WriteString("# pinned\n")
+	b.WriteString(toolsManifest())
+	b.WriteString("# installed\n")
+	for _, tool := range toolClients(cfg) {
+		version, err := InstalledToolVersion(tool)
+		if err != nil {
+			version = fmt.Sprintf("unavailable: %s", err)
+		}
+		fmt.Fprintf(&b, "%s=%s\n", filepath.Base(tool), version)
+	}
+	return []byte(b.String())
+}
+
+// recentLogs returns the tail of the most recently modified .log files in the directory of logFile
+func recentLogs(logFile string) map[string][]byte {
+	logs := map[string][]byte{}
+	if logFile == "" {
+		log.Warn().Msg("no log file configured, logs not added to diagnostics")
+		return logs
+	}
+
+	paths, err := filepath.Glob(filepath.Join(filepath.Dir(logFile), "*.log"))
+	if err != nil {
+		return logs
+	}
+	modTimes := map[string]time.Time{}
+	for _, path := range paths {
+		if fi, err := os.Stat(path); err == nil {
+			modTimes[path] = fi.ModTime()
+		}
+	}
+	sort.Slice(paths, func(i, j int) bool { return modTimes[paths[i]].After(modTimes[paths[j]]) })
+
+	for i, path := range paths {
+		if i == diagnosticsLogFiles {
+			break
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			log.Warn().Msgf("log %s not added to diagnostics: %s", path, err)
+			continue
+		}
+		if len(content) > diagnosticsLogBytes {
+			content = content[len(content)-diagnosticsLogBytes:]
+		}
+		logs[filepath.Base(path)] = content
+	}
+	return logs
+}
@@ -0,0 +1,76 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// hostResolver is satisfied by *net.Resolver
+type hostResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// ingressResolver is the resolver used to validate ingress hostnames
+var ingressResolver hostResolver = net.DefaultResolver
+
+// IngressHosts returns the fully qualified ingress hostnames required under domainName
+func IngressHosts(domainName string) []string {
+	hosts := make([]string, 0, len(ingressServices))
+	for _, service := range ingressServices {
+		hosts = append(hosts, fmt.Sprintf("%s.%s", service.subdomain, domainName))
+	}
+	return hosts
+}
+
+// ValidateIngressDNS checks each ingress host resolves under domainName, defaulting to IngressHosts
+// hosts not qualified with domainName are resolved as subdomains of it
+// for the local k3d domain, hosts resolving to a non-loopback address are reported as a warning
+func ValidateIngressDNS(domainName string, hosts []string) error {
+	if len(hosts) == 0 {
+		hosts = IngressHosts(domainName)
+	}
+
+	unresolved := []string{}
+	for _, host := range hosts {
+		fqdn := host
+		if fqdn != domainName && !strings.HasSuffix(fqdn, "."+domainName) {
+			fqdn = fmt.Sprintf("%s.%s", host, domainName)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		addresses, err := ingressResolver.LookupHost(ctx, fqdn)
+		cancel()
+		if err != nil || len(addresses) == 0 {
+			log.Error().Msgf("ingress host %s does not resolve: %v", fqdn, err)
+			unresolved = append(unresolved, fqdn)
+			continue
+		}
+
+		if domainName != DomainName {
+			continue
+		}
+		for _, address := range addresses {
+			ip := net.ParseIP(address)
+			if ip == nil || !ip.IsLoopback() {
+				log.Warn().Msgf("ingress host %s resolves to %s, expected a loopback address for local k3d", fqdn, address)
+			}
+		}
+	}
+
+	if len(unresolved) > 0 {
+		return fmt.Errorf("the following ingress hosts do not resolve under %s: %s", domainName, strings.Join(unresolved, ", "))
+	}
+
+	return nil
+}
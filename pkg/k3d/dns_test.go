@@ -0,0 +1,77 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// stubResolver resolves hosts from a fixed table
+type stubResolver map[string][]string
+
+func (r stubResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	addresses, ok := r[host]
+	if !ok {
+		return nil, fmt.Errorf("lookup %s: no such host", host)
+	}
+	return addresses, nil
+}
+
+func TestValidateIngressDNS(t *testing.T) {
+
+	defaultResolver := ingressResolver
+	defer func() { ingressResolver = defaultResolver }()
+	ingressResolver = stubResolver{
+		"argocd.kubefirst.dev":    {"127.0.0.1"},
+		"vault.kubefirst.dev":     {"127.0.0.1"},
+		"argocd.example.com":      {"203.0.113.10"},
+		"kubefirst.kubefirst.dev": {"::1"},
+	}
+
+	tests := []struct {
+		name       string
+		domainName string
+		hosts      []string
+		wantErr    bool
+	}{
+		{name: "all resolve locally", domainName: "kubefirst.dev", hosts: []string{"argocd", "vault.kubefirst.dev", "kubefirst"}},
+		{name: "public domain", domainName: "example.com", hosts: []string{"argocd"}},
+		{name: "host does not resolve", domainName: "kubefirst.dev", hosts: []string{"argocd", "atlantis"}, wantErr: true},
+		{name: "default ingress hosts", domainName: "kubefirst.dev", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateIngressDNS(tt.domainName, tt.hosts)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateIngressDNS() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestIngressHosts(t *testing.T) {
+
+	want := []string{
+		"argocd.example.com",
+		"vault.example.com",
+		"argo.example.com",
+		"atlantis.example.com",
+		"chartmuseum.example.com",
+		"kubefirst.example.com",
+		"minio.example.com",
+		"minio-console.example.com",
+		"metaphor-development.example.com",
+		"metaphor-staging.example.com",
+		"metaphor-production.example.com",
+	}
+	if got := IngressHosts("example.com"); !reflect.DeepEqual(got, want) {
+		t.Errorf("IngressHosts() = %v, want %v", got, want)
+	}
+}
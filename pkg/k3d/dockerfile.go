@@ -0,0 +1,44 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/rs/zerolog/log"
+)
+
+// LintDockerfile parses the Dockerfile at path with the buildkit parser and checks every instruction
+// and its arguments, reporting syntax errors without building anything
+func LintDockerfile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening dockerfile %s: %s", path, err)
+	}
+	defer f.Close()
+
+	result, err := parser.Parse(f)
+	if err != nil {
+		return fmt.Errorf("error parsing dockerfile %s: %s", path, err)
+	}
+	for _, warning := range result.Warnings {
+		log.Warn().Str("path", path).Int("line", warning.Location.Start.Line).Msg(warning.Short)
+	}
+
+	stages, _, err := instructions.Parse(result.AST)
+	if err != nil {
+		return fmt.Errorf("invalid dockerfile %s: %s", path, err)
+	}
+	if len(stages) == 0 {
+		return fmt.Errorf("invalid dockerfile %s: no FROM instruction", path)
+	}
+
+	return nil
+}
@@ -0,0 +1,59 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLintDockerfile(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		dockerfile string
+		wantErr    string
+	}{
+		{
+			name: "valid multi stage",
+			dockerfile: `FROM node:18-alpine AS build
+WORKDIR /app
+COPY package*.json ./
+RUN npm ci \
+    && npm run build
+
+FROM nginx:1.23-alpine
+COPY --from=build /app/dist /usr/share/nginx/html
+EXPOSE 80
+CMD ["nginx", "-g", "daemon off;"]
+`,
+		},
+		{name: "unknown instruction", dockerfile: "FROM alpine:3.17\nRUNN echo hello\n", wantErr: "unknown instruction"},
+		{name: "missing arguments", dockerfile: "FROM alpine:3.17\nCOPY\n", wantErr: "COPY requires at least two arguments"},
+		{name: "instruction before from", dockerfile: "RUN echo hello\nFROM alpine:3.17\n", wantErr: "no build stage"},
+		{name: "no from", dockerfile: "# only a comment\n", wantErr: "file with no instructions"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFixture(t, dir, map[string]string{"Dockerfile": tt.dockerfile})
+
+			err := LintDockerfile(filepath.Join(dir, "Dockerfile"))
+			if (err != nil) != (tt.wantErr != "") {
+				t.Fatalf("LintDockerfile() error = %v, wantErr %q", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("LintDockerfile() error = %q, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	if err := LintDockerfile(filepath.Join(t.TempDir(), "Dockerfile")); err == nil {
+		t.Error("LintDockerfile() expected error for a missing dockerfile")
+	}
+}
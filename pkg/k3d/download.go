@@ -19,12 +19,17 @@ func DownloadTools(configName string, clusterName string, gitopsRepoName string,
 	config := GetConfig(configName, clusterName, gitopsRepoName, metaphorRepoName, gitProvider, gitOwner, gitProtocol)
 
 	if _, err := os.Stat(toolsDir); os.IsNotExist(err) {
-		err := os.MkdirAll(toolsDir, os.ModePerm)
+		err := os.MkdirAll(toolsDir, config.dirMode())
 		if err != nil {
 			log.Info().Msgf("%s directory already exists, continuing", toolsDir)
 		}
 	}
 
+	if toolsRestored(config) {
+		log.Info().Msgf("tools restored from archive in %s, skipping download", config.ToolsDir)
+		return nil
+	}
+
 	//* k3d
 	k3dDownloadUrl := fmt.Sprintf(
 		"https://github.com/k3d-io/k3d/releases/download/%s/k3d-%s-%s",
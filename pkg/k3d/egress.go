@@ -0,0 +1,147 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// EgressResult is the outcome of checking a single endpoint
+type EgressResult struct {
+	Endpoint  string
+	Reachable bool
+	Latency   time.Duration
+	Err       error
+}
+
+// defaultEgressEndpoints returns the endpoints an install needs to reach: the git host, the
+// container registry the kubefirst images are pulled from and the tool download hosts
+func defaultEgressEndpoints(gitHost string) []string {
+	endpoints := []string{fmt.Sprintf("https://%s", gitHost)}
+	for _, endpoint := range []string{
+		"https://github.com",
+		"https://ghcr.io",
+		"https://dl.k8s.io",
+		"https://releases.hashicorp.com",
+	} {
+		if endpoint != endpoints[0] {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints
+}
+
+// CheckEgress checks every endpoint can be reached within timeout, defaulting to cfg.EgressEndpoints.
+// Endpoints are either urls, checked with an https (or http) request where any response counts as
+// reachable, or host:port pairs, checked with a tcp connection. https endpoints are verified with
+// the provider client so a self-managed git host signed by cfg.CACertPath counts as reachable.
+// Results are returned in the order of endpoints and an error lists the unreachable ones
+func CheckEgress(cfg *K3dConfig, endpoints []string, timeout time.Duration) ([]EgressResult, error) {
+	if len(endpoints) == 0 {
+		endpoints = cfg.EgressEndpoints
+	}
+	httpClient, err := ProviderHttpClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	httpClient.Timeout = timeout
+	// a redirect means the host answered, following it would measure another host
+	httpClient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return checkEgress(httpClient, endpoints, timeout)
+}
+
+func checkEgress(httpClient *http.Client, endpoints []string, timeout time.Duration) ([]EgressResult, error) {
+	for _, endpoint := range endpoints {
+		if err := validateEgressEndpoint(endpoint); err != nil {
+			return nil, err
+		}
+	}
+
+	results := make([]EgressResult, len(endpoints))
+	var wg sync.WaitGroup
+	for i, endpoint := range endpoints {
+		wg.Add(1)
+		go func(i int, endpoint string) {
+			defer wg.Done()
+			results[i] = checkEgressEndpoint(httpClient, endpoint, timeout)
+		}(i, endpoint)
+	}
+	wg.Wait()
+
+	unreachable := []string{}
+	for _, result := range results {
+		if !result.Reachable {
+			log.Warn().Str("endpoint", result.Endpoint).Msgf("endpoint unreachable: %s", result.Err)
+			unreachable = append(unreachable, result.Endpoint)
+			continue
+		}
+		log.Info().Str("endpoint", result.Endpoint).Dur("latency", result.Latency).Msg("endpoint reachable")
+	}
+	if len(unreachable) > 0 {
+		return results, fmt.Errorf("unable to reach %s, check your network and proxy settings", strings.Join(unreachable, ", "))
+	}
+	return results, nil
+}
+
+// validateEgressEndpoint checks endpoint is an http(s) url or a host:port pair
+func validateEgressEndpoint(endpoint string) error {
+	if strings.Contains(endpoint, "://") {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return fmt.Errorf("invalid egress endpoint %q: %s", endpoint, err)
+		}
+		if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("invalid egress endpoint %q: expected an http or https url", endpoint)
+		}
+		return nil
+	}
+	_, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid egress endpoint %q: %s", endpoint, err)
+	}
+	return nil
+}
+
+func checkEgressEndpoint(httpClient *http.Client, endpoint string, timeout time.Duration) EgressResult {
+	result := EgressResult{Endpoint: endpoint}
+	start := time.Now()
+
+	if !strings.Contains(endpoint, "://") {
+		conn, err := net.DialTimeout("tcp", endpoint, timeout)
+		if err != nil {
+			result.Err = err
+			return result
+		}
+		conn.Close()
+		result.Reachable, result.Latency = true, time.Since(start)
+		return result
+	}
+
+	req, err := http.NewRequest(http.MethodHead, endpoint, nil)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	res.Body.Close()
+	result.Reachable, result.Latency = true, time.Since(start)
+	return result
+}
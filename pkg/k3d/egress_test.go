@@ -0,0 +1,111 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckEgress(t *testing.T) {
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	})
+	tlsServer := httptest.NewTLSServer(handler)
+	defer tlsServer.Close()
+	plainServer := httptest.NewServer(handler)
+	defer plainServer.Close()
+
+	// a closed listener gives an address nothing is listening on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := listener.Addr().String()
+	listener.Close()
+
+	tests := []struct {
+		name          string
+		endpoints     []string
+		wantReachable []bool
+		wantErr       string
+	}{
+		{
+			name:          "all reachable",
+			endpoints:     []string{tlsServer.URL, plainServer.URL, tlsServer.Listener.Addr().String()},
+			wantReachable: []bool{true, true, true},
+		},
+		{
+			name:          "unreachable url",
+			endpoints:     []string{tlsServer.URL, "http://" + closedAddr},
+			wantReachable: []bool{true, false},
+			wantErr:       "unable to reach http://" + closedAddr,
+		},
+		{
+			name:          "unreachable tcp endpoint",
+			endpoints:     []string{closedAddr, plainServer.URL},
+			wantReachable: []bool{false, true},
+			wantErr:       "unable to reach " + closedAddr,
+		},
+		{name: "unsupported scheme", endpoints: []string{"ftp://ghcr.io"}, wantErr: "expected an http or https url"},
+		{name: "missing port", endpoints: []string{"ghcr.io"}, wantErr: "invalid egress endpoint"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := checkEgress(tlsServer.Client(), tt.endpoints, 2*time.Second)
+			if (err != nil) != (tt.wantErr != "") {
+				t.Fatalf("checkEgress() error = %v, wantErr %q", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("checkEgress() error = %q, want it to contain %q", err, tt.wantErr)
+			}
+			if len(results) != len(tt.wantReachable) {
+				t.Fatalf("checkEgress() returned %d results, want %d", len(results), len(tt.wantReachable))
+			}
+			for i, result := range results {
+				if result.Endpoint != tt.endpoints[i] || result.Reachable != tt.wantReachable[i] {
+					t.Errorf("result %d = %+v, want %s reachable %v", i, result, tt.endpoints[i], tt.wantReachable[i])
+				}
+				if result.Reachable && (result.Latency <= 0 || result.Err != nil) {
+					t.Errorf("result %d = %+v, want a latency and no error", i, result)
+				}
+				if !result.Reachable && result.Err == nil {
+					t.Errorf("result %d has no error explaining why it is unreachable", i)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckEgressCABundle(t *testing.T) {
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	tests := []struct {
+		name          string
+		caCertPath    string
+		wantReachable bool
+	}{
+		{name: "self-signed git host trusted through the ca bundle", caCertPath: newCABundle(t, server), wantReachable: true},
+		{name: "self-signed git host without a ca bundle"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &K3dConfig{CACertPath: tt.caCertPath, EgressEndpoints: []string{server.URL}}
+			results, _ := CheckEgress(cfg, nil, 2*time.Second)
+			if len(results) != 1 || results[0].Reachable != tt.wantReachable {
+				t.Errorf("CheckEgress() = %+v, want %s reachable %v", results, server.URL, tt.wantReachable)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// installBaseDuration is the time spent creating the k3d cluster and bootstrapping argocd
+const installBaseDuration = 6 * time.Minute
+
+// componentSyncDuration is the time argocd takes to sync and health check a registry application
+const componentSyncDuration = 45 * time.Second
+
+// EstimateInstallDuration returns a rough, deterministic estimate of the install time based on the
+// number of argocd applications in the cluster registry and the local architecture
+func EstimateInstallDuration(cfg *K3dConfig) time.Duration {
+	components := 0
+	registryPath, err := RegistryPath(cfg.GitopsDir, cfg.ClusterName)
+	if err == nil {
+		components, err = countApplications(registryPath)
+	}
+	if err != nil {
+		log.Debug().Msgf("unable to count registry applications, estimating without them: %s", err)
+	}
+
+	return estimateInstallDuration(components, LocalhostARCH)
+}
+
+func estimateInstallDuration(components int, arch string) time.Duration {
+	estimate := installBaseDuration + time.Duration(components)*componentSyncDuration
+
+	// images without arm64 builds run emulated and pull and start noticeably slower
+	if arch == "arm64" {
+		estimate = estimate * 3 / 2
+	}
+
+	return estimate.Round(time.Minute)
+}
+
+// countApplications returns the number of argocd Application documents in the manifests under registryPath
+func countApplications(registryPath string) (int, error) {
+	count := 0
+	err := filepath.Walk(registryPath, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if isHelmTemplatesDir(file) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if ext := filepath.Ext(file); ext != ".yaml" && ext != ".yml" {
+			return nil
+		}
+
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		docs, err := decodeYAMLDocuments(content)
+		if err != nil {
+			// unparsable manifests are reported by ValidateManifests, they don't affect the estimate
+			return nil
+		}
+		for _, doc := range docs {
+			if len(doc.Content) == 0 {
+				continue
+			}
+			if kind := mappingValue(doc.Content[0], "kind"); kind != nil && kind.Value == "Application" {
+				count++
+			}
+		}
+		return nil
+	})
+
+	return count, err
+}
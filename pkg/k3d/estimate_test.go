@@ -0,0 +1,93 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newRegistryFixture returns a gitops directory whose kubefirst registry holds components applications
+func newRegistryFixture(t *testing.T, components int) string {
+	t.Helper()
+
+	gitopsDir := t.TempDir()
+	files := map[string]string{
+		"registry/kubefirst/components/README.md":   "components synced by argocd\n",
+		"registry/kubefirst/components/ns.yaml":     "apiVersion: v1\nkind: Namespace\nmetadata:\n  name: kubefirst\n",
+		"registry/kubefirst/chart/Chart.yaml":       "apiVersion: v2\nname: chart\nversion: 0.1.0\n",
+		"registry/kubefirst/chart/templates/a.yaml": "kind: Application\nmetadata:\n  name: {{ .Release.Name }}\n",
+	}
+	for i := 0; i < components; i++ {
+		files[fmt.Sprintf("registry/kubefirst/components/app-%d/application.yaml", i)] = application(fmt.Sprintf("app-%d", i), "charts/app")
+	}
+	writeFixture(t, gitopsDir, files)
+
+	return gitopsDir
+}
+
+func TestEstimateInstallDuration(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		components int
+	}{
+		{name: "empty registry", components: 0},
+		{name: "small registry", components: 4},
+		{name: "large registry", components: 16},
+	}
+	previous := time.Duration(0)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &K3dConfig{ClusterName: "kubefirst", GitopsDir: newRegistryFixture(t, tt.components)}
+
+			got := EstimateInstallDuration(cfg)
+			if got <= previous {
+				t.Errorf("EstimateInstallDuration() with %d components = %s, want more than %s", tt.components, got, previous)
+			}
+			if again := EstimateInstallDuration(cfg); again != got {
+				t.Errorf("EstimateInstallDuration() not deterministic, got %s then %s", got, again)
+			}
+			previous = got
+		})
+	}
+
+	count, err := countApplications(filepath.Join(newRegistryFixture(t, 3), "registry", "kubefirst"))
+	if err != nil || count != 3 {
+		t.Errorf("countApplications() = %d, %v, want 3", count, err)
+	}
+
+	// an invalid cluster name must not escape the gitops registry
+	escaping := &K3dConfig{ClusterName: "..", GitopsDir: filepath.Join(newRegistryFixture(t, 3), "registry", "kubefirst")}
+	if got, want := EstimateInstallDuration(escaping), estimateInstallDuration(0, LocalhostARCH); got != want {
+		t.Errorf("EstimateInstallDuration() with cluster name %q = %s, want %s", escaping.ClusterName, got, want)
+	}
+}
+
+func TestEstimateInstallDurationFactors(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		components int
+		arch       string
+		want       time.Duration
+	}{
+		{name: "amd64", components: 8, arch: "amd64", want: 12 * time.Minute},
+		{name: "arm64", components: 8, arch: "arm64", want: 18 * time.Minute},
+		{name: "empty registry", components: 0, arch: "amd64", want: 6 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := estimateInstallDuration(tt.components, tt.arch)
+			if got != tt.want {
+				t.Errorf("estimateInstallDuration() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// vaultSecretStore is the ClusterSecretStore external-secrets reads the vault kv secrets through
+const vaultSecretStore = "vault-kv-secret"
+
+// externalSecret is the part of an external-secrets.io ExternalSecret used to sync a vault kv secret
+type externalSecret struct {
+	APIVersion string                 `yaml:"apiVersion"`
+	Kind       string                 `yaml:"kind"`
+	Metadata   externalSecretMetadata `yaml:"metadata"`
+	Spec       externalSecretSpec     `yaml:"spec"`
+}
+
+type externalSecretMetadata struct {
+	Name      string `yaml:"name"`
+	Namespace string `yaml:"namespace"`
+}
+
+type externalSecretSpec struct {
+	RefreshInterval string                    `yaml:"refreshInterval"`
+	SecretStoreRef  externalSecretStoreRef    `yaml:"secretStoreRef"`
+	Target          externalSecretTarget      `yaml:"target"`
+	Data            []externalSecretDataEntry `yaml:"data"`
+}
+
+type externalSecretStoreRef struct {
+	Kind string `yaml:"kind"`
+	Name string `yaml:"name"`
+}
+
+type externalSecretTarget struct {
+	Name string `yaml:"name"`
+}
+
+type externalSecretDataEntry struct {
+	SecretKey string                  `yaml:"secretKey"`
+	RemoteRef externalSecretRemoteRef `yaml:"remoteRef"`
+}
+
+type externalSecretRemoteRef struct {
+	Key      string `yaml:"key"`
+	Property string `yaml:"property"`
+}
+
+// vaultExternalSecret returns the manifest of an ExternalSecret syncing keys of the vault kv secret
+// at vaultPath into the kubernetes secret name in namespace, so the values stay out of the gitops repo
+func vaultExternalSecret(name, namespace, vaultPath string, keys []string) ([]byte, error) {
+	secret := externalSecret{
+		APIVersion: "external-secrets.io/v1beta1",
+		Kind:       "ExternalSecret",
+		Metadata:   externalSecretMetadata{Name: name, Namespace: namespace},
+		Spec: externalSecretSpec{
+			RefreshInterval: "10s",
+			SecretStoreRef:  externalSecretStoreRef{Kind: "ClusterSecretStore", Name: vaultSecretStore},
+			Target:          externalSecretTarget{Name: name},
+		},
+	}
+	for _, key := range keys {
+		secret.Spec.Data = append(secret.Spec.Data, externalSecretDataEntry{
+			SecretKey: key,
+			RemoteRef: externalSecretRemoteRef{Key: vaultPath, Property: key},
+		})
+	}
+
+	manifest, err := yaml.Marshal(secret)
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling external secret %s/%s: %s", namespace, name, err)
+	}
+	return manifest, nil
+}
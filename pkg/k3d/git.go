@@ -0,0 +1,238 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/rs/zerolog/log"
+)
+
+// scpLikeGitURL matches ssh remotes in the git@host:owner/repo.git form
+var scpLikeGitURL = regexp.MustCompile(`^[\w.-]+@[\w.-]+:[\w./~-]+$`)
+
+// validateGitURL checks a remote url is an http(s), ssh or scp-like git url
+func validateGitURL(gitURL string) error {
+	if scpLikeGitURL.MatchString(gitURL) {
+		return nil
+	}
+
+	u, err := url.Parse(gitURL)
+	if err != nil {
+		return fmt.Errorf("invalid git url %q: %s", gitURL, err)
+	}
+	switch u.Scheme {
+	case "https", "http", "ssh":
+	default:
+		return fmt.Errorf("invalid git url %q: unsupported scheme %q", gitURL, u.Scheme)
+	}
+	if u.Host == "" || u.Path == "" || u.Path == "/" {
+		return fmt.Errorf("invalid git url %q: missing host or repository path", gitURL)
+	}
+
+	return nil
+}
+
+// AuthMethod is the go-git authentication used when cloning templates, nil for public repositories
+type AuthMethod = transport.AuthMethod
+
+// CloneTemplate clones a single branch of the template repository at url into dest
+// depth 0 performs a shallow clone of the latest commit, a negative depth performs a full clone
+// if the remote does not support shallow fetches the clone falls back to a full clone
+func CloneTemplate(url, branch, dest string, depth int, auth AuthMethod) (*git.Repository, error) {
+	if depth == 0 {
+		depth = 1
+	}
+	if depth < 0 {
+		depth = 0
+	}
+
+	cloneOptions := &git.CloneOptions{
+		URL:           url,
+		Auth:          auth,
+		ReferenceName: plumbing.NewBranchReferenceName(branch),
+		SingleBranch:  true,
+		Depth:         depth,
+	}
+
+	log.Info().Str("url", url).Str("branch", branch).Int("depth", depth).Msg("cloning template repository")
+	repo, err := git.PlainClone(dest, false, cloneOptions)
+	if err != nil && depth > 0 && isShallowUnsupported(err) {
+		log.Warn().Err(err).Str("url", url).Msg("shallow clone not supported by remote, falling back to a full clone")
+		cloneOptions.Depth = 0
+		repo, err = git.PlainClone(dest, false, cloneOptions)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error cloning template %s at branch %s: %s", url, branch, err)
+	}
+
+	return repo, nil
+}
+
+// isShallowUnsupported reports whether a clone failed because the remote cannot serve a depth limited fetch
+func isShallowUnsupported(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "shallow not supported") || strings.Contains(msg, "unsupported capability: shallow")
+}
+
+// UpdateGitopsRemote re-points the origin remote of the local gitops clone to newURL
+func UpdateGitopsRemote(gitopsRepoDir, newURL string) error {
+	err := validateGitURL(newURL)
+	if err != nil {
+		return err
+	}
+
+	repo, err := git.PlainOpen(gitopsRepoDir)
+	if err != nil {
+		return fmt.Errorf("error opening gitops repo at %s: %s", gitopsRepoDir, err)
+	}
+
+	cfg, err := repo.Config()
+	if err != nil {
+		return fmt.Errorf("error reading gitops repo config: %s", err)
+	}
+
+	remote, ok := cfg.Remotes["origin"]
+	if !ok {
+		remote = &config.RemoteConfig{
+			Name:  "origin",
+			Fetch: []config.RefSpec{config.RefSpec(fmt.Sprintf(config.DefaultFetchRefSpec, "origin"))},
+		}
+		cfg.Remotes["origin"] = remote
+	}
+	remote.URLs = []string{newURL}
+
+	err = repo.SetConfig(cfg)
+	if err != nil {
+		return fmt.Errorf("error updating gitops remote to %s: %s", newURL, err)
+	}
+	log.Info().Msgf("gitops remote origin set to %s", newURL)
+
+	return nil
+}
+
+// CommitIdentity is the author and committer of the commits created by the package
+type CommitIdentity struct {
+	Name  string
+	Email string
+}
+
+// DefaultCommitIdentity is used when no commit identity is configured
+var DefaultCommitIdentity = CommitIdentity{Name: "kbot", Email: "kbot@kubefirst.com"}
+
+// signature returns the git signature for the identity, falling back to DefaultCommitIdentity
+func (identity CommitIdentity) signature() *object.Signature {
+	if identity.Name == "" || identity.Email == "" {
+		identity = DefaultCommitIdentity
+	}
+	return &object.Signature{
+		Name:  identity.Name,
+		Email: identity.Email,
+		When:  time.Now(),
+	}
+}
+
+// default messages of the initial commits of the repositories created from the templates
+const (
+	defaultGitopsCommitMessage   = "committing initial detokenized gitops-template repo content"
+	defaultMetaphorCommitMessage = "committing initial detokenized metaphor repo content"
+)
+
+// commitMessageOrDefault returns message, or fallback when no message is configured
+func commitMessageOrDefault(message, fallback string) string {
+	if strings.TrimSpace(message) == "" {
+		return fallback
+	}
+	return message
+}
+
+// commitRepo stages all changes in repo, respecting .gitignore, and commits them as identity
+func commitRepo(repo *git.Repository, message string, identity CommitIdentity) (plumbing.Hash, error) {
+	w, err := repo.Worktree()
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("error getting worktree: %s", err)
+	}
+
+	err = w.AddWithOptions(&git.AddOptions{All: true})
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("error staging changes: %s", err)
+	}
+
+	log.Info().Msg(message)
+	signature := identity.signature()
+	hash, err := w.Commit(message, &git.CommitOptions{
+		Author:    signature,
+		Committer: signature,
+	})
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("error committing: %s", err)
+	}
+
+	return hash, nil
+}
+
+// CommitGitopsRepo stages all changes in the gitops repo, respecting .gitignore,
+// and commits them as kbot, returning the new commit hash
+func CommitGitopsRepo(gitopsRepoDir, message string) (plumbing.Hash, error) {
+	return CommitGitopsRepoAs(gitopsRepoDir, message, DefaultCommitIdentity)
+}
+
+// CommitGitopsRepoAs is CommitGitopsRepo committing as identity
+func CommitGitopsRepoAs(gitopsRepoDir, message string, identity CommitIdentity) (plumbing.Hash, error) {
+	repo, err := git.PlainOpen(gitopsRepoDir)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("error opening gitops repo at %s: %s", gitopsRepoDir, err)
+	}
+
+	hash, err := commitRepo(repo, message, identity)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("error committing gitops repo: %s", err)
+	}
+
+	return hash, nil
+}
+
+// VerifyRepo checks the repository at dir can be opened, HEAD points at the main branch,
+// the commit HEAD references exists and the origin remote is set
+func VerifyRepo(dir string) error {
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		return fmt.Errorf("error opening repo at %s: %s", dir, err)
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return fmt.Errorf("error reading HEAD of repo at %s: %s", dir, err)
+	}
+	if head.Name() != plumbing.NewBranchReferenceName("main") {
+		return fmt.Errorf("repo at %s HEAD points at %s, expected refs/heads/main", dir, head.Name())
+	}
+
+	_, err = repo.CommitObject(head.Hash())
+	if err != nil {
+		return fmt.Errorf("error reading initial commit %s of repo at %s: %s", head.Hash(), dir, err)
+	}
+
+	remote, err := repo.Remote("origin")
+	if err != nil {
+		return fmt.Errorf("error reading origin remote of repo at %s: %s", dir, err)
+	}
+	if len(remote.Config().URLs) == 0 {
+		return fmt.Errorf("origin remote of repo at %s has no url", dir)
+	}
+
+	return nil
+}
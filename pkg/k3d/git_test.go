@@ -0,0 +1,302 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	"github.com/go-git/go-git/v5/plumbing/transport/file"
+	"github.com/go-git/go-git/v5/plumbing/transport/server"
+	cp "github.com/otiai10/copy"
+)
+
+func TestUpdateGitopsRemote(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		withOrigin bool
+		newURL     string
+		wantErr    bool
+	}{
+		{name: "https url", withOrigin: true, newURL: "https://gitlab.example.com/new-org/gitops.git"},
+		{name: "ssh url", withOrigin: true, newURL: "git@github.com:new-org/gitops.git"},
+		{name: "missing origin", withOrigin: false, newURL: "ssh://git@github.com/new-org/gitops.git"},
+		{name: "invalid scheme", withOrigin: true, newURL: "htps://github.com/new-org/gitops.git", wantErr: true},
+		{name: "missing path", withOrigin: true, newURL: "https://github.com", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			repo, err := git.PlainInit(dir, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.withOrigin {
+				_, err = repo.CreateRemote(&config.RemoteConfig{
+					Name: "origin",
+					URLs: []string{"https://github.com/old-org/gitops.git"},
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err = UpdateGitopsRemote(dir, tt.newURL)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UpdateGitopsRemote() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			repo, _ = git.PlainOpen(dir)
+			remote, err := repo.Remote("origin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := remote.Config().URLs; len(got) != 1 || got[0] != tt.newURL {
+				t.Errorf("UpdateGitopsRemote() origin urls = %v, want [%s]", got, tt.newURL)
+			}
+		})
+	}
+}
+
+func TestCommitGitopsRepo(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		identity  CommitIdentity
+		wantName  string
+		wantEmail string
+	}{
+		{name: "default identity", wantName: "kbot", wantEmail: "kbot@kubefirst.com"},
+		{
+			name:      "configured identity",
+			identity:  CommitIdentity{Name: "Platform Team", Email: "platform@example.com"},
+			wantName:  "Platform Team",
+			wantEmail: "platform@example.com",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			repo, err := git.PlainInit(dir, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeFixture(t, dir, map[string]string{
+				".gitignore":                  "*.log\n",
+				"registry/kubefirst/app.yaml": "kind: Application\n",
+				"install.log":                 "ignored\n",
+			})
+
+			message := "committing initial detokenized gitops-template repo content"
+			var hash plumbing.Hash
+			if tt.identity == (CommitIdentity{}) {
+				hash, err = CommitGitopsRepo(dir, message)
+			} else {
+				hash, err = CommitGitopsRepoAs(dir, message, tt.identity)
+			}
+			if err != nil {
+				t.Fatalf("CommitGitopsRepo() error = %v", err)
+			}
+
+			head, err := repo.Head()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if head.Hash() != hash {
+				t.Errorf("CommitGitopsRepo() hash = %s, want HEAD %s", hash, head.Hash())
+			}
+
+			w, _ := repo.Worktree()
+			status, err := w.Status()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !status.IsClean() {
+				t.Errorf("worktree not clean after commit: %s", status)
+			}
+
+			commit, _ := repo.CommitObject(hash)
+			if _, err := commit.File("install.log"); err == nil {
+				t.Error("ignored install.log was committed")
+			}
+			if commit.Author.Name != tt.wantName || commit.Author.Email != tt.wantEmail {
+				t.Errorf("commit author = %s <%s>, want %s <%s>", commit.Author.Name, commit.Author.Email, tt.wantName, tt.wantEmail)
+			}
+			if commit.Committer.Name != tt.wantName || commit.Committer.Email != tt.wantEmail {
+				t.Errorf("commit committer = %s <%s>, want %s <%s>", commit.Committer.Name, commit.Committer.Email, tt.wantName, tt.wantEmail)
+			}
+		})
+	}
+}
+
+func TestVerifyRepo(t *testing.T) {
+
+	k1Dir, gitopsDir := newMetaphorFixture(t, map[string]string{"Dockerfile": "FROM scratch\n"})
+	err := AdjustMetaphorRepo("https://github.com/kubefirst/metaphor.git", gitopsDir, "metaphor", "github", k1Dir)
+	if err != nil {
+		t.Fatalf("AdjustMetaphorRepo() error = %v", err)
+	}
+	metaphorDir := filepath.Join(k1Dir, "metaphor")
+
+	tests := []struct {
+		name    string
+		corrupt func(t *testing.T, dir string)
+		wantErr bool
+	}{
+		{name: "adjusted repo", corrupt: func(t *testing.T, dir string) {}},
+		{
+			name: "head on master",
+			corrupt: func(t *testing.T, dir string) {
+				writeFixture(t, dir, map[string]string{".git/HEAD": "ref: refs/heads/master\n"})
+			},
+			wantErr: true,
+		},
+		{
+			name: "missing origin",
+			corrupt: func(t *testing.T, dir string) {
+				repo, _ := git.PlainOpen(dir)
+				if err := repo.DeleteRemote("origin"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: true,
+		},
+		{
+			name: "missing commit object",
+			corrupt: func(t *testing.T, dir string) {
+				if err := os.RemoveAll(filepath.Join(dir, ".git", "objects")); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Mkdir(filepath.Join(dir, ".git", "objects"), 0700); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			err := cp.Copy(metaphorDir, dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.corrupt(t, dir)
+
+			err = VerifyRepo(dir)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("VerifyRepo() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// newBareTemplateRepo creates a bare repository with commits on main and returns its file url
+func newBareTemplateRepo(t *testing.T, commits int) string {
+	t.Helper()
+
+	workDir := t.TempDir()
+	repo, err := git.PlainInit(workDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, plumbing.NewBranchReferenceName("main")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, _ := repo.Worktree()
+	for i := 0; i < commits; i++ {
+		writeFixture(t, workDir, map[string]string{"README.md": fmt.Sprintf("revision %d\n", i)})
+		_, err = w.Add("README.md")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = w.Commit(fmt.Sprintf("revision %d", i), &git.CommitOptions{
+			Author: &object.Signature{Name: "kbot", Email: "kbot@kubefirst.com", When: time.Now()},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bareDir := t.TempDir()
+	_, err = git.PlainClone(bareDir, true, &git.CloneOptions{URL: workDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return "file://" + bareDir
+}
+
+func TestCloneTemplate(t *testing.T) {
+
+	templateURL := newBareTemplateRepo(t, 3)
+
+	tests := []struct {
+		name            string
+		depth           int
+		inProcessServer bool
+		wantCommits     int
+		wantShallow     bool
+	}{
+		{name: "shallow by default", depth: 0, wantCommits: 1, wantShallow: true},
+		{name: "full clone", depth: -1, wantCommits: 3},
+		{name: "shallow unsupported falls back", depth: 1, inProcessServer: true, wantCommits: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.inProcessServer {
+				// the in-process go-git server does not support shallow fetches
+				client.InstallProtocol("file", server.DefaultServer)
+				defer client.InstallProtocol("file", file.DefaultClient)
+			}
+
+			dest := filepath.Join(t.TempDir(), "gitops")
+			repo, err := CloneTemplate(templateURL, "main", dest, tt.depth, nil)
+			if err != nil {
+				t.Fatalf("CloneTemplate() error = %v", err)
+			}
+
+			shallows, err := repo.Storer.Shallow()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (len(shallows) > 0) != tt.wantShallow {
+				t.Errorf("CloneTemplate() shallow = %v, want %v", shallows, tt.wantShallow)
+			}
+
+			head, err := repo.Head()
+			if err != nil {
+				t.Fatal(err)
+			}
+			commits := 0
+			commit, err := repo.CommitObject(head.Hash())
+			for err == nil {
+				commits++
+				if commit.NumParents() == 0 {
+					break
+				}
+				commit, err = commit.Parent(0)
+			}
+			if commits != tt.wantCommits {
+				t.Errorf("CloneTemplate() commits = %d, want %d", commits, tt.wantCommits)
+			}
+		})
+	}
+}
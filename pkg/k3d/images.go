@@ -0,0 +1,122 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/kubefirst/runtime/pkg"
+	"github.com/rs/zerolog/log"
+)
+
+// PreloadImages loads images, e.g. the metaphor base images, into the nodes of the cfg.ClusterName
+// cluster with k3d image import so the first deploys don't pull them over a slow connection.
+// Images every node already holds are skipped, and images missing from the local docker daemon
+// are pulled before the import
+func PreloadImages(cfg *K3dConfig, images []string) error {
+	present, err := clusterImages(cfg)
+	if err != nil {
+		return err
+	}
+
+	for _, image := range images {
+		image = strings.TrimSpace(image)
+		if image == "" {
+			continue
+		}
+		if present[normalizeImageRef(image)] {
+			log.Info().Str("image", image).Msg("image already present on the cluster nodes, skipping import")
+			continue
+		}
+
+		_, _, err := pkg.ExecShellReturnStrings(dockerClient, "image", "inspect", image)
+		if err != nil {
+			log.Info().Str("image", image).Msg("pulling image")
+			_, stdErr, err := pkg.ExecShellReturnStrings(dockerClient, "pull", image)
+			if err != nil {
+				return fmt.Errorf("error pulling image %s: %s %s", image, err, stdErr)
+			}
+		}
+
+		log.Info().Str("image", image).Str("cluster", cfg.ClusterName).Msg("importing image into k3d")
+		_, stdErr, err := pkg.ExecShellReturnStrings(cfg.K3dClient, "image", "import", image, "--cluster", cfg.ClusterName)
+		if err != nil {
+			return fmt.Errorf("error importing image %s into k3d cluster %s: %s %s", image, cfg.ClusterName, err, stdErr)
+		}
+	}
+
+	return nil
+}
+
+// clusterImages returns the normalized references of the images held by every node of the cluster
+func clusterImages(cfg *K3dConfig) (map[string]bool, error) {
+	stdOut, stdErr, err := pkg.ExecShellReturnStrings(cfg.KubectlClient, "--kubeconfig", cfg.Kubeconfig, "get", "nodes", "-o", "json")
+	if err != nil {
+		return nil, fmt.Errorf("error listing the images on the cluster nodes: %s %s", err, stdErr)
+	}
+
+	var nodes struct {
+		Items []struct {
+			Status struct {
+				Images []struct {
+					Names []string `json:"names"`
+				} `json:"images"`
+			} `json:"status"`
+		} `json:"items"`
+	}
+	err = json.Unmarshal([]byte(stdOut), &nodes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing the cluster nodes: %s", err)
+	}
+
+	counts := map[string]int{}
+	for _, node := range nodes.Items {
+		onNode := map[string]bool{}
+		for _, image := range node.Status.Images {
+			for _, name := range image.Names {
+				onNode[normalizeImageRef(name)] = true
+			}
+		}
+		for name := range onNode {
+			counts[name]++
+		}
+	}
+
+	present := map[string]bool{}
+	for name, count := range counts {
+		if len(nodes.Items) > 0 && count == len(nodes.Items) {
+			present[name] = true
+		}
+	}
+	return present, nil
+}
+
+// normalizeImageRef expands a docker image reference to the fully qualified form the nodes
+// report, e.g. nginx becomes docker.io/library/nginx:latest
+func normalizeImageRef(image string) string {
+	name, digest, hasDigest := strings.Cut(image, "@")
+
+	domain, remainder := "docker.io", name
+	if first, rest, ok := strings.Cut(name, "/"); ok && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		domain, remainder = first, rest
+	}
+	if domain == "docker.io" && !strings.Contains(remainder, "/") {
+		remainder = "library/" + remainder
+	}
+
+	ref := domain + "/" + remainder
+	if hasDigest {
+		return ref + "@" + digest
+	}
+	// a colon after the last slash is a tag, one before it belongs to a registry port
+	if !strings.Contains(remainder[strings.LastIndex(remainder, "/")+1:], ":") {
+		ref += ":latest"
+	}
+	return ref
+}
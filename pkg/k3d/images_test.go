@@ -0,0 +1,138 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// k3dNodes lists two nodes that both hold busybox while only the server holds golang
+const k3dNodes = `{"items":[
+{"status":{"images":[{"names":["docker.io/library/busybox:1.36"]},{"names":["docker.io/library/golang:1.20-alpine"]}]}},
+{"status":{"images":[{"names":["docker.io/library/busybox:1.36"]}]}}
+]}`
+
+func TestPreloadImages(t *testing.T) {
+
+	tests := []struct {
+		name        string
+		images      []string
+		localImages string
+		importFails bool
+		wantImports []string
+		wantPulls   []string
+		wantErr     bool
+	}{
+		{
+			name:        "import missing images",
+			images:      []string{"node:18-alpine", "ghcr.io/kubefirst/metaphor:1.0.0"},
+			localImages: "node:18-alpine ghcr.io/kubefirst/metaphor:1.0.0",
+			wantImports: []string{"node:18-alpine", "ghcr.io/kubefirst/metaphor:1.0.0"},
+		},
+		{
+			name:        "skip images on every node",
+			images:      []string{"busybox:1.36", "docker.io/library/busybox:1.36", "golang:1.20-alpine"},
+			localImages: "golang:1.20-alpine",
+			wantImports: []string{"golang:1.20-alpine"},
+		},
+		{
+			name:        "pull images missing locally",
+			images:      []string{"nginx"},
+			wantPulls:   []string{"nginx"},
+			wantImports: []string{"nginx"},
+		},
+		{
+			name:        "import fails",
+			images:      []string{"nginx"},
+			localImages: "nginx",
+			importFails: true,
+			wantImports: []string{"nginx"},
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			toolsDir := t.TempDir()
+			importLog := filepath.Join(toolsDir, "imports")
+			pullLog := filepath.Join(toolsDir, "pulls")
+			writeFixture(t, toolsDir, map[string]string{"nodes.json": k3dNodes})
+
+			importStatus := "0"
+			if tt.importFails {
+				importStatus = "1"
+			}
+			dockerClient = writeStubTool(t, toolsDir, "docker", `case "$*" in
+"image inspect "*) for image in `+tt.localImages+`; do [ "$image" = "$3" ] && exit 0; done; exit 1 ;;
+"pull "*) echo "$2" >> `+pullLog+` ;;
+*) exit 2 ;;
+esac
+`)
+			defer func() { dockerClient = "docker" }()
+			cfg := &K3dConfig{
+				ClusterName: "kubefirst",
+				Kubeconfig:  "/tmp/kubeconfig",
+				KubectlClient: writeStubTool(t, toolsDir, "kubectl", `[ "$*" = "--kubeconfig /tmp/kubeconfig get nodes -o json" ] || exit 2
+cat `+filepath.Join(toolsDir, "nodes.json")+"\n"),
+				K3dClient: writeStubTool(t, toolsDir, "k3d", `[ "$1 $2" = "image import" ] && [ "$4 $5" = "--cluster kubefirst" ] || exit 2
+echo "$3" >> `+importLog+`
+exit `+importStatus+"\n"),
+			}
+
+			err := PreloadImages(cfg, tt.images)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PreloadImages() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			for _, check := range []struct {
+				name string
+				path string
+				want []string
+			}{
+				{"imported", importLog, tt.wantImports},
+				{"pulled", pullLog, tt.wantPulls},
+			} {
+				content, _ := os.ReadFile(check.path)
+				got := strings.Fields(string(content))
+				want := check.want
+				if want == nil {
+					want = []string{}
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("PreloadImages() %s %v, want %v", check.name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNormalizeImageRef(t *testing.T) {
+
+	tests := []struct {
+		image string
+		want  string
+	}{
+		{image: "nginx", want: "docker.io/library/nginx:latest"},
+		{image: "nginx:1.25", want: "docker.io/library/nginx:1.25"},
+		{image: "kubefirst/metaphor:1.0.0", want: "docker.io/kubefirst/metaphor:1.0.0"},
+		{image: "docker.io/library/nginx:1.25", want: "docker.io/library/nginx:1.25"},
+		{image: "ghcr.io/kubefirst/metaphor", want: "ghcr.io/kubefirst/metaphor:latest"},
+		{image: "localhost:5000/metaphor", want: "localhost:5000/metaphor:latest"},
+		{image: "registry.local:5000/team/metaphor:dev", want: "registry.local:5000/team/metaphor:dev"},
+		{image: "nginx@sha256:abc", want: "docker.io/library/nginx@sha256:abc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			if got := normalizeImageRef(tt.image); got != tt.want {
+				t.Errorf("normalizeImageRef(%q) = %q, want %q", tt.image, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/kubefirst/runtime/pkg"
+	"github.com/rs/zerolog/log"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// RewriteKubeconfigServer points every cluster in cfg.Kubeconfig at serverURL, e.g. the
+// host's LAN address in place of https://0.0.0.0:PORT for access from another machine
+func RewriteKubeconfigServer(cfg *K3dConfig, serverURL string) error {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return fmt.Errorf("invalid kubeconfig server url %q: %s", serverURL, err)
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("invalid kubeconfig server url %q: expected https://host:port", serverURL)
+	}
+
+	kubeconfig, err := clientcmd.LoadFromFile(cfg.Kubeconfig)
+	if err != nil {
+		return fmt.Errorf("error loading kubeconfig %s: %s", cfg.Kubeconfig, err)
+	}
+	if len(kubeconfig.Clusters) == 0 {
+		return fmt.Errorf("no clusters found in kubeconfig %s", cfg.Kubeconfig)
+	}
+
+	for name, cluster := range kubeconfig.Clusters {
+		log.Info().Str("cluster", name).Str("from", cluster.Server).Str("to", serverURL).Msg("rewriting kubeconfig server")
+		cluster.Server = serverURL
+	}
+
+	err = clientcmd.WriteToFile(*kubeconfig, cfg.Kubeconfig)
+	if err != nil {
+		return fmt.Errorf("error writing kubeconfig %s: %s", cfg.Kubeconfig, err)
+	}
+
+	return nil
+}
+
+// MergeKubeconfig merges the clusters, contexts and users of cfg.Kubeconfig into the kubeconfig
+// at targetPath, e.g. ~/.kube/config, creating it if needed
+// entries with other names are left untouched and the target's current context is only set
+// when it has none
+func MergeKubeconfig(cfg *K3dConfig, targetPath string) error {
+	source, err := clientcmd.LoadFromFile(cfg.Kubeconfig)
+	if err != nil {
+		return fmt.Errorf("error loading kubeconfig %s: %s", cfg.Kubeconfig, err)
+	}
+
+	target := clientcmdapi.NewConfig()
+	if _, err := os.Stat(targetPath); err == nil {
+		target, err = clientcmd.LoadFromFile(targetPath)
+		if err != nil {
+			return fmt.Errorf("error loading kubeconfig %s: %s", targetPath, err)
+		}
+	}
+
+	for name, cluster := range source.Clusters {
+		target.Clusters[name] = cluster
+	}
+	for name, authInfo := range source.AuthInfos {
+		target.AuthInfos[name] = authInfo
+	}
+	for name, context := range source.Contexts {
+		target.Contexts[name] = context
+	}
+	if target.CurrentContext == "" {
+		target.CurrentContext = source.CurrentContext
+	}
+
+	err = clientcmd.WriteToFile(*target, targetPath)
+	if err != nil {
+		return fmt.Errorf("error writing kubeconfig %s: %s", targetPath, err)
+	}
+	log.Info().Str("source", cfg.Kubeconfig).Str("target", targetPath).Msg("kubeconfig merged")
+
+	return nil
+}
+
+// kubeconfigRequestTimeout bounds how long ValidateKubeconfig waits on the cluster api
+const kubeconfigRequestTimeout = "10s"
+
+// ValidateKubeconfig checks the kubeconfig written by CreateCluster is usable, failing when
+// cfg.Kubeconfig is missing or malformed, or when kubectl can't reach the cluster through it
+func ValidateKubeconfig(cfg *K3dConfig) error {
+	kubeconfig, err := clientcmd.LoadFromFile(cfg.Kubeconfig)
+	if err != nil {
+		return fmt.Errorf("error loading kubeconfig %s: %s", cfg.Kubeconfig, err)
+	}
+	err = clientcmd.Validate(*kubeconfig)
+	if err != nil {
+		return fmt.Errorf("kubeconfig %s is invalid: %s", cfg.Kubeconfig, err)
+	}
+
+	_, stdErr, err := pkg.ExecShellReturnStrings(cfg.KubectlClient, "--kubeconfig", cfg.Kubeconfig,
+		"--request-timeout", kubeconfigRequestTimeout, "version", "-o", "json")
+	if err != nil {
+		return fmt.Errorf("cluster unreachable with kubeconfig %s: %s %s", cfg.Kubeconfig, err, strings.TrimSpace(stdErr))
+	}
+	log.Info().Str("kubeconfig", cfg.Kubeconfig).Msg("kubeconfig validated")
+
+	return nil
+}
@@ -0,0 +1,213 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const k3dKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- cluster:
+    certificate-authority-data: Y2EtZGF0YQ==
+    server: https://0.0.0.0:6443
+  name: k3d-kubefirst
+contexts:
+- context:
+    cluster: k3d-kubefirst
+    user: admin@k3d-kubefirst
+  name: k3d-kubefirst
+current-context: k3d-kubefirst
+users:
+- name: admin@k3d-kubefirst
+  user:
+    client-certificate-data: Y2VydA==
+    client-key-data: a2V5
+`
+
+func TestRewriteKubeconfigServer(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		serverURL string
+		wantErr   bool
+	}{
+		{name: "lan address", serverURL: "https://192.168.1.20:6443"},
+		{name: "http scheme", serverURL: "http://192.168.1.20:6443", wantErr: true},
+		{name: "missing host", serverURL: "https://", wantErr: true},
+		{name: "not a url", serverURL: "192.168.1.20:6443", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFixture(t, dir, map[string]string{"kubeconfig": k3dKubeconfig})
+			cfg := &K3dConfig{Kubeconfig: filepath.Join(dir, "kubeconfig")}
+
+			err := RewriteKubeconfigServer(cfg, tt.serverURL)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RewriteKubeconfigServer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			kubeconfig, err := clientcmd.LoadFromFile(cfg.Kubeconfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cluster := kubeconfig.Clusters["k3d-kubefirst"]
+			wantServer := tt.serverURL
+			if tt.wantErr {
+				wantServer = "https://0.0.0.0:6443"
+			}
+			if cluster.Server != wantServer {
+				t.Errorf("server = %v, want %v", cluster.Server, wantServer)
+			}
+			if string(cluster.CertificateAuthorityData) != "ca-data" {
+				t.Errorf("certificate authority data = %q, want ca-data", cluster.CertificateAuthorityData)
+			}
+			if kubeconfig.CurrentContext != "k3d-kubefirst" {
+				t.Errorf("current context = %v, want k3d-kubefirst", kubeconfig.CurrentContext)
+			}
+			user := kubeconfig.AuthInfos["admin@k3d-kubefirst"]
+			if user == nil || string(user.ClientKeyData) != "key" {
+				t.Errorf("user credentials were not preserved: %v", user)
+			}
+		})
+	}
+}
+
+func TestMergeKubeconfig(t *testing.T) {
+
+	const existingKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- cluster:
+    server: https://prod.example.com:6443
+  name: prod
+contexts:
+- context:
+    cluster: prod
+    user: prod-admin
+  name: prod
+current-context: prod
+users:
+- name: prod-admin
+  user:
+    token: prod-token
+`
+
+	tests := []struct {
+		name               string
+		existing           string
+		wantCurrentContext string
+		wantContexts       []string
+	}{
+		{name: "existing kubeconfig", existing: existingKubeconfig, wantCurrentContext: "prod", wantContexts: []string{"prod", "k3d-kubefirst"}},
+		{name: "missing kubeconfig", wantCurrentContext: "k3d-kubefirst", wantContexts: []string{"k3d-kubefirst"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFixture(t, dir, map[string]string{"k1/kubeconfig": k3dKubeconfig})
+			if tt.existing != "" {
+				writeFixture(t, dir, map[string]string{".kube/config": tt.existing})
+			}
+			cfg := &K3dConfig{Kubeconfig: filepath.Join(dir, "k1", "kubeconfig")}
+			targetPath := filepath.Join(dir, ".kube", "config")
+
+			err := MergeKubeconfig(cfg, targetPath)
+			if err != nil {
+				t.Fatalf("MergeKubeconfig() error = %v", err)
+			}
+
+			merged, err := clientcmd.LoadFromFile(targetPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if merged.CurrentContext != tt.wantCurrentContext {
+				t.Errorf("current context = %v, want %v", merged.CurrentContext, tt.wantCurrentContext)
+			}
+			for _, name := range tt.wantContexts {
+				context, ok := merged.Contexts[name]
+				if !ok {
+					t.Errorf("context %s missing after merge", name)
+					continue
+				}
+				if _, ok := merged.Clusters[context.Cluster]; !ok {
+					t.Errorf("cluster %s of context %s missing after merge", context.Cluster, name)
+				}
+				if _, ok := merged.AuthInfos[context.AuthInfo]; !ok {
+					t.Errorf("user %s of context %s missing after merge", context.AuthInfo, name)
+				}
+			}
+			if tt.existing != "" && merged.AuthInfos["prod-admin"].Token != "prod-token" {
+				t.Error("existing user credentials were not preserved")
+			}
+		})
+	}
+}
+
+func TestValidateKubeconfig(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		kubeconfig string
+		script     string
+		wantErr    string
+	}{
+		{name: "reachable cluster", kubeconfig: k3dKubeconfig, script: `echo '{"serverVersion":{"gitVersion":"v1.26.3+k3s1"}}'`},
+		{
+			name:       "unreachable cluster",
+			kubeconfig: k3dKubeconfig,
+			script:     `echo "Unable to connect to the server: dial tcp 0.0.0.0:6443: connect: connection refused" >&2; exit 1`,
+			wantErr:    "cluster unreachable with kubeconfig",
+		},
+		{name: "malformed kubeconfig", kubeconfig: "apiVersion: v1\nclusters: [broken\n", wantErr: "error loading kubeconfig"},
+		{
+			name:       "context without cluster",
+			kubeconfig: strings.Replace(k3dKubeconfig, "cluster: k3d-kubefirst\n    user:", "cluster: missing\n    user:", 1),
+			wantErr:    "is invalid",
+		},
+		{name: "missing kubeconfig", wantErr: "error loading kubeconfig"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tt.kubeconfig != "" {
+				writeFixture(t, dir, map[string]string{"kubeconfig": tt.kubeconfig})
+			}
+			// the stub fails on anything but the expected invocation, and when it shouldn't be reached
+			script := tt.script
+			if script == "" {
+				script = "exit 3"
+			}
+			kubeconfigPath := filepath.Join(dir, "kubeconfig")
+			cfg := &K3dConfig{
+				Kubeconfig: kubeconfigPath,
+				KubectlClient: writeStubTool(t, dir, "kubectl", `[ "$*" = "--kubeconfig `+kubeconfigPath+` --request-timeout 10s version -o json" ] || exit 2
+`+script+"\n"),
+			}
+
+			err := ValidateKubeconfig(cfg)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("ValidateKubeconfig() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("ValidateKubeconfig() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+			if strings.Contains(err.Error(), "exit status 3") {
+				t.Errorf("ValidateKubeconfig() ran kubectl with an invalid kubeconfig")
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// TailPodLogs follows the logs of the pods in namespace matching selector, streaming them to out
+// until the returned stop function is called. stop blocks until kubectl has exited and may be
+// called more than once
+func TailPodLogs(cfg *K3dConfig, namespace, selector string, out io.Writer) (stop func(), err error) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var stdErr bytes.Buffer
+	cmd := exec.CommandContext(ctx, cfg.KubectlClient, "--kubeconfig", cfg.Kubeconfig,
+		"-n", namespace, "logs", "-f", "-l", selector, "--prefix")
+	cmd.Stdout = out
+	cmd.Stderr = &stdErr
+
+	err = cmd.Start()
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("error tailing logs for %s in %s: %s", selector, namespace, err)
+	}
+	log.Info().Msgf("tailing logs for pods matching %s in %s", selector, namespace)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		err := cmd.Wait()
+		if err != nil && ctx.Err() == nil {
+			log.Warn().Msgf("kubectl logs for %s in %s exited: %s %s", selector, namespace, err, strings.TrimSpace(stdErr.String()))
+		}
+	}()
+
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			cancel()
+			<-done
+		})
+	}
+
+	return stop, nil
+}
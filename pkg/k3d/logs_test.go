@@ -0,0 +1,80 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe for the concurrent writes made while streaming
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestTailPodLogs(t *testing.T) {
+
+	toolsDir := t.TempDir()
+	cfg := &K3dConfig{
+		Kubeconfig: "/tmp/kubeconfig",
+		KubectlClient: writeStubTool(t, toolsDir, "kubectl", `[ "$*" = "--kubeconfig /tmp/kubeconfig -n argocd logs -f -l app.kubernetes.io/name=argocd-server --prefix" ] || exit 1
+echo "[pod/argocd-server-0/argocd-server] starting argocd-server"
+echo "[pod/argocd-server-0/argocd-server] failed to load repository credentials"
+exec sleep 30
+`),
+	}
+
+	var out syncBuffer
+	stop, err := TailPodLogs(cfg, "argocd", "app.kubernetes.io/name=argocd-server", &out)
+	if err != nil {
+		t.Fatalf("TailPodLogs() error = %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for strings.Count(out.String(), "\n") < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		stop()
+		stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stop() did not terminate kubectl")
+	}
+
+	want := "[pod/argocd-server-0/argocd-server] starting argocd-server\n[pod/argocd-server-0/argocd-server] failed to load repository credentials\n"
+	if got := out.String(); got != want {
+		t.Errorf("TailPodLogs() streamed %q, want %q", got, want)
+	}
+
+	_, err = TailPodLogs(&K3dConfig{KubectlClient: filepath.Join(toolsDir, "missing")}, "argocd", "app=argocd", &out)
+	if err == nil {
+		t.Error("TailPodLogs() with missing kubectl error = nil, want error")
+	}
+}
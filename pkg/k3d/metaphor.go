@@ -0,0 +1,315 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// InjectImagePullSecret adds secretName to the imagePullSecrets of every Deployment manifest
+// under metaphorDir, leaving the rest of each manifest as it was
+// files that are not plain yaml, such as helm templates, are skipped
+func InjectImagePullSecret(metaphorDir, secretName string) error {
+	if secretName == "" {
+		return fmt.Errorf("image pull secret name cannot be empty")
+	}
+
+	err := patchDeployments(metaphorDir, func(path string, podSpec *yaml.Node) {
+		addImagePullSecret(podSpec, secretName)
+		log.Info().Str("path", path).Str("secret", secretName).Msg("added image pull secret to metaphor deployment")
+	})
+	if err != nil {
+		return fmt.Errorf("error injecting image pull secret into %s: %s", metaphorDir, err)
+	}
+	return nil
+}
+
+// ValidateMetaphorURLs checks the ingress url of each metaphor environment is an absolute http(s)
+// url and that no two environments share a host, which would make their ingresses conflict
+func ValidateMetaphorURLs(values MetaphorTokenValues) error {
+	environments := []struct{ name, url string }{
+		{"development", values.MetaphorDevelopmentIngressURL},
+		{"staging", values.MetaphorStagingIngressURL},
+		{"production", values.MetaphorProductionIngressURL},
+	}
+
+	problems := []string{}
+	hosts := map[string]string{}
+	for _, environment := range environments {
+		u, err := url.Parse(environment.url)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Hostname() == "" {
+			problems = append(problems, fmt.Sprintf("%s ingress url %q is not an absolute http(s) url", environment.name, environment.url))
+			continue
+		}
+		host := strings.ToLower(u.Hostname())
+		if other, ok := hosts[host]; ok {
+			problems = append(problems, fmt.Sprintf("%s and %s share the ingress host %s", other, environment.name, host))
+			continue
+		}
+		hosts[host] = environment.name
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid metaphor ingress urls: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// ResourceSpec is a cpu and memory quantity, e.g. 100m and 128Mi, an empty value is left unchanged
+type ResourceSpec struct {
+	CPU    string
+	Memory string
+}
+
+// quantities returns the resource names and parsed quantities set in spec
+func (spec ResourceSpec) quantities() (map[string]resource.Quantity, error) {
+	quantities := map[string]resource.Quantity{}
+	for name, value := range map[string]string{"cpu": spec.CPU, "memory": spec.Memory} {
+		if value == "" {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s quantity %q: %s", name, value, err)
+		}
+		quantities[name] = quantity
+	}
+	return quantities, nil
+}
+
+// SetMetaphorResources sets the resource requests and limits of every container of the Deployment
+// manifests under metaphorDir, across all environments, e.g. to fit metaphor on a small local cluster
+// files that are not plain yaml, such as helm templates, are skipped
+func SetMetaphorResources(metaphorDir string, requests, limits ResourceSpec) error {
+	requestQuantities, err := requests.quantities()
+	if err != nil {
+		return fmt.Errorf("error setting metaphor resource requests: %s", err)
+	}
+	limitQuantities, err := limits.quantities()
+	if err != nil {
+		return fmt.Errorf("error setting metaphor resource limits: %s", err)
+	}
+	if len(requestQuantities) == 0 && len(limitQuantities) == 0 {
+		return fmt.Errorf("no metaphor resource requests or limits given")
+	}
+	for name, request := range requestQuantities {
+		if limit, ok := limitQuantities[name]; ok && request.Cmp(limit) > 0 {
+			return fmt.Errorf("metaphor %s request %s is greater than its limit %s", name, request.String(), limit.String())
+		}
+	}
+
+	err = patchDeployments(metaphorDir, func(path string, podSpec *yaml.Node) {
+		containers := mappingValue(podSpec, "containers")
+		if containers == nil || containers.Kind != yaml.SequenceNode {
+			return
+		}
+		for _, container := range containers.Content {
+			resources := ensureMapping(container, "resources")
+			setQuantities(ensureMapping(resources, "requests"), requests)
+			setQuantities(ensureMapping(resources, "limits"), limits)
+		}
+		log.Info().Str("path", path).Msg("set metaphor deployment resources")
+	})
+	if err != nil {
+		return fmt.Errorf("error setting metaphor resources in %s: %s", metaphorDir, err)
+	}
+	return nil
+}
+
+// setQuantities sets the cpu and memory keys of node to the values set in spec
+func setQuantities(node *yaml.Node, spec ResourceSpec) {
+	for _, q := range []struct{ name, value string }{{"cpu", spec.CPU}, {"memory", spec.Memory}} {
+		if q.value == "" {
+			continue
+		}
+		value := mappingValue(node, q.name)
+		if value == nil {
+			value = &yaml.Node{}
+			node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: q.name}, value)
+		}
+		*value = yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: q.value}
+	}
+}
+
+// ensureMapping returns the mapping value for key in node, adding an empty one when missing
+func ensureMapping(node *yaml.Node, key string) *yaml.Node {
+	value := mappingValue(node, key)
+	if value != nil && value.Kind == yaml.MappingNode {
+		return value
+	}
+	mapping := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	if value != nil {
+		// replace an empty or null value in place
+		*value = *mapping
+		return value
+	}
+	node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, mapping)
+	return mapping
+}
+
+// patchDeployments calls patch with the pod spec of every Deployment manifest under dir and rewrites
+// the files holding one, failing when none is found
+// files that are not plain yaml, such as helm templates, are skipped
+func patchDeployments(dir string, patch func(path string, podSpec *yaml.Node)) error {
+	deployments := 0
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if fi.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if ext := filepath.Ext(path); ext != ".yaml" && ext != ".yml" {
+			return nil
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		docs, err := decodeYAMLDocuments(content)
+		if err != nil {
+			log.Warn().Err(err).Str("path", path).Msg("skipping manifest that is not plain yaml")
+			return nil
+		}
+
+		found := 0
+		for _, doc := range docs {
+			podSpec := deploymentPodSpec(doc)
+			if podSpec == nil {
+				continue
+			}
+			found++
+			patch(path, podSpec)
+		}
+		if found == 0 {
+			return nil
+		}
+		deployments += found
+
+		out, err := encodeYAMLDocuments(docs)
+		if err != nil {
+			return fmt.Errorf("error encoding %s: %s", path, err)
+		}
+		return os.WriteFile(path, out, fi.Mode().Perm())
+	})
+	if err != nil {
+		return err
+	}
+	if deployments == 0 {
+		return fmt.Errorf("no deployment manifests found in %s", dir)
+	}
+	return nil
+}
+
+// decodeYAMLDocuments parses every document in content
+func decodeYAMLDocuments(content []byte) ([]*yaml.Node, error) {
+	docs := []*yaml.Node{}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	for {
+		doc := &yaml.Node{}
+		err := decoder.Decode(doc)
+		if errors.Is(err, io.EOF) {
+			return docs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+}
+
+// encodeYAMLDocuments writes docs as a multi document yaml stream with two space indentation
+func encodeYAMLDocuments(docs []*yaml.Node) ([]byte, error) {
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	for _, doc := range docs {
+		err := encoder.Encode(doc)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := encoder.Close()
+	if err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// deploymentPodSpec returns the spec.template.spec node of a Deployment document, nil for other kinds
+func deploymentPodSpec(doc *yaml.Node) *yaml.Node {
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 {
+		return nil
+	}
+	root := doc.Content[0]
+	kind := mappingValue(root, "kind")
+	if kind == nil || kind.Value != "Deployment" {
+		return nil
+	}
+
+	node := root
+	for _, key := range []string{"spec", "template", "spec"} {
+		node = mappingValue(node, key)
+		if node == nil || node.Kind != yaml.MappingNode {
+			return nil
+		}
+	}
+	return node
+}
+
+// mappingValue returns the value for key in a mapping node
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// addImagePullSecret appends secretName to the pod spec imagePullSecrets unless already referenced
+func addImagePullSecret(podSpec *yaml.Node, secretName string) {
+	secrets := mappingValue(podSpec, "imagePullSecrets")
+	if secrets == nil || secrets.Kind != yaml.SequenceNode {
+		secrets = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		podSpec.Content = append(podSpec.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "imagePullSecrets"},
+			secrets,
+		)
+	}
+
+	for _, secret := range secrets.Content {
+		if name := mappingValue(secret, "name"); name != nil && name.Value == secretName {
+			return
+		}
+	}
+	secrets.Content = append(secrets.Content, &yaml.Node{
+		Kind: yaml.MappingNode,
+		Tag:  "!!map",
+		Content: []*yaml.Node{
+			{Kind: yaml.ScalarNode, Tag: "!!str", Value: "name"},
+			{Kind: yaml.ScalarNode, Tag: "!!str", Value: secretName},
+		},
+	})
+}
@@ -0,0 +1,266 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+const metaphorDeployment = `# metaphor deployment
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: metaphor
+spec:
+  template:
+    spec:
+      containers:
+        - name: metaphor
+          image: ghcr.io/kubefirst/metaphor:latest
+`
+
+func TestInjectImagePullSecret(t *testing.T) {
+
+	metaphorDir := t.TempDir()
+	writeFixture(t, metaphorDir, map[string]string{
+		"kubernetes/development/deployment.yaml": metaphorDeployment,
+		"kubernetes/staging/deployment.yaml":     metaphorDeployment + "---\napiVersion: v1\nkind: Service\nmetadata:\n  name: metaphor\n",
+		"kubernetes/production/deployment.yml": strings.Replace(metaphorDeployment, "      containers:",
+			"      imagePullSecrets:\n        - name: registry-auth\n      containers:", 1),
+		"kubernetes/service.yaml":               "apiVersion: v1\nkind: Service\nmetadata:\n  name: metaphor\n",
+		"charts/metaphor/templates/deploy.yaml": "kind: Deployment\n{{- if .Values.enabled }}\n",
+	})
+
+	err := InjectImagePullSecret(metaphorDir, "registry-auth")
+	if err != nil {
+		t.Fatalf("InjectImagePullSecret() error = %v", err)
+	}
+
+	for _, path := range []string{
+		"kubernetes/development/deployment.yaml",
+		"kubernetes/staging/deployment.yaml",
+		"kubernetes/production/deployment.yml",
+	} {
+		t.Run(path, func(t *testing.T) {
+			content, err := os.ReadFile(filepath.Join(metaphorDir, path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(content), "# metaphor deployment") {
+				t.Errorf("comment was not preserved:\n%s", content)
+			}
+
+			docs, err := decodeYAMLDocuments(content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var deployment struct {
+				Spec struct {
+					Template struct {
+						Spec struct {
+							ImagePullSecrets []struct{ Name string } `yaml:"imagePullSecrets"`
+							Containers       []struct{ Image string }
+						}
+					}
+				}
+			}
+			if err := docs[0].Decode(&deployment); err != nil {
+				t.Fatal(err)
+			}
+			podSpec := deployment.Spec.Template.Spec
+			if len(podSpec.ImagePullSecrets) != 1 || podSpec.ImagePullSecrets[0].Name != "registry-auth" {
+				t.Errorf("imagePullSecrets = %v, want [registry-auth]", podSpec.ImagePullSecrets)
+			}
+			if len(podSpec.Containers) != 1 || podSpec.Containers[0].Image != "ghcr.io/kubefirst/metaphor:latest" {
+				t.Errorf("containers were not preserved: %v", podSpec.Containers)
+			}
+		})
+	}
+
+	service, _ := os.ReadFile(filepath.Join(metaphorDir, "kubernetes/service.yaml"))
+	if strings.Contains(string(service), "imagePullSecrets") {
+		t.Errorf("service manifest was modified:\n%s", service)
+	}
+	staging, _ := os.ReadFile(filepath.Join(metaphorDir, "kubernetes/staging/deployment.yaml"))
+	var stagingDocs []*yaml.Node
+	if stagingDocs, err = decodeYAMLDocuments(staging); err != nil || len(stagingDocs) != 2 {
+		t.Errorf("staging manifest documents = %d, want 2 (err %v)", len(stagingDocs), err)
+	}
+}
+
+func TestInjectImagePullSecretNoDeployments(t *testing.T) {
+
+	metaphorDir := t.TempDir()
+	writeFixture(t, metaphorDir, map[string]string{"kubernetes/service.yaml": "kind: Service\n"})
+
+	if err := InjectImagePullSecret(metaphorDir, "registry-auth"); err == nil {
+		t.Error("InjectImagePullSecret() expected an error without deployment manifests")
+	}
+}
+
+func TestSetMetaphorResources(t *testing.T) {
+
+	withResources := metaphorDeployment + `          resources:
+            requests:
+              cpu: 500m
+              memory: 1Gi
+        - name: sidecar
+          image: envoyproxy/envoy:v1.25.0
+          resources: {}
+`
+	environments := []string{"development", "staging", "production"}
+
+	tests := []struct {
+		name     string
+		requests ResourceSpec
+		limits   ResourceSpec
+		want     map[string]map[string]string
+		wantErr  bool
+	}{
+		{
+			name:     "requests and limits",
+			requests: ResourceSpec{CPU: "50m", Memory: "64Mi"},
+			limits:   ResourceSpec{CPU: "200m", Memory: "256Mi"},
+			want: map[string]map[string]string{
+				"requests": {"cpu": "50m", "memory": "64Mi"},
+				"limits":   {"cpu": "200m", "memory": "256Mi"},
+			},
+		},
+		{
+			name:     "memory only",
+			requests: ResourceSpec{Memory: "64Mi"},
+			want:     map[string]map[string]string{"requests": {"memory": "64Mi"}},
+		},
+		{name: "invalid quantity", requests: ResourceSpec{CPU: "lots"}, wantErr: true},
+		{name: "request above limit", requests: ResourceSpec{Memory: "1Gi"}, limits: ResourceSpec{Memory: "512Mi"}, wantErr: true},
+		{name: "nothing to set", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metaphorDir := t.TempDir()
+			files := map[string]string{"kubernetes/service.yaml": "apiVersion: v1\nkind: Service\nmetadata:\n  name: metaphor\n"}
+			for _, environment := range environments {
+				files["kubernetes/"+environment+"/deployment.yaml"] = withResources
+			}
+			writeFixture(t, metaphorDir, files)
+
+			err := SetMetaphorResources(metaphorDir, tt.requests, tt.limits)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SetMetaphorResources() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				got, _ := os.ReadFile(filepath.Join(metaphorDir, "kubernetes", "development", "deployment.yaml"))
+				if string(got) != withResources {
+					t.Errorf("SetMetaphorResources() modified the manifest on error: %s", got)
+				}
+				return
+			}
+
+			for _, environment := range environments {
+				content, err := os.ReadFile(filepath.Join(metaphorDir, "kubernetes", environment, "deployment.yaml"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				var deployment struct {
+					Kind string
+					Spec struct {
+						Template struct {
+							Spec struct {
+								Containers []struct {
+									Name      string
+									Image     string
+									Resources map[string]map[string]string
+								}
+							}
+						}
+					}
+				}
+				if err := yaml.Unmarshal(content, &deployment); err != nil {
+					t.Fatalf("%s deployment is not valid yaml: %v", environment, err)
+				}
+				containers := deployment.Spec.Template.Spec.Containers
+				if len(containers) != 2 || containers[0].Image != "ghcr.io/kubefirst/metaphor:latest" {
+					t.Fatalf("%s containers = %+v, want both containers kept", environment, containers)
+				}
+				for _, container := range containers {
+					for kind, values := range tt.want {
+						for name, want := range values {
+							if got := container.Resources[kind][name]; got != want {
+								t.Errorf("%s %s %s.%s = %q, want %q", environment, container.Name, kind, name, got, want)
+							}
+						}
+					}
+				}
+				// values not given are left as they were
+				if _, ok := tt.want["requests"]["cpu"]; !ok && containers[0].Resources["requests"]["cpu"] != "500m" {
+					t.Errorf("%s metaphor cpu request = %q, want it unchanged", environment, containers[0].Resources["requests"]["cpu"])
+				}
+				if !strings.HasPrefix(string(content), "# metaphor deployment") {
+					t.Errorf("%s deployment lost its comment", environment)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateMetaphorURLs(t *testing.T) {
+
+	valid := BuildMetaphorValues(&K3dConfig{ClusterName: "kubefirst"}, "", "")
+
+	tests := []struct {
+		name    string
+		modify  func(v *MetaphorTokenValues)
+		wantErr []string
+	}{
+		{name: "distinct urls", modify: func(v *MetaphorTokenValues) {}},
+		{
+			name:    "staging duplicates development",
+			modify:  func(v *MetaphorTokenValues) { v.MetaphorStagingIngressURL = v.MetaphorDevelopmentIngressURL },
+			wantErr: []string{"development and staging share the ingress host metaphor-development.kubefirst.dev"},
+		},
+		{
+			name: "same host with a different path",
+			modify: func(v *MetaphorTokenValues) {
+				v.MetaphorProductionIngressURL = "https://METAPHOR-DEVELOPMENT.kubefirst.dev/prod"
+			},
+			wantErr: []string{"development and production share"},
+		},
+		{
+			name:    "untemplated url",
+			modify:  func(v *MetaphorTokenValues) { v.MetaphorStagingIngressURL = "<METAPHOR_STAGING_INGRESS_URL>" },
+			wantErr: []string{`staging ingress url "<METAPHOR_STAGING_INGRESS_URL>" is not an absolute http(s) url`},
+		},
+		{
+			name: "empty urls",
+			modify: func(v *MetaphorTokenValues) {
+				v.MetaphorDevelopmentIngressURL, v.MetaphorProductionIngressURL = "", ""
+			},
+			wantErr: []string{"development ingress url", "production ingress url"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := valid
+			tt.modify(&values)
+
+			err := ValidateMetaphorURLs(values)
+			if (err != nil) != (len(tt.wantErr) > 0) {
+				t.Fatalf("ValidateMetaphorURLs() error = %v, want error containing %v", err, tt.wantErr)
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("ValidateMetaphorURLs() error = %q, want it to contain %q", err, want)
+				}
+			}
+		})
+	}
+}
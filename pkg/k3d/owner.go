@@ -0,0 +1,160 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// gitlabDeveloperAccess is the minimum gitlab group access level able to create and push projects
+const gitlabDeveloperAccess = 30
+
+// ValidateOwnerAccess checks the configured git token belongs to cfg.GitOwner or to an active
+// member of the cfg.GitOwner organization (group on gitlab)
+func ValidateOwnerAccess(cfg *K3dConfig) error {
+	if cfg.GitOwner == "" {
+		return fmt.Errorf("error validating owner access: git owner is not set")
+	}
+
+	httpClient, err := ProviderHttpClient(cfg)
+	if err != nil {
+		return err
+	}
+
+	switch cfg.GitProvider {
+	case "github":
+		err = validateGithubOwnerAccess(httpClient, cfg.GithubToken, cfg.GitOwner)
+	case "gitlab":
+		err = validateGitlabOwnerAccess(httpClient, cfg.GitlabToken, gitlabAPIHostFor(cfg), cfg.GitOwner)
+	default:
+		return fmt.Errorf("unsupported git provider %q", cfg.GitProvider)
+	}
+	if err != nil {
+		return err
+	}
+	log.Info().Str("owner", cfg.GitOwner).Msg("git token has access to the git owner")
+	return nil
+}
+
+// getProviderJSON sends an authenticated GET to apiURL and decodes a 200 response into out,
+// returning the status code so callers can interpret 403 and 404
+func getProviderJSON(httpClient *http.Client, apiURL string, header http.Header, out interface{}) (int, error) {
+	req, err := http.NewRequest(http.MethodGet, apiURL, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error building request for %s: %s", apiURL, err)
+	}
+	req.Header = header
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("error calling %s: %s", apiURL, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return res.StatusCode, nil
+	}
+	err = json.NewDecoder(res.Body).Decode(out)
+	if err != nil {
+		return res.StatusCode, fmt.Errorf("error decoding response from %s: %s", apiURL, err)
+	}
+	return res.StatusCode, nil
+}
+
+func validateGithubOwnerAccess(httpClient *http.Client, token, owner string) error {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+token)
+	header.Set("Accept", "application/vnd.github+json")
+
+	var user struct {
+		Login string `json:"login"`
+	}
+	status, err := getProviderJSON(httpClient, fmt.Sprintf("%s/user", githubAPIURL), header, &user)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusUnauthorized {
+		return fmt.Errorf("github token was rejected, check it is valid and not expired")
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("unexpected status %d looking up the github token user", status)
+	}
+	if strings.EqualFold(user.Login, owner) {
+		return nil
+	}
+
+	var membership struct {
+		State string `json:"state"`
+	}
+	status, err = getProviderJSON(httpClient, fmt.Sprintf("%s/user/memberships/orgs/%s", githubAPIURL, url.PathEscape(owner)), header, &membership)
+	if err != nil {
+		return err
+	}
+	switch {
+	case status == http.StatusOK && membership.State == "active":
+		return nil
+	case status == http.StatusOK:
+		return fmt.Errorf("github user %s has a %s membership of %s, accept the invitation before installing", user.Login, membership.State, owner)
+	case status == http.StatusNotFound:
+		return fmt.Errorf("github user %s is not the owner or a member of %s, check the git owner or use a token from a member of %s", user.Login, owner, owner)
+	case status == http.StatusForbidden:
+		return fmt.Errorf("github token for %s cannot read its membership of %s, grant the token the read:org scope", user.Login, owner)
+	default:
+		return fmt.Errorf("unexpected status %d checking github membership of %s", status, owner)
+	}
+}
+
+func validateGitlabOwnerAccess(httpClient *http.Client, token, host, owner string) error {
+	base := providerAPIBase(host)
+	header := http.Header{}
+	header.Set("PRIVATE-TOKEN", token)
+
+	var user struct {
+		ID       int    `json:"id"`
+		Username string `json:"username"`
+	}
+	status, err := getProviderJSON(httpClient, fmt.Sprintf("%s/api/v4/user", base), header, &user)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusUnauthorized {
+		return fmt.Errorf("gitlab token was rejected by %s, check it is valid and not expired", host)
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("unexpected status %d looking up the gitlab token user", status)
+	}
+	if strings.EqualFold(user.Username, owner) {
+		return nil
+	}
+
+	var member struct {
+		AccessLevel int    `json:"access_level"`
+		State       string `json:"state"`
+	}
+	memberURL := fmt.Sprintf("%s/api/v4/groups/%s/members/all/%d", base, url.PathEscape(owner), user.ID)
+	status, err = getProviderJSON(httpClient, memberURL, header, &member)
+	if err != nil {
+		return err
+	}
+	switch {
+	case status == http.StatusNotFound:
+		return fmt.Errorf("gitlab user %s is not the owner or a member of group %s, check the git owner or use a token from a member of %s", user.Username, owner, owner)
+	case status != http.StatusOK:
+		return fmt.Errorf("unexpected status %d checking gitlab membership of %s", status, owner)
+	case member.State != "" && member.State != "active":
+		return fmt.Errorf("gitlab user %s has a %s membership of group %s", user.Username, member.State, owner)
+	case member.AccessLevel < gitlabDeveloperAccess:
+		return fmt.Errorf("gitlab user %s has access level %d in group %s, at least developer (%d) is required", user.Username, member.AccessLevel, owner, gitlabDeveloperAccess)
+	}
+	return nil
+}
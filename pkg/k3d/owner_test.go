@@ -0,0 +1,101 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newMembershipProvider returns a github and gitlab api where "token" belongs to kubefirst-bot (id 7)
+// and responses maps a membership path to its status and body
+func newMembershipProvider(t *testing.T, responses map[string]struct {
+	status int
+	body   string
+}) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" && r.Header.Get("PRIVATE-TOKEN") != "token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/user":
+			w.Write([]byte(`{"login":"kubefirst-bot"}`))
+			return
+		case "/api/v4/user":
+			w.Write([]byte(`{"id":7,"username":"kubefirst-bot"}`))
+			return
+		}
+		response, ok := responses[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(response.status)
+		w.Write([]byte(response.body))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestValidateOwnerAccess(t *testing.T) {
+
+	server := newMembershipProvider(t, map[string]struct {
+		status int
+		body   string
+	}{
+		"/user/memberships/orgs/kubefirst":       {status: http.StatusOK, body: `{"state":"active","role":"member"}`},
+		"/user/memberships/orgs/invited":         {status: http.StatusOK, body: `{"state":"pending","role":"member"}`},
+		"/user/memberships/orgs/private":         {status: http.StatusForbidden, body: `{"message":"Must have admin rights"}`},
+		"/api/v4/groups/kubefirst/members/all/7": {status: http.StatusOK, body: `{"access_level":40,"state":"active"}`},
+		"/api/v4/groups/readers/members/all/7":   {status: http.StatusOK, body: `{"access_level":20,"state":"active"}`},
+	})
+	defaultGithubAPIURL, defaultGitlabAPIHost := githubAPIURL, gitlabAPIHost
+	defer func() { githubAPIURL, gitlabAPIHost = defaultGithubAPIURL, defaultGitlabAPIHost }()
+	githubAPIURL, gitlabAPIHost = server.URL, server.URL
+
+	tests := []struct {
+		name        string
+		gitProvider string
+		gitOwner    string
+		token       string
+		wantErr     string
+	}{
+		{name: "github personal account", gitProvider: "github", gitOwner: "Kubefirst-Bot"},
+		{name: "github org member", gitProvider: "github", gitOwner: "kubefirst"},
+		{name: "github not a member", gitProvider: "github", gitOwner: "other-org", wantErr: "not the owner or a member of other-org"},
+		{name: "github pending invitation", gitProvider: "github", gitOwner: "invited", wantErr: "pending membership"},
+		{name: "github missing read:org", gitProvider: "github", gitOwner: "private", wantErr: "read:org"},
+		{name: "github rejected token", gitProvider: "github", gitOwner: "kubefirst", token: "expired", wantErr: "rejected"},
+		{name: "gitlab personal namespace", gitProvider: "gitlab", gitOwner: "kubefirst-bot"},
+		{name: "gitlab group maintainer", gitProvider: "gitlab", gitOwner: "kubefirst"},
+		{name: "gitlab reporter", gitProvider: "gitlab", gitOwner: "readers", wantErr: "access level 20"},
+		{name: "gitlab not a member", gitProvider: "gitlab", gitOwner: "other-group", wantErr: "not the owner or a member of group other-group"},
+		{name: "missing owner", gitProvider: "github", wantErr: "git owner is not set"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := tt.token
+			if token == "" {
+				token = "token"
+			}
+			cfg := &K3dConfig{GitProvider: tt.gitProvider, GitOwner: tt.gitOwner, GithubToken: token, GitlabToken: token}
+
+			err := ValidateOwnerAccess(cfg)
+			if (err != nil) != (tt.wantErr != "") {
+				t.Fatalf("ValidateOwnerAccess() error = %v, wantErr %q", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ValidateOwnerAccess() error = %q, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,19 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"net/http"
+
+	"github.com/kubefirst/runtime/pkg/httpCommon"
+)
+
+// ProviderHttpClient returns the http client used for git provider API calls,
+// trusting cfg.CACertPath in addition to the system roots when set
+func ProviderHttpClient(cfg *K3dConfig) (*http.Client, error) {
+	return httpCommon.CustomHttpClientWithCA(cfg.CACertPath)
+}
@@ -0,0 +1,58 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProviderHttpClientCABundle(t *testing.T) {
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	caCertPath := filepath.Join(t.TempDir(), "ca.pem")
+	caCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(caCertPath, caCert, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		caCertPath string
+		wantErr    bool
+	}{
+		{name: "custom ca bundle trusted", caCertPath: caCertPath},
+		{name: "system roots only", caCertPath: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := ProviderHttpClient(&K3dConfig{CACertPath: tt.caCertPath})
+			if err != nil {
+				t.Fatalf("ProviderHttpClient() error = %v", err)
+			}
+			res, err := client.Get(srv.URL)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("client.Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				res.Body.Close()
+			}
+		})
+	}
+
+	if _, err := ProviderHttpClient(&K3dConfig{CACertPath: filepath.Join(t.TempDir(), "missing.pem")}); err == nil {
+		t.Error("ProviderHttpClient() expected error for missing ca bundle")
+	}
+}
@@ -0,0 +1,369 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// RegistryPath returns the registry directory of clusterName in the gitops repo at gitopsRepoDir,
+// rejecting cluster names that are empty, contain a path separator or traverse out of the registry
+func RegistryPath(gitopsRepoDir, clusterName string) (string, error) {
+	if clusterName == "" || clusterName == "." || strings.Contains(clusterName, "..") || strings.ContainsAny(clusterName, `/\`) {
+		return "", fmt.Errorf("invalid cluster name %q, the name must not be empty or contain path separators or ..", clusterName)
+	}
+	return fmt.Sprintf("%s/registry/%s", gitopsRepoDir, clusterName), nil
+}
+
+// Component is an Argo CD Application found under registry/<clusterName>/components, Path and
+// RepoURL are those of its first source
+type Component struct {
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	RepoURL string `json:"repoURL"`
+}
+
+// ListRegistryComponents returns the Argo CD Applications defined under the components of the
+// registry of clusterName, sorted by name. Helm chart templates and manifests that are not plain
+// yaml are skipped
+func ListRegistryComponents(gitopsRepoDir, clusterName string) ([]Component, error) {
+	registryPath, err := RegistryPath(gitopsRepoDir, clusterName)
+	if err != nil {
+		return nil, err
+	}
+	componentsDir := filepath.Join(registryPath, "components")
+	if _, err := os.Stat(componentsDir); err != nil {
+		return nil, fmt.Errorf("error reading components for cluster %s: %s", clusterName, err)
+	}
+
+	components := []Component{}
+	err = filepath.Walk(componentsDir, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if isHelmTemplatesDir(file) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if ext := filepath.Ext(file); ext != ".yaml" && ext != ".yml" {
+			return nil
+		}
+
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		docs, err := decodeYAMLDocuments(content)
+		if err != nil {
+			log.Warn().Err(err).Str("path", file).Msg("skipping manifest that is not plain yaml")
+			return nil
+		}
+
+		for _, doc := range docs {
+			if len(doc.Content) == 0 {
+				continue
+			}
+			root := doc.Content[0]
+			if kind := mappingValue(root, "kind"); kind == nil || kind.Value != "Application" {
+				continue
+			}
+
+			component := Component{}
+			if metadata := mappingValue(root, "metadata"); metadata != nil {
+				if name := mappingValue(metadata, "name"); name != nil {
+					component.Name = name.Value
+				}
+			}
+			if sources := applicationSources(doc); len(sources) > 0 {
+				if sourcePath := mappingValue(sources[0], "path"); sourcePath != nil {
+					component.Path = sourcePath.Value
+				}
+				if repoURL := mappingValue(sources[0], "repoURL"); repoURL != nil {
+					component.RepoURL = repoURL.Value
+				}
+			}
+			components = append(components, component)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing components for cluster %s: %s", clusterName, err)
+	}
+
+	sort.Slice(components, func(i, j int) bool { return components[i].Name < components[j].Name })
+	return components, nil
+}
+
+// FixRegistryPaths rewrites the source paths of the Argo CD Application manifests under
+// registryPath so they point inside registry/<clusterName>
+//   - cluster-types/<type>/... and registry/<other>/... are moved under registry/<clusterName>
+//   - ./ and ../ paths are resolved against the manifest directory
+//
+// paths already under registry/<clusterName> and paths outside the registry are left as they are
+func FixRegistryPaths(registryPath, clusterName string) error {
+	return fixRegistryPaths(registryPath, clusterName, nil)
+}
+
+// fixRegistryPaths is FixRegistryPaths recording every rewritten manifest in audit
+func fixRegistryPaths(registryPath, clusterName string, audit *auditLog) error {
+	// the registry lives at <gitops>/registry/<clusterName>, application paths are relative to <gitops>
+	repoRoot := filepath.Dir(filepath.Dir(registryPath))
+	clusterRegistry := path.Join("registry", clusterName)
+
+	return filepath.Walk(registryPath, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		if ext := filepath.Ext(file); ext != ".yaml" && ext != ".yml" {
+			return nil
+		}
+
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		docs, err := decodeYAMLDocuments(content)
+		if err != nil {
+			log.Warn().Err(err).Str("path", file).Msg("skipping manifest that is not plain yaml")
+			return nil
+		}
+
+		manifestDir, err := filepath.Rel(repoRoot, filepath.Dir(file))
+		if err != nil {
+			return err
+		}
+
+		changed := false
+		for _, doc := range docs {
+			for _, source := range applicationSources(doc) {
+				sourcePath := mappingValue(source, "path")
+				if sourcePath == nil || sourcePath.Kind != yaml.ScalarNode {
+					continue
+				}
+				fixed, err := fixRegistryPath(sourcePath.Value, filepath.ToSlash(manifestDir), clusterRegistry)
+				if err != nil {
+					return fmt.Errorf("error fixing path in %s: %s", file, err)
+				}
+				if fixed != sourcePath.Value {
+					log.Info().Str("path", file).Str("from", sourcePath.Value).Str("to", fixed).Msg("fixing application source path")
+					sourcePath.Value = fixed
+					changed = true
+				}
+			}
+		}
+		if !changed {
+			return nil
+		}
+
+		out, err := encodeYAMLDocuments(docs)
+		if err != nil {
+			return fmt.Errorf("error encoding %s: %s", file, err)
+		}
+		err = os.WriteFile(file, out, fi.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		audit.record(auditRewrite, file, "")
+		return nil
+	})
+}
+
+// ValidateManifests parses every yaml manifest under dir, including each document of multi
+// document files, and returns the first parse error with its file and line. Helm chart
+// templates are skipped as they are not yaml until rendered
+func ValidateManifests(dir string) error {
+	return filepath.Walk(dir, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if fi.Name() == ".git" || isHelmTemplatesDir(file) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if ext := filepath.Ext(file); ext != ".yaml" && ext != ".yml" {
+			return nil
+		}
+
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("error reading manifest %s: %s", file, err)
+		}
+
+		decoder := yaml.NewDecoder(bytes.NewReader(content))
+		for doc := 1; ; doc++ {
+			var node yaml.Node
+			err = decoder.Decode(&node)
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				// yaml errors carry the line within the file, e.g. yaml: line 4: ...
+				return fmt.Errorf("invalid manifest %s document %d: %s", file, doc, err)
+			}
+		}
+	})
+}
+
+// isHelmTemplatesDir reports whether dir holds the templates of a helm chart
+func isHelmTemplatesDir(dir string) bool {
+	if filepath.Base(dir) != "templates" {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(filepath.Dir(dir), "Chart.yaml"))
+	return err == nil
+}
+
+// fixRegistryPath returns sourcePath relocated under clusterRegistry
+func fixRegistryPath(sourcePath, manifestDir, clusterRegistry string) (string, error) {
+	if strings.HasPrefix(sourcePath, "./") || strings.HasPrefix(sourcePath, "../") {
+		resolved := path.Join(manifestDir, sourcePath)
+		if resolved != clusterRegistry && !strings.HasPrefix(resolved, clusterRegistry+"/") {
+			return "", fmt.Errorf("relative path %s resolves to %s outside %s", sourcePath, resolved, clusterRegistry)
+		}
+		return resolved, nil
+	}
+
+	parts := strings.SplitN(sourcePath, "/", 3)
+	if len(parts) == 3 && (parts[0] == "cluster-types" || parts[0] == "registry") {
+		return path.Join(clusterRegistry, parts[2]), nil
+	}
+
+	return sourcePath, nil
+}
+
+// applicationSources returns the spec.source and spec.sources entries of an Argo CD Application document
+func applicationSources(doc *yaml.Node) []*yaml.Node {
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 {
+		return nil
+	}
+	root := doc.Content[0]
+	kind := mappingValue(root, "kind")
+	if kind == nil || kind.Value != "Application" {
+		return nil
+	}
+	spec := mappingValue(root, "spec")
+	if spec == nil {
+		return nil
+	}
+
+	sources := []*yaml.Node{}
+	if source := mappingValue(spec, "source"); source != nil && source.Kind == yaml.MappingNode {
+		sources = append(sources, source)
+	}
+	if multiple := mappingValue(spec, "sources"); multiple != nil && multiple.Kind == yaml.SequenceNode {
+		for _, source := range multiple.Content {
+			if source.Kind == yaml.MappingNode {
+				sources = append(sources, source)
+			}
+		}
+	}
+	return sources
+}
+
+// RegistryChange is how a file differs between two registries
+type RegistryChange string
+
+const (
+	RegistryFileAdded    RegistryChange = "added"
+	RegistryFileRemoved  RegistryChange = "removed"
+	RegistryFileModified RegistryChange = "modified"
+)
+
+// RegistryDiff is a file that differs between two registries, Path is relative to the registry root
+type RegistryDiff struct {
+	Path   string
+	Change RegistryChange
+}
+
+// DiffRegistries compares the files of two populated registries, e.g. adjusted against two template
+// versions, returning the files added in pathB, removed from pathA and modified, sorted by path
+func DiffRegistries(pathA, pathB string) ([]RegistryDiff, error) {
+	filesA, err := registryFiles(pathA)
+	if err != nil {
+		return nil, err
+	}
+	filesB, err := registryFiles(pathB)
+	if err != nil {
+		return nil, err
+	}
+
+	diffs := []RegistryDiff{}
+	for rel, fileA := range filesA {
+		fileB, ok := filesB[rel]
+		if !ok {
+			diffs = append(diffs, RegistryDiff{Path: rel, Change: RegistryFileRemoved})
+			continue
+		}
+		contentA, err := os.ReadFile(fileA)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %s", fileA, err)
+		}
+		contentB, err := os.ReadFile(fileB)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %s", fileB, err)
+		}
+		if !bytes.Equal(contentA, contentB) {
+			diffs = append(diffs, RegistryDiff{Path: rel, Change: RegistryFileModified})
+		}
+	}
+	for rel := range filesB {
+		if _, ok := filesA[rel]; !ok {
+			diffs = append(diffs, RegistryDiff{Path: rel, Change: RegistryFileAdded})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Path < diffs[j].Path })
+
+	return diffs, nil
+}
+
+// registryFiles maps the slash separated path, relative to root, of every regular file under root
+// to its full path, ignoring .git
+func registryFiles(root string) (map[string]string, error) {
+	files := map[string]string{}
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if fi.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = p
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing registry files in %s: %s", root, err)
+	}
+	return files, nil
+}
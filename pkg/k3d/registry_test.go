@@ -0,0 +1,263 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// application returns an Argo CD Application manifest with a single source path
+func application(name, sourcePath string) string {
+	return `apiVersion: argoproj.io/v1alpha1
+kind: Application
+metadata:
+  name: ` + name + `
+spec:
+  source:
+    repoURL: https://github.com/kubefirst/gitops.git
+    path: ` + sourcePath + `
+    targetRevision: HEAD
+`
+}
+
+func TestFixRegistryPaths(t *testing.T) {
+
+	gitopsDir := t.TempDir()
+	registryPath := filepath.Join(gitopsDir, "registry", "kubefirst")
+	writeFixture(t, registryPath, map[string]string{
+		"components/vault/application.yaml":         application("vault", "cluster-types/mgmt/components/vault/chart"),
+		"components/vault/config.yaml":              application("vault-config", "../vault-config"),
+		"components/argocd/application.yaml":        application("argocd", "registry/mgmt/components/argocd/install"),
+		"components/metaphor/application.yaml":      application("metaphor", "./manifests"),
+		"components/kubefirst/application.yaml":     application("kubefirst", "registry/kubefirst/components/kubefirst/chart"),
+		"components/external/application.yaml":      application("external", "charts/external"),
+		"components/vault-config/configmap.yaml":    "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: path\ndata:\n  path: cluster-types/mgmt\n",
+		"components/argo-workflows/application.yml": "kind: Application\nspec:\n  sources:\n    - path: cluster-types/mgmt/components/argo-workflows\n    - chart: argo-workflows\n",
+	})
+
+	err := FixRegistryPaths(registryPath, "kubefirst")
+	if err != nil {
+		t.Fatalf("FixRegistryPaths() error = %v", err)
+	}
+
+	tests := []struct {
+		file string
+		want string
+	}{
+		{file: "components/vault/application.yaml", want: application("vault", "registry/kubefirst/components/vault/chart")},
+		{file: "components/vault/config.yaml", want: application("vault-config", "registry/kubefirst/components/vault-config")},
+		{file: "components/argocd/application.yaml", want: application("argocd", "registry/kubefirst/components/argocd/install")},
+		{file: "components/metaphor/application.yaml", want: application("metaphor", "registry/kubefirst/components/metaphor/manifests")},
+		{file: "components/kubefirst/application.yaml", want: application("kubefirst", "registry/kubefirst/components/kubefirst/chart")},
+		{file: "components/external/application.yaml", want: application("external", "charts/external")},
+		{file: "components/vault-config/configmap.yaml", want: "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: path\ndata:\n  path: cluster-types/mgmt\n"},
+		{file: "components/argo-workflows/application.yml", want: "kind: Application\nspec:\n  sources:\n    - path: registry/kubefirst/components/argo-workflows\n    - chart: argo-workflows\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			got, err := os.ReadFile(filepath.Join(registryPath, tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("FixRegistryPaths() %s =\n%s\nwant\n%s", tt.file, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFixRegistryPathsOutsideRegistry(t *testing.T) {
+
+	gitopsDir := t.TempDir()
+	registryPath := filepath.Join(gitopsDir, "registry", "kubefirst")
+	writeFixture(t, registryPath, map[string]string{
+		"components/vault/application.yaml": application("vault", "../../../../terraform"),
+	})
+
+	if err := FixRegistryPaths(registryPath, "kubefirst"); err == nil {
+		t.Error("FixRegistryPaths() expected an error for a path escaping the registry")
+	}
+}
+
+func TestValidateManifests(t *testing.T) {
+
+	valid := map[string]string{
+		"kubefirst/argocd.yaml":                                "apiVersion: argoproj.io/v1alpha1\nkind: Application\nmetadata:\n  name: argocd\n",
+		"kubefirst/components/vault/resources.yaml":            "apiVersion: v1\nkind: Namespace\nmetadata:\n  name: vault\n---\napiVersion: v1\nkind: ServiceAccount\nmetadata:\n  name: vault\n",
+		"kubefirst/components/chart/Chart.yaml":                "apiVersion: v2\nname: chart\nversion: 0.1.0\n",
+		"kubefirst/components/chart/templates/deployment.yaml": "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: {{ .Release.Name }}\n  {{- include \"labels\" . | nindent 2 }}\n",
+		"kubefirst/README.md":                                  "not: [yaml\n",
+	}
+
+	tests := []struct {
+		name    string
+		broken  map[string]string
+		wantErr []string
+	}{
+		{name: "valid manifests"},
+		{
+			name:    "broken manifest",
+			broken:  map[string]string{"kubefirst/components/argo/wait.yml": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: wait\ndata:\n  key: value\n  other: [unterminated\n"},
+			wantErr: []string{"wait.yml", "document 1", "line 6"},
+		},
+		{
+			name:    "broken second document",
+			broken:  map[string]string{"kubefirst/components/vault/policy.yaml": "apiVersion: v1\nkind: Namespace\nmetadata:\n  name: vault\n---\napiVersion: v1\nkind: ConfigMap\n  name: bad\n"},
+			wantErr: []string{"policy.yaml", "document 2", "line 8"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registryDir := t.TempDir()
+			writeFixture(t, registryDir, valid)
+			writeFixture(t, registryDir, tt.broken)
+
+			err := ValidateManifests(registryDir)
+			if (err != nil) != (len(tt.wantErr) > 0) {
+				t.Fatalf("ValidateManifests() error = %v, want error containing %v", err, tt.wantErr)
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("ValidateManifests() error = %q, want it to contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDiffRegistries(t *testing.T) {
+
+	root := t.TempDir()
+	registryA := filepath.Join(root, "v1", "registry", "kubefirst")
+	registryB := filepath.Join(root, "v2", "registry", "kubefirst")
+	writeFixture(t, registryA, map[string]string{
+		"argocd.yaml":                          application("argocd", "registry/kubefirst/components/argocd"),
+		"vault.yaml":                           application("vault", "registry/kubefirst/components/vault"),
+		"chartmuseum.yaml":                     application("chartmuseum", "registry/kubefirst/components/chartmuseum"),
+		"components/vault/application.yaml":    "chart: vault\nversion: 0.22.0\n",
+		".git/HEAD":                            "ref: refs/heads/main\n",
+		"components/argocd/kustomization.yaml": "resources: []\n",
+	})
+	writeFixture(t, registryB, map[string]string{
+		"argocd.yaml":                          application("argocd", "registry/kubefirst/components/argocd"),
+		"vault.yaml":                           application("vault", "registry/kubefirst/components/vault"),
+		"components/vault/application.yaml":    "chart: vault\nversion: 0.23.0\n",
+		"components/argocd/kustomization.yaml": "resources: []\n",
+		"crossplane.yaml":                      application("crossplane", "registry/kubefirst/components/crossplane"),
+		".git/HEAD":                            "ref: refs/heads/v2\n",
+	})
+
+	tests := []struct {
+		name         string
+		pathA, pathB string
+		want         []RegistryDiff
+		wantErr      bool
+	}{
+		{
+			name:  "template upgrade",
+			pathA: registryA,
+			pathB: registryB,
+			want: []RegistryDiff{
+				{Path: "chartmuseum.yaml", Change: RegistryFileRemoved},
+				{Path: "components/vault/application.yaml", Change: RegistryFileModified},
+				{Path: "crossplane.yaml", Change: RegistryFileAdded},
+			},
+		},
+		{
+			name:  "reversed",
+			pathA: registryB,
+			pathB: registryA,
+			want: []RegistryDiff{
+				{Path: "chartmuseum.yaml", Change: RegistryFileAdded},
+				{Path: "components/vault/application.yaml", Change: RegistryFileModified},
+				{Path: "crossplane.yaml", Change: RegistryFileRemoved},
+			},
+		},
+		{name: "identical", pathA: registryA, pathB: registryA, want: []RegistryDiff{}},
+		{name: "missing registry", pathA: registryA, pathB: filepath.Join(root, "missing"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DiffRegistries(tt.pathA, tt.pathB)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DiffRegistries() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DiffRegistries() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegistryPath(t *testing.T) {
+
+	tests := []struct {
+		clusterName string
+		want        string
+		wantErr     bool
+	}{
+		{clusterName: "kubefirst", want: "/k1/gitops/registry/kubefirst"},
+		{clusterName: "my-cluster-2", want: "/k1/gitops/registry/my-cluster-2"},
+		{clusterName: "", wantErr: true},
+		{clusterName: ".", wantErr: true},
+		{clusterName: "..", wantErr: true},
+		{clusterName: "../../etc", wantErr: true},
+		{clusterName: "kubefirst/../../etc", wantErr: true},
+		{clusterName: "nested/cluster", wantErr: true},
+		{clusterName: `..\windows`, wantErr: true},
+		{clusterName: "/etc", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.clusterName, func(t *testing.T) {
+			got, err := RegistryPath("/k1/gitops", tt.clusterName)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RegistryPath() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("RegistryPath() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListRegistryComponents(t *testing.T) {
+
+	gitopsDir := t.TempDir()
+	writeFixture(t, filepath.Join(gitopsDir, "registry", "kubefirst"), map[string]string{
+		"argocd.yaml":                            application("argocd", "registry/kubefirst/components/argocd"),
+		"components/vault/application.yaml":      application("vault", "registry/kubefirst/components/vault/chart"),
+		"components/vault/chart/Chart.yaml":      "apiVersion: v2\nname: vault\n",
+		"components/vault/chart/templates/a.yml": "kind: Application\nmetadata:\n  name: {{ .Values.name }}\n",
+		"components/vault/configmap.yaml":        "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: vault\n",
+		"components/metaphor/applications.yaml":  application("metaphor-development", "registry/kubefirst/components/metaphor/development") + "---\n" + application("metaphor-staging", "registry/kubefirst/components/metaphor/staging"),
+		"components/argo-workflows/app.yml":      "kind: Application\nmetadata:\n  name: argo-workflows\nspec:\n  sources:\n    - repoURL: https://argoproj.github.io/argo-helm\n      chart: argo-workflows\n    - repoURL: https://github.com/kubefirst/gitops.git\n      path: registry/kubefirst/components/argo-workflows\n",
+		"components/broken/application.yaml":     "kind: Application\nmetadata: [broken\n",
+	})
+
+	got, err := ListRegistryComponents(gitopsDir, "kubefirst")
+	if err != nil {
+		t.Fatalf("ListRegistryComponents() error = %v", err)
+	}
+	want := []Component{
+		{Name: "argo-workflows", RepoURL: "https://argoproj.github.io/argo-helm"},
+		{Name: "metaphor-development", Path: "registry/kubefirst/components/metaphor/development", RepoURL: "https://github.com/kubefirst/gitops.git"},
+		{Name: "metaphor-staging", Path: "registry/kubefirst/components/metaphor/staging", RepoURL: "https://github.com/kubefirst/gitops.git"},
+		{Name: "vault", Path: "registry/kubefirst/components/vault/chart", RepoURL: "https://github.com/kubefirst/gitops.git"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ListRegistryComponents() = %+v, want %+v", got, want)
+	}
+
+	_, err = ListRegistryComponents(gitopsDir, "missing")
+	if err == nil {
+		t.Error("ListRegistryComponents() for a cluster without a registry error = nil")
+	}
+}
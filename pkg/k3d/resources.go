@@ -0,0 +1,66 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// errResourcesUnsupported is returned by the resource readers on platforms they can't inspect
+var errResourcesUnsupported = errors.New("reading system resources is not supported on " + LocalhostOS)
+
+// availableMemoryMB and freeDiskGB read the host resources, they are replaced in tests
+var (
+	availableMemoryMB = systemAvailableMemoryMB
+	freeDiskGB        = systemFreeDiskGB
+)
+
+// CheckSystemResources returns an error when the memory available to k3d or the free disk space
+// on the filesystem holding the k1 directory is below minMemoryMB or minDiskGB
+func CheckSystemResources(minMemoryMB int, minDiskGB int) error {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return fmt.Errorf("error getting home path: %s", err)
+	}
+	k1Dir := filepath.Join(homeDir, ".k1")
+	if _, err := os.Stat(k1Dir); err != nil {
+		k1Dir = homeDir
+	}
+
+	memoryMB, err := availableMemoryMB()
+	if errors.Is(err, errResourcesUnsupported) {
+		log.Warn().Msgf("%s, skipping system resource checks", err)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading available memory: %s", err)
+	}
+	diskGB, err := freeDiskGB(k1Dir)
+	if err != nil {
+		return fmt.Errorf("error reading free disk space of %s: %s", k1Dir, err)
+	}
+	log.Info().Msgf("system resources: %dMB memory available, %dGB disk free", memoryMB, diskGB)
+
+	shortfalls := []string{}
+	if memoryMB < minMemoryMB {
+		shortfalls = append(shortfalls, fmt.Sprintf("%dMB of memory is available, at least %dMB is required", memoryMB, minMemoryMB))
+	}
+	if diskGB < minDiskGB {
+		shortfalls = append(shortfalls, fmt.Sprintf("%dGB of disk is free on %s, at least %dGB is required", diskGB, k1Dir, minDiskGB))
+	}
+	if len(shortfalls) > 0 {
+		return fmt.Errorf("insufficient system resources for k3d: %s", strings.Join(shortfalls, "; "))
+	}
+
+	return nil
+}
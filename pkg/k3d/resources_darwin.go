@@ -0,0 +1,39 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"encoding/binary"
+	"fmt"
+	"syscall"
+)
+
+// systemAvailableMemoryMB returns the physical memory from hw.memsize. On macOS k3d runs in the
+// docker desktop vm, whose memory is reserved up front, so total memory is the useful bound
+func systemAvailableMemoryMB() (int, error) {
+	memsize, err := syscall.Sysctl("hw.memsize")
+	if err != nil {
+		return 0, err
+	}
+	// Sysctl returns the raw little endian value and trims a trailing zero byte
+	if len(memsize) == 0 || len(memsize) > 8 {
+		return 0, fmt.Errorf("unexpected hw.memsize value length %d", len(memsize))
+	}
+	raw := make([]byte, 8)
+	copy(raw, memsize)
+	return int(binary.LittleEndian.Uint64(raw) / (1 << 20)), nil
+}
+
+// systemFreeDiskGB returns the space available to unprivileged users on the filesystem holding path
+func systemFreeDiskGB(path string) (int, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return 0, err
+	}
+	return int(stat.Bavail * uint64(stat.Bsize) / (1 << 30)), nil
+}
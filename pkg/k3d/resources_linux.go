@@ -0,0 +1,54 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// systemAvailableMemoryMB returns MemAvailable from /proc/meminfo, which unlike free memory
+// includes the page cache the kernel can reclaim
+func systemAvailableMemoryMB() (int, error) {
+	meminfo, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer meminfo.Close()
+
+	scanner := bufio.NewScanner(meminfo)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "MemAvailable:" {
+			continue
+		}
+		availableKB, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return 0, fmt.Errorf("error parsing MemAvailable: %s", err)
+		}
+		return availableKB / 1024, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	return 0, fmt.Errorf("MemAvailable not found in /proc/meminfo")
+}
+
+// systemFreeDiskGB returns the space available to unprivileged users on the filesystem holding path
+func systemFreeDiskGB(path string) (int, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return 0, err
+	}
+	return int(stat.Bavail * uint64(stat.Bsize) / (1 << 30)), nil
+}
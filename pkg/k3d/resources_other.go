@@ -0,0 +1,18 @@
+//go:build !linux && !darwin
+
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+
+package k3d
+
+func systemAvailableMemoryMB() (int, error) {
+	return 0, errResourcesUnsupported
+}
+
+func systemFreeDiskGB(path string) (int, error) {
+	return 0, errResourcesUnsupported
+}
@@ -0,0 +1,68 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCheckSystemResources(t *testing.T) {
+
+	t.Setenv("HOME", t.TempDir())
+	defer func(memory func() (int, error), disk func(string) (int, error)) {
+		availableMemoryMB, freeDiskGB = memory, disk
+	}(availableMemoryMB, freeDiskGB)
+
+	tests := []struct {
+		name     string
+		memoryMB int
+		diskGB   int
+		readErr  error
+		wantErr  []string
+	}{
+		{name: "sufficient", memoryMB: 8192, diskGB: 50},
+		{name: "exact minimum", memoryMB: 4096, diskGB: 20},
+		{name: "low memory", memoryMB: 2048, diskGB: 50, wantErr: []string{"2048MB of memory", "4096MB"}},
+		{name: "low disk", memoryMB: 8192, diskGB: 5, wantErr: []string{"5GB of disk", "20GB"}},
+		{name: "low memory and disk", memoryMB: 1024, diskGB: 1, wantErr: []string{"1024MB of memory", "1GB of disk"}},
+		{name: "read error", readErr: errors.New("permission denied"), wantErr: []string{"permission denied"}},
+		{name: "unsupported platform", readErr: errResourcesUnsupported},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			availableMemoryMB = func() (int, error) { return tt.memoryMB, tt.readErr }
+			freeDiskGB = func(string) (int, error) { return tt.diskGB, nil }
+
+			err := CheckSystemResources(4096, 20)
+			if (err != nil) != (len(tt.wantErr) > 0) {
+				t.Fatalf("CheckSystemResources() error = %v, want error containing %v", err, tt.wantErr)
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("CheckSystemResources() error = %q, want it to contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSystemResourceReaders(t *testing.T) {
+
+	memoryMB, err := systemAvailableMemoryMB()
+	if errors.Is(err, errResourcesUnsupported) {
+		t.Skip(err)
+	}
+	if err != nil || memoryMB <= 0 {
+		t.Errorf("systemAvailableMemoryMB() = %d, %v, want positive memory", memoryMB, err)
+	}
+	_, err = systemFreeDiskGB(t.TempDir())
+	if err != nil {
+		t.Errorf("systemFreeDiskGB() error = %v", err)
+	}
+}
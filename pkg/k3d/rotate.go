@@ -0,0 +1,126 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/kubefirst/runtime/pkg/k8s"
+	"github.com/rs/zerolog/log"
+)
+
+// gitTokenSecret is a vault kv secret key holding the git provider token
+type gitTokenSecret struct {
+	Path string
+	Key  string
+}
+
+// gitTokenSecrets returns the vault secrets holding the token for gitProvider. ci-secrets is
+// synced to argo workflows by external-secrets, so updating it rotates the token used by ci
+func gitTokenSecrets(gitProvider string) []gitTokenSecret {
+	atlantisKey := "ATLANTIS_GH_TOKEN"
+	if gitProvider == "gitlab" {
+		atlantisKey = "ATLANTIS_GITLAB_TOKEN"
+	}
+	return []gitTokenSecret{
+		{Path: "ci-secrets", Key: "PERSONAL_ACCESS_TOKEN"},
+		{Path: "atlantis", Key: atlantisKey},
+	}
+}
+
+// RotateGitToken validates newToken against the git provider then replaces the token stored in
+// vault, including the ci secrets. Every secret is read before any is written and written secrets
+// are restored if a later write fails, the returned error lists each secret that was not rotated
+func RotateGitToken(cfg *K3dConfig, newToken string) error {
+	err := validateGitToken(cfg, newToken)
+	if err != nil {
+		return fmt.Errorf("new git token is not valid, nothing was rotated: %s", err)
+	}
+
+	clientset, err := k8s.GetClientSet(cfg.Kubeconfig)
+	if err != nil {
+		return fmt.Errorf("error getting kubernetes clientset: %s", err)
+	}
+	rootToken, err := vaultRootToken(clientset)
+	if err != nil {
+		return err
+	}
+	vaultClient, err := newVaultClient(vaultAPIURL, rootToken)
+	if err != nil {
+		return err
+	}
+
+	err = rotateGitTokenSecrets(vaultClient, gitTokenSecrets(cfg.GitProvider), newToken)
+	if err != nil {
+		return err
+	}
+
+	switch cfg.GitProvider {
+	case "github":
+		cfg.GithubToken = newToken
+	case "gitlab":
+		cfg.GitlabToken = newToken
+	}
+	log.Info().Msg("git token rotated")
+	return nil
+}
+
+// rotateGitTokenSecrets sets each of secrets to newToken, restoring the written ones if a write fails
+func rotateGitTokenSecrets(vaultClient *vaultapi.Client, secrets []gitTokenSecret, newToken string) error {
+	kv := vaultClient.KVv2(vaultKVMount)
+
+	// read everything first so a vault problem is found before anything changes
+	previous := map[string]map[string]interface{}{}
+	targets := []gitTokenSecret{}
+	for _, secret := range secrets {
+		existing, err := kv.Get(context.Background(), secret.Path)
+		if errors.Is(err, vaultapi.ErrSecretNotFound) {
+			log.Info().Msgf("vault secret %s not found, skipping", secret.Path)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error reading vault secret %s, nothing was rotated: %s", secret.Path, err)
+		}
+		previous[secret.Path] = existing.Data
+		targets = append(targets, secret)
+	}
+
+	for i, secret := range targets {
+		data := map[string]interface{}{}
+		for key, value := range previous[secret.Path] {
+			data[key] = value
+		}
+		data[secret.Key] = newToken
+
+		_, err := kv.Put(context.Background(), secret.Path, data)
+		if err == nil {
+			log.Info().Msgf("rotated git token in vault secret %s", secret.Path)
+			continue
+		}
+
+		failures := []string{fmt.Sprintf("%s: %s", secret.Path, err)}
+		for _, failed := range targets[i+1:] {
+			failures = append(failures, fmt.Sprintf("%s: not attempted", failed.Path))
+		}
+		rolledBack := []string{}
+		for _, written := range targets[:i] {
+			_, rollbackErr := kv.Put(context.Background(), written.Path, previous[written.Path])
+			if rollbackErr != nil {
+				failures = append(failures, fmt.Sprintf("%s: rotated but rollback failed: %s", written.Path, rollbackErr))
+				continue
+			}
+			rolledBack = append(rolledBack, written.Path)
+		}
+		return fmt.Errorf("error rotating git token, rolled back [%s], failed [%s]", strings.Join(rolledBack, ", "), strings.Join(failures, "; "))
+	}
+
+	return nil
+}
@@ -0,0 +1,178 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newGithubUserServer returns a github api answering /user for token with the given oauth scopes
+func newGithubUserServer(t *testing.T, token, scopes string) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/user" || r.Header.Get("Authorization") != "Bearer "+token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if scopes != "" {
+			w.Header().Set("X-OAuth-Scopes", scopes)
+		}
+		w.Write([]byte(`{"login":"kubefirst-bot"}`))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestValidateGithubToken(t *testing.T) {
+
+	defaultGithubAPIURL := githubAPIURL
+	defer func() { githubAPIURL = defaultGithubAPIURL }()
+
+	tests := []struct {
+		name    string
+		token   string
+		scopes  string
+		wantErr string
+	}{
+		{name: "classic token with repo scope", token: "ghp_new", scopes: "read:org, repo, workflow"},
+		{name: "fine grained token", token: "github_pat_new"},
+		{name: "missing repo scope", token: "ghp_new", scopes: "read:org, workflow", wantErr: "missing required scope: repo"},
+		{name: "rejected token", token: "ghp_expired", scopes: "repo", wantErr: "rejected"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newGithubUserServer(t, strings.Replace(tt.token, "_expired", "_new", 1), tt.scopes)
+			githubAPIURL = server.URL
+
+			err := validateGithubToken(server.Client(), tt.token)
+			if (err != nil) != (tt.wantErr != "") {
+				t.Fatalf("validateGithubToken() error = %v, wantErr %q", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validateGithubToken() error = %q, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRotateGitTokenInvalidToken(t *testing.T) {
+
+	defaultGithubAPIURL := githubAPIURL
+	defer func() { githubAPIURL = defaultGithubAPIURL }()
+	githubAPIURL = newGithubUserServer(t, "ghp_valid", "repo").URL
+
+	cfg := &K3dConfig{GitProvider: "github", GithubToken: "ghp_old", Kubeconfig: "/nonexistent/kubeconfig"}
+	err := RotateGitToken(cfg, "ghp_invalid")
+	if err == nil || !strings.Contains(err.Error(), "nothing was rotated") {
+		t.Fatalf("RotateGitToken() error = %v, want the new token to be rejected before vault is touched", err)
+	}
+	if cfg.GithubToken != "ghp_old" {
+		t.Errorf("GithubToken = %q, want it unchanged", cfg.GithubToken)
+	}
+}
+
+func TestRotateGitTokenSecrets(t *testing.T) {
+
+	kvMount := map[string]interface{}{"secret/": map[string]interface{}{"type": "kv", "options": map[string]string{"version": "2"}}}
+	stored := map[string]map[string]interface{}{
+		"ci-secrets": {"PERSONAL_ACCESS_TOKEN": "ghp_old", "SSH_PRIVATE_KEY": "key"},
+		"atlantis":   {"ATLANTIS_GH_TOKEN": "ghp_old", "ATLANTIS_GH_WEBHOOK_SECRET": "webhook"},
+	}
+	ciRotated := vaultWrite{Method: http.MethodPut, Path: "/v1/secret/data/ci-secrets", Payload: map[string]interface{}{
+		"data": map[string]interface{}{"PERSONAL_ACCESS_TOKEN": "ghp_new", "SSH_PRIVATE_KEY": "key"},
+	}}
+	ciRestored := vaultWrite{Method: http.MethodPut, Path: "/v1/secret/data/ci-secrets", Payload: map[string]interface{}{
+		"data": map[string]interface{}{"PERSONAL_ACCESS_TOKEN": "ghp_old", "SSH_PRIVATE_KEY": "key"},
+	}}
+	atlantisRotated := vaultWrite{Method: http.MethodPut, Path: "/v1/secret/data/atlantis", Payload: map[string]interface{}{
+		"data": map[string]interface{}{"ATLANTIS_GH_TOKEN": "ghp_new", "ATLANTIS_GH_WEBHOOK_SECRET": "webhook"},
+	}}
+
+	tests := []struct {
+		name       string
+		stored     map[string]map[string]interface{}
+		failPath   string
+		wantWrites []vaultWrite
+		wantErr    []string
+	}{
+		{
+			name:       "rotates every secret",
+			stored:     stored,
+			wantWrites: []vaultWrite{ciRotated, atlantisRotated},
+		},
+		{
+			name:       "skips missing secrets",
+			stored:     map[string]map[string]interface{}{"ci-secrets": stored["ci-secrets"]},
+			wantWrites: []vaultWrite{ciRotated},
+		},
+		{
+			name:       "rolls back on a failed write",
+			stored:     stored,
+			failPath:   "/v1/secret/data/atlantis",
+			wantWrites: []vaultWrite{ciRotated, ciRestored},
+			wantErr:    []string{"rolled back [ci-secrets]", "atlantis:"},
+		},
+		{
+			name:     "first write fails",
+			stored:   stored,
+			failPath: "/v1/secret/data/ci-secrets",
+			wantErr:  []string{"rolled back []", "ci-secrets:", "atlantis: not attempted"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kvServer, writes := newVaultKVServer(t, kvMount, tt.stored)
+			target, _ := url.Parse(kvServer.URL)
+			proxy := httputil.NewSingleHostReverseProxy(target)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodPut && r.URL.Path == tt.failPath {
+					w.WriteHeader(http.StatusInternalServerError)
+					w.Write([]byte(`{"errors":["storage unavailable"]}`))
+					return
+				}
+				proxy.ServeHTTP(w, r)
+			}))
+			defer server.Close()
+
+			vaultClient, err := newVaultClient(server.URL, "root-token")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = rotateGitTokenSecrets(vaultClient, gitTokenSecrets("github"), "ghp_new")
+			if (err != nil) != (len(tt.wantErr) > 0) {
+				t.Fatalf("rotateGitTokenSecrets() error = %v, want error containing %v", err, tt.wantErr)
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("rotateGitTokenSecrets() error = %q, want it to contain %q", err, want)
+				}
+			}
+			if len(*writes) != len(tt.wantWrites) {
+				t.Fatalf("rotateGitTokenSecrets() made %d writes, want %d: %+v", len(*writes), len(tt.wantWrites), *writes)
+			}
+			for i, want := range tt.wantWrites {
+				got := (*writes)[i]
+				if got.Method != want.Method || got.Path != want.Path {
+					t.Errorf("write %d = %s %s, want %s %s", i, got.Method, got.Path, want.Method, want.Path)
+				}
+				for key, value := range want.Payload {
+					if !reflect.DeepEqual(got.Payload[key], value) {
+						t.Errorf("write %d %s %s = %v, want %v", i, got.Path, key, got.Payload[key], value)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,341 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// lfsPointerHeader starts every git lfs pointer file
+var lfsPointerHeader = []byte("version https://git-lfs")
+
+// DetectLFSPointers returns the paths under dir, relative to dir, of unresolved git lfs pointer files
+func DetectLFSPointers(dir string) ([]string, error) {
+	pointers := []string{}
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if fi.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// pointer files are always small
+		if fi.Size() > 1024 || !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		header := make([]byte, len(lfsPointerHeader))
+		_, err = io.ReadFull(f, header)
+		if err != nil {
+			return nil
+		}
+		if bytes.Equal(header, lfsPointerHeader) {
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			pointers = append(pointers, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return pointers, nil
+}
+
+// checkLFSPointers warns about lfs pointer files under dir, failing instead when strict
+func checkLFSPointers(dir string, strict bool) error {
+	pointers, err := DetectLFSPointers(dir)
+	if err != nil {
+		return fmt.Errorf("error scanning %s for git lfs pointers: %s", dir, err)
+	}
+	if len(pointers) == 0 {
+		return nil
+	}
+
+	if strict {
+		return fmt.Errorf("unresolved git lfs pointer files found in %s: %s", dir, strings.Join(pointers, ", "))
+	}
+	for _, pointer := range pointers {
+		log.Warn().Str("dir", dir).Str("path", pointer).Msg("unresolved git lfs pointer file, content will be missing from the repository")
+	}
+
+	return nil
+}
+
+// metaphorLineEndingFiles are the copied metaphor files executed inside linux containers
+var metaphorLineEndingFiles = []string{".sh", ".yaml", ".yml", "Dockerfile"}
+
+// NormalizeLineEndings converts CRLF line endings to LF and strips any utf-8 byte order mark in
+// files under dir whose extension, or base name for files like Dockerfile, is in extensions -
+// binary files are left untouched
+func NormalizeLineEndings(dir string, extensions []string) error {
+	return normalizeLineEndings(dir, extensions, nil)
+}
+
+// normalizeLineEndings is NormalizeLineEndings recording every rewritten file in audit
+func normalizeLineEndings(dir string, extensions []string, audit *auditLog) error {
+	return filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if fi.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fi.Mode().IsRegular() || !matchesExtension(fi.Name(), extensions) {
+			return nil
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if bytes.IndexByte(content, 0) != -1 {
+			return nil
+		}
+		normalized := []byte(stripBOM(string(content)))
+		if bytes.Contains(normalized, []byte("\r\n")) {
+			log.Info().Str("path", path).Msg("converting CRLF line endings to LF")
+			normalized = bytes.ReplaceAll(normalized, []byte("\r\n"), []byte("\n"))
+		}
+		if bytes.Equal(normalized, content) {
+			return nil
+		}
+
+		err = os.WriteFile(path, normalized, fi.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		audit.record(auditRewrite, path, "")
+		return nil
+	})
+}
+
+// utf8BOM is the byte order mark editors on windows prefix utf-8 text files with
+const utf8BOM = "\xef\xbb\xbf"
+
+// stripBOM removes a leading utf-8 byte order mark from text content, which yaml parsers and
+// shells reject - content containing a NUL byte is treated as binary and returned unchanged
+func stripBOM(content string) string {
+	if strings.IndexByte(content, 0) != -1 {
+		return content
+	}
+	return strings.TrimPrefix(content, utf8BOM)
+}
+
+// matchesExtension reports whether name has one of extensions or equals one of them
+func matchesExtension(name string, extensions []string) bool {
+	for _, ext := range extensions {
+		if filepath.Ext(name) == ext || name == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultLargeFileThreshold is the file size github starts warning about on push
+const defaultLargeFileThreshold int64 = 50 * 1024 * 1024
+
+// FileSizeReport is a file larger than the threshold passed to DetectLargeFiles
+type FileSizeReport struct {
+	Path string
+	Size int64
+}
+
+// DetectLargeFiles returns the files under dir, relative to dir, larger than thresholdBytes - .git is skipped
+func DetectLargeFiles(dir string, thresholdBytes int64) ([]FileSizeReport, error) {
+	reports := []FileSizeReport{}
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if fi.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fi.Mode().IsRegular() || fi.Size() <= thresholdBytes {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		reports = append(reports, FileSizeReport{Path: rel, Size: fi.Size()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return reports, nil
+}
+
+// checkLargeFiles warns about files under dir larger than thresholdBytes, failing instead when strict
+func checkLargeFiles(dir string, thresholdBytes int64, strict bool) error {
+	reports, err := DetectLargeFiles(dir, thresholdBytes)
+	if err != nil {
+		return fmt.Errorf("error scanning %s for large files: %s", dir, err)
+	}
+	if len(reports) == 0 {
+		return nil
+	}
+
+	paths := []string{}
+	for _, report := range reports {
+		log.Warn().Str("dir", dir).Str("path", report.Path).Int64("size", report.Size).Int64("threshold", thresholdBytes).Msg("large file found in repository content, it will slow down pushes")
+		paths = append(paths, fmt.Sprintf("%s (%d bytes)", report.Path, report.Size))
+	}
+	if strict {
+		return fmt.Errorf("files larger than %d bytes found in %s: %s", thresholdBytes, dir, strings.Join(paths, ", "))
+	}
+
+	return nil
+}
+
+// SecretFinding is a line of a file matching a secret detector
+type SecretFinding struct {
+	Path     string
+	Line     int
+	Detector string
+}
+
+// redacted replaces the secrets scrubbed from diagnostics
+const redacted = "<redacted>"
+
+// secretDetector matches a credential by shape. replacement is what the match is scrubbed to in
+// diagnostics, defaulting to redacted, and redactOnly detectors match by key name, too broadly to
+// report findings in repository content but worth scrubbing from logs
+type secretDetector struct {
+	name        string
+	pattern     *regexp.Regexp
+	replacement string
+	redactOnly  bool
+}
+
+// secretDetectors match git provider tokens, common cloud credential formats, kubeconfig
+// credential data and the values of secret looking keys, see ScanForSecrets and scrubSecrets
+var secretDetectors = []secretDetector{
+	{name: "github token", pattern: regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36}\b`)},
+	{name: "github fine-grained token", pattern: regexp.MustCompile(`\bgithub_pat_[A-Za-z0-9_]{82}\b`)},
+	{name: "gitlab token", pattern: regexp.MustCompile(`\bglpat-[A-Za-z0-9_-]{20}\b`)},
+	{name: "aws access key", pattern: regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{name: "digitalocean token", pattern: regexp.MustCompile(`\bdop_v1_[a-f0-9]{64}\b`)},
+	// the header alone is matched line by line, the whole block when scrubbing content
+	{name: "private key", pattern: regexp.MustCompile(`-----BEGIN (RSA |EC |DSA |OPENSSH )?PRIVATE KEY-----(?s:.*?-----END (RSA |EC |DSA |OPENSSH )?PRIVATE KEY-----)?`)},
+	// client-key-data, client-certificate-data and the like, e.g. in logged k3d kubeconfig output
+	{
+		name:        "kubeconfig credential data",
+		pattern:     regexp.MustCompile(`("?[\w.-]+-data"?\s*:[ \t]*)"?[A-Za-z0-9+/]{16,}={0,2}"?`),
+		replacement: "${1}" + redacted,
+	},
+	{
+		name:        "secret value",
+		pattern:     regexp.MustCompile(`(?i)("?[\w.-]*(?:token|password|secret|private[_-]?key)[\w.-]*"?\s*[:=]\s*)"[^"\n]+"`),
+		replacement: `${1}"` + redacted + `"`,
+		redactOnly:  true,
+	},
+	{
+		name:        "secret value",
+		pattern:     regexp.MustCompile(`(?i)("?[\w.-]*(?:token|password|secret|private[_-]?key)[\w.-]*"?\s*[:=][ \t]*)[^\s",}]+`),
+		replacement: "${1}" + redacted,
+		redactOnly:  true,
+	},
+}
+
+// ScanForSecrets returns the lines of files under dir, relative to dir, that look like they
+// contain a credential - binary files and .git are skipped
+func ScanForSecrets(dir string) ([]SecretFinding, error) {
+	findings := []SecretFinding{}
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if fi.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if bytes.IndexByte(content, 0) != -1 {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		for i, line := range strings.Split(string(content), "\n") {
+			for _, detector := range secretDetectors {
+				if !detector.redactOnly && detector.pattern.MatchString(line) {
+					findings = append(findings, SecretFinding{Path: rel, Line: i + 1, Detector: detector.name})
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return findings, nil
+}
+
+// checkSecrets warns about possible secrets under dir, failing instead when strict
+// the matched values are never logged
+func checkSecrets(dir string, strict bool) error {
+	findings, err := ScanForSecrets(dir)
+	if err != nil {
+		return fmt.Errorf("error scanning %s for secrets: %s", dir, err)
+	}
+	if len(findings) == 0 {
+		return nil
+	}
+
+	locations := []string{}
+	for _, finding := range findings {
+		log.Warn().Str("dir", dir).Str("path", finding.Path).Int("line", finding.Line).Str("detector", finding.Detector).Msg("possible secret found in repository content")
+		locations = append(locations, fmt.Sprintf("%s:%d", finding.Path, finding.Line))
+	}
+	if strict {
+		return fmt.Errorf("possible secrets found in %s: %s", dir, strings.Join(locations, ", "))
+	}
+
+	return nil
+}
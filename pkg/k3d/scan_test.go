@@ -0,0 +1,217 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const lfsPointer = `version https://git-lfs.github.com/spec/v1
+oid sha256:4d7a214614ab2935c943f9e0ff69d22eadbb8f32b1258daaa5e2ca24d17e2393
+size 12345
+`
+
+func TestDetectLFSPointers(t *testing.T) {
+
+	dir := t.TempDir()
+	writeFixture(t, dir, map[string]string{
+		"assets/logo.png":  lfsPointer,
+		"assets/readme.md": "version 1 of the assets\n",
+		".git/lfs/pointer": lfsPointer,
+	})
+
+	got, err := DetectLFSPointers(dir)
+	if err != nil {
+		t.Fatalf("DetectLFSPointers() error = %v", err)
+	}
+	if want := []string{"assets/logo.png"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("DetectLFSPointers() got = %v, want %v", got, want)
+	}
+}
+
+func TestAdjustMetaphorRepoLFSPointers(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		opts    AdjustOptions
+		wantErr bool
+	}{
+		{name: "lenient warns"},
+		{name: "strict fails", opts: AdjustOptions{StrictLFS: true}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k1Dir, gitopsDir := newMetaphorFixture(t, map[string]string{
+				"Dockerfile":      "FROM scratch\n",
+				"assets/logo.png": lfsPointer,
+			})
+
+			err := AdjustMetaphorRepo("https://github.com/kubefirst/metaphor.git", gitopsDir, "metaphor", "github", k1Dir, tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("AdjustMetaphorRepo() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNormalizeLineEndings(t *testing.T) {
+
+	dir := t.TempDir()
+	binary := "\x7fELF\x00\x01\r\n\x00"
+	writeFixture(t, dir, map[string]string{
+		".argo/build.sh":      "#!/bin/sh\r\necho build\r\n",
+		".github/ci.yaml":     "on: push\r\n",
+		"build/Dockerfile":    "FROM scratch\r\nCOPY . .\r\n",
+		"bin/tool.sh":         binary,
+		"docs/notes.txt":      "left alone\r\n",
+		".git/hooks/hook.sh":  "#!/bin/sh\r\n",
+		"scripts/already.yml": "key: value\n",
+		"values/bom.yaml":     "\xef\xbb\xbfreplicas: 1\r\nimage: metaphor\r\n",
+		"bin/bom.sh":          "\xef\xbb\xbf\x00binary",
+	})
+
+	err := NormalizeLineEndings(dir, metaphorLineEndingFiles)
+	if err != nil {
+		t.Fatalf("NormalizeLineEndings() error = %v", err)
+	}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: ".argo/build.sh", want: "#!/bin/sh\necho build\n"},
+		{path: ".github/ci.yaml", want: "on: push\n"},
+		{path: "build/Dockerfile", want: "FROM scratch\nCOPY . .\n"},
+		{path: "bin/tool.sh", want: binary},
+		{path: "docs/notes.txt", want: "left alone\r\n"},
+		{path: ".git/hooks/hook.sh", want: "#!/bin/sh\r\n"},
+		{path: "scripts/already.yml", want: "key: value\n"},
+		{path: "values/bom.yaml", want: "replicas: 1\nimage: metaphor\n"},
+		{path: "bin/bom.sh", want: "\xef\xbb\xbf\x00binary"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := os.ReadFile(filepath.Join(dir, tt.path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("NormalizeLineEndings() %s = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScanForSecrets(t *testing.T) {
+
+	// fake credentials are assembled so the fixture source does not match the detectors itself
+	dir := t.TempDir()
+	writeFixture(t, dir, map[string]string{
+		"registry/kubefirst/vault.yaml": "kind: Secret\ndata:\n  token: " + "ghp_" + strings.Repeat("a1B2", 9) + "\n",
+		"terraform/gitlab/main.tf":      "token = \"" + "glpat-" + strings.Repeat("x", 20) + "\"\n",
+		"terraform/aws/provider.tf":     "provider \"aws\" {}\n\naccess_key = \"" + "AKIA" + strings.Repeat("Q", 16) + "\"\n",
+		"ssl/key.pem":                   "-----BEGIN " + "PRIVATE KEY-----\n",
+		"kubeconfig":                    "users:\n- user:\n    client-key-data: " + strings.Repeat("LS0t", 8) + "\n",
+		"registry/kubefirst/argo.yaml":  "token: <GITHUB_TOKEN>\n",
+		"bin/tool":                      "\x00ghp_" + strings.Repeat("a", 36),
+		".git/config":                   "ghp_" + strings.Repeat("a", 36) + "\n",
+	})
+
+	got, err := ScanForSecrets(dir)
+	if err != nil {
+		t.Fatalf("ScanForSecrets() error = %v", err)
+	}
+	want := []SecretFinding{
+		{Path: "kubeconfig", Line: 3, Detector: "kubeconfig credential data"},
+		{Path: "registry/kubefirst/vault.yaml", Line: 3, Detector: "github token"},
+		{Path: "ssl/key.pem", Line: 1, Detector: "private key"},
+		{Path: "terraform/aws/provider.tf", Line: 3, Detector: "aws access key"},
+		{Path: "terraform/gitlab/main.tf", Line: 1, Detector: "gitlab token"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ScanForSecrets() = %v, want %v", got, want)
+	}
+}
+
+func TestAdjustMetaphorRepoSecrets(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		opts    AdjustOptions
+		wantErr bool
+	}{
+		{name: "findings logged"},
+		{name: "findings fail the adjust", opts: AdjustOptions{FailOnSecrets: true}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k1Dir, gitopsDir := newMetaphorFixture(t, map[string]string{
+				"Dockerfile":   "FROM scratch\n",
+				"values.yaml":  "registryToken: " + "glpat-" + strings.Repeat("x", 20) + "\n",
+				"chart/a.yaml": "kind: Deployment\n",
+			})
+
+			err := AdjustMetaphorRepo("https://github.com/kubefirst/metaphor.git", gitopsDir, "metaphor", "github", k1Dir, tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("AdjustMetaphorRepo() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDetectLargeFiles(t *testing.T) {
+
+	dir := t.TempDir()
+	writeFixture(t, dir, map[string]string{
+		"chart/values.yaml":   "replicas: 1\n",
+		"assets/demo.bin":     strings.Repeat("x", 2048),
+		"assets/limit.bin":    strings.Repeat("x", 1024),
+		".git/objects/pack/a": strings.Repeat("x", 4096),
+	})
+
+	got, err := DetectLargeFiles(dir, 1024)
+	if err != nil {
+		t.Fatalf("DetectLargeFiles() error = %v", err)
+	}
+	want := []FileSizeReport{{Path: filepath.Join("assets", "demo.bin"), Size: 2048}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DetectLargeFiles() = %v, want %v", got, want)
+	}
+}
+
+func TestAdjustMetaphorRepoLargeFiles(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		opts    AdjustOptions
+		wantErr bool
+	}{
+		{name: "below the default threshold"},
+		{name: "large files logged", opts: AdjustOptions{LargeFileThreshold: 1024}},
+		{name: "large files fail the adjust", opts: AdjustOptions{LargeFileThreshold: 1024, StrictLargeFiles: true}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k1Dir, gitopsDir := newMetaphorFixture(t, map[string]string{
+				"Dockerfile":       "FROM scratch\n",
+				"assets/video.bin": strings.Repeat("x", 4096),
+			})
+
+			err := AdjustMetaphorRepo("https://github.com/kubefirst/metaphor.git", gitopsDir, "metaphor", "github", k1Dir, tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("AdjustMetaphorRepo() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && !strings.Contains(err.Error(), filepath.Join("assets", "video.bin")+" (4096 bytes)") {
+				t.Errorf("AdjustMetaphorRepo() error = %v, want the large file reported", err)
+			}
+		})
+	}
+}
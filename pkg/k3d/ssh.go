@@ -0,0 +1,88 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/kubefirst/runtime/pkg"
+	"github.com/rs/zerolog/log"
+)
+
+// sshClient is the ssh cli used to check git host authentication
+var sshClient = "ssh"
+
+// sshAuthenticated matches the greetings git hosts answer an authenticated `ssh -T` with, github
+// exits 1 as it provides no shell so the output decides the result
+var sshAuthenticated = regexp.MustCompile(`(?i)successfully authenticated|welcome to gitlab|logged in as`)
+
+// sshUnknownHostKey matches the output of a strict host key check for a host missing from known_hosts
+var sshUnknownHostKey = regexp.MustCompile(`No \S+ host key is known for`)
+
+// SSHAuthOptions are the optional settings of ValidateSSHAuth
+type SSHAuthOptions struct {
+	// Port is the ssh port of the git host, defaulting to 22
+	Port int
+}
+
+// sshAuthOptions returns the first of opts, or the defaults when none were passed
+func sshAuthOptions(opts []SSHAuthOptions) SSHAuthOptions {
+	if len(opts) == 0 {
+		return SSHAuthOptions{}
+	}
+	return opts[0]
+}
+
+// ValidateSSHAuth checks an ssh key or agent identity can authenticate as git to gitHost, as
+// needed to push the repositories over the ssh git protocol. A port in gitHost is the https port
+// of a self-managed instance and is ignored, the ssh port is set with SSHAuthOptions. The host key
+// must already be trusted in known_hosts, an unknown host is reported rather than trusted
+func ValidateSSHAuth(gitHost string, opts ...SSHAuthOptions) error {
+	host, port := sshHost(gitHost, sshAuthOptions(opts).Port)
+	if host == "" || strings.ContainsAny(host, " @/:") || strings.HasPrefix(host, "-") {
+		return fmt.Errorf("invalid git host %q", gitHost)
+	}
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("invalid ssh port %d for git host %s", port, host)
+	}
+
+	// BatchMode fails instead of prompting for a passphrase or password, strict checking and no
+	// host key updates keep the check from writing to known_hosts
+	stdOut, stdErr, err := pkg.ExecShellReturnStrings(sshClient, "-T",
+		"-o", "BatchMode=yes",
+		"-o", "ConnectTimeout=10",
+		"-o", "StrictHostKeyChecking=yes",
+		"-o", "UpdateHostKeys=no",
+		"-p", strconv.Itoa(port),
+		"git@"+host)
+	output := strings.TrimSpace(stdOut + stdErr)
+	if sshAuthenticated.MatchString(output) {
+		log.Info().Str("host", host).Int("port", port).Msg("ssh authentication to the git host succeeded")
+		return nil
+	}
+
+	// known_hosts records hosts on a non default port as [host]:port
+	knownHost := host
+	if port != defaultSSHPort {
+		knownHost = fmt.Sprintf("[%s]:%d", host, port)
+	}
+	switch {
+	case sshUnknownHostKey.MatchString(output):
+		return fmt.Errorf("unknown host key for %s, verify its fingerprint and add it to ~/.ssh/known_hosts, e.g. with `ssh-keyscan -p %d %s >> ~/.ssh/known_hosts`", knownHost, port, host)
+	case strings.Contains(output, "Permission denied"):
+		return fmt.Errorf("ssh authentication to %s was denied, add your public key to your %s account and load it with `ssh-add`, or use the https git protocol", host, host)
+	case strings.Contains(output, "Host key verification failed"):
+		return fmt.Errorf("the host key of %s does not match your known_hosts, verify and update the %s entry in ~/.ssh/known_hosts", host, knownHost)
+	case err != nil:
+		return fmt.Errorf("error checking ssh authentication to %s: %s %s", host, err, output)
+	default:
+		return fmt.Errorf("unexpected response checking ssh authentication to %s: %s", host, output)
+	}
+}
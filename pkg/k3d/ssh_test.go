@@ -0,0 +1,121 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateSSHAuth(t *testing.T) {
+
+	defer func(client string) { sshClient = client }(sshClient)
+
+	tests := []struct {
+		name       string
+		host       string
+		port       int
+		script     string
+		wantTarget string
+		wantErr    string
+	}{
+		{
+			name:   "github authenticated",
+			host:   GithubHost,
+			script: `echo "Hi kubefirst-bot! You've successfully authenticated, but GitHub does not provide shell access." >&2; exit 1`,
+		},
+		{
+			name:   "gitlab authenticated",
+			host:   GitlabHost,
+			script: `echo "Welcome to GitLab, @kubefirst-bot!"`,
+		},
+		{
+			name:    "no key",
+			host:    GithubHost,
+			script:  `echo "git@github.com: Permission denied (publickey)." >&2; exit 255`,
+			wantErr: "add your public key",
+		},
+		{
+			name:    "host key changed",
+			host:    GitlabHost,
+			script:  `echo "Host key verification failed." >&2; exit 255`,
+			wantErr: "known_hosts",
+		},
+		{
+			name:    "unreachable",
+			host:    "git.example.com",
+			script:  `echo "ssh: connect to host git.example.com port 22: Connection timed out" >&2; exit 255`,
+			wantErr: "Connection timed out",
+		},
+		{
+			name:    "unknown host key",
+			host:    "git.example.com",
+			script:  `printf "No ED25519 host key is known for git.example.com and you have requested strict checking.\nHost key verification failed.\n" >&2; exit 255`,
+			wantErr: "unknown host key for git.example.com",
+		},
+		{
+			name:       "unknown host key on a custom ssh port",
+			host:       "gitlab.internal",
+			port:       2222,
+			script:     `printf "No ED25519 host key is known for [gitlab.internal]:2222 and you have requested strict checking.\nHost key verification failed.\n" >&2; exit 255`,
+			wantTarget: "-p 2222 git@gitlab.internal",
+			wantErr:    "ssh-keyscan -p 2222 gitlab.internal",
+		},
+		{
+			name:       "self-managed gitlab on a custom ssh port",
+			host:       "gitlab.internal:8443",
+			port:       2222,
+			script:     `echo "Welcome to GitLab, @kubefirst-bot!"`,
+			wantTarget: "-p 2222 git@gitlab.internal",
+		},
+		{
+			name:       "host key changed on a custom ssh port",
+			host:       "gitlab.internal",
+			port:       2222,
+			script:     `echo "Host key verification failed." >&2; exit 255`,
+			wantTarget: "-p 2222 git@gitlab.internal",
+			wantErr:    "[gitlab.internal]:2222 entry",
+		},
+		{name: "option injection", host: "-oProxyCommand=touch", wantErr: "invalid git host"},
+		{name: "invalid port", host: "gitlab.internal", port: 70000, wantErr: "invalid ssh port"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			argsFile := filepath.Join(dir, "args")
+			sshClient = writeStubTool(t, dir, "ssh", `echo "$@" > `+argsFile+"\n"+tt.script+"\n")
+
+			err := ValidateSSHAuth(tt.host, SSHAuthOptions{Port: tt.port})
+			if (err != nil) != (tt.wantErr != "") {
+				t.Fatalf("ValidateSSHAuth() error = %v, wantErr %q", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ValidateSSHAuth() error = %q, want it to contain %q", err, tt.wantErr)
+			}
+
+			args, _ := os.ReadFile(argsFile)
+			if strings.HasPrefix(tt.wantErr, "invalid") {
+				if len(args) > 0 {
+					t.Errorf("ssh was run for an invalid host: %s", args)
+				}
+				return
+			}
+			wantTarget := tt.wantTarget
+			if wantTarget == "" {
+				wantTarget = "-p 22 git@" + tt.host
+			}
+			if want := "-T -o BatchMode=yes"; !strings.HasPrefix(string(args), want) || !strings.HasSuffix(strings.TrimSpace(string(args)), wantTarget) {
+				t.Errorf("ssh args = %q, want %q ... %s", args, want, wantTarget)
+			}
+			if !strings.Contains(string(args), "StrictHostKeyChecking=yes") || strings.Contains(string(args), "accept-new") {
+				t.Errorf("ssh args = %q, want strict host key checking", args)
+			}
+		})
+	}
+}
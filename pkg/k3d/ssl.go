@@ -9,7 +9,9 @@ package k3d
 import (
 	"context"
 	"fmt"
+	"net"
 	"os"
+	"regexp"
 	"strings"
 
 	"github.com/kubefirst/runtime/pkg"
@@ -19,17 +21,68 @@ import (
 	"k8s.io/client-go/kubernetes"
 )
 
+// localTLDs are the top level domains reserved for local use, no public certificate authority
+// issues certificates for them so mkcert is the only option
+var localTLDs = []string{"localhost", "local", "test", "internal", "home.arpa"}
+
+// domainLabel is a single dns label of a domain name
+var domainLabel = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// SupportsWildcardCert reports whether a wildcard certificate for domainName can be generated
+// locally with mkcert, which is the case for the k3d domain and the domains reserved for local
+// use. Public domains return false, their wildcard certificate has to be issued by a certificate
+// authority through a dns challenge instead
+func SupportsWildcardCert(domainName string) (bool, error) {
+	domain := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domainName)), ".")
+	if domain == "" {
+		return false, fmt.Errorf("domain name is empty")
+	}
+	if strings.HasPrefix(domain, "*.") {
+		return false, fmt.Errorf("invalid domain name %q: pass the domain without the wildcard", domainName)
+	}
+	if net.ParseIP(domain) != nil {
+		return false, fmt.Errorf("invalid domain name %q: wildcard certificates need a domain name, not an ip address", domainName)
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if !domainLabel.MatchString(label) {
+			return false, fmt.Errorf("invalid domain name %q: %q is not a valid dns label", domainName, label)
+		}
+	}
+
+	if domain == DomainName {
+		return true, nil
+	}
+	for _, tld := range localTLDs {
+		if domain == tld || strings.HasSuffix(domain, "."+tld) {
+			return true, nil
+		}
+	}
+
+	log.Info().Str("domain", domain).Msg("public domain, the wildcard certificate has to be issued by a certificate authority")
+	return false, nil
+}
+
+// certificateApps returns the tls secret of every ingress service, so a certificate is generated
+// for each host IngressHosts returns
+func certificateApps() []pkg.CertificateAppList {
+	apps := make([]pkg.CertificateAppList, 0, len(ingressServices))
+	for _, service := range ingressServices {
+		apps = append(apps, pkg.CertificateAppList{Namespace: service.namespace, AppName: service.subdomain})
+	}
+	return apps
+}
+
 // GenerateTLSSecrets generates default certificates for k3d
 func GenerateTLSSecrets(clientset *kubernetes.Clientset, config K3dConfig) error {
 	sslPemDir := config.MkCertPemDir
 	if _, err := os.Stat(sslPemDir); os.IsNotExist(err) {
-		err := os.MkdirAll(sslPemDir, os.ModePerm)
+		err := os.MkdirAll(sslPemDir, config.dirMode())
 		if err != nil {
 			log.Info().Msgf("%s directory already exists, continuing", sslPemDir)
 		}
 	}
 
-	for i, app := range pkg.GetCertificateAppList() {
+	for i, app := range certificateApps() {
 		namespace := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: app.Namespace}}
 		_, err := clientset.CoreV1().Namespaces().Get(context.TODO(), app.Namespace, metav1.GetOptions{})
 		if err != nil {
@@ -0,0 +1,71 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/kubefirst/runtime/pkg"
+)
+
+func TestSupportsWildcardCert(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		domainName string
+		want       bool
+		wantErr    bool
+	}{
+		{name: "k3d domain", domainName: DomainName, want: true},
+		{name: "k3d domain fully qualified", domainName: "Kubefirst.dev.", want: true},
+		{name: "localhost", domainName: "localhost", want: true},
+		{name: "local tld", domainName: "cluster.test", want: true},
+		{name: "home network", domainName: "k1.home.arpa", want: true},
+		{name: "public domain", domainName: "example.com"},
+		{name: "public subdomain", domainName: "k1.example.co.uk"},
+		{name: "subdomain of the k3d domain", domainName: "staging.kubefirst.dev"},
+		{name: "empty", domainName: "", wantErr: true},
+		{name: "wildcard", domainName: "*.example.com", wantErr: true},
+		{name: "ip address", domainName: "127.0.0.1", wantErr: true},
+		{name: "invalid label", domainName: "exa_mple.com", wantErr: true},
+		{name: "empty label", domainName: "example..com", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SupportsWildcardCert(tt.domainName)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SupportsWildcardCert() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("SupportsWildcardCert(%q) = %v, want %v", tt.domainName, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCertificateApps(t *testing.T) {
+
+	hosts := []string{}
+	for _, app := range certificateApps() {
+		hosts = append(hosts, app.AppName+"."+DomainName)
+	}
+	if want := IngressHosts(DomainName); !reflect.DeepEqual(hosts, want) {
+		t.Errorf("certificateApps() hosts = %v, want the ingress hosts %v", hosts, want)
+	}
+
+	// every certificate of the shared list keeps its namespace
+	got := certificateApps()
+	want := pkg.GetCertificateAppList()
+	for _, apps := range [][]pkg.CertificateAppList{got, want} {
+		sort.Slice(apps, func(i, j int) bool { return apps[i].AppName < apps[j].AppName })
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("certificateApps() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,149 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// AdjustResult describes the registry content produced by the adjust functions
+type AdjustResult struct {
+	ClusterName  string   `json:"clusterName"`
+	RegistryPath string   `json:"registryPath"`
+	Components   []string `json:"components"`
+}
+
+// InstallSummary describes what was installed for a cluster
+type InstallSummary struct {
+	ClusterName     string            `json:"clusterName"`
+	CloudProvider   string            `json:"cloudProvider"`
+	GitProvider     string            `json:"gitProvider"`
+	GitProtocol     string            `json:"gitProtocol"`
+	GitopsRepoURL   string            `json:"gitopsRepoURL"`
+	MetaphorRepoURL string            `json:"metaphorRepoURL"`
+	IngressURLs     map[string]string `json:"ingressURLs"`
+	RegistryPath    string            `json:"registryPath"`
+	Components      []string          `json:"components"`
+}
+
+// serviceURLs returns the ingress url of every service installed under domainName, keyed by service subdomain
+func serviceURLs(domainName string) map[string]string {
+	urls := map[string]string{}
+	for _, service := range ingressServices {
+		urls[service.subdomain] = ingressURL(service.subdomain, domainName)
+	}
+	return urls
+}
+
+// portForwardURLs are the localhost urls of the services reachable through a port-forward
+var portForwardURLs = map[string]string{
+	"argocd": ArgocdPortForwardURL,
+	"vault":  VaultPortForwardURL,
+}
+
+// AllServiceURLs returns the url of every installed service keyed by service name. In local access
+// mode the services with a port-forward are reached through their localhost url instead of the ingress
+func AllServiceURLs(cfg *K3dConfig) map[string]string {
+	urls := serviceURLs(DomainName)
+	if cfg.LocalAccessMode {
+		for service, url := range portForwardURLs {
+			urls[service] = url
+		}
+	}
+	return urls
+}
+
+// RenderURLsMarkdown returns a markdown table of the services installed under domainName and
+// their urls, sorted by service name
+func RenderURLsMarkdown(domainName string) string {
+	urls := serviceURLs(domainName)
+	services := []string{}
+	for service := range urls {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+
+	var b strings.Builder
+	b.WriteString("| Service | URL |\n")
+	b.WriteString("| --- | --- |\n")
+	for _, service := range services {
+		fmt.Fprintf(&b, "| %s | [%s](%s) |\n", service, urls[service], urls[service])
+	}
+	return b.String()
+}
+
+// GetAdjustResult reads the components of an adjusted cluster registry
+func GetAdjustResult(gitopsRepoDir, clusterName string) (*AdjustResult, error) {
+	registryPath, err := RegistryPath(gitopsRepoDir, clusterName)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(fmt.Sprintf("%s/components", registryPath))
+	if err != nil {
+		return nil, fmt.Errorf("error reading components for cluster %s: %s", clusterName, err)
+	}
+
+	components := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			components = append(components, entry.Name())
+		}
+	}
+	sort.Strings(components)
+
+	return &AdjustResult{
+		ClusterName:  clusterName,
+		RegistryPath: registryPath,
+		Components:   components,
+	}, nil
+}
+
+// WriteInstallSummary writes a json summary of the install combining the config and
+// adjust result, relative paths are written under cfg.K1Dir
+func WriteInstallSummary(cfg *K3dConfig, result *AdjustResult, path string) error {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(cfg.K1Dir, path)
+	}
+
+	summary := InstallSummary{
+		ClusterName:     cfg.ClusterName,
+		CloudProvider:   CloudProvider,
+		GitProvider:     cfg.GitProvider,
+		GitProtocol:     cfg.GitProtocol,
+		GitopsRepoURL:   cfg.DestinationGitopsRepoURL,
+		MetaphorRepoURL: cfg.DestinationMetaphorRepoURL,
+		IngressURLs:     AllServiceURLs(cfg),
+	}
+	if result != nil {
+		summary.RegistryPath = result.RegistryPath
+		summary.Components = result.Components
+	}
+
+	content, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), cfg.dirMode())
+	if err != nil {
+		return fmt.Errorf("error creating install summary directory: %s", err)
+	}
+	err = os.WriteFile(path, content, 0600)
+	if err != nil {
+		return fmt.Errorf("error writing install summary %s: %s", path, err)
+	}
+	log.Info().Msgf("install summary written to %s", path)
+
+	return nil
+}
@@ -0,0 +1,148 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestWriteInstallSummary(t *testing.T) {
+
+	gitopsDir := t.TempDir()
+	writeFixture(t, gitopsDir, map[string]string{
+		"registry/kubefirst/components/vault/application.yaml":  "kind: Application\n",
+		"registry/kubefirst/components/argocd/application.yaml": "kind: Application\n",
+	})
+	result, err := GetAdjustResult(gitopsDir, "kubefirst")
+	if err != nil {
+		t.Fatalf("GetAdjustResult() error = %v", err)
+	}
+
+	cfg := &K3dConfig{
+		ClusterName:              "kubefirst",
+		DestinationGitopsRepoURL: "https://github.com/kubefirst/gitops.git",
+		GitProvider:              "github",
+		GitProtocol:              "https",
+		K1Dir:                    t.TempDir(),
+	}
+	err = WriteInstallSummary(cfg, result, "install-summary.json")
+	if err != nil {
+		t.Fatalf("WriteInstallSummary() error = %v", err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(cfg.K1Dir, "install-summary.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summary map[string]interface{}
+	if err := json.Unmarshal(content, &summary); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, want := range map[string]interface{}{
+		"clusterName":   "kubefirst",
+		"cloudProvider": "k3d",
+		"gitProvider":   "github",
+		"gitopsRepoURL": "https://github.com/kubefirst/gitops.git",
+		"components":    []interface{}{"argocd", "vault"},
+	} {
+		if !reflect.DeepEqual(summary[key], want) {
+			t.Errorf("summary %s = %v, want %v", key, summary[key], want)
+		}
+	}
+	ingressURLs, _ := summary["ingressURLs"].(map[string]interface{})
+	if ingressURLs["argocd"] != "https://argocd.kubefirst.dev" {
+		t.Errorf("summary ingressURLs.argocd = %v, want https://argocd.kubefirst.dev", ingressURLs["argocd"])
+	}
+}
+
+func TestRenderURLsMarkdown(t *testing.T) {
+
+	want := map[string]string{
+		"argo":                 ArgoWorkflowsURL,
+		"argocd":               ArgocdURL,
+		"atlantis":             AtlantisURL,
+		"chartmuseum":          ChartMuseumURL,
+		"kubefirst":            KubefirstConsoleURL,
+		"metaphor-development": MetaphorDevelopmentURL,
+		"metaphor-production":  MetaphorProductionURL,
+		"metaphor-staging":     MetaphorStagingURL,
+		"minio":                "https://minio." + DomainName,
+		"minio-console":        "https://minio-console." + DomainName,
+		"vault":                VaultURL,
+	}
+	if got := serviceURLs(DomainName); !reflect.DeepEqual(got, want) {
+		t.Errorf("serviceURLs() = %v, want %v", got, want)
+	}
+
+	got := RenderURLsMarkdown("example.com")
+	lines := strings.Split(strings.TrimSuffix(got, "\n"), "\n")
+	if len(lines) != len(want)+2 || lines[0] != "| Service | URL |" || lines[1] != "| --- | --- |" {
+		t.Fatalf("RenderURLsMarkdown() = %q, want a header and a row per service", got)
+	}
+	rows := lines[2:]
+	if !sort.StringsAreSorted(rows) {
+		t.Errorf("RenderURLsMarkdown() rows are not sorted by service: %v", rows)
+	}
+	for _, wantRow := range []string{
+		"| argocd | [https://argocd.example.com](https://argocd.example.com) |",
+		"| vault | [https://vault.example.com](https://vault.example.com) |",
+		"| metaphor-staging | [https://metaphor-staging.example.com](https://metaphor-staging.example.com) |",
+	} {
+		if !strings.Contains(got, wantRow+"\n") {
+			t.Errorf("RenderURLsMarkdown() = %q, missing row %q", got, wantRow)
+		}
+	}
+	for service := range want {
+		if !strings.Contains(got, "| "+service+" | [https://"+service+".example.com]") {
+			t.Errorf("RenderURLsMarkdown() has no row for %s", service)
+		}
+	}
+}
+
+func TestAllServiceURLs(t *testing.T) {
+
+	tests := []struct {
+		name            string
+		localAccessMode bool
+		want            map[string]string
+	}{
+		{
+			name: "ingress",
+			want: map[string]string{"argocd": ArgocdURL, "vault": VaultURL, "argo": ArgoWorkflowsURL, "kubefirst": KubefirstConsoleURL},
+		},
+		{
+			name:            "local access",
+			localAccessMode: true,
+			want:            map[string]string{"argocd": "http://localhost:8080", "vault": "http://localhost:8200", "argo": ArgoWorkflowsURL, "kubefirst": KubefirstConsoleURL},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := AllServiceURLs(&K3dConfig{LocalAccessMode: tt.localAccessMode})
+			if len(got) != len(serviceURLs(DomainName)) {
+				t.Errorf("AllServiceURLs() = %v, want every service", got)
+			}
+			for service, want := range tt.want {
+				if got[service] != want {
+					t.Errorf("AllServiceURLs()[%s] = %v, want %v", service, got[service], want)
+				}
+			}
+		})
+	}
+
+	// the shared service urls are not modified by local access mode
+	if serviceURLs(DomainName)["argocd"] != ArgocdURL {
+		t.Error("local access mode leaked into serviceURLs")
+	}
+}
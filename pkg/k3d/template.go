@@ -0,0 +1,122 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kubefirst/runtime/configs"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/mod/semver"
+)
+
+// templateVersionFile is the file at the root of a template repo declaring the range of
+// runtime versions the template supports, one key=value per line, e.g.
+//
+//	min=v2.0.0
+//	max=v2.2.0
+//
+// both bounds are inclusive and max may be omitted
+const templateVersionFile = ".kubefirst-template-version"
+
+// templateVersionRange is the supported runtime range declared by a template repo
+type templateVersionRange struct {
+	Min string
+	Max string
+}
+
+// CheckTemplateCompatibility fails when runtimeVersion is outside the range of runtime versions
+// declared in the .kubefirst-template-version file of the template cloned at gitopsRepoDir,
+// saying whether kubefirst or the template has to change. Templates without the file and
+// development builds of the runtime are not checked
+func CheckTemplateCompatibility(gitopsRepoDir string, runtimeVersion string) error {
+	path := filepath.Join(gitopsRepoDir, templateVersionFile)
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		log.Warn().Str("path", gitopsRepoDir).Msgf("template does not declare a %s, skipping the compatibility check", templateVersionFile)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading template version file %s: %s", path, err)
+	}
+
+	if runtimeVersion == configs.DefaultK1Version {
+		log.Warn().Str("path", gitopsRepoDir).Msg("development build of kubefirst, skipping the template compatibility check")
+		return nil
+	}
+	runtime := canonicalVersion(runtimeVersion)
+	if !semver.IsValid(runtime) {
+		return fmt.Errorf("runtime version %q is not a semantic version", runtimeVersion)
+	}
+
+	supported, err := parseTemplateVersionRange(content)
+	if err != nil {
+		return fmt.Errorf("error parsing template version file %s: %s", path, err)
+	}
+
+	if semver.Compare(runtime, supported.Min) < 0 {
+		return fmt.Errorf("the template requires kubefirst %s or newer but this is %s, upgrade kubefirst or use an older template release", supported.Min, runtime)
+	}
+	if supported.Max != "" && semver.Compare(runtime, supported.Max) > 0 {
+		return fmt.Errorf("the template supports kubefirst up to %s but this is %s, use a newer template release or downgrade kubefirst to %s", supported.Max, runtime, supported.Max)
+	}
+
+	return nil
+}
+
+// parseTemplateVersionRange parses the content of a template version file, requiring a min
+// and rejecting unknown keys and a max lower than the min
+func parseTemplateVersionRange(content []byte) (templateVersionRange, error) {
+	supported := templateVersionRange{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(text, "=")
+		if !ok {
+			return supported, fmt.Errorf("line %d: expected key=value, got %q", line, text)
+		}
+		key, value = strings.TrimSpace(key), canonicalVersion(strings.TrimSpace(value))
+		if !semver.IsValid(value) {
+			return supported, fmt.Errorf("line %d: %s is not a semantic version", line, value)
+		}
+		switch key {
+		case "min":
+			supported.Min = value
+		case "max":
+			supported.Max = value
+		default:
+			return supported, fmt.Errorf("line %d: unknown key %q, expected min or max", line, key)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return supported, err
+	}
+
+	if supported.Min == "" {
+		return supported, fmt.Errorf("no min version declared")
+	}
+	if supported.Max != "" && semver.Compare(supported.Min, supported.Max) > 0 {
+		return supported, fmt.Errorf("min version %s is greater than max version %s", supported.Min, supported.Max)
+	}
+	return supported, nil
+}
+
+// canonicalVersion prefixes version with the v golang.org/x/mod/semver expects
+func canonicalVersion(version string) string {
+	if version == "" || strings.HasPrefix(version, "v") {
+		return version
+	}
+	return "v" + version
+}
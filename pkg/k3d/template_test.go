@@ -0,0 +1,72 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kubefirst/runtime/configs"
+)
+
+func TestCheckTemplateCompatibility(t *testing.T) {
+
+	tests := []struct {
+		name           string
+		versionFile    string
+		runtimeVersion string
+		wantErr        string
+	}{
+		{name: "within range", versionFile: "min=v2.0.0\nmax=v2.2.0\n", runtimeVersion: "v2.1.3"},
+		{name: "bounds are inclusive", versionFile: "min=v2.0.0\nmax=v2.2.0\n", runtimeVersion: "2.2.0"},
+		{name: "no max", versionFile: "# supported runtimes\nmin=2.0.0\n", runtimeVersion: "v3.0.0"},
+		{name: "no version file", runtimeVersion: "v1.0.0"},
+		{name: "development build", versionFile: "min=v2.0.0\n", runtimeVersion: configs.DefaultK1Version},
+		{
+			name:           "runtime too old",
+			versionFile:    "min=v2.1.0\nmax=v2.2.0\n",
+			runtimeVersion: "v2.0.9",
+			wantErr:        "requires kubefirst v2.1.0 or newer but this is v2.0.9, upgrade kubefirst",
+		},
+		{
+			name:           "runtime too new",
+			versionFile:    "min=v2.0.0\nmax=v2.2.0\n",
+			runtimeVersion: "v2.3.0",
+			wantErr:        "supports kubefirst up to v2.2.0 but this is v2.3.0, use a newer template release or downgrade kubefirst to v2.2.0",
+		},
+		{
+			name:           "prerelease before min",
+			versionFile:    "min=v2.1.0\n",
+			runtimeVersion: "v2.1.0-rc.1",
+			wantErr:        "upgrade kubefirst",
+		},
+		{name: "missing min", versionFile: "max=v2.2.0\n", runtimeVersion: "v2.1.0", wantErr: "no min version declared"},
+		{name: "inverted range", versionFile: "min=v2.2.0\nmax=v2.0.0\n", runtimeVersion: "v2.1.0", wantErr: "greater than max version"},
+		{name: "unknown key", versionFile: "min=v2.0.0\nlatest=v2.2.0\n", runtimeVersion: "v2.1.0", wantErr: `line 2: unknown key "latest"`},
+		{name: "invalid version", versionFile: "min=two\n", runtimeVersion: "v2.1.0", wantErr: "vtwo is not a semantic version"},
+		{name: "invalid runtime version", versionFile: "min=v2.0.0\n", runtimeVersion: "latest", wantErr: `runtime version "latest"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gitopsDir := t.TempDir()
+			if tt.versionFile != "" {
+				writeFixture(t, gitopsDir, map[string]string{templateVersionFile: tt.versionFile})
+			}
+
+			err := CheckTemplateCompatibility(gitopsDir, tt.runtimeVersion)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("CheckTemplateCompatibility() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("CheckTemplateCompatibility() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
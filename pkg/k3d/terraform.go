@@ -7,6 +7,9 @@ See the LICENSE file for more details.
 package k3d
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/kubefirst/runtime/pkg"
 )
 
@@ -45,6 +48,17 @@ func GetVaultTerraformEnvs(config *K3dConfig, envs map[string]string) map[string
 	return envs
 }
 
+// ValidateTerraform parses the terraform files under dir with the configured terraform client
+// without modifying them, returning any parse errors reported
+func ValidateTerraform(cfg *K3dConfig, dir string) error {
+	_, stdErr, err := pkg.ExecShellReturnStrings(cfg.TerraformClient, "fmt", "-write=false", "-list=false", "-recursive", "-no-color", dir)
+	if err != nil {
+		return fmt.Errorf("terraform files in %s failed to parse: %s", dir, strings.TrimSpace(stdErr))
+	}
+
+	return nil
+}
+
 type GithubTerraformEnvs struct {
 	GithubToken           string
 	GithubOwner           string
@@ -0,0 +1,62 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeStubTool writes an executable shell script to dir/name
+func writeStubTool(t *testing.T, dir, name, script string) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestValidateTerraform(t *testing.T) {
+
+	toolsDir := t.TempDir()
+	cfg := &K3dConfig{
+		TerraformClient: writeStubTool(t, toolsDir, "terraform", `
+for last; do :; done
+if [ -f "$last/bad.tf" ]; then
+  echo "Error: Invalid expression on bad.tf line 1" >&2
+  exit 1
+fi
+`),
+	}
+
+	tests := []struct {
+		name    string
+		files   map[string]string
+		wantErr string
+	}{
+		{name: "valid terraform", files: map[string]string{"repos.tf": "name = \"gitops\"\n"}},
+		{name: "invalid terraform", files: map[string]string{"bad.tf": "name = \n"}, wantErr: "Invalid expression on bad.tf"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFixture(t, dir, tt.files)
+
+			err := ValidateTerraform(cfg, dir)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("ValidateTerraform() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("ValidateTerraform() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
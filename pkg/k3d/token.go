@@ -0,0 +1,207 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// requiredGitlabScopes are the personal access token scopes needed to create and push the repositories
+var requiredGitlabScopes = []string{"api", "write_repository"}
+
+// githubAPIURL is the api endpoint used for repositories hosted on GithubHost
+var githubAPIURL = "https://api.github.com"
+
+// gitlabAPIHost is the gitlab instance git tokens are validated against when GitlabHost isn't configured
+var gitlabAPIHost = GitlabHost
+
+// gitlabAPIHostFor returns the self-managed cfg.GitlabHost, defaulting to gitlabAPIHost
+func gitlabAPIHostFor(cfg *K3dConfig) string {
+	if cfg.GitlabHost != "" {
+		return cfg.GitlabHost
+	}
+	return gitlabAPIHost
+}
+
+// maxRepoNameSuffix bounds the numeric suffixes tried by EnsureUniqueRepoName
+const maxRepoNameSuffix = 100
+
+// providerAPIBase returns the scheme qualified base url for host, defaulting to https
+func providerAPIBase(host string) string {
+	host = strings.TrimSuffix(host, "/")
+	if strings.HasPrefix(host, "http://") || strings.HasPrefix(host, "https://") {
+		return host
+	}
+	return "https://" + host
+}
+
+// validateGitlabScopes checks the token used against the gitlab instance at host
+// carries the api and write_repository scopes
+func validateGitlabScopes(httpClient *http.Client, token, host string) error {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/api/v4/personal_access_tokens/self", providerAPIBase(host)), nil)
+	if err != nil {
+		return fmt.Errorf("error building gitlab token request: %s", err)
+	}
+	req.Header.Set("PRIVATE-TOKEN", token)
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error validating gitlab token against %s: %s", host, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("gitlab token was rejected by %s, check it is valid and not expired", host)
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status validating gitlab token against %s: %s", host, res.Status)
+	}
+
+	var tokenInfo struct {
+		Scopes []string `json:"scopes"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&tokenInfo)
+	if err != nil {
+		return fmt.Errorf("error decoding gitlab token response: %s", err)
+	}
+
+	granted := map[string]bool{}
+	for _, scope := range tokenInfo.Scopes {
+		granted[scope] = true
+	}
+	missing := []string{}
+	for _, scope := range requiredGitlabScopes {
+		if !granted[scope] {
+			missing = append(missing, scope)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("gitlab token is missing required scopes: %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// validateGithubToken checks the token is accepted by the github api and, for classic tokens that
+// report their scopes, carries the repo scope
+func validateGithubToken(httpClient *http.Client, token string) error {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/user", githubAPIURL), nil)
+	if err != nil {
+		return fmt.Errorf("error building github token request: %s", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error validating github token: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("github token was rejected, check it is valid and not expired")
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status validating github token: %s", res.Status)
+	}
+
+	// fine-grained tokens don't report scopes
+	scopes := res.Header.Get("X-OAuth-Scopes")
+	if scopes == "" {
+		return nil
+	}
+	for _, scope := range strings.Split(scopes, ",") {
+		if strings.TrimSpace(scope) == "repo" {
+			return nil
+		}
+	}
+	return fmt.Errorf("github token is missing required scope: repo")
+}
+
+// validateGitToken checks token against the api of the configured git provider
+func validateGitToken(cfg *K3dConfig, token string) error {
+	httpClient, err := ProviderHttpClient(cfg)
+	if err != nil {
+		return err
+	}
+
+	switch cfg.GitProvider {
+	case "github":
+		return validateGithubToken(httpClient, token)
+	case "gitlab":
+		return validateGitlabScopes(httpClient, token, gitlabAPIHostFor(cfg))
+	default:
+		return fmt.Errorf("unsupported git provider %q", cfg.GitProvider)
+	}
+}
+
+// EnsureUniqueRepoName returns baseName if owner has no repository of that name on host,
+// otherwise the first free name with a numeric suffix, e.g. gitops-2
+// repositories on GithubHost are checked against the github api, any other host is treated as gitlab
+// httpClient is the client for the provider api, see ProviderHttpClient
+func EnsureUniqueRepoName(httpClient *http.Client, token, host, owner, baseName string) (string, error) {
+	for suffix := 1; suffix <= maxRepoNameSuffix; suffix++ {
+		name := baseName
+		if suffix > 1 {
+			name = fmt.Sprintf("%s-%d", baseName, suffix)
+		}
+
+		exists, err := repoExists(httpClient, token, host, owner, name)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return name, nil
+		}
+		log.Info().Str("owner", owner).Str("repo", name).Msg("repository already exists, trying the next name")
+	}
+
+	return "", fmt.Errorf("no free repository name found for %s/%s after %d attempts", owner, baseName, maxRepoNameSuffix)
+}
+
+// repoExists reports whether owner/name exists on host
+func repoExists(httpClient *http.Client, token, host, owner, name string) (bool, error) {
+	var req *http.Request
+	var err error
+	if host == GithubHost {
+		req, err = http.NewRequest(http.MethodGet, fmt.Sprintf("%s/repos/%s/%s", githubAPIURL, owner, name), nil)
+		if err == nil {
+			req.Header.Set("Authorization", "Bearer "+token)
+			req.Header.Set("Accept", "application/vnd.github+json")
+		}
+	} else {
+		project := url.PathEscape(fmt.Sprintf("%s/%s", owner, name))
+		req, err = http.NewRequest(http.MethodGet, fmt.Sprintf("%s/api/v4/projects/%s", providerAPIBase(host), project), nil)
+		if err == nil {
+			req.Header.Set("PRIVATE-TOKEN", token)
+		}
+	}
+	if err != nil {
+		return false, fmt.Errorf("error building repository request for %s/%s: %s", owner, name, err)
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("error checking repository %s/%s on %s: %s", owner, name, host, err)
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected status checking repository %s/%s on %s: %s", owner, name, host, res.Status)
+	}
+}
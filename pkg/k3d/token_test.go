@@ -0,0 +1,209 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newCABundle writes the certificate of the tls server to a PEM bundle for K3dConfig.CACertPath
+func newCABundle(t *testing.T, server *httptest.Server) string {
+	t.Helper()
+
+	caCertPath := filepath.Join(t.TempDir(), "ca.pem")
+	caCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caCertPath, caCert, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return caCertPath
+}
+
+func TestValidateGitlabScopes(t *testing.T) {
+
+	tokens := map[string][]string{
+		"full":       {"api", "read_repository", "write_repository"},
+		"read-only":  {"read_api", "read_repository"},
+		"api-only":   {"api"},
+		"repos-only": {"write_repository"},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v4/personal_access_tokens/self" {
+			http.NotFound(w, r)
+			return
+		}
+		scopes, ok := tokens[r.Header.Get("PRIVATE-TOKEN")]
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"active": true, "scopes": scopes})
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		token       string
+		wantMissing []string
+		wantErr     bool
+	}{
+		{token: "full"},
+		{token: "read-only", wantMissing: []string{"api", "write_repository"}, wantErr: true},
+		{token: "api-only", wantMissing: []string{"write_repository"}, wantErr: true},
+		{token: "repos-only", wantMissing: []string{"api"}, wantErr: true},
+		{token: "unknown", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.token, func(t *testing.T) {
+			err := validateGitlabScopes(server.Client(), tt.token, server.URL)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateGitlabScopes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(tt.wantMissing) > 0 && !strings.HasSuffix(err.Error(), strings.Join(tt.wantMissing, ", ")) {
+				t.Errorf("validateGitlabScopes() error = %v, want missing %v", err, tt.wantMissing)
+			}
+		})
+	}
+}
+
+// newRepoProvider serves the github and gitlab repository lookups for the listed owner/name repositories over tls
+func newRepoProvider(t *testing.T, repos ...string) *httptest.Server {
+	t.Helper()
+
+	existing := map[string]bool{}
+	for _, repo := range repos {
+		existing[repo] = true
+	}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var repo string
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/repos/"):
+			repo = strings.TrimPrefix(r.URL.Path, "/repos/")
+		case strings.HasPrefix(r.URL.Path, "/api/v4/projects/"):
+			repo = strings.TrimPrefix(r.URL.Path, "/api/v4/projects/")
+		}
+		if !existing[repo] {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"name": repo})
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestValidateGitTokenCABundle(t *testing.T) {
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/user" {
+			w.Write([]byte(`{"login":"kubefirst-bot"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"scopes": requiredGitlabScopes})
+	}))
+	defer server.Close()
+	defaultGithubAPIURL, defaultGitlabAPIHost := githubAPIURL, gitlabAPIHost
+	defer func() { githubAPIURL, gitlabAPIHost = defaultGithubAPIURL, defaultGitlabAPIHost }()
+	githubAPIURL, gitlabAPIHost = server.URL, server.URL
+	caCertPath := newCABundle(t, server)
+
+	tests := []struct {
+		name        string
+		gitProvider string
+		caCertPath  string
+		wantErr     bool
+	}{
+		{name: "self-signed gitlab trusted through the ca bundle", gitProvider: "gitlab", caCertPath: caCertPath},
+		{name: "self-signed gitlab without a ca bundle", gitProvider: "gitlab", wantErr: true},
+		{name: "github api trusted through the ca bundle", gitProvider: "github", caCertPath: caCertPath},
+		{name: "github api without a ca bundle", gitProvider: "github", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateGitToken(&K3dConfig{GitProvider: tt.gitProvider, CACertPath: tt.caCertPath}, "token")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateGitToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEnsureUniqueRepoName(t *testing.T) {
+
+	server := newRepoProvider(t, "kubefirst/gitops", "kubefirst/gitops-2", "kubefirst/metaphor")
+	defaultGithubAPIURL := githubAPIURL
+	defer func() { githubAPIURL = defaultGithubAPIURL }()
+	githubAPIURL = server.URL
+
+	tests := []struct {
+		name     string
+		host     string
+		baseName string
+		want     string
+	}{
+		{name: "github free name", host: GithubHost, baseName: "gitops-prod", want: "gitops-prod"},
+		{name: "github collisions", host: GithubHost, baseName: "gitops", want: "gitops-3"},
+		{name: "gitlab free name", host: server.URL, baseName: "gitops-prod", want: "gitops-prod"},
+		{name: "gitlab collision", host: server.URL, baseName: "metaphor", want: "metaphor-2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := EnsureUniqueRepoName(server.Client(), "token", tt.host, "kubefirst", tt.baseName)
+			if err != nil {
+				t.Fatalf("EnsureUniqueRepoName() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("EnsureUniqueRepoName() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetUniqueGitopsRepoName(t *testing.T) {
+
+	server := newRepoProvider(t, "kubefirst/gitops")
+	defaultGithubAPIURL := githubAPIURL
+	defer func() { githubAPIURL = defaultGithubAPIURL }()
+	githubAPIURL = server.URL
+
+	cfg := GetConfig("test", "kubefirst", "gitops", "metaphor", "github", "kubefirst", "https")
+	// the provider api is self-signed, so the check only succeeds through the ca bundle
+	cfg.CACertPath = newCABundle(t, server)
+	err := SetUniqueGitopsRepoName(cfg, "kubefirst")
+	if err != nil {
+		t.Fatalf("SetUniqueGitopsRepoName() error = %v", err)
+	}
+	if cfg.GitopsRepoName != "gitops-2" {
+		t.Errorf("GitopsRepoName = %v, want gitops-2", cfg.GitopsRepoName)
+	}
+	if want := "git@github.com:kubefirst/gitops-2.git"; cfg.DestinationGitopsRepoGitURL != want {
+		t.Errorf("DestinationGitopsRepoGitURL = %v, want %v", cfg.DestinationGitopsRepoGitURL, want)
+	}
+}
+
+func TestSelfManagedGitlabHost(t *testing.T) {
+
+	server := newMembershipProvider(t, nil)
+	defaultGitlabAPIHost := gitlabAPIHost
+	defer func() { gitlabAPIHost = defaultGitlabAPIHost }()
+	// nothing listens on the default host, so the checks only succeed against cfg.GitlabHost
+	gitlabAPIHost = "http://127.0.0.1:1"
+
+	cfg := &K3dConfig{GitProvider: "gitlab", GitlabHost: server.URL, GitlabToken: "token", GitOwner: "kubefirst-bot"}
+	if err := ValidateOwnerAccess(cfg); err != nil {
+		t.Errorf("ValidateOwnerAccess() error = %v", err)
+	}
+	if err := validateGitToken(cfg, "expired"); err == nil || !strings.Contains(err.Error(), server.URL) {
+		t.Errorf("validateGitToken() error = %v, want the token rejected by %s", err, server.URL)
+	}
+}
@@ -0,0 +1,351 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/kubefirst/runtime/pkg"
+	"github.com/rs/zerolog/log"
+)
+
+// toolVersionPattern matches the first semantic version in a tool's version output
+var toolVersionPattern = regexp.MustCompile(`\bv?(\d+\.\d+\.\d+(?:-[0-9A-Za-z.-]+)?)`)
+
+// toolVersionArgs are the version subcommands per tool, kubectl is limited to the client
+// so no cluster is contacted
+var toolVersionArgs = map[string][][]string{
+	"k3d":       {{"version"}},
+	"kubectl":   {{"version", "--client"}},
+	"terraform": {{"version"}},
+	"mkcert":    {{"-version"}},
+}
+
+// InstalledToolVersion runs the version command of the tool at toolPath and returns the
+// semantic version it reports, always prefixed with v, e.g. v1.3.8
+// unknown tools are tried with `version` and then `--version`
+func InstalledToolVersion(toolPath string) (string, error) {
+	attempts, ok := toolVersionArgs[strings.TrimSuffix(filepath.Base(toolPath), ".exe")]
+	if !ok {
+		attempts = [][]string{{"version"}, {"--version"}}
+	}
+
+	var lastErr error
+	for _, args := range attempts {
+		stdOut, stdErr, err := pkg.ExecShellReturnStrings(toolPath, args...)
+		if err != nil {
+			lastErr = fmt.Errorf("error running %s %s: %s %s", toolPath, strings.Join(args, " "), err, stdErr)
+			continue
+		}
+
+		match := toolVersionPattern.FindStringSubmatch(stdOut + stdErr)
+		if match == nil {
+			lastErr = fmt.Errorf("no version found in output of %s %s", toolPath, strings.Join(args, " "))
+			continue
+		}
+		return "v" + match[1], nil
+	}
+
+	return "", lastErr
+}
+
+// toolsManifestName is the file recording the pinned tool versions of an archived tools directory
+const toolsManifestName = ".tools-versions"
+
+// toolsManifest lists the pinned tool versions the tools directory is expected to hold
+func toolsManifest() string {
+	return fmt.Sprintf("k3d=%s\nkubectl=%s\nmkcert=%s\nterraform=%s\n", K3dVersion, KubectlVersion, MkCertVersion, TerraformVersion)
+}
+
+// toolClients returns the tool binaries expected in cfg.ToolsDir
+func toolClients(cfg *K3dConfig) []string {
+	return []string{cfg.K3dClient, cfg.KubectlClient, cfg.MkCertClient, cfg.TerraformClient}
+}
+
+// toolVersionsBaselineName is the file under K1Dir recording the tool versions of a known good run
+const toolVersionsBaselineName = "tool-versions.json"
+
+// toolVersionUnavailable is recorded for tools whose version can't be determined
+const toolVersionUnavailable = "unavailable"
+
+// VersionDrift is a tool whose installed version differs from the recorded baseline,
+// Recorded or Current is empty when the tool was added or removed since
+type VersionDrift struct {
+	Tool     string
+	Recorded string
+	Current  string
+}
+
+// installedToolVersions returns the installed version of each tool keyed by tool name
+func installedToolVersions(cfg *K3dConfig) map[string]string {
+	versions := map[string]string{}
+	for _, tool := range toolClients(cfg) {
+		version, err := InstalledToolVersion(tool)
+		if err != nil {
+			log.Warn().Msgf("unable to determine the version of %s: %s", tool, err)
+			version = toolVersionUnavailable
+		}
+		versions[strings.TrimSuffix(filepath.Base(tool), ".exe")] = version
+	}
+	return versions
+}
+
+// RecordToolVersions writes the installed tool versions to K1Dir as the baseline ToolVersionDrift
+// compares against
+func RecordToolVersions(cfg *K3dConfig) error {
+	content, err := json.MarshalIndent(installedToolVersions(cfg), "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding tool versions: %s", err)
+	}
+
+	path := filepath.Join(cfg.K1Dir, toolVersionsBaselineName)
+	err = os.WriteFile(path, append(content, '\n'), 0600)
+	if err != nil {
+		return fmt.Errorf("error writing tool versions %s: %s", path, err)
+	}
+
+	log.Info().Str("path", path).Msg("tool versions recorded")
+	return nil
+}
+
+// ToolVersionDrift returns the tools whose installed version differs from the versions recorded
+// by RecordToolVersions, sorted by tool name
+func ToolVersionDrift(cfg *K3dConfig) ([]VersionDrift, error) {
+	path := filepath.Join(cfg.K1Dir, toolVersionsBaselineName)
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no tool versions recorded at %s, record a baseline with RecordToolVersions first", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading tool versions %s: %s", path, err)
+	}
+	recorded := map[string]string{}
+	err = json.Unmarshal(content, &recorded)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing tool versions %s: %s", path, err)
+	}
+
+	current := installedToolVersions(cfg)
+	tools := []string{}
+	for tool := range recorded {
+		tools = append(tools, tool)
+	}
+	for tool := range current {
+		if _, ok := recorded[tool]; !ok {
+			tools = append(tools, tool)
+		}
+	}
+	sort.Strings(tools)
+
+	drift := []VersionDrift{}
+	for _, tool := range tools {
+		if recorded[tool] != current[tool] {
+			drift = append(drift, VersionDrift{Tool: tool, Recorded: recorded[tool], Current: current[tool]})
+		}
+	}
+	return drift, nil
+}
+
+// ArchiveTools writes cfg.ToolsDir to destPath as a gzipped tarball, along with a manifest of
+// the pinned tool versions so a later RestoreTools can tell whether the archive is current
+func ArchiveTools(cfg *K3dConfig, destPath string) error {
+	for _, tool := range toolClients(cfg) {
+		if _, err := os.Stat(tool); err != nil {
+			return fmt.Errorf("tool %s missing, download the tools before archiving: %s", tool, err)
+		}
+	}
+
+	f, err := os.Create(destPath)
+	if err != nil {
+		return fmt.Errorf("error creating tools archive %s: %s", destPath, err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	err = filepath.Walk(cfg.ToolsDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() || fi.Name() == toolsManifestName {
+			return nil
+		}
+		rel, err := filepath.Rel(cfg.ToolsDir, path)
+		if err != nil {
+			return err
+		}
+
+		header, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		err = tw.WriteHeader(header)
+		if err != nil {
+			return err
+		}
+		content, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer content.Close()
+		_, err = io.Copy(tw, content)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error archiving tools from %s: %s", cfg.ToolsDir, err)
+	}
+
+	manifest := toolsManifest()
+	err = tw.WriteHeader(&tar.Header{Name: toolsManifestName, Mode: 0644, Size: int64(len(manifest)), Typeflag: tar.TypeReg})
+	if err == nil {
+		_, err = tw.Write([]byte(manifest))
+	}
+	if err != nil {
+		return fmt.Errorf("error writing tools manifest: %s", err)
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return fmt.Errorf("error closing tools archive: %s", err)
+	}
+	err = gz.Close()
+	if err != nil {
+		return fmt.Errorf("error closing tools archive: %s", err)
+	}
+
+	log.Info().Str("path", destPath).Msg("tools archived")
+	return nil
+}
+
+// RestoreTools extracts an archive written by ArchiveTools into cfg.ToolsDir, keeping file modes,
+// and fails unless the archive holds every tool at the pinned versions
+func RestoreTools(cfg *K3dConfig, srcPath string) error {
+	f, err := os.Open(srcPath)
+	if err != nil {
+		return fmt.Errorf("error opening tools archive %s: %s", srcPath, err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("error reading tools archive %s: %s", srcPath, err)
+	}
+	tr := tar.NewReader(gz)
+
+	err = os.MkdirAll(cfg.ToolsDir, cfg.dirMode())
+	if err != nil {
+		return fmt.Errorf("error creating tools directory %s: %s", cfg.ToolsDir, err)
+	}
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading tools archive %s: %s", srcPath, err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := filepath.FromSlash(header.Name)
+		if filepath.IsAbs(name) || name != filepath.Clean(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("invalid path %q in tools archive %s", header.Name, srcPath)
+		}
+		path := filepath.Join(cfg.ToolsDir, name)
+		err = os.MkdirAll(filepath.Dir(path), cfg.dirMode())
+		if err != nil {
+			return err
+		}
+		out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode).Perm())
+		if err != nil {
+			return fmt.Errorf("error restoring %s: %s", path, err)
+		}
+		_, err = io.Copy(out, tr)
+		out.Close()
+		if err != nil {
+			return fmt.Errorf("error restoring %s: %s", path, err)
+		}
+		// the mode passed to OpenFile only applies to new files and is subject to umask
+		err = os.Chmod(path, os.FileMode(header.Mode).Perm())
+		if err != nil {
+			return err
+		}
+	}
+
+	if !toolsRestored(cfg) {
+		return fmt.Errorf("tools archive %s does not contain the pinned tool versions, download the tools instead", srcPath)
+	}
+
+	log.Info().Str("path", srcPath).Msg("tools restored")
+	return nil
+}
+
+// toolsRestored reports whether cfg.ToolsDir was restored from an archive of the pinned
+// tool versions with every tool executable
+func toolsRestored(cfg *K3dConfig) bool {
+	manifest, err := os.ReadFile(filepath.Join(cfg.ToolsDir, toolsManifestName))
+	if err != nil || string(manifest) != toolsManifest() {
+		return false
+	}
+	for _, tool := range toolClients(cfg) {
+		fi, err := os.Stat(tool)
+		if err != nil || fi.Mode().Perm()&0100 == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// CleanTools removes the content of cfg.ToolsDir, e.g. after a corrupt download, so DownloadTools
+// fetches every tool again. The tools directory itself is kept, and the rest of the config such as
+// the gitops and metaphor repos and the kubeconfig is left untouched
+func CleanTools(cfg *K3dConfig) error {
+	if cfg.ToolsDir == "" {
+		return fmt.Errorf("error cleaning tools: tools directory is not set")
+	}
+	toolsDir := filepath.Clean(cfg.ToolsDir)
+
+	// refuse a tools directory holding the rest of the config, e.g. ToolsDir set to K1Dir
+	for _, kept := range []string{cfg.K1Dir, cfg.GitopsDir, cfg.MetaphorDir, cfg.Kubeconfig} {
+		if kept == "" {
+			continue
+		}
+		rel, err := filepath.Rel(toolsDir, filepath.Clean(kept))
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("refusing to clean tools directory %s: it contains %s", toolsDir, kept)
+		}
+	}
+
+	entries, err := os.ReadDir(toolsDir)
+	if os.IsNotExist(err) {
+		log.Info().Str("path", toolsDir).Msg("tools directory does not exist, nothing to clean")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading tools directory %s: %s", toolsDir, err)
+	}
+	for _, entry := range entries {
+		err = os.RemoveAll(filepath.Join(toolsDir, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("error removing %s from tools directory %s: %s", entry.Name(), toolsDir, err)
+		}
+	}
+
+	log.Info().Str("path", toolsDir).Int("removed", len(entries)).Msg("tools directory cleaned")
+	return nil
+}
@@ -0,0 +1,275 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestInstalledToolVersion(t *testing.T) {
+
+	toolsDir := t.TempDir()
+
+	tests := []struct {
+		tool    string
+		script  string
+		want    string
+		wantErr bool
+	}{
+		{
+			tool:   "k3d",
+			script: `[ "$1" = version ] && printf 'k3d version v5.4.6\nk3s version v1.24.4-k3s1 (default)\n'`,
+			want:   "v5.4.6",
+		},
+		{
+			tool:   "kubectl",
+			script: `[ "$1 $2" = "version --client" ] && printf 'Client Version: version.Info{Major:"1", Minor:"25", GitVersion:"v1.25.7", GitCommit:"723bcdb232300aaf5e147ff19b4df7ec8a20278d", GitTreeState:"clean"}\nKustomize Version: v4.5.7\n'`,
+			want:   "v1.25.7",
+		},
+		{
+			tool:   "terraform",
+			script: `[ "$1" = version ] && printf 'Terraform v1.3.8\non linux_amd64\n'`,
+			want:   "v1.3.8",
+		},
+		{
+			tool:   "mkcert",
+			script: `[ "$1" = -version ] && printf 'v1.4.4\n'`,
+			want:   "v1.4.4",
+		},
+		{
+			tool:   "helm",
+			script: `[ "$1" = --version ] && printf 'version.BuildInfo{Version:"v3.11.2-rc.1", GoVersion:"go1.20"}\n'`,
+			want:   "v3.11.2-rc.1",
+		},
+		{
+			tool:    "broken",
+			script:  `echo "no version here"`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tool, func(t *testing.T) {
+			got, err := InstalledToolVersion(writeStubTool(t, toolsDir, tt.tool, tt.script))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("InstalledToolVersion() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("InstalledToolVersion() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// newToolsConfig returns a config whose tool clients live in a new tools directory
+func newToolsConfig(t *testing.T) *K3dConfig {
+	t.Helper()
+
+	toolsDir := t.TempDir()
+	return &K3dConfig{
+		ToolsDir:        toolsDir,
+		K3dClient:       filepath.Join(toolsDir, "k3d"),
+		KubectlClient:   filepath.Join(toolsDir, "kubectl"),
+		MkCertClient:    filepath.Join(toolsDir, "mkcert"),
+		TerraformClient: filepath.Join(toolsDir, "terraform"),
+	}
+}
+
+func TestArchiveRestoreTools(t *testing.T) {
+
+	cfg := newToolsConfig(t)
+	for _, tool := range toolClients(cfg) {
+		writeStubTool(t, cfg.ToolsDir, filepath.Base(tool), "echo "+filepath.Base(tool)+"\n")
+	}
+	writeFixture(t, cfg.ToolsDir, map[string]string{"terraform.zip": "zip"})
+	archive := filepath.Join(t.TempDir(), "tools.tar.gz")
+
+	err := ArchiveTools(cfg, archive)
+	if err != nil {
+		t.Fatalf("ArchiveTools() error = %v", err)
+	}
+
+	restored := newToolsConfig(t)
+	err = RestoreTools(restored, archive)
+	if err != nil {
+		t.Fatalf("RestoreTools() error = %v", err)
+	}
+	for _, tool := range toolClients(restored) {
+		out, err := exec.Command(tool).Output()
+		if err != nil {
+			t.Fatalf("restored tool %s is not executable: %v", tool, err)
+		}
+		if want := filepath.Base(tool) + "\n"; string(out) != want {
+			t.Errorf("restored tool %s output = %q, want %q", tool, out, want)
+		}
+	}
+	if !toolsRestored(restored) {
+		t.Error("toolsRestored() = false after restore")
+	}
+	if fi, err := os.Stat(filepath.Join(restored.ToolsDir, "terraform.zip")); err != nil || fi.Mode().Perm()&0111 != 0 {
+		t.Errorf("terraform.zip not restored with its mode: %v", err)
+	}
+}
+
+func TestRestoreToolsInvalidArchive(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		files map[string]string
+	}{
+		{name: "stale versions", files: map[string]string{toolsManifestName: "k3d=v5.0.0\n", "k3d": "", "kubectl": "", "mkcert": "", "terraform": ""}},
+		{name: "missing tool", files: map[string]string{toolsManifestName: toolsManifest(), "k3d": ""}},
+		{name: "path traversal", files: map[string]string{"../escape": ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archive := filepath.Join(t.TempDir(), "tools.tar.gz")
+			f, err := os.Create(archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			gz := gzip.NewWriter(f)
+			tw := tar.NewWriter(gz)
+			for name, content := range tt.files {
+				tw.WriteHeader(&tar.Header{Name: name, Mode: 0755, Size: int64(len(content)), Typeflag: tar.TypeReg})
+				tw.Write([]byte(content))
+			}
+			tw.Close()
+			gz.Close()
+			f.Close()
+
+			cfg := newToolsConfig(t)
+			if err := RestoreTools(cfg, archive); err == nil {
+				t.Error("RestoreTools() expected an error")
+			}
+			if fileExists(filepath.Join(filepath.Dir(cfg.ToolsDir), "escape")) {
+				t.Error("archive entry escaped the tools directory")
+			}
+		})
+	}
+}
+
+func TestToolVersionDrift(t *testing.T) {
+
+	cfg := newToolsConfig(t)
+	cfg.K1Dir = t.TempDir()
+	versions := map[string]string{"k3d": "v5.4.6", "kubectl": "v1.25.7", "mkcert": "v1.4.4", "terraform": "v1.3.8"}
+	for tool, version := range versions {
+		writeStubTool(t, cfg.ToolsDir, tool, "echo "+tool+" "+version+"\n")
+	}
+
+	_, err := ToolVersionDrift(cfg)
+	if err == nil {
+		t.Fatal("ToolVersionDrift() without a recorded baseline error = nil")
+	}
+
+	err = RecordToolVersions(cfg)
+	if err != nil {
+		t.Fatalf("RecordToolVersions() error = %v", err)
+	}
+	drift, err := ToolVersionDrift(cfg)
+	if err != nil || len(drift) != 0 {
+		t.Fatalf("ToolVersionDrift() without changes = %v, %v, want no drift", drift, err)
+	}
+
+	// terraform upgraded and mkcert removed since the baseline
+	writeStubTool(t, cfg.ToolsDir, "terraform", "echo terraform v1.4.0\n")
+	if err := os.Remove(cfg.MkCertClient); err != nil {
+		t.Fatal(err)
+	}
+
+	drift, err = ToolVersionDrift(cfg)
+	if err != nil {
+		t.Fatalf("ToolVersionDrift() error = %v", err)
+	}
+	want := []VersionDrift{
+		{Tool: "mkcert", Recorded: "v1.4.4", Current: toolVersionUnavailable},
+		{Tool: "terraform", Recorded: "v1.3.8", Current: "v1.4.0"},
+	}
+	if !reflect.DeepEqual(drift, want) {
+		t.Errorf("ToolVersionDrift() = %v, want %v", drift, want)
+	}
+}
+
+func TestCleanTools(t *testing.T) {
+
+	k1Dir := t.TempDir()
+	cfg := &K3dConfig{
+		K1Dir:       k1Dir,
+		GitopsDir:   filepath.Join(k1Dir, "gitops"),
+		MetaphorDir: filepath.Join(k1Dir, "metaphor"),
+		Kubeconfig:  filepath.Join(k1Dir, "kubeconfig"),
+		ToolsDir:    filepath.Join(k1Dir, "tools"),
+	}
+	writeFixture(t, k1Dir, map[string]string{
+		"gitops/registry/kubefirst/argocd.yaml": "kind: Application\n",
+		"metaphor/Dockerfile":                   "FROM scratch\n",
+		"kubeconfig":                            "apiVersion: v1\n",
+		toolVersionsBaselineName:                "{}\n",
+		"tools/kubectl":                         "corrupt\n",
+		"tools/terraform.zip":                   "zip\n",
+		"tools/mkcert/partial":                  "partial\n",
+	})
+
+	err := CleanTools(cfg)
+	if err != nil {
+		t.Fatalf("CleanTools() error = %v", err)
+	}
+
+	entries, err := os.ReadDir(cfg.ToolsDir)
+	if err != nil {
+		t.Fatalf("CleanTools() removed the tools directory: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("CleanTools() left %d entries in the tools directory", len(entries))
+	}
+	for _, kept := range []string{"gitops/registry/kubefirst/argocd.yaml", "metaphor/Dockerfile", "kubeconfig", toolVersionsBaselineName} {
+		if !fileExists(filepath.Join(k1Dir, kept)) {
+			t.Errorf("CleanTools() removed %s", kept)
+		}
+	}
+
+	// a second clean and a missing tools directory are fine
+	if err := CleanTools(cfg); err != nil {
+		t.Errorf("CleanTools() on an empty tools directory error = %v", err)
+	}
+	cfg.ToolsDir = filepath.Join(k1Dir, "missing")
+	if err := CleanTools(cfg); err != nil {
+		t.Errorf("CleanTools() on a missing tools directory error = %v", err)
+	}
+}
+
+func TestCleanToolsRefusesConfigDirs(t *testing.T) {
+
+	k1Dir := t.TempDir()
+	writeFixture(t, k1Dir, map[string]string{"kubeconfig": "apiVersion: v1\n"})
+
+	tests := []struct {
+		name     string
+		toolsDir string
+	}{
+		{name: "unset", toolsDir: ""},
+		{name: "k1 directory", toolsDir: k1Dir},
+		{name: "parent of the k1 directory", toolsDir: filepath.Dir(k1Dir)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &K3dConfig{K1Dir: k1Dir, Kubeconfig: filepath.Join(k1Dir, "kubeconfig"), ToolsDir: tt.toolsDir}
+			if err := CleanTools(cfg); err == nil {
+				t.Errorf("CleanTools() with tools directory %q error = nil, want a refusal", tt.toolsDir)
+			}
+			if !fileExists(cfg.Kubeconfig) {
+				t.Fatal("CleanTools() removed the kubeconfig")
+			}
+		})
+	}
+}
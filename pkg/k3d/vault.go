@@ -0,0 +1,344 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/kubefirst/runtime/pkg/k8s"
+	"github.com/rs/zerolog/log"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// vaultAPIURL is the vault server configured by ConfigureVaultOIDC
+var vaultAPIURL = VaultURL
+
+// vaultKVMount is the kv-v2 secrets engine mount seeded by SeedVaultSecrets
+const vaultKVMount = "secret"
+
+// vaultUnsealSecretName holds the root token written when vault is initialized
+const vaultUnsealSecretName = "vault-unseal-secret"
+
+// OIDCConfig describes the oidc auth method, role and policy written to vault
+type OIDCConfig struct {
+	// MountPath is the auth mount path, defaults to oidc
+	MountPath           string
+	DiscoveryURL        string
+	ClientID            string
+	ClientSecret        string
+	DefaultRole         string
+	AllowedRedirectURIs []string
+	// UserClaim defaults to sub
+	UserClaim   string
+	GroupsClaim string
+	OIDCScopes  []string
+	// PolicyName is attached to the role alongside default when set
+	PolicyName  string
+	PolicyRules string
+}
+
+// ConfigureVaultOIDC enables the oidc auth method in vault, using the root token from the
+// vault-unseal-secret, and writes its config, default role and policy. Running it again
+// updates the existing configuration
+func ConfigureVaultOIDC(cfg *K3dConfig, oidc OIDCConfig) error {
+	clientset, err := k8s.GetClientSet(cfg.Kubeconfig)
+	if err != nil {
+		return fmt.Errorf("error getting kubernetes clientset: %s", err)
+	}
+
+	rootToken, err := vaultRootToken(clientset)
+	if err != nil {
+		return err
+	}
+
+	vaultClient, err := newVaultClient(vaultAPIURL, rootToken)
+	if err != nil {
+		return err
+	}
+
+	return configureVaultOIDC(vaultClient, oidc)
+}
+
+// vaultRootToken reads the root token stored in the vault-unseal-secret during unseal
+func vaultRootToken(clientset kubernetes.Interface) (string, error) {
+	secret, err := clientset.CoreV1().Secrets("vault").Get(context.TODO(), vaultUnsealSecretName, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("error getting %s: %s", vaultUnsealSecretName, err)
+	}
+	rootToken := string(secret.Data["root-token"])
+	if rootToken == "" {
+		return "", fmt.Errorf("%s has no root-token, has vault been unsealed?", vaultUnsealSecretName)
+	}
+	return rootToken, nil
+}
+
+// newVaultClient returns a vault client for address authenticated with token
+func newVaultClient(address, token string) (*vaultapi.Client, error) {
+	config := vaultapi.DefaultConfig()
+	config.Address = address
+	err := config.ConfigureTLS(&vaultapi.TLSConfig{Insecure: true})
+	if err != nil {
+		return nil, fmt.Errorf("error configuring vault tls: %s", err)
+	}
+
+	vaultClient, err := vaultapi.NewClient(config)
+	if err != nil {
+		return nil, fmt.Errorf("error creating vault client: %s", err)
+	}
+	vaultClient.SetToken(token)
+
+	return vaultClient, nil
+}
+
+func configureVaultOIDC(vaultClient *vaultapi.Client, oidc OIDCConfig) error {
+	if oidc.DiscoveryURL == "" || oidc.ClientID == "" || oidc.DefaultRole == "" {
+		return fmt.Errorf("error configuring vault oidc: discovery url, client id and default role are required")
+	}
+	mountPath := strings.Trim(oidc.MountPath, "/")
+	if mountPath == "" {
+		mountPath = "oidc"
+	}
+	userClaim := oidc.UserClaim
+	if userClaim == "" {
+		userClaim = "sub"
+	}
+
+	mounts, err := vaultClient.Sys().ListAuth()
+	if err != nil {
+		return fmt.Errorf("error listing vault auth methods: %s", err)
+	}
+	if _, exists := mounts[mountPath+"/"]; exists {
+		log.Info().Msgf("vault auth method %s already enabled, updating configuration", mountPath)
+	} else {
+		err = vaultClient.Sys().EnableAuthWithOptions(mountPath, &vaultapi.EnableAuthOptions{Type: "oidc"})
+		if err != nil {
+			return fmt.Errorf("error enabling vault oidc auth method: %s", err)
+		}
+		log.Info().Msgf("enabled vault oidc auth method at %s", mountPath)
+	}
+
+	policies := []string{"default"}
+	if oidc.PolicyName != "" {
+		err = vaultClient.Sys().PutPolicy(oidc.PolicyName, oidc.PolicyRules)
+		if err != nil {
+			return fmt.Errorf("error writing vault policy %s: %s", oidc.PolicyName, err)
+		}
+		policies = append(policies, oidc.PolicyName)
+	}
+
+	_, err = vaultClient.Logical().Write(fmt.Sprintf("auth/%s/config", mountPath), map[string]interface{}{
+		"oidc_discovery_url": oidc.DiscoveryURL,
+		"oidc_client_id":     oidc.ClientID,
+		"oidc_client_secret": oidc.ClientSecret,
+		"default_role":       oidc.DefaultRole,
+	})
+	if err != nil {
+		return fmt.Errorf("error writing vault oidc config: %s", err)
+	}
+
+	role := map[string]interface{}{
+		"role_type":             "oidc",
+		"user_claim":            userClaim,
+		"allowed_redirect_uris": oidc.AllowedRedirectURIs,
+		"token_policies":        policies,
+	}
+	if oidc.GroupsClaim != "" {
+		role["groups_claim"] = oidc.GroupsClaim
+	}
+	if len(oidc.OIDCScopes) > 0 {
+		role["oidc_scopes"] = oidc.OIDCScopes
+	}
+	_, err = vaultClient.Logical().Write(fmt.Sprintf("auth/%s/role/%s", mountPath, oidc.DefaultRole), role)
+	if err != nil {
+		return fmt.Errorf("error writing vault oidc role %s: %s", oidc.DefaultRole, err)
+	}
+
+	log.Info().Msgf("vault oidc auth method %s configured with role %s", mountPath, oidc.DefaultRole)
+	return nil
+}
+
+// SeedVaultSecrets writes each entry of secrets, keyed by path, to the kv-v2 engine mounted at
+// secret/, enabling the engine when it is absent. Secrets already holding the same data are
+// left untouched so repeated runs do not create new versions
+func SeedVaultSecrets(cfg *K3dConfig, rootToken string, secrets map[string]map[string]interface{}) error {
+	vaultClient, err := newVaultClient(vaultAPIURL, rootToken)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Msgf("seeding %d vault secrets for cluster %s", len(secrets), cfg.ClusterName)
+	return seedVaultSecrets(vaultClient, secrets)
+}
+
+func seedVaultSecrets(vaultClient *vaultapi.Client, secrets map[string]map[string]interface{}) error {
+	mounts, err := vaultClient.Sys().ListMounts()
+	if err != nil {
+		return fmt.Errorf("error listing vault secrets engines: %s", err)
+	}
+	if mount, exists := mounts[vaultKVMount+"/"]; exists {
+		if mount.Type != "kv" || mount.Options["version"] != "2" {
+			return fmt.Errorf("vault mount %s is %s version %q, expected kv version 2", vaultKVMount, mount.Type, mount.Options["version"])
+		}
+	} else {
+		err = vaultClient.Sys().Mount(vaultKVMount, &vaultapi.MountInput{
+			Type:    "kv",
+			Options: map[string]string{"version": "2"},
+		})
+		if err != nil {
+			return fmt.Errorf("error enabling vault kv engine at %s: %s", vaultKVMount, err)
+		}
+		log.Info().Msgf("enabled vault kv-v2 engine at %s", vaultKVMount)
+	}
+
+	paths := make([]string, 0, len(secrets))
+	for path := range secrets {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	kv := vaultClient.KVv2(vaultKVMount)
+	for _, path := range paths {
+		data := secrets[path]
+
+		existing, err := kv.Get(context.Background(), path)
+		if err != nil && !errors.Is(err, vaultapi.ErrSecretNotFound) {
+			return fmt.Errorf("error reading vault secret %s: %s", path, err)
+		}
+		if existing != nil {
+			same, err := sameSecretData(existing.Data, data)
+			if err != nil {
+				return err
+			}
+			if same {
+				log.Info().Msgf("vault secret %s is up to date", path)
+				continue
+			}
+		}
+
+		_, err = kv.Put(context.Background(), path, data)
+		if err != nil {
+			return fmt.Errorf("error writing vault secret %s: %s", path, err)
+		}
+		log.Info().Msgf("wrote vault secret %s", path)
+	}
+
+	return nil
+}
+
+// sameSecretData compares secret data by its json encoding, as values read back from
+// vault decode to json types
+func sameSecretData(existing, desired map[string]interface{}) (bool, error) {
+	existingJSON, err := json.Marshal(existing)
+	if err != nil {
+		return false, fmt.Errorf("error encoding vault secret data: %s", err)
+	}
+	desiredJSON, err := json.Marshal(desired)
+	if err != nil {
+		return false, fmt.Errorf("error encoding vault secret data: %s", err)
+	}
+	return bytes.Equal(existingJSON, desiredJSON), nil
+}
+
+// SnapshotVault saves a raft snapshot of vault to destPath so its data can be restored after
+// teardown. It returns an error when vault is not using raft integrated storage
+func SnapshotVault(cfg *K3dConfig, rootToken, destPath string) error {
+	vaultClient, err := newVaultClient(vaultAPIURL, rootToken)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Msgf("saving vault snapshot for cluster %s to %s", cfg.ClusterName, destPath)
+	return snapshotVault(vaultClient, destPath, cfg.dirMode())
+}
+
+// RestoreVaultSnapshot restores a snapshot taken by SnapshotVault. The restore is forced as the
+// snapshot usually comes from a previous cluster sealed with different keys, vault must then be
+// unsealed with the keys and root token of the snapshotted cluster
+func RestoreVaultSnapshot(cfg *K3dConfig, rootToken, srcPath string) error {
+	vaultClient, err := newVaultClient(vaultAPIURL, rootToken)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Msgf("restoring vault snapshot %s to cluster %s", srcPath, cfg.ClusterName)
+	return restoreVaultSnapshot(vaultClient, srcPath)
+}
+
+func snapshotVault(vaultClient *vaultapi.Client, destPath string, dirMode os.FileMode) error {
+	err := os.MkdirAll(filepath.Dir(destPath), dirMode)
+	if err != nil {
+		return fmt.Errorf("error creating snapshot directory: %s", err)
+	}
+
+	// write to a temporary file so a failed snapshot never replaces a good one
+	tmpFile, err := os.CreateTemp(filepath.Dir(destPath), filepath.Base(destPath)+".*")
+	if err != nil {
+		return fmt.Errorf("error creating snapshot file: %s", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	err = vaultClient.Sys().RaftSnapshot(tmpFile)
+	closeErr := tmpFile.Close()
+	if err != nil {
+		return vaultRaftError("error taking vault snapshot", err)
+	}
+	if closeErr != nil {
+		return fmt.Errorf("error writing vault snapshot: %s", closeErr)
+	}
+
+	err = os.Rename(tmpFile.Name(), destPath)
+	if err != nil {
+		return fmt.Errorf("error saving vault snapshot to %s: %s", destPath, err)
+	}
+
+	log.Info().Msgf("vault snapshot saved to %s", destPath)
+	return nil
+}
+
+func restoreVaultSnapshot(vaultClient *vaultapi.Client, srcPath string) error {
+	snapshot, err := os.Open(srcPath)
+	if err != nil {
+		return fmt.Errorf("error opening vault snapshot: %s", err)
+	}
+	defer snapshot.Close()
+
+	err = vaultClient.Sys().RaftSnapshotRestore(snapshot, true)
+	if err != nil {
+		return vaultRaftError("error restoring vault snapshot", err)
+	}
+
+	log.Info().Msgf("vault snapshot %s restored", srcPath)
+	return nil
+}
+
+// vaultRaftError explains failures caused by vault not using raft integrated storage
+func vaultRaftError(msg string, err error) error {
+	var respErr *vaultapi.ResponseError
+	if errors.As(err, &respErr) {
+		notRaft := respErr.StatusCode == http.StatusNotFound
+		for _, e := range respErr.Errors {
+			if strings.Contains(e, "raft storage is not in use") {
+				notRaft = true
+			}
+		}
+		if notRaft {
+			return fmt.Errorf("%s: vault is not using raft storage, snapshots are only supported with raft integrated storage", msg)
+		}
+	}
+	return fmt.Errorf("%s: %s", msg, err)
+}
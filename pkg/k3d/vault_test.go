@@ -0,0 +1,424 @@
+/*
+Copyright (C) 2021-2023, Kubefirst
+
+This program is licensed under MIT.
+See the LICENSE file for more details.
+*/
+package k3d
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// vaultWrite is a request recorded by newVaultServer, only the keys in an expected
+// Payload are compared
+type vaultWrite struct {
+	Method  string
+	Path    string
+	Payload map[string]interface{}
+}
+
+// newVaultServer mocks the vault api, reporting the auth mounts in enabled and recording
+// every write made with the root token
+func newVaultServer(t *testing.T, enabled map[string]bool) (*httptest.Server, *[]vaultWrite) {
+	t.Helper()
+
+	writes := []vaultWrite{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "root-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.Method == http.MethodGet && r.URL.Path == "/v1/sys/auth" {
+			mounts := map[string]interface{}{"token/": map[string]string{"type": "token"}}
+			for path := range enabled {
+				mounts[path+"/"] = map[string]string{"type": "oidc"}
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": mounts})
+			return
+		}
+
+		payload := map[string]interface{}{}
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		writes = append(writes, vaultWrite{Method: r.Method, Path: r.URL.Path, Payload: payload})
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(server.Close)
+	return server, &writes
+}
+
+func TestConfigureVaultOIDC(t *testing.T) {
+
+	oidc := OIDCConfig{
+		DiscoveryURL:        "https://gitlab.kubefirst.dev",
+		ClientID:            "vault",
+		ClientSecret:        "client-secret",
+		DefaultRole:         "kubefirst-admin",
+		AllowedRedirectURIs: []string{"https://vault.kubefirst.dev/ui/vault/auth/oidc/oidc/callback"},
+		GroupsClaim:         "groups",
+		PolicyName:          "admin",
+		PolicyRules:         `path "*" { capabilities = ["create", "read", "update", "delete", "list", "sudo"] }`,
+	}
+	configWrite := vaultWrite{Method: http.MethodPut, Path: "/v1/auth/oidc/config", Payload: map[string]interface{}{
+		"oidc_discovery_url": "https://gitlab.kubefirst.dev",
+		"oidc_client_id":     "vault",
+		"oidc_client_secret": "client-secret",
+		"default_role":       "kubefirst-admin",
+	}}
+	policyWrite := vaultWrite{Method: http.MethodPut, Path: "/v1/sys/policies/acl/admin", Payload: map[string]interface{}{
+		"policy": oidc.PolicyRules,
+	}}
+	roleWrite := vaultWrite{Method: http.MethodPut, Path: "/v1/auth/oidc/role/kubefirst-admin", Payload: map[string]interface{}{
+		"role_type":             "oidc",
+		"user_claim":            "sub",
+		"groups_claim":          "groups",
+		"allowed_redirect_uris": []interface{}{"https://vault.kubefirst.dev/ui/vault/auth/oidc/oidc/callback"},
+		"token_policies":        []interface{}{"default", "admin"},
+	}}
+
+	tests := []struct {
+		name       string
+		enabled    map[string]bool
+		oidc       OIDCConfig
+		wantWrites []vaultWrite
+		wantErr    bool
+	}{
+		{
+			name: "fresh vault",
+			oidc: oidc,
+			wantWrites: []vaultWrite{
+				{Method: http.MethodPost, Path: "/v1/sys/auth/oidc", Payload: map[string]interface{}{"type": "oidc"}},
+				policyWrite,
+				configWrite,
+				roleWrite,
+			},
+		},
+		{
+			name:       "already enabled",
+			enabled:    map[string]bool{"oidc": true},
+			oidc:       oidc,
+			wantWrites: []vaultWrite{policyWrite, configWrite, roleWrite},
+		},
+		{name: "missing discovery url", oidc: OIDCConfig{ClientID: "vault", DefaultRole: "kubefirst-admin"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, writes := newVaultServer(t, tt.enabled)
+			vaultClient, err := newVaultClient(server.URL, "root-token")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = configureVaultOIDC(vaultClient, tt.oidc)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("configureVaultOIDC() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(*writes) != len(tt.wantWrites) {
+				t.Fatalf("configureVaultOIDC() made %d writes, want %d: %+v", len(*writes), len(tt.wantWrites), *writes)
+			}
+			for i, want := range tt.wantWrites {
+				got := (*writes)[i]
+				if got.Method != want.Method || got.Path != want.Path {
+					t.Errorf("write %d = %s %s, want %s %s", i, got.Method, got.Path, want.Method, want.Path)
+				}
+				for key, value := range want.Payload {
+					if !reflect.DeepEqual(got.Payload[key], value) {
+						t.Errorf("write %d %s %s = %v, want %v", i, got.Path, key, got.Payload[key], value)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestVaultRootToken(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		data    map[string][]byte
+		want    string
+		wantErr bool
+	}{
+		{name: "unsealed", data: map[string][]byte{"root-token": []byte("hvs.root")}, want: "hvs.root"},
+		{name: "missing root token", data: map[string][]byte{"unseal-key-0": []byte("key")}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset(&v1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "vault-unseal-secret", Namespace: "vault"},
+				Data:       tt.data,
+			})
+
+			got, err := vaultRootToken(clientset)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("vaultRootToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("vaultRootToken() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	_, err := vaultRootToken(fake.NewSimpleClientset())
+	if err == nil {
+		t.Error("vaultRootToken() without secret error = nil, want error")
+	}
+}
+
+// newVaultKVServer mocks the vault mounts and kv-v2 api, serving the secrets in stored
+// and recording every write
+func newVaultKVServer(t *testing.T, mounts map[string]interface{}, stored map[string]map[string]interface{}) (*httptest.Server, *[]vaultWrite) {
+	t.Helper()
+
+	metadata := map[string]interface{}{"version": 1, "created_time": "2023-05-01T00:00:00Z", "deletion_time": "", "destroyed": false}
+	writes := []vaultWrite{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "root-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		path := strings.TrimPrefix(r.URL.Path, "/v1/secret/data/")
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/sys/mounts":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": mounts})
+		case r.Method == http.MethodGet && path != r.URL.Path:
+			data, ok := stored[path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `{"errors":[]}`)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"data": data, "metadata": metadata}})
+		default:
+			payload := map[string]interface{}{}
+			_ = json.NewDecoder(r.Body).Decode(&payload)
+			writes = append(writes, vaultWrite{Method: r.Method, Path: r.URL.Path, Payload: payload})
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": metadata})
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &writes
+}
+
+func TestSeedVaultSecrets(t *testing.T) {
+
+	kvMount := map[string]interface{}{
+		"cubbyhole/": map[string]interface{}{"type": "cubbyhole"},
+		"secret/":    map[string]interface{}{"type": "kv", "options": map[string]string{"version": "2"}},
+	}
+	secrets := map[string]map[string]interface{}{
+		"development/metaphor": {"SECRET_ONE": "alpha", "REPLICAS": 2},
+		"ci-secrets":           {"GITHUB_TOKEN": "ghp_token", "REGISTRY_PASSWORD": "registry"},
+	}
+	ciWrite := vaultWrite{Method: http.MethodPut, Path: "/v1/secret/data/ci-secrets", Payload: map[string]interface{}{
+		"data": map[string]interface{}{"GITHUB_TOKEN": "ghp_token", "REGISTRY_PASSWORD": "registry"},
+	}}
+	metaphorWrite := vaultWrite{Method: http.MethodPut, Path: "/v1/secret/data/development/metaphor", Payload: map[string]interface{}{
+		"data": map[string]interface{}{"SECRET_ONE": "alpha", "REPLICAS": float64(2)},
+	}}
+
+	tests := []struct {
+		name       string
+		mounts     map[string]interface{}
+		stored     map[string]map[string]interface{}
+		wantWrites []vaultWrite
+		wantErr    bool
+	}{
+		{
+			name:   "fresh vault",
+			mounts: map[string]interface{}{"cubbyhole/": map[string]interface{}{"type": "cubbyhole"}},
+			wantWrites: []vaultWrite{
+				{Method: http.MethodPost, Path: "/v1/sys/mounts/secret", Payload: map[string]interface{}{
+					"type":    "kv",
+					"options": map[string]interface{}{"version": "2"},
+				}},
+				ciWrite,
+				metaphorWrite,
+			},
+		},
+		{
+			name:       "existing mount",
+			mounts:     kvMount,
+			wantWrites: []vaultWrite{ciWrite, metaphorWrite},
+		},
+		{
+			name:   "already seeded",
+			mounts: kvMount,
+			stored: map[string]map[string]interface{}{
+				"development/metaphor": {"SECRET_ONE": "alpha", "REPLICAS": 2},
+				"ci-secrets":           {"GITHUB_TOKEN": "ghp_token", "REGISTRY_PASSWORD": "registry"},
+			},
+		},
+		{
+			name:   "changed secret",
+			mounts: kvMount,
+			stored: map[string]map[string]interface{}{
+				"development/metaphor": {"SECRET_ONE": "alpha", "REPLICAS": 2},
+				"ci-secrets":           {"GITHUB_TOKEN": "ghp_expired", "REGISTRY_PASSWORD": "registry"},
+			},
+			wantWrites: []vaultWrite{ciWrite},
+		},
+		{
+			name:    "kv version 1 mount",
+			mounts:  map[string]interface{}{"secret/": map[string]interface{}{"type": "kv", "options": map[string]string{"version": "1"}}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, writes := newVaultKVServer(t, tt.mounts, tt.stored)
+			vaultClient, err := newVaultClient(server.URL, "root-token")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = seedVaultSecrets(vaultClient, secrets)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("seedVaultSecrets() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(*writes) != len(tt.wantWrites) {
+				t.Fatalf("seedVaultSecrets() made %d writes, want %d: %+v", len(*writes), len(tt.wantWrites), *writes)
+			}
+			for i, want := range tt.wantWrites {
+				got := (*writes)[i]
+				if got.Method != want.Method || got.Path != want.Path {
+					t.Errorf("write %d = %s %s, want %s %s", i, got.Method, got.Path, want.Method, want.Path)
+				}
+				for key, value := range want.Payload {
+					if !reflect.DeepEqual(got.Payload[key], value) {
+						t.Errorf("write %d %s %s = %v, want %v", i, got.Path, key, got.Payload[key], value)
+					}
+				}
+			}
+		})
+	}
+}
+
+// vaultSnapshotArchive returns a gzipped tar shaped like a vault raft snapshot
+func vaultSnapshotArchive(t *testing.T) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, file := range []struct{ name, content string }{
+		{name: "meta.json", content: `{"Version":1,"Index":42}`},
+		{name: "state.bin", content: "raft state"},
+		{name: "SHA256SUMS.sealed", content: "sealed checksums"},
+	} {
+		err := tw.WriteHeader(&tar.Header{Name: file.name, Mode: 0600, Size: int64(len(file.content))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tw.Write([]byte(file.content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSnapshotVault(t *testing.T) {
+
+	archive := vaultSnapshotArchive(t)
+
+	tests := []struct {
+		name      string
+		raft      bool
+		wantErr   string
+		wantBytes []byte
+	}{
+		{name: "raft storage", raft: true, wantBytes: archive},
+		{name: "non raft storage", wantErr: "not using raft storage", wantBytes: []byte("previous snapshot")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var restored []byte
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("X-Vault-Token") != "root-token" {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				if !tt.raft {
+					w.WriteHeader(http.StatusBadRequest)
+					fmt.Fprint(w, `{"errors":["raft storage is not in use"]}`)
+					return
+				}
+				switch {
+				case r.Method == http.MethodGet && r.URL.Path == "/v1/sys/storage/raft/snapshot":
+					_, _ = w.Write(archive)
+				case r.Method == http.MethodPost && r.URL.Path == "/v1/sys/storage/raft/snapshot-force":
+					restored, _ = io.ReadAll(r.Body)
+					w.WriteHeader(http.StatusNoContent)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer server.Close()
+
+			vaultClient, err := newVaultClient(server.URL, "root-token")
+			if err != nil {
+				t.Fatal(err)
+			}
+			destPath := filepath.Join(t.TempDir(), "backups", "vault.snap")
+			writeFixture(t, filepath.Dir(destPath), map[string]string{"vault.snap": "previous snapshot"})
+
+			err = snapshotVault(vaultClient, destPath, defaultDirMode)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("snapshotVault() error = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("snapshotVault() error = %v", err)
+			}
+
+			got, _ := os.ReadFile(destPath)
+			if !bytes.Equal(got, tt.wantBytes) {
+				t.Errorf("snapshot file = %d bytes, want %d bytes", len(got), len(tt.wantBytes))
+			}
+			entries, _ := os.ReadDir(filepath.Dir(destPath))
+			if len(entries) != 1 {
+				t.Errorf("snapshot directory has %d entries, temporary file left behind", len(entries))
+			}
+
+			err = restoreVaultSnapshot(vaultClient, destPath)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("restoreVaultSnapshot() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("restoreVaultSnapshot() error = %v", err)
+			}
+			if !bytes.Equal(restored, archive) {
+				t.Errorf("restored snapshot = %d bytes, want %d bytes", len(restored), len(archive))
+			}
+		})
+	}
+}